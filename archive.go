@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/cloudflare/utahfs/internal/logging"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -17,8 +21,12 @@ type archive struct {
 //
 // It allows new files to be created, and old files to be moved / renamed /
 // appended to. Empty directories may be deleted, but no files may be deleted or
-// overwritten. This is just enforced by the FUSE binding, not by an actual
-// access management system. Data stored is compatible with NewFilesystem.
+// overwritten. Attempting to delete a file, or to write over any of its existing
+// contents with different data, fails with EACCES. Writes that only extend a
+// file, like appending to a log, are allowed. Renaming over an existing file
+// succeeds, but the file that was replaced is kept under a name like
+// "name.~1~". This is just enforced by the FUSE binding, not by an actual access
+// management system. Data stored is compatible with NewFilesystem.
 func NewArchive(bfs *BlockFilesystem) (fuseutil.FileSystem, error) {
 	fs, err := NewFilesystem(bfs)
 	if err != nil {
@@ -27,6 +35,12 @@ func NewArchive(bfs *BlockFilesystem) (fuseutil.FileSystem, error) {
 	return archive{fs.(*filesystem)}, nil
 }
 
+// NewArchiveAs is like NewArchive, but takes the same arguments for the owner of
+// files as NewFilesystemAs.
+func NewArchiveAs(bfs *BlockFilesystem, uid, gid uint32, uidMap, gidMap map[uint32]uint32) (fuseutil.FileSystem, error) {
+	return NewFilesystemWithOptions(bfs, Options{Archive: true, Uid: uid, Gid: gid, UidMap: uidMap, GidMap: gidMap})
+}
+
 func (a archive) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
 	return a.setInodeAttributes(ctx, op, true)
 }
@@ -43,8 +57,53 @@ func (a archive) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
 	return a.writeFile(ctx, op, true)
 }
 
+// keepNode makes way for a file to be renamed over the child of `parent` called
+// `name`. If the child is a file whose data would be lost, it's moved to the
+// first free name of the form "name.~N~", like `mv --backup=numbered` does.
+// If that would be longer than the filesystem allows, "name" is shortened to
+// fit. Anything else is removed as usual.
+func (fs *filesystem) keepNode(ctx context.Context, parent *node, name string) error {
+	childID := parent.Children[name]
+	child, err := fs.nm.Open(ctx, fs.ptr(childID))
+	if err != nil {
+		return err
+	} else if !child.Attrs.Mode.IsRegular() || child.Attrs.Nlink > 1 {
+		return fs.rmNode(ctx, parent, name, true)
+	}
+
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf(".~%v~", i)
+		backup := truncateName(name, fs.maxNameLength-len(suffix)) + suffix
+		if _, ok := fs.childName(parent, backup); !ok {
+			delete(parent.Children, name)
+			parent.Children[backup] = childID
+			break
+		}
+	}
+	parent.Attrs.Mtime = now()
+	parent.Attrs.Ctime = now()
+
+	return nil
+}
+
+// truncateName returns the longest prefix of `name` that's at most `max` bytes
+// long, without splitting a UTF-8 character.
+func truncateName(name string, max int) string {
+	if max <= 0 {
+		return ""
+	} else if len(name) <= max {
+		return name
+	}
+	for max > 0 && !utf8.RuneStart(name[max]) {
+		max--
+	}
+	return name[:max]
+}
+
 // checkForChanges ensures that `op` won't modify any already-written parts of
-// the file stored by `nd`.
+// the file stored by `nd`. Writing data that's the same as what's already there
+// is allowed, so that a write which overlaps the end of the file can still
+// extend it.
 func checkForChanges(nd *node, op *fuseops.WriteFileOp) error {
 	max := min(
 		op.Offset+int64(len(op.Data)),
@@ -60,7 +119,8 @@ func checkForChanges(nd *node, op *fuseops.WriteFileOp) error {
 		}
 		cand := op.Data[pos-op.Offset : pos+int64(n)-op.Offset]
 		if !bytes.Equal(cand, temp[:n]) {
-			return fmt.Errorf("utahfs: refusing to admit write that would modify file contents")
+			logging.Warn("utahfs: refusing to admit write that would modify file contents")
+			return syscall.EACCES
 		}
 		pos += int64(n)
 	}
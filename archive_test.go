@@ -0,0 +1,181 @@
+package utahfs
+
+import (
+	"testing"
+
+	"context"
+	"syscall"
+
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func testArchive(t *testing.T, archive bool) fuseutil.FileSystem {
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fs fuseutil.FileSystem
+	if archive {
+		fs, err = NewArchive(bfs)
+	} else {
+		fs, err = NewFilesystem(bfs)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func testCreate(t *testing.T, fs fuseutil.FileSystem, name, data string) {
+	ctx := context.Background()
+
+	op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: name, Mode: 0644}
+	if err := fs.CreateFile(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+	write := &fuseops.WriteFileOp{Inode: op.Entry.Child, Handle: op.Handle, Data: []byte(data)}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRead(t *testing.T, fs fuseutil.FileSystem, name string) (string, bool) {
+	ctx := context.Background()
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+	if err := fs.LookUpInode(ctx, lookup); err == syscall.ENOENT {
+		return "", false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	read := &fuseops.ReadFileOp{Inode: lookup.Entry.Child, Dst: make([]byte, 1024)}
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatal(err)
+	}
+	return string(read.Dst[:read.BytesRead]), true
+}
+
+func testRename(fs fuseutil.FileSystem, oldName, newName string) error {
+	return fs.Rename(context.Background(), &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   oldName,
+		NewParent: fuseops.RootInodeID,
+		NewName:   newName,
+	})
+}
+
+func TestArchiveRename(t *testing.T) {
+	fs := testArchive(t, true)
+	testCreate(t, fs, "a", "first")
+	testCreate(t, fs, "b", "second")
+	testCreate(t, fs, "c", "third")
+
+	// Renaming over an existing file should keep a backup of it.
+	if err := testRename(fs, "a", "b"); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "b"); data != "first" {
+		t.Fatalf("unexpected data in renamed file: %q", data)
+	} else if data, _ := testRead(t, fs, "b.~1~"); data != "second" {
+		t.Fatalf("unexpected data in backup: %q", data)
+	} else if _, ok := testRead(t, fs, "a"); ok {
+		t.Fatal("old name still exists after rename")
+	}
+
+	if err := testRename(fs, "c", "b"); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "b"); data != "third" {
+		t.Fatalf("unexpected data in renamed file: %q", data)
+	} else if data, _ := testRead(t, fs, "b.~2~"); data != "first" {
+		t.Fatalf("unexpected data in backup: %q", data)
+	}
+
+	// Deleting a file should still be refused.
+	err := fs.Unlink(context.Background(), &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "b"})
+	if err != syscall.EACCES {
+		t.Fatalf("expected EACCES when deleting archived file, got: %v", err)
+	} else if _, ok := testRead(t, fs, "b"); !ok {
+		t.Fatal("archived file was deleted")
+	}
+}
+
+func TestArchiveBackupNameLength(t *testing.T) {
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{Archive: true, MaxNameLength: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "abcdefgh", "first")
+	testCreate(t, fs, "a", "second")
+	testCreate(t, fs, "b", "third")
+
+	// A backup of a file whose name is already at the limit should be given a
+	// shorter name that fits, instead of one that can't be renamed or copied.
+	if err := testRename(fs, "a", "abcdefgh"); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "abcd.~1~"); data != "first" {
+		t.Fatalf("unexpected data in backup: %q", data)
+	}
+	if err := testRename(fs, "b", "abcdefgh"); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "abcd.~2~"); data != "second" {
+		t.Fatalf("unexpected data in backup: %q", data)
+	} else if data, _ := testRead(t, fs, "abcdefgh"); data != "third" {
+		t.Fatalf("unexpected data in renamed file: %q", data)
+	}
+}
+
+func TestRenameReplace(t *testing.T) {
+	fs := testArchive(t, false)
+	testCreate(t, fs, "a", "first")
+	testCreate(t, fs, "b", "second")
+
+	if err := testRename(fs, "a", "b"); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "b"); data != "first" {
+		t.Fatalf("unexpected data in renamed file: %q", data)
+	} else if _, ok := testRead(t, fs, "b.~1~"); ok {
+		t.Fatal("backup was made outside of archive mode")
+	}
+}
+
+func TestArchiveAppend(t *testing.T) {
+	ctx := context.Background()
+	fs := testArchive(t, true)
+	testCreate(t, fs, "log", "first")
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "log"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	write := func(offset int64, data string) error {
+		return fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: lookup.Entry.Child, Offset: offset, Data: []byte(data)})
+	}
+
+	// Writes that start at the end of the file, or that only repeat what's
+	// already there before extending it, should be allowed.
+	if err := write(5, " second"); err != nil {
+		t.Fatal(err)
+	} else if err := write(7, "econd third"); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "log"); data != "first second third" {
+		t.Fatalf("unexpected data after appending: %q", data)
+	}
+
+	// Writes that change existing data should be refused, even if they'd also
+	// extend the file.
+	if err := write(0, "FIRST"); err != syscall.EACCES {
+		t.Fatalf("expected EACCES when overwriting archived file, got: %v", err)
+	} else if err := write(14, "THIRD fourth"); err != syscall.EACCES {
+		t.Fatalf("expected EACCES when overwriting end of archived file, got: %v", err)
+	} else if data, _ := testRead(t, fs, "log"); data != "first second third" {
+		t.Fatalf("archived file was modified: %q", data)
+	}
+}
@@ -10,11 +10,36 @@ import (
 
 const nilPtr = ^uint64(0)
 
+// Files may have holes: ranges that have never been written to, which read back
+// as zeros and don't have any blocks allocated. If the block after a hole isn't
+// the next block in the skiplist, the first pointer to it has holeFlag set. Any
+// other pointer that would point into a hole is set to holePtr instead.
+const (
+	holeFlag = uint64(1) << 63
+	holePtr  = nilPtr - 1
+)
+
 var errEndOfBlock = fmt.Errorf("blockfs: reached end of block")
 
 func p(ptr uint64) uint64 { return 2 * ptr }
 func d(ptr uint64) uint64 { return 2*ptr + 1 }
 
+// isPtr returns true if `ptr` points to a block, rather than being nilPtr,
+// holePtr, or having holeFlag set.
+func isPtr(ptr uint64) bool { return ptr&holeFlag == 0 }
+
+// isHole returns true if `ptr` points into a hole, or past one.
+func isHole(ptr uint64) bool { return ptr != nilPtr && !isPtr(ptr) }
+
+// nextPtr returns the pointer to the next block of a file, given the first
+// pointer of the previous block.
+func nextPtr(ptr uint64) uint64 {
+	if ptr == nilPtr {
+		return nilPtr
+	}
+	return ptr &^ holeFlag
+}
+
 // BlockFilesystem implements large files as skiplists over fixed-size blocks
 // stored in an object storage service.
 type BlockFilesystem struct {
@@ -23,6 +48,8 @@ type BlockFilesystem struct {
 	numPtrs   int64
 	dataSize  int64
 	splitPtrs bool
+	dedup     bool
+	dedupHash string
 }
 
 // NewBlockFilesystem returns a new block-based filesystem. Blocks will have
@@ -42,10 +69,8 @@ type BlockFilesystem struct {
 // separately from the data section, and false if they should be stored
 // together. Storing them separately can improve seek performance.
 func NewBlockFilesystem(store *persistent.AppStorage, numPtrs, dataSize int64, splitPtrs bool) (*BlockFilesystem, error) {
-	if numPtrs < 1 {
-		return nil, fmt.Errorf("blockfs: number of pointers must be greater than zero")
-	} else if dataSize < 1 || dataSize >= (1<<24) {
-		return nil, fmt.Errorf("blockfs: size of data block must be greater zero and less than %v", 1<<24)
+	if err := ValidateBlockParams(numPtrs, dataSize); err != nil {
+		return nil, err
 	}
 
 	return &BlockFilesystem{
@@ -57,10 +82,76 @@ func NewBlockFilesystem(store *persistent.AppStorage, numPtrs, dataSize int64, s
 	}, nil
 }
 
-func (bfs *BlockFilesystem) blockSize() int64     { return bfs.blockPtrsSize() + bfs.blockDataSize() }
+// NewDedupBlockFilesystem returns a block-based filesystem like
+// NewBlockFilesystem does with `splitPtrs` set, except that identical blocks of
+// file content are stored only once. Each full block of content is hashed, and
+// if an identical block is already stored, the block just refers to it instead
+// of storing a copy. Reference counts are kept in an index that's stored in the
+// filesystem, so a shared block is only freed once nothing refers to it.
+//
+// Sharing a block the first time it's seen takes extra writes, so this is only
+// worthwhile if a lot of data is duplicated.
+func NewDedupBlockFilesystem(store *persistent.AppStorage, numPtrs, dataSize int64) (*BlockFilesystem, error) {
+	return NewDedupBlockFilesystemWithHash(store, numPtrs, dataSize, "")
+}
+
+// NewDedupBlockFilesystemWithHash returns a block-based filesystem like
+// NewDedupBlockFilesystem, where blocks are hashed with the function named
+// `hash`: either DedupSHA256 or DedupBLAKE2b. An index that already exists
+// keeps the hash function it was created with, and it's an error for `hash` to
+// name a different one. If `hash` is empty, any existing index is accepted and
+// a new index uses DedupBLAKE2b.
+func NewDedupBlockFilesystemWithHash(store *persistent.AppStorage, numPtrs, dataSize int64, hash string) (*BlockFilesystem, error) {
+	if _, ok := dedupHashes[hash]; hash != "" && !ok {
+		return nil, fmt.Errorf("blockfs: unknown dedup hash: %v", hash)
+	} else if dataSize < blockRefSize {
+		return nil, fmt.Errorf("blockfs: size of data block must be at least %v for dedup", blockRefSize)
+	}
+	bfs, err := NewBlockFilesystem(store, numPtrs, dataSize, true)
+	if err != nil {
+		return nil, err
+	}
+	bfs.dedup, bfs.dedupHash = true, hash
+	return bfs, nil
+}
+
+// ValidateBlockParams returns an error if a filesystem can't be created with
+// `numPtrs` pointers and `dataSize` bytes of data in each block.
+func ValidateBlockParams(numPtrs, dataSize int64) error {
+	if numPtrs < 1 {
+		return fmt.Errorf("blockfs: number of pointers must be greater than zero")
+	} else if dataSize < 1 || dataSize >= refMarker {
+		return fmt.Errorf("blockfs: size of data block must be greater zero and less than %v", refMarker)
+	}
+	return nil
+}
+
+// BlockSize returns the maximum size of the blocks that a filesystem with
+// `numPtrs` pointers and `dataSize` bytes of data in each block will store,
+// before any encryption.
+func BlockSize(numPtrs, dataSize int64) int64 {
+	//  8 = size of a single pointer
+	//  3 = size of length field before data
+	return (8 * numPtrs) + (3 + dataSize)
+}
+
+func (bfs *BlockFilesystem) blockSize() int64     { return BlockSize(bfs.numPtrs, bfs.dataSize) }
 func (bfs *BlockFilesystem) blockPtrsSize() int64 { return 8 * bfs.numPtrs }
 func (bfs *BlockFilesystem) blockDataSize() int64 { return 3 + bfs.dataSize }
 
+// ancestor returns the index of the block that's passed through right before
+// block `idx`, when seeking to it from the start of a file, and the level of
+// the pointer between them.
+func (bfs *BlockFilesystem) ancestor(idx int64) (int64, int) {
+	maxLevel := int(bfs.numPtrs) - 1
+	for i := 0; i < maxLevel; i++ {
+		if jump := int64(1) << uint(i); idx&jump != 0 {
+			return idx - jump, i
+		}
+	}
+	return idx - int64(1)<<uint(maxLevel), maxLevel
+}
+
 // allocate returns the pointer of a block which is free for use by the caller.
 func (bfs *BlockFilesystem) allocate(ctx context.Context) (uint64, error) {
 	state, err := bfs.store.State(ctx)
@@ -90,7 +181,7 @@ func (bfs *BlockFilesystem) allocate(ctx context.Context) (uint64, error) {
 	}
 
 	trash := state.TrashPtr
-	state.TrashPtr = b.ptrs[0]
+	state.TrashPtr = nextPtr(b.ptrs[0])
 	return trash, nil
 }
 
@@ -161,9 +252,13 @@ func (bfs *BlockFilesystem) Unlink(ctx context.Context, ptr uint64) error {
 
 		stepped := false
 		for i := len(bf.curr.ptrs) - 1; i >= 0; i-- {
-			if bf.curr.ptrs[i] == nilPtr {
+			ptr := bf.curr.ptrs[i]
+			if i == 0 { // Step over any hole to get to the next block.
+				ptr = nextPtr(ptr)
+			} else if !isPtr(ptr) {
 				continue
-			} else if err := bf.load(bf.curr.ptrs[i], 0, false); err != nil {
+			}
+			if err := bf.load(ptr, 0, false); err != nil {
 				return err
 			}
 			stepped = true
@@ -179,6 +274,10 @@ func (bfs *BlockFilesystem) Unlink(ctx context.Context, ptr uint64) error {
 	state, err := bfs.store.State(ctx)
 	if err != nil {
 		return err
+	} else if state.DedupPtr != 0 {
+		if err := bfs.releaseAll(ctx, ptr); err != nil {
+			return err
+		}
 	}
 	bf.curr.ptrs[0] = state.TrashPtr
 	state.TrashPtr = ptr
@@ -186,6 +285,181 @@ func (bfs *BlockFilesystem) Unlink(ctx context.Context, ptr uint64) error {
 	return bf.persist()
 }
 
+// Sync blocks until all committed changes have reached remote storage, rather
+// than just the local WAL. It returns persistent.ErrWALPaused if uploads have
+// been paused with PauseSync.
+func (bfs *BlockFilesystem) Sync(ctx context.Context) error {
+	return bfs.store.Sync(ctx)
+}
+
+// PauseSync stops committed changes from being uploaded from the local WAL to
+// remote storage if `paused` is true, or lets uploads continue if it's false.
+func (bfs *BlockFilesystem) PauseSync(paused bool) error {
+	return bfs.store.PauseSync(paused)
+}
+
+// Check validates the structure of the skiplist of the file at `ptr`, without
+// reading any of its data. It returns an error describing the first block that
+// is inconsistent.
+func (bfs *BlockFilesystem) Check(ctx context.Context, ptr uint64) error {
+	_, err := bfs.check(ctx, ptr)
+	return err
+}
+
+// check implements Check, and returns the index of the file's tail block.
+func (bfs *BlockFilesystem) check(ctx context.Context, ptr uint64) (int64, error) {
+	bf := &BlockFile{parent: bfs, ctx: ctx, start: ptr, dt: persistent.Unknown}
+
+	// Walk the file's blocks in order. A block's index is one more than the
+	// index of the block before it, unless there's a hole between them. In that
+	// case, the block must be reachable through a higher-level pointer of an
+	// earlier block, which decides its index, because that's how Seek finds it.
+	indices := map[uint64]int64{ptr: 0}
+	visited := make(map[uint64]struct{})
+	predict := func(from, to uint64, idx int64, level int) error {
+		if _, ok := visited[to]; ok {
+			return fmt.Errorf("blockfs: block %x: pointer at level %v points backwards", from, level)
+		} else if prev, ok := indices[to]; ok && prev != idx {
+			return fmt.Errorf("blockfs: block %x: pointer at level %v says next block has index %v, but it has index %v", from, level, idx, prev)
+		}
+		indices[to] = idx
+		return nil
+	}
+
+	prevIdx, hole := int64(-1), false
+	for {
+		idx, ok := indices[ptr]
+		if !ok {
+			return 0, fmt.Errorf("blockfs: block %x: block after hole can't be reached by seeking", ptr)
+		} else if !hole && idx != prevIdx+1 || hole && idx <= prevIdx {
+			return 0, fmt.Errorf("blockfs: block %x: block has index %v, but follows block with index %v", ptr, idx, prevIdx)
+		}
+		visited[ptr] = struct{}{}
+		if err := bf.load(ptr, idx*bfs.dataSize, false); err != nil {
+			return 0, fmt.Errorf("blockfs: block %x: %v", ptr, err)
+		}
+		ptrs := bf.curr.ptrs
+
+		// The tail block's higher-level pointers are to the last block at each
+		// level, which will need to be updated when the file is extended.
+		if ptrs[0] == nilPtr {
+			for i := 1; i < len(ptrs); i++ {
+				if !isPtr(ptrs[i]) {
+					continue
+				}
+				backIdx, ok := indices[ptrs[i]]
+				if _, seen := visited[ptrs[i]]; !ok || !seen {
+					return 0, fmt.Errorf("blockfs: block %x: tail pointer at level %v is not to a block of the file", ptr, i)
+				} else if backIdx > idx || backIdx%(int64(1)<<uint(i)) != 0 {
+					return 0, fmt.Errorf("blockfs: block %x: tail pointer at level %v is to block with unexpected index %v", ptr, i, backIdx)
+				}
+			}
+			return idx, nil
+		}
+
+		for i := 1; i < len(ptrs); i++ {
+			jump := int64(1) << uint(i)
+			if ptrs[i] == nilPtr || ptrs[i] == holePtr {
+				continue
+			} else if !isPtr(ptrs[i]) {
+				return 0, fmt.Errorf("blockfs: block %x: pointer at level %v is malformed", ptr, i)
+			} else if idx%jump != 0 {
+				return 0, fmt.Errorf("blockfs: block %x: pointer at level %v is set, but block index %v isn't aligned", ptr, i, idx)
+			} else if err := predict(ptr, ptrs[i], idx+jump, i); err != nil {
+				return 0, err
+			}
+		}
+		next := nextPtr(ptrs[0])
+		hole = !isPtr(ptrs[0])
+		if !hole {
+			if err := predict(ptr, next, idx+1, 0); err != nil {
+				return 0, err
+			}
+		} else if _, ok := visited[next]; ok {
+			return 0, fmt.Errorf("blockfs: block %x: pointer at level 0 points backwards", ptr)
+		}
+		ptr, prevIdx = next, idx
+	}
+}
+
+// blocks returns the pointers of every block in the skiplist at `ptr`, in the
+// order they're linked at the lowest level. It also works on the trash list.
+// Pointers are in the underlying storage, so each block has two with splitPtrs.
+// If a block can't be read, the pointers found so far are returned along with
+// the error, including the block that couldn't be read.
+func (bfs *BlockFilesystem) blocks(ctx context.Context, ptr uint64) ([]uint64, error) {
+	bf := &BlockFile{parent: bfs, ctx: ctx, start: ptr, dt: persistent.Unknown}
+
+	out := make([]uint64, 0)
+	visited := make(map[uint64]struct{})
+	for ptr != nilPtr {
+		if _, ok := visited[ptr]; ok {
+			return nil, fmt.Errorf("blockfs: block %x: skiplist contains a cycle", ptr)
+		}
+		visited[ptr] = struct{}{}
+		if bfs.splitPtrs {
+			out = append(out, p(ptr), d(ptr))
+		} else {
+			out = append(out, ptr)
+		}
+		if err := bf.load(ptr, 0, false); err != nil {
+			return out, fmt.Errorf("blockfs: block %x: %v", ptr, err)
+		}
+		ptr = nextPtr(bf.curr.ptrs[0])
+	}
+	return out, nil
+}
+
+// prefetch reads the first block of each of the files at `ptrs`, in batches,
+// so that later reads of them can be served by the cache beneath the
+// filesystem.
+func (bfs *BlockFilesystem) prefetch(ctx context.Context, ptrs []uint64) error {
+	const batchSize = 128
+
+	keys := make([]uint64, 0, 2*batchSize)
+	for i, ptr := range ptrs {
+		if bfs.splitPtrs {
+			keys = append(keys, p(ptr), d(ptr))
+		} else {
+			keys = append(keys, ptr)
+		}
+		if len(keys) >= 2*batchSize || i == len(ptrs)-1 {
+			if _, err := bfs.store.GetMany(ctx, keys); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	return nil
+}
+
+// checkLayout returns an error if the block at `ptr` doesn't have the size that
+// this filesystem's blocks should, which means that the repository was created
+// with a different number of pointers or amount of data per block.
+func (bfs *BlockFilesystem) checkLayout(ctx context.Context, ptr uint64) error {
+	if !bfs.splitPtrs {
+		raw, err := bfs.store.Get(ctx, ptr)
+		if err != nil {
+			return err
+		} else if int64(len(raw)) != bfs.blockSize() {
+			return fmt.Errorf("blockfs: block %x is %v bytes instead of %v, so the repository was created with a different num-ptrs or data-size", ptr, len(raw), bfs.blockSize())
+		}
+		return nil
+	}
+
+	raw, err := bfs.store.GetMany(ctx, []uint64{p(ptr), d(ptr)})
+	if err != nil {
+		return err
+	} else if raw[p(ptr)] == nil || raw[d(ptr)] == nil {
+		return persistent.ErrObjectNotFound
+	} else if size := int64(len(raw[p(ptr)])); size != bfs.blockPtrsSize() {
+		return fmt.Errorf("blockfs: block %x has %v pointers instead of %v, so the repository was created with a different num-ptrs", ptr, size/8, bfs.numPtrs)
+	} else if size := int64(len(raw[d(ptr)])); size != bfs.blockDataSize() {
+		return fmt.Errorf("blockfs: block %x holds %v bytes of data instead of %v, so the repository was created with a different data-size", ptr, size-3, bfs.dataSize)
+	}
+	return nil
+}
+
 // BlockFile implements read-write functionality for a variable-size file over
 // a skiplist of fixed-size blocks.
 type BlockFile struct {
@@ -203,22 +477,74 @@ type BlockFile struct {
 	pos int64
 	// idx is the index of this block in the skiplist.
 	idx int64
-	// ptr is the pointer for the current block of the file.
+	// ptr is the pointer for the current block of the file, or holePtr if the
+	// current block is in a hole. curr is nil in that case.
 	ptr uint64
 	// curr is the parsed version of the current block.
 	curr *block
+
+	// recent are the blocks that were loaded most recently, so that seeking
+	// backwards can start from one of them rather than from the first block.
+	recent []recentBlock
+}
+
+// recentBlocks is the number of recently loaded blocks that a BlockFile
+// remembers.
+const recentBlocks = 4
+
+type recentBlock struct {
+	idx int64
+	ptr uint64
+}
+
+// nearest returns the most recently loaded block that's closest to, but not
+// after, the block at index `idx`.
+func (bf *BlockFile) nearest(idx int64) (recentBlock, bool) {
+	best, ok := recentBlock{}, false
+	for _, rb := range bf.recent {
+		if rb.idx <= idx && (!ok || rb.idx > best.idx) {
+			best, ok = rb, true
+		}
+	}
+	return best, ok
+}
+
+// remember adds the block at index `idx` to the recently loaded blocks.
+func (bf *BlockFile) remember(idx int64, ptr uint64) {
+	for _, rb := range bf.recent {
+		if rb.idx == idx {
+			return
+		}
+	}
+	bf.recent = append(bf.recent, recentBlock{idx, ptr})
+	if len(bf.recent) > recentBlocks {
+		bf.recent = bf.recent[1:]
+	}
 }
 
 // persist saves any changes to the current block to the storage backend.
 func (bf *BlockFile) persist() error {
+	if bf.ptr == holePtr {
+		return nil
+	}
+	for _, ptr := range bf.curr.ptrs {
+		if isHole(ptr) {
+			if err := bf.parent.useFeature(bf.ctx, persistent.FeatureHoles); err != nil {
+				return err
+			}
+			break
+		}
+	}
 	if bf.parent.splitPtrs {
 		err := bf.parent.store.Set(bf.ctx, p(bf.ptr), bf.curr.MarshalPtrs(), persistent.Metadata)
 		if err != nil {
 			return err
 		} else if bf.curr.data != nil {
-			err := bf.parent.store.Set(bf.ctx, d(bf.ptr), bf.curr.MarshalData(), bf.dt)
+			raw, err := bf.parent.marshalData(bf.ctx, bf.curr, bf.dt)
 			if err != nil {
 				return err
+			} else if err := bf.parent.store.Set(bf.ctx, d(bf.ptr), raw, bf.dt); err != nil {
+				return err
 			}
 		}
 	} else {
@@ -255,7 +581,7 @@ func (bf *BlockFile) load(ptr uint64, pos int64, data bool) error { // NOTE: Don
 		if err := curr.UnmarshalPtrs(raw[ptrPtr]); err != nil {
 			return fmt.Errorf("blockfs: failed to parse block %x: %v", ptr, err)
 		} else if data {
-			if err := curr.UnmarshalData(raw[dataPtr]); err != nil {
+			if err := bf.parent.unmarshalData(bf.ctx, curr, raw[dataPtr]); err != nil {
 				return fmt.Errorf("blockfs: failed to parse block %x: %v", ptr, err)
 			}
 		}
@@ -272,6 +598,9 @@ func (bf *BlockFile) load(ptr uint64, pos int64, data bool) error { // NOTE: Don
 	bf.idx = pos / bf.parent.dataSize
 	bf.ptr = ptr
 	bf.curr = curr
+	if bf.idx > 0 {
+		bf.remember(bf.idx, ptr)
+	}
 
 	return nil
 }
@@ -285,8 +614,17 @@ func (bf *BlockFile) Read(p []byte) (int, error) {
 func (bf *BlockFile) read(p []byte) (int, error) {
 	n, err := bf.readAt(p, bf.pos)
 	if err == errEndOfBlock {
-		if bf.curr.ptrs[0] == nilPtr {
-			return 0, io.EOF
+		if bf.ptr == holePtr { // Find out if the next block is also in the hole.
+			if _, err := bf.Seek(bf.pos, io.SeekStart); err != nil {
+				return 0, err
+			}
+		} else if bf.curr.ptrs[0] == nilPtr {
+			if bf.pos >= bf.size {
+				return 0, io.EOF
+			}
+			bf.hole(bf.idx + 1)
+		} else if !isPtr(bf.curr.ptrs[0]) {
+			bf.hole(bf.idx + 1)
 		} else if err := bf.load(bf.curr.ptrs[0], bf.pos, true); err != nil {
 			return 0, err
 		}
@@ -302,6 +640,8 @@ func (bf *BlockFile) readAt(p []byte, offset int64) (int, error) {
 		return 0, errEndOfBlock
 	} else if offset < 0 || offset > bf.parent.dataSize {
 		return 0, fmt.Errorf("blockfs: invalid offset to read from block")
+	} else if bf.ptr == holePtr {
+		return bf.readHole(p, offset)
 	} else if bf.curr.data == nil { // Load the block data if it hasn't been already.
 		if err := bf.load(bf.ptr, bf.pos, true); err != nil {
 			return 0, err
@@ -309,12 +649,34 @@ func (bf *BlockFile) readAt(p []byte, offset int64) (int, error) {
 	}
 
 	if offset >= int64(len(bf.curr.data)) {
-		return 0, io.EOF
+		return bf.readHole(p, offset)
 	}
 	n := copy(p, bf.curr.data[offset:])
 	return n, nil
 }
 
+// readHole fills `p` with zeros from a hole in the current block, starting at
+// `offset`. A hole lasts until the end of the block, or until the end of the
+// file if there are no blocks after this one.
+func (bf *BlockFile) readHole(p []byte, offset int64) (int, error) {
+	end := bf.parent.dataSize
+	if bf.curr == nil || bf.curr.ptrs[0] == nilPtr {
+		if rest := bf.size - bf.idx*bf.parent.dataSize; rest < end {
+			end = rest
+		}
+	}
+	if offset >= end {
+		return 0, io.EOF
+	} else if n := end - offset; int64(len(p)) > n {
+		p = p[:n]
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
 func (bf *BlockFile) Write(p []byte) (int, error) {
 	n := 0
 
@@ -344,51 +706,33 @@ func (bf *BlockFile) write(first bool, p []byte) (int, error) {
 	} // else err == errEndOfBlock
 
 	// Check if the next block already exists and just write over it if so.
-	if bf.curr.ptrs[0] != nilPtr {
+	if bf.ptr == holePtr {
+		if _, err := bf.Seek(bf.pos, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return bf.writeAt(p, bf.pos)
+	} else if isPtr(bf.curr.ptrs[0]) {
 		if err := bf.persist(); err != nil {
 			return 0, err
 		} else if err := bf.load(bf.curr.ptrs[0], bf.pos, true); err != nil {
 			return 0, err
 		}
 		return bf.writeAt(p, bf.pos)
+	} else if bf.curr.ptrs[0] != nilPtr { // The next block is in a hole.
+		if err := bf.persist(); err != nil {
+			return 0, err
+		}
+		bf.hole(bf.idx + 1)
+		return bf.writeAt(p, bf.pos)
 	}
 
-	// There is no next block. We have to create it. First thing is to change
-	// the format of the current block from a tail to an intermediate.
-	ptr, err := bf.parent.allocate(bf.ctx)
-	if err != nil {
-		return 0, err
-	}
+	// There is no next block. We have to create it.
 	if first && bf.parent.splitPtrs {
 		bf.curr.data = nil
 	}
-	ptrs := bf.curr.Upgrade(bf.idx, bf.ptr, ptr) // NOTE: Are we just changing ptrs here? Unload data if so?
-	if err := bf.persist(); err != nil {
+	if err := bf.extend(bf.idx + 1); err != nil {
 		return 0, err
 	}
-
-	// Load all the ancestor blocks that should point to our new block into
-	// memory, and give them the pointer to the new block.
-	pos, idx := bf.pos, bf.idx+1
-
-	for i := 1; i < len(ptrs); i++ {
-		if idx%(1<<uint(i)) != 0 {
-			continue
-		} else if err := bf.load(ptrs[i], pos-(1<<uint(i))*bf.parent.dataSize, false); err != nil {
-			return 0, err
-		}
-		bf.curr.ptrs[i] = ptr
-		if err := bf.persist(); err != nil {
-			return 0, err
-		}
-	}
-
-	// 'Load' the new block into memory.
-	bf.pos = pos
-	bf.idx = idx
-	bf.ptr = ptr
-	bf.curr = &block{parent: bf.parent, ptrs: ptrs, data: make([]byte, 0)}
-
 	return bf.writeAt(p, bf.pos)
 }
 
@@ -398,7 +742,12 @@ func (bf *BlockFile) writeAt(p []byte, offset int64) (int, error) {
 		return 0, errEndOfBlock
 	} else if offset < 0 || offset > bf.parent.dataSize {
 		return 0, fmt.Errorf("blockfs: invalid offset to write to block")
-	} else if bf.curr.data == nil { // Load the block data if it hasn't been already.
+	} else if bf.ptr == holePtr { // Allocate a block for this part of the hole.
+		if _, err := bf.fill(true); err != nil {
+			return 0, err
+		}
+	}
+	if bf.curr.data == nil { // Load the block data if it hasn't been already.
 		if err := bf.load(bf.ptr, bf.pos, true); err != nil {
 			return 0, err
 		}
@@ -419,6 +768,224 @@ func (bf *BlockFile) writeAt(p []byte, offset int64) (int, error) {
 	return n, nil
 }
 
+// hole moves to block `idx` of the file, which is in a hole. The caller is
+// responsible for updating pos.
+func (bf *BlockFile) hole(idx int64) {
+	bf.idx = idx
+	bf.ptr = holePtr
+	bf.curr = nil
+}
+
+// fill allocates a block for the current position, which is in a hole, along
+// with any blocks that are needed to reach it from the start of the file. If the
+// hole is past the last block of the file and `extend` is false, nothing is
+// allocated and false is returned.
+func (bf *BlockFile) fill(extend bool) (bool, error) {
+	pos, dataSize := bf.pos, bf.parent.dataSize
+
+	// Compute the path that would be taken to the current block, and follow it
+	// until the first missing block.
+	path := []int64{bf.idx}
+	for path[0] > 0 {
+		idx, _ := bf.parent.ancestor(path[0])
+		path = append([]int64{idx}, path...)
+	}
+	if err := bf.load(bf.start, 0, false); err != nil {
+		return false, err
+	}
+
+	next := nilPtr
+	for len(path) > 1 {
+		next = nilPtr
+		if _, level := bf.parent.ancestor(path[1]); bf.curr.ptrs[0] != nilPtr {
+			next = bf.curr.ptrs[level]
+		}
+		if !isPtr(next) {
+			break
+		} else if err := bf.load(next, path[1]*dataSize, false); err != nil {
+			return false, err
+		}
+		path = path[1:]
+	}
+	missing := path[1:]
+
+	if len(missing) > 0 && next == nilPtr {
+		if !extend {
+			bf.pos = pos
+			bf.hole(pos / dataSize)
+			return false, nil
+		} else if err := bf.seekTail(); err != nil {
+			return false, err
+		}
+		for _, idx := range missing {
+			if err := bf.extend(idx); err != nil {
+				return false, err
+			}
+		}
+	} else {
+		for _, idx := range missing {
+			if err := bf.insert(idx); err != nil {
+				return false, err
+			}
+		}
+	}
+	bf.pos = pos
+
+	return true, nil
+}
+
+// seekTail moves to the last block of the file, from a block that's on the
+// path to it.
+func (bf *BlockFile) seekTail() error {
+	for bf.curr.ptrs[0] != nilPtr {
+		stepped := false
+		for i := len(bf.curr.ptrs) - 1; i >= 0; i-- {
+			if !isPtr(bf.curr.ptrs[i]) {
+				continue
+			}
+			pos := (bf.idx + 1<<uint(i)) * bf.parent.dataSize
+			if err := bf.load(bf.curr.ptrs[i], pos, false); err != nil {
+				return err
+			}
+			stepped = true
+			break
+		}
+		if !stepped { // This error should only ever occur if the skiplist is corrupted.
+			return fmt.Errorf("blockfs: failed to find a suitable pointer in skiplist")
+		}
+	}
+	return nil
+}
+
+// extend adds a new tail block to the file, at index `idx`. The current block
+// must be the tail, and any blocks between them are left as a hole.
+func (bf *BlockFile) extend(idx int64) error {
+	// First thing is to change the format of the current block from a tail to
+	// an intermediate.
+	ptr, err := bf.parent.allocate(bf.ctx)
+	if err != nil {
+		return err
+	}
+	tailIdx := bf.idx
+	ptrs := bf.curr.Upgrade(bf.idx, bf.ptr, idx, ptr) // NOTE: Are we just changing ptrs here? Unload data if so?
+	if err := bf.persist(); err != nil {
+		return err
+	}
+
+	// Load all the ancestor blocks that should point to our new block, or to
+	// the hole before it, into memory and update them.
+	for i := 1; i < len(ptrs); i++ {
+		jump := int64(1) << uint(i)
+		if tailIdx%jump == 0 {
+			continue
+		}
+		target := tailIdx/jump*jump + jump
+		if target > idx {
+			continue
+		} else if err := bf.load(ptrs[i], (target-jump)*bf.parent.dataSize, false); err != nil {
+			return err
+		}
+		if target == idx {
+			bf.curr.ptrs[i] = ptr
+		} else {
+			bf.curr.ptrs[i] = holePtr
+		}
+		if err := bf.persist(); err != nil {
+			return err
+		}
+	}
+
+	// 'Load' the new block into memory.
+	bf.pos = idx * bf.parent.dataSize
+	bf.idx = idx
+	bf.ptr = ptr
+	bf.curr = &block{parent: bf.parent, ptrs: ptrs, data: make([]byte, 0)}
+
+	return nil
+}
+
+// insert adds a new block to the file at index `idx`, which is in a hole before
+// the tail. The current block must be the one that's passed through right
+// before `idx` when seeking to it.
+func (bf *BlockFile) insert(idx int64) error {
+	ptr, err := bf.parent.allocate(bf.ctx)
+	if err != nil {
+		return err
+	}
+	_, level := bf.parent.ancestor(idx)
+	parent := bf.curr.ptrs
+
+	// The new block would've been on the path to anything its lower pointers
+	// reach, so those are all in the hole. Its highest pointer goes to the same
+	// place as the pointer one level above it in the previous block.
+	ptrs := make([]uint64, bf.parent.numPtrs)
+	for i := 1; i < len(ptrs); i++ {
+		if i > level {
+			ptrs[i] = nilPtr
+		} else if i == level && i+1 < len(ptrs) {
+			ptrs[i] = parent[i+1]
+		} else {
+			ptrs[i] = holePtr
+		}
+	}
+
+	// Find the last block before the new one, remembering the blocks we see on
+	// the way. Some of them should point to the new block.
+	seen := map[int64]uint64{bf.idx: bf.ptr}
+	for {
+		stepped := false
+		for i := len(bf.curr.ptrs) - 1; i >= 0; i-- {
+			next := bf.idx + 1<<uint(i)
+			if !isPtr(bf.curr.ptrs[i]) || next >= idx {
+				continue
+			} else if err := bf.load(bf.curr.ptrs[i], next*bf.parent.dataSize, false); err != nil {
+				return err
+			}
+			seen[next] = bf.ptr
+			stepped = true
+			break
+		}
+		if !stepped {
+			break
+		}
+	}
+
+	// Splice the new block into the list of the file's blocks.
+	ptrs[0] = nextPtr(bf.curr.ptrs[0])
+	if level > 0 || len(parent) < 2 || !isPtr(parent[1]) {
+		ptrs[0] |= holeFlag
+	}
+	bf.curr.ptrs[0] = ptr
+	if bf.idx+1 != idx {
+		bf.curr.ptrs[0] |= holeFlag
+	}
+	if err := bf.persist(); err != nil {
+		return err
+	}
+
+	for i := 1; i <= level && i < len(ptrs); i++ {
+		prev := idx - int64(1)<<uint(i)
+		prevPtr, ok := seen[prev]
+		if !ok {
+			continue
+		} else if err := bf.load(prevPtr, prev*bf.parent.dataSize, false); err != nil {
+			return err
+		}
+		bf.curr.ptrs[i] = ptr
+		if err := bf.persist(); err != nil {
+			return err
+		}
+	}
+
+	// 'Load' the new block into memory.
+	bf.pos = idx * bf.parent.dataSize
+	bf.idx = idx
+	bf.ptr = ptr
+	bf.curr = &block{parent: bf.parent, ptrs: ptrs, data: make([]byte, 0)}
+
+	return bf.persist()
+}
+
 func (bf *BlockFile) Seek(offset int64, whence int) (int64, error) {
 	// Calculate offset relative to the beginning of the file.
 	if whence == io.SeekStart {
@@ -436,14 +1003,32 @@ func (bf *BlockFile) Seek(offset int64, whence int) (int64, error) {
 	} else if offset > bf.size {
 		return -1, fmt.Errorf("blockfs: cannot seek past end of file")
 	}
-	bf.pos = bf.idx * bf.parent.dataSize
 
-	// Follow the skiplist.
-	if offset < bf.pos {
-		if err := bf.load(bf.start, 0, false); err != nil {
-			return -1, err
+	loads := 0
+	defer func() { SkiplistSeekBlocks.Observe(float64(loads)) }()
+	load := func(ptr uint64, pos int64) error {
+		loads++
+		return bf.load(ptr, pos, false)
+	}
+
+	// Follow the skiplist. Going backwards starts from whichever block that
+	// was loaded recently is closest, or from the first block.
+	fromStart := false
+	if bf.ptr == holePtr || offset < bf.idx*bf.parent.dataSize {
+		rb, ok := bf.nearest(offset / bf.parent.dataSize)
+		if ok {
+			if err := load(rb.ptr, rb.idx*bf.parent.dataSize); err != nil {
+				bf.recent, ok = nil, false
+			}
+		}
+		if !ok {
+			if err := load(bf.start, 0); err != nil {
+				return -1, err
+			}
+			fromStart = true
 		}
 	}
+	bf.pos = bf.idx * bf.parent.dataSize
 
 	for bf.pos != offset {
 		// See if we have what we need in-memory.
@@ -455,14 +1040,18 @@ func (bf *BlockFile) Seek(offset int64, whence int) (int64, error) {
 			return offset, nil
 		}
 
-		// We need to load another block. Choose the next pointer to follow.
+		// We need to load another block. If there are none, then the offset is
+		// in a hole at the end of the file.
 		if bf.curr.ptrs[0] == nilPtr {
-			return -1, fmt.Errorf("blockfs: unexpectedly reached end of skiplist")
+			bf.pos = offset
+			bf.hole(offset / bf.parent.dataSize)
+			return offset, nil
 		}
 
+		// Choose the next pointer to follow.
 		stepped := false
 		for i := len(bf.curr.ptrs) - 1; i >= 0; i-- {
-			if bf.curr.ptrs[i] == nilPtr {
+			if !isPtr(bf.curr.ptrs[i]) {
 				continue
 			}
 			pos := bf.pos + (1<<uint(i))*bf.parent.dataSize
@@ -471,15 +1060,28 @@ func (bf *BlockFile) Seek(offset int64, whence int) (int64, error) {
 			}
 
 			// This pointer will get us as far as possible without going over.
-			if err := bf.load(bf.curr.ptrs[i], pos, false); err != nil {
+			if err := load(bf.curr.ptrs[i], pos); err != nil {
 				return -1, err
 			}
 			stepped = true
 			break
 		}
-		if !stepped { // This error should only ever occur if the skiplist is corrupted.
-			return -1, fmt.Errorf("blockfs: failed to find a suitable pointer in skiplist")
+		if stepped {
+			continue
+		} else if !fromStart {
+			// Blocks next to a hole might not have a way around it, so try
+			// again from the start of the file.
+			if err := load(bf.start, 0); err != nil {
+				return -1, err
+			}
+			fromStart = true
+			continue
 		}
+
+		// The offset is in a hole between two blocks.
+		bf.pos = offset
+		bf.hole(offset / bf.parent.dataSize)
+		return offset, nil
 	}
 
 	return bf.pos, nil
@@ -489,18 +1091,52 @@ func (bf *BlockFile) Truncate(size int64) error {
 	if size < 0 {
 		return fmt.Errorf("blockfs: cannot truncate to negative size")
 	} else if size >= bf.size {
+		// Growing the file leaves a hole at the end, which doesn't have any
+		// blocks allocated for it until it's written to.
+		if size > bf.size {
+			if err := bf.parent.useFeature(bf.ctx, persistent.FeatureHoles); err != nil {
+				return err
+			}
+		}
+		bf.size = size
 		_, err := bf.Seek(0, io.SeekEnd)
 		return err
 	}
 	bf.size = size
 
+	// Blocks past the new end are about to be removed, so forget them.
+	recent := bf.recent[:0]
+	for _, rb := range bf.recent {
+		if rb.idx*bf.parent.dataSize < size {
+			recent = append(recent, rb)
+		}
+	}
+	bf.recent = recent
+
+	// Make sure the new tail block exists. If it would be past the current
+	// tail, there's nothing to remove.
+	endIdx := (bf.size - 1) / bf.parent.dataSize
+	if _, err := bf.Seek(endIdx*bf.parent.dataSize, io.SeekStart); err != nil {
+		return err
+	} else if bf.idx != endIdx { // We're at the very end of the tail block.
+		_, err := bf.Seek(0, io.SeekEnd)
+		return err
+	} else if bf.ptr == holePtr {
+		ok, err := bf.fill(false)
+		if err != nil {
+			return err
+		} else if !ok {
+			_, err := bf.Seek(0, io.SeekEnd)
+			return err
+		}
+	}
+
 	// Seek to any blocks that might point past the end of the new file
 	// boundary. Update them to no longer point over, and collect their pointers
 	// for the new tail block.
 	tailPtrs := make([]uint64, bf.parent.numPtrs)
 	tailPtrs[0] = nilPtr
 
-	endIdx := (bf.size - 1) / bf.parent.dataSize
 	for i := len(tailPtrs) - 1; i >= 1; i-- {
 		jump := int64(1) << uint(i)
 		idx := endIdx / jump * jump
@@ -526,7 +1162,7 @@ func (bf *BlockFile) Truncate(size int64) error {
 	if _, err := bf.Seek(endIdx*bf.parent.dataSize, io.SeekStart); err != nil {
 		return err
 	} else if bf.curr.ptrs[0] != nilPtr {
-		if err := bf.parent.Unlink(bf.ctx, bf.curr.ptrs[0]); err != nil {
+		if err := bf.parent.Unlink(bf.ctx, nextPtr(bf.curr.ptrs[0])); err != nil {
 			return err
 		}
 	}
@@ -536,11 +1172,13 @@ func (bf *BlockFile) Truncate(size int64) error {
 		return err
 	}
 	bf.curr.ptrs = tailPtrs
-	bf.curr.data = bf.curr.data[:bf.size-endIdx*bf.parent.dataSize]
+	if end := bf.size - endIdx*bf.parent.dataSize; end < int64(len(bf.curr.data)) {
+		bf.curr.data = bf.curr.data[:end]
+	}
 	if err := bf.persist(); err != nil {
 		return err
 	}
-	bf.pos += int64(len(bf.curr.data))
+	bf.pos = bf.size
 
 	return nil
 }
@@ -548,13 +1186,15 @@ func (bf *BlockFile) Truncate(size int64) error {
 type block struct {
 	parent *BlockFilesystem
 
-	ptrs []uint64 // ptrs contains the skiplist pointers from the current block.
-	data []byte   // data is the block's application data.
+	ptrs []uint64  // ptrs contains the skiplist pointers from the current block.
+	data []byte    // data is the block's application data.
+	ref  *blockRef // ref is the shared copy of data that this block refers to, if any.
 }
 
-// Upgrade modifies this block from a tail into an intermediate and returns the
-// pointers for the next tail.
-func (b *block) Upgrade(currIdx int64, currPtr, nextPtr uint64) []uint64 {
+// Upgrade modifies this block from a tail into an intermediate, given that the
+// next block of the file is at index `nextIdx`, and returns the pointers for the
+// next tail.
+func (b *block) Upgrade(currIdx int64, currPtr uint64, nextIdx int64, next uint64) []uint64 {
 	// Compute the tail pointers for the subsequent block.
 	out := make([]uint64, b.parent.numPtrs)
 	out[0] = nilPtr
@@ -567,10 +1207,21 @@ func (b *block) Upgrade(currIdx int64, currPtr, nextPtr uint64) []uint64 {
 	}
 
 	// Update this block to point to the next block and nothing else, because
-	// nothing else exists past that.
-	b.ptrs[0] = nextPtr
+	// nothing else exists past that. Pointers that land before the next block
+	// are in a hole.
+	b.ptrs[0] = next
+	if nextIdx != currIdx+1 {
+		b.ptrs[0] |= holeFlag
+	}
 	for i := 1; i < len(b.ptrs); i++ {
 		b.ptrs[i] = nilPtr
+		if jump := int64(1) << uint(i); currIdx%jump != 0 {
+			continue
+		} else if target := currIdx + jump; target == nextIdx {
+			b.ptrs[i] = next
+		} else if target < nextIdx {
+			b.ptrs[i] = holePtr
+		}
 	}
 
 	return out
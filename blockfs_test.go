@@ -6,11 +6,15 @@ import (
 	"bytes"
 	"context"
 	crand "crypto/rand"
+	"fmt"
 	"io"
 	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func init() {
@@ -66,6 +70,14 @@ func testBFS(t *testing.T, td *testData) {
 		}
 		pos = int(size)
 		data = data[:size]
+	} else if dice == 4 { // Truncate to a larger size.
+		size := len(data) + rand.Intn(16*256)
+		err := bf.Truncate(int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos = size
+		data = append(data, make([]byte, size-len(data))...)
 	} else if len(data) > 0 && dice < 20 { // Read.
 		p := make([]byte, rand.Int63n(256)+1)
 
@@ -144,6 +156,11 @@ func testBlockFilesystem(t *testing.T, splitPtrs bool) {
 			}
 			ptrs = append(ptrs, ptr)
 			files[ptr] = &testData{bf, 0, nil}
+		} else if dice < 10 {
+			ptr := ptrs[rand.Intn(len(ptrs))]
+			if err := bfs.Check(ctx, ptr); err != nil {
+				t.Fatal(err)
+			}
 		} else {
 			ptr := ptrs[rand.Intn(len(ptrs))]
 			testBFS(t, files[ptr])
@@ -153,9 +170,733 @@ func testBlockFilesystem(t *testing.T, splitPtrs bool) {
 	t.Logf("created %v files", len(ptrs))
 	sum := 0
 	for _, ptr := range ptrs {
+		if err := bfs.Check(ctx, ptr); err != nil {
+			t.Fatal(err)
+		}
 		n := len(files[ptr].data)
 		sum += n
 		t.Logf("- %x: contains %v bytes", ptr, n)
 	}
 	t.Logf("%v bytes total", sum)
 }
+
+func TestBlockFileSparse(t *testing.T) {
+	ctx := context.Background()
+
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := func() uint64 {
+		state, err := store.State(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.NextPtr
+	}
+	readAt := func(bf *BlockFile, offset int64, n int) []byte {
+		if _, err := bf.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		out := make([]byte, n)
+		if _, err := io.ReadFull(bf, out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	zeros := make([]byte, 3000)
+
+	_, bf, err := bfs.Create(ctx, persistent.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(10000*1024 + 10)
+	if err := bf.Truncate(size); err != nil {
+		t.Fatal(err)
+	} else if n := blocks(); n != 1 {
+		t.Fatalf("growing file allocated blocks: %v", n)
+	}
+	if state, err := store.State(ctx); err != nil {
+		t.Fatal(err)
+	} else if state.Header.Features&persistent.FeatureHoles == 0 {
+		t.Fatal("hole wasn't recorded in the repository's features")
+	}
+
+	// Write the last byte of the file. Only the blocks needed to reach it
+	// should be allocated.
+	if _, err := bf.Seek(size-1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	} else if _, err := bf.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	} else if n := blocks(); n > 20 {
+		t.Fatalf("writing last byte allocated too many blocks: %v", n)
+	}
+	if got := readAt(bf, 0, len(zeros)); !bytes.Equal(got, zeros) {
+		t.Fatal("start of file is not zeros")
+	} else if got := readAt(bf, 4321*1024-5, len(zeros)); !bytes.Equal(got, zeros) {
+		t.Fatal("middle of file is not zeros")
+	} else if got := readAt(bf, size-3, 3); !bytes.Equal(got, []byte{0, 0, 1}) {
+		t.Fatal("end of file has unexpected data")
+	}
+
+	// Overwrite part of the hole, and check that the data around it is still
+	// zeros.
+	if _, err := bf.Seek(5000*1024-2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	} else if _, err := bf.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := readAt(bf, 5000*1024-1002, 2005)
+	if !bytes.Equal(got[:1000], zeros[:1000]) || !bytes.Equal(got[1005:], zeros[:1000]) {
+		t.Fatal("data around overwrite is not zeros")
+	} else if string(got[1000:1005]) != "hello" {
+		t.Fatal("overwritten data is not as expected")
+	} else if got := readAt(bf, size-3, 3); !bytes.Equal(got, []byte{0, 0, 1}) {
+		t.Fatal("end of file has unexpected data")
+	}
+
+	// Shrinking the file into the hole should keep the overwritten data, and
+	// reading should stop at the new end.
+	if err := bf.Truncate(6000 * 1024); err != nil {
+		t.Fatal(err)
+	} else if got := readAt(bf, 5000*1024-2, 5); string(got) != "hello" {
+		t.Fatal("overwritten data is not as expected")
+	}
+	if _, err := bf.Seek(-1, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if n, err := bf.Read(make([]byte, 10)); n != 1 || err != nil {
+		t.Fatalf("unexpected read at end of file: %v %v", n, err)
+	} else if n, err := bf.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("unexpected read at end of file: %v %v", n, err)
+	} else if err := bfs.Check(ctx, bf.start); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeekRecentBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bfs, err := NewBlockFilesystem(store, 3, 256, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bf, err := bfs.Create(ctx, persistent.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 200*256)
+	crand.Read(data)
+	if _, err := bf.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	loads := func(offset int64) int {
+		prev := seekBlocks(t)
+		if _, err := bf.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buff := make([]byte, 100)
+		if _, err := io.ReadFull(bf, buff); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buff, data[offset:offset+100]) {
+			t.Fatalf("unexpected data read at %v", offset)
+		}
+		return int(seekBlocks(t) - prev)
+	}
+	// Seeking to the middle of the file from the start has to walk the
+	// skiplist, but seeking back a little way afterwards shouldn't.
+	if n := loads(150 * 256); n < 10 {
+		t.Fatalf("expected seek from start to load more blocks, loaded %v", n)
+	} else if n := loads(149*256 + 10); n > 3 {
+		t.Fatalf("backward seek loaded too many blocks: %v", n)
+	}
+
+	// Blocks forgotten by truncating the file aren't used again.
+	if err := bf.Truncate(100 * 256); err != nil {
+		t.Fatal(err)
+	}
+	for _, rb := range bf.recent {
+		if rb.idx >= 100 {
+			t.Fatalf("block %v is past the end of the file", rb.idx)
+		}
+	}
+	if n := loads(50 * 256); n == 0 {
+		t.Fatal("expected seek to load blocks")
+	}
+}
+
+// seekBlocks returns the total number of blocks loaded by seeks so far.
+func seekBlocks(t *testing.T) float64 {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(SkiplistSeekBlocks)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families[0].GetMetric()[0].GetHistogram().GetSampleSum()
+}
+
+func TestBlockFilesystemCheck(t *testing.T) {
+	ctx := context.Background()
+
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bfs, err := NewBlockFilesystem(store, 3, 256, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, bf, err := bfs.Create(ctx, persistent.Content)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := bf.Write(make([]byte, 20*256)); err != nil {
+		t.Fatal(err)
+	} else if err := bfs.Check(ctx, ptr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt one of the higher-level pointers of the first block, so that it
+	// points to the wrong block.
+	corrupt := func(f func(b *block)) {
+		bf := &BlockFile{parent: bfs, ctx: ctx, start: ptr}
+		if err := bf.load(ptr, 0, true); err != nil {
+			t.Fatal(err)
+		}
+		f(bf.curr)
+		if err := bf.persist(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var orig uint64
+	corrupt(func(b *block) {
+		orig = b.ptrs[2]
+		b.ptrs[2] = b.ptrs[1]
+	})
+	if err := bfs.Check(ctx, ptr); err == nil {
+		t.Fatal("expected error from corrupted skiplist")
+	}
+	corrupt(func(b *block) { b.ptrs[2] = orig })
+	if err := bfs.Check(ctx, ptr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the file's blocks form a cycle.
+	corrupt(func(b *block) { b.ptrs[0] = ptr })
+	if err := bfs.Check(ctx, ptr); err == nil {
+		t.Fatal("expected error from cycle in skiplist")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bfs, err := NewDedupBlockFilesystem(store, 3, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 10*256+100)
+	crand.Read(data)
+	create := func() uint64 {
+		ptr, bf, err := bfs.Create(ctx, persistent.Content)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := bf.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		return ptr
+	}
+	check := func(ptr uint64, expected []byte) {
+		bf, err := bfs.Open(ctx, ptr, persistent.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(expected)+1)
+		n, err := io.ReadFull(bf, got)
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("unexpected error reading file: %v", err)
+		} else if !bytes.Equal(got[:n], expected) {
+			t.Fatal("file has unexpected contents")
+		} else if err := bfs.Check(ctx, ptr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := create()
+	before := state.NextPtr
+	b := create()
+	if used := state.NextPtr - before; used != 11 {
+		t.Fatalf("expected second file to use 11 blocks, used %v", used)
+	}
+	check(a, data)
+	check(b, data)
+	if state.Header.Features&persistent.FeatureDedup == 0 {
+		t.Fatal("shared blocks weren't recorded in the repository's features")
+	}
+
+	// Overwriting a block of one file doesn't change the other.
+	modified := append([]byte{}, data...)
+	modified[300] ^= 0xff
+	bf, err := bfs.Open(ctx, b, persistent.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf.size = int64(len(data))
+	if _, err := bf.Seek(300, io.SeekStart); err != nil {
+		t.Fatal(err)
+	} else if _, err := bf.Write(modified[300:301]); err != nil {
+		t.Fatal(err)
+	}
+	check(a, data)
+	check(b, modified)
+
+	// Unlinking one file leaves the shared blocks for the other.
+	if err := bfs.Unlink(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	check(b, modified)
+
+	idx, err := bfs.index(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := 0
+	err = idx.Range(func(ptr, refs uint64) error {
+		shared++
+		if refs != 1 {
+			t.Fatalf("shared block %x has %v references, expected 1", ptr, refs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if shared != 10 {
+		t.Fatalf("expected 10 shared blocks, got %v", shared)
+	}
+
+	// Once both are unlinked, nothing is shared anymore and the blocks are
+	// reused.
+	if err := bfs.Unlink(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Range(func(ptr, refs uint64) error {
+		t.Fatalf("shared block %x is still in index", ptr)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = state.NextPtr
+	c := create()
+	if state.NextPtr != before {
+		t.Fatal("blocks in trash were not reused")
+	}
+	check(c, data)
+}
+
+// stateCounter wraps a block storage backend and counts how many times the
+// application's shared state is read and written.
+type stateCounter struct {
+	persistent.BlockStorage
+	reads, writes int
+}
+
+func (sc *stateCounter) Get(ctx context.Context, ptr uint64) ([]byte, error) {
+	if ptr == 0 {
+		sc.reads++
+	}
+	return sc.BlockStorage.Get(ctx, ptr)
+}
+
+func (sc *stateCounter) GetMany(ctx context.Context, ptrs []uint64) (map[uint64][]byte, error) {
+	for _, ptr := range ptrs {
+		if ptr == 0 {
+			sc.reads++
+		}
+	}
+	return sc.BlockStorage.GetMany(ctx, ptrs)
+}
+
+func (sc *stateCounter) Set(ctx context.Context, ptr uint64, data []byte, dt persistent.DataType) error {
+	if ptr == 0 {
+		sc.writes++
+	}
+	return sc.BlockStorage.Set(ctx, ptr, data, dt)
+}
+
+func TestStateCaching(t *testing.T) {
+	ctx := context.Background()
+
+	counter := &stateCounter{BlockStorage: persistent.NewBlockMemory()}
+	store := persistent.NewAppStorage(counter)
+	bfs, err := NewBlockFilesystem(store, 3, 256, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, _, err := bfs.Create(ctx, persistent.Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !store.StateChanged() {
+		t.Fatal("state should be marked as changed")
+	} else if err := store.Commit(ctx); err != nil {
+		t.Fatal(err)
+	} else if counter.reads != 1 || counter.writes != 1 {
+		t.Fatalf("expected one read and one write of state, got %v reads and %v writes", counter.reads, counter.writes)
+	}
+
+	// A transaction that doesn't change the state doesn't write it.
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if _, err := store.State(ctx); err != nil {
+		t.Fatal(err)
+	} else if store.StateChanged() {
+		t.Fatal("state should not be marked as changed")
+	} else if err := store.Commit(ctx); err != nil {
+		t.Fatal(err)
+	} else if counter.writes != 1 {
+		t.Fatal("unexpected write of unchanged state")
+	}
+}
+
+// crashingStorage wraps a reliable storage backend, and fails to commit while
+// `crash` is set, like the process had died before its changes were written.
+type crashingStorage struct {
+	persistent.ReliableStorage
+	crash bool
+}
+
+func (cs *crashingStorage) Commit(ctx context.Context, writes map[uint64]persistent.WriteData) error {
+	if cs.crash && len(writes) > 0 {
+		cs.ReliableStorage.Commit(ctx, nil)
+		return fmt.Errorf("crashed")
+	}
+	return cs.ReliableStorage.Commit(ctx, writes)
+}
+
+func TestAbortedAllocate(t *testing.T) {
+	ctx := context.Background()
+
+	crashing := &crashingStorage{ReliableStorage: persistent.NewSimpleReliable(persistent.NewMemory())}
+	store := persistent.NewAppStorage(persistent.NewBufferedStorage(crashing))
+	bfs, err := NewBlockFilesystem(store, 3, 256, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := func() persistent.State {
+		if err := store.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer store.Rollback(ctx)
+		state, err := store.State(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *state
+	}
+	create := func() (uint64, error) {
+		if err := store.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		ptr, bf, err := bfs.Create(ctx, persistent.Content)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := bf.Write(make([]byte, 5*256)); err != nil {
+			t.Fatal(err)
+		}
+		return ptr, store.Commit(ctx)
+	}
+
+	// A file whose blocks were allocated, but never committed, is forgotten.
+	before := state()
+	crashing.crash = true
+	if _, err := create(); err == nil {
+		t.Fatal("expected commit to fail")
+	} else if after := state(); after != before {
+		t.Fatalf("state changed by failed commit: %+v != %+v", after, before)
+	}
+	crashing.crash = false
+	ptr, err := create()
+	if err != nil {
+		t.Fatal(err)
+	} else if after := state(); after.NextPtr != 5 {
+		t.Fatalf("blocks were leaked: next pointer is %v, not 5", after.NextPtr)
+	}
+
+	// The same goes for blocks taken from the trash.
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := bfs.Unlink(ctx, ptr); err != nil {
+		t.Fatal(err)
+	} else if err := store.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	before = state()
+	crashing.crash = true
+	if _, err := create(); err == nil {
+		t.Fatal("expected commit to fail")
+	} else if after := state(); after != before {
+		t.Fatalf("state changed by failed commit: %+v != %+v", after, before)
+	}
+	crashing.crash = false
+	if ptr, err = create(); err != nil {
+		t.Fatal(err)
+	} else if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := bfs.Check(ctx, ptr); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Rollback(ctx)
+	if state, err := store.State(ctx); err != nil {
+		t.Fatal(err)
+	} else if state.NextPtr != 5 || state.TrashPtr != nilPtr {
+		t.Fatalf("trash was not reused: %+v", state)
+	}
+}
+
+func TestRepositoryHeader(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	check := func(numPtrs, dataSize int64, splitPtrs bool) error {
+		bfs, err := NewBlockFilesystem(store, numPtrs, dataSize, splitPtrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bfs.CheckHeader(ctx, persistent.KDFParams{})
+	}
+
+	// Create a repository without a header, like an older client would.
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := NewFilesystem(bfs); err != nil {
+		t.Fatal(err)
+	}
+
+	// It shouldn't be stamped with the wrong parameters.
+	if err := check(12, 2048, true); err == nil {
+		t.Fatal("stamped repository with the wrong data size")
+	} else if err := check(12, 1024, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if state.Header != bfs.header(persistent.KDFParams{}) {
+		t.Fatalf("unexpected header: %#v", state.Header)
+	}
+	store.Rollback(ctx)
+
+	// Once it's stamped, any mismatch should be refused.
+	if err := check(12, 1024, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, params := range []struct {
+		numPtrs, dataSize int64
+		splitPtrs         bool
+	}{{8, 1024, true}, {12, 4096, true}} {
+		if err := check(params.numPtrs, params.dataSize, params.splitPtrs); err == nil {
+			t.Fatalf("opened repository with the wrong parameters: %v", params)
+		}
+	}
+
+	// A header without KDF parameters should have them recorded.
+	bfs, err = NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := bfs.CheckHeader(ctx, persistent.DefaultKDFParams); err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := bfs.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if header.KDF != persistent.DefaultKDFParams {
+		t.Fatalf("unexpected kdf parameters in header: %v", header.KDF)
+	}
+}
+
+func TestRepositoryInfo(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := persistent.Info{Name: "photos", Creator: "alice@laptop", Version: "v1.2.3"}
+	if err := bfs.StampInfo(ctx, info); err != nil {
+		t.Fatal(err)
+	} else if _, err := NewFilesystem(bfs); err != nil {
+		t.Fatal(err)
+	} else if err := bfs.StampInfo(ctx, persistent.Info{Name: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	_, stored, err := bfs.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if stored.Created == 0 {
+		t.Fatal("creation time wasn't recorded")
+	}
+	stored.Created = 0
+	if stored != info {
+		t.Fatalf("unexpected info: %#v", stored)
+	}
+
+	// A repository that already has files isn't stamped, but can be named.
+	store = persistent.NewAppStorage(persistent.NewBlockMemory())
+	if bfs, err = NewBlockFilesystem(store, 12, 1024, true); err != nil {
+		t.Fatal(err)
+	} else if _, err := NewFilesystem(bfs); err != nil {
+		t.Fatal(err)
+	} else if err := bfs.StampInfo(ctx, info); err != nil {
+		t.Fatal(err)
+	} else if err := bfs.SetName(ctx, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, stored, err := bfs.Info(ctx); err != nil {
+		t.Fatal(err)
+	} else if stored != (persistent.Info{Name: "renamed"}) {
+		t.Fatalf("unexpected info: %#v", stored)
+	}
+}
+
+func TestRepositoryLayout(t *testing.T) {
+	ctx := context.Background()
+
+	for _, stamped := range []bool{false, true} {
+		// Create a repository the way a client with ORAM would, with pointers
+		// stored together with data.
+		store := persistent.NewAppStorage(persistent.NewBlockMemory())
+		bfs, err := NewBlockFilesystem(store, 12, 1024, false)
+		if err != nil {
+			t.Fatal(err)
+		} else if stamped {
+			if err := bfs.CheckHeader(ctx, persistent.KDFParams{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Archive mode commits writes immediately, instead of buffering them.
+		fs, err := NewArchive(bfs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCreate(t, fs, "a", "hello")
+
+		// Opening it without ORAM should use the layout it was created with.
+		bfs, err = NewBlockFilesystem(store, 12, 1024, true)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := bfs.CheckHeader(ctx, persistent.KDFParams{}); err != nil {
+			t.Fatal(err)
+		} else if bfs.splitPtrs {
+			t.Fatalf("stamped %v: layout of repository wasn't detected", stamped)
+		}
+		fs, err = NewFilesystem(bfs)
+		if err != nil {
+			t.Fatal(err)
+		} else if data := testReadAll(t, fs, "a"); data != "hello" {
+			t.Fatalf("unexpected file contents: %q", data)
+		}
+
+		// Dedup can't use that layout, and should say why.
+		bfs, err = NewDedupBlockFilesystem(store, 12, 1024)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := bfs.CheckHeader(ctx, persistent.KDFParams{}); err == nil || !strings.Contains(err.Error(), "dedup") {
+			t.Fatalf("expected error about dedup, got: %v", err)
+		}
+	}
+}
+
+func TestDedupHash(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+
+	data := make([]byte, 4*256)
+	crand.Read(data)
+	write := func(hash string) error {
+		bfs, err := NewDedupBlockFilesystemWithHash(store, 3, 256, hash)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := store.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer store.Rollback(ctx)
+		for i := 0; i < 2; i++ {
+			_, bf, err := bfs.Create(ctx, persistent.Content)
+			if err != nil {
+				return err
+			} else if _, err := bf.Write(data); err != nil {
+				return err
+			}
+		}
+		return store.Commit(ctx)
+	}
+
+	if _, err := NewDedupBlockFilesystemWithHash(store, 3, 256, "md5"); err == nil {
+		t.Fatal("accepted unknown hash")
+	} else if err := write(DedupSHA256); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index keeps the hash it was created with.
+	if err := write(DedupBLAKE2b); err == nil {
+		t.Fatal("wrote to index with a different hash")
+	} else if err := write(""); err != nil {
+		t.Fatal(err)
+	}
+	bfs, err := NewDedupBlockFilesystem(store, 3, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := bfs.DedupStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if stats.Hash != DedupSHA256 || stats.Shared != 4 || stats.Refs != 16 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	} else if stats.Ratio() != 4 || stats.Saved() != 12*256 {
+		t.Fatalf("unexpected ratio or savings: %v %v", stats.Ratio(), stats.Saved())
+	}
+
+	// A new index defaults to BLAKE2b.
+	store = persistent.NewAppStorage(persistent.NewBlockMemory())
+	if err := write(""); err != nil {
+		t.Fatal(err)
+	} else if err := write(DedupSHA256); err == nil {
+		t.Fatal("wrote to index with a different hash")
+	}
+	bfs, err = NewDedupBlockFilesystem(store, 3, 256)
+	if err != nil {
+		t.Fatal(err)
+	} else if stats, err := bfs.DedupStats(ctx); err != nil {
+		t.Fatal(err)
+	} else if stats.Hash != DedupBLAKE2b {
+		t.Fatalf("unexpected hash for new index: %v", stats.Hash)
+	}
+}
@@ -96,6 +96,14 @@ func (c *cache) Delete(k interface{}) {
 	c.mu.Unlock()
 }
 
+// Delete all items from the cache.
+func (c *cache) Flush() {
+	c.mu.Lock()
+	c.items = make(map[interface{}]Item)
+	c.keys.keys = nil
+	c.mu.Unlock()
+}
+
 // Delete all expired items from the cache.
 func (c *cache) DeleteExpired() {
 	c.mu.Lock()
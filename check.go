@@ -0,0 +1,170 @@
+package utahfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+// CheckFilesystem validates the structure of every file and directory that's
+// reachable from the root of the block filesystem. Unlike the checks done by
+// the integrity layer, which detect tampering, this detects logic errors that
+// left a skiplist in an inconsistent state. It returns the first problem found.
+func CheckFilesystem(ctx context.Context, bfs *BlockFilesystem) error {
+	nm := newNodeManager(bfs, 128, 0, 0, nil, nil)
+	if err := nm.Start(ctx); err != nil {
+		return err
+	}
+	defer nm.Rollback(ctx)
+
+	state, err := nm.State(ctx)
+	if err != nil {
+		return err
+	} else if state.RootPtr == nilPtr {
+		return nil
+	}
+	rootPtr := state.RootPtr
+
+	seen := make(map[uint64]struct{})
+	queue := []uint64{rootPtr}
+	for len(queue) > 0 {
+		ptr := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[ptr]; ok {
+			continue
+		}
+		seen[ptr] = struct{}{}
+
+		if _, err := bfs.check(ctx, ptr); err != nil {
+			return fmt.Errorf("utahfs: inode %v: %v", ptr-rootPtr+1, err)
+		}
+		nd, err := nm.Open(ctx, ptr)
+		if err != nil {
+			return fmt.Errorf("utahfs: inode %v: %v", ptr-rootPtr+1, err)
+		}
+		if nd.Data != nilPtr {
+			tail, err := bfs.check(ctx, nd.Data)
+			if err != nil {
+				return fmt.Errorf("utahfs: inode %v: data: %v", ptr-rootPtr+1, err)
+			} else if tail > 0 && tail*bfs.dataSize >= int64(nd.Attrs.Size) {
+				return fmt.Errorf("utahfs: inode %v: data: tail block %v is past the end of the file", ptr-rootPtr+1, tail)
+			}
+		}
+		for _, childID := range nd.Children {
+			queue = append(queue, uint64(childID)+rootPtr-1)
+		}
+	}
+
+	return nil
+}
+
+// FindOrphans compares the objects in `backend` against the blocks that are
+// reachable from the root of the block filesystem, the trash, or the dedup
+// index. `backend` should be the object storage provider at the bottom of the
+// block filesystem's storage stack, and the local WAL is drained into it first.
+//
+// It returns the keys of leaked objects, which exist in the backend but
+// aren't used by anything, and dangling references, which are blocks that
+// should exist but don't. Both are sorted. Files that can't be read because a
+// block is missing are skipped, and an error is only returned if there were
+// unreadable files but no dangling references to explain them.
+func FindOrphans(ctx context.Context, bfs *BlockFilesystem, backend persistent.ObjectStorage) (leaked, dangling []string, err error) {
+	if err := bfs.Sync(ctx); err != nil {
+		return nil, nil, err
+	}
+	nm := newNodeManager(bfs, 128, 0, 0, nil, nil)
+	if err := nm.Start(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer nm.Rollback(ctx)
+
+	state, err := nm.State(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var readErr error
+	ptrs := make([]uint64, 0)
+	walk := func(ptr uint64, desc string) bool {
+		blocks, err := bfs.blocks(ctx, ptr)
+		ptrs = append(ptrs, blocks...)
+		if err != nil && readErr == nil {
+			readErr = fmt.Errorf("utahfs: %v: %v", desc, err)
+		}
+		return err == nil
+	}
+	walk(state.TrashPtr, "trash")
+	if state.RootPtr != nilPtr {
+		rootPtr := state.RootPtr
+
+		seen := make(map[uint64]struct{})
+		queue := []uint64{rootPtr}
+		for len(queue) > 0 {
+			ptr := queue[0]
+			queue = queue[1:]
+			if _, ok := seen[ptr]; ok {
+				continue
+			}
+			seen[ptr] = struct{}{}
+
+			desc := fmt.Sprintf("inode %v", ptr-rootPtr+1)
+			if !walk(ptr, desc) {
+				continue
+			}
+			nd, err := nm.Open(ctx, ptr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("utahfs: %v: %v", desc, err)
+			}
+			if nd.Data != nilPtr {
+				walk(nd.Data, desc+": data")
+			}
+			for _, childID := range nd.Children {
+				queue = append(queue, uint64(childID)+rootPtr-1)
+			}
+		}
+	}
+
+	if state.DedupPtr != 0 && walk(state.DedupPtr-1, "dedup index") {
+		idx, err := bfs.index(ctx, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = idx.Range(func(ptr, refs uint64) error {
+			ptrs = append(ptrs, p(ptr), d(ptr))
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("utahfs: dedup index: %v", err)
+		}
+	}
+
+	expected, err := bfs.store.Keys(ptrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := backend.List(ctx, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	present := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		present[key] = struct{}{}
+		if _, ok := expected[key]; !ok {
+			leaked = append(leaked, key)
+		}
+	}
+	for key, required := range expected {
+		if _, ok := present[key]; required && !ok {
+			dangling = append(dangling, key)
+		}
+	}
+	if readErr != nil && len(dangling) == 0 {
+		return nil, nil, readErr
+	}
+	sort.Strings(leaked)
+	sort.Strings(dangling)
+
+	return leaked, dangling, nil
+}
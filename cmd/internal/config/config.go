@@ -1,25 +1,38 @@
 package config
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"os"
+	"os/user"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/internal/logging"
 	"github.com/cloudflare/utahfs/persistent"
 
 	"golang.org/x/crypto/ssh/terminal"
 	"gopkg.in/yaml.v2"
 )
 
-func maxSize(numPtrs, dataSize int64) int64 {
-	//  8 = size of a single pointer
-	//  3 = size of length field before data
-	// 28 = encryption overhead
-	return (8 * numPtrs) + (3 + dataSize) + 28
+// maxSize returns the size of ORAM blocks, which must fit an encrypted block of
+// a filesystem with the given parameters. The client and server must agree on
+// it exactly.
+func maxSize(numPtrs, dataSize int64) (int64, error) {
+	if err := utahfs.ValidateBlockParams(numPtrs, dataSize); err != nil {
+		return 0, fmt.Errorf("invalid oram parameters: %v", err)
+	}
+	return utahfs.BlockSize(numPtrs, dataSize) + persistent.EncryptionOverhead, nil
 }
 
 type StorageProvider struct {
@@ -30,6 +43,8 @@ type StorageProvider struct {
 	B2Bucket string `yaml:"b2-bucket"`
 	B2Url    string `yaml:"b2-url"`
 
+	B2RetentionDays int `yaml:"b2-retention-days"` // Refuse to start unless the bucket keeps hidden and overwritten versions of objects for at least this many days. Default: 0, not checked.
+
 	// AWS S3 and compatible APIs
 	S3AppId  string `yaml:"s3-app-id"`
 	S3AppKey string `yaml:"s3-app-key"`
@@ -38,18 +53,35 @@ type StorageProvider struct {
 	S3Region string `yaml:"s3-region"`
 
 	// Google Cloud Storage
-	GCSBucketName      string `yaml:"gcs-bucket-name"`
-	GCSCredentialsPath string `yaml:"gcs-credentials-path"`
+	GCSBucketName         string `yaml:"gcs-bucket-name"`
+	GCSCredentialsPath    string `yaml:"gcs-credentials-path"`
+	GCSResumableThreshold int    `yaml:"gcs-resumable-threshold"` // Objects at least this many bytes are uploaded with resumable uploads. Default: use client library's default.
+	GCSCSEK               string `yaml:"gcs-csek"`                // Base64-encoded, customer-supplied encryption key for objects at rest. Default: none.
 
 	// Local disk storage
 	DiskPath string `yaml:"disk-path"`
 
+	// A backend registered with persistent.RegisterBackend
+	Provider *Provider `yaml:"provider"`
+
 	Retry  int    `yaml:"retry"`  // Max number of times to retry reqs that fail.
 	Prefix string `yaml:"prefix"` // Prefix to put on every key, like `folder-name/`.
+	Volume string `yaml:"volume"` // Name of the volume to use, if several are kept under the same prefix.
+
+	VerifyWrites bool `yaml:"verify-writes"` // Read every object back after writing it, and fail the write if it doesn't match. Default: false.
+
+	ShadowPath string `yaml:"shadow-path"` // Location of a local database that every object written to the storage provider is copied into, but never read from. Default: none.
+}
+
+// Provider selects object storage from a backend that's been registered with
+// persistent.RegisterBackend, by a package that's linked into the binary.
+type Provider struct {
+	Type    string            `yaml:"type"`    // Name the backend was registered with.
+	Options map[string]string `yaml:"options"` // Passed to the backend's factory as-is.
 }
 
 func (sp *StorageProvider) hasB2() bool {
-	return sp.B2AcctId != "" || sp.B2AppKey != "" || sp.B2Bucket != "" || sp.B2Url != ""
+	return sp.B2AcctId != "" || sp.B2AppKey != "" || sp.B2Bucket != "" || sp.B2Url != "" || sp.B2RetentionDays != 0
 }
 
 func (sp *StorageProvider) hasS3() bool {
@@ -57,11 +89,13 @@ func (sp *StorageProvider) hasS3() bool {
 }
 
 func (sp *StorageProvider) hasGCS() bool {
-	return sp.GCSBucketName != ""
+	return sp.GCSBucketName != "" || sp.GCSCredentialsPath != "" || sp.GCSResumableThreshold != 0 || sp.GCSCSEK != ""
 }
 
 func (sp *StorageProvider) hasDisk() bool { return sp.DiskPath != "" }
 
+func (sp *StorageProvider) hasProvider() bool { return sp.Provider != nil }
+
 func (sp *StorageProvider) hasMultiple() bool {
 	count := 0
 	if sp.hasB2() {
@@ -76,74 +110,326 @@ func (sp *StorageProvider) hasMultiple() bool {
 	if sp.hasDisk() {
 		count++
 	}
+	if sp.hasProvider() {
+		count++
+	}
 	return count > 1
 }
 
-func (sp *StorageProvider) Store() (persistent.ObjectStorage, error) {
-	if sp == nil || !sp.hasB2() && !sp.hasS3() && !sp.hasGCS() && !sp.hasDisk() {
+func (sp *StorageProvider) Store() (_ persistent.ObjectStorage, err error) {
+	out, err := sp.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+		}
+	}()
+	// Copy everything into a local shadow if the user wants.
+	if sp.ShadowPath != "" && sp.ShadowPath == sp.DiskPath {
+		return nil, fmt.Errorf("shadow-path must be different from disk-path")
+	} else if sp.ShadowPath != "" {
+		shadow, err := persistent.NewDisk(sp.ShadowPath)
+		if err != nil {
+			return nil, err
+		}
+		out = persistent.NewTee(out, shadow)
+	}
+	// Configure a key prefix if the user wants.
+	prefix, err := sp.keyPrefix()
+	if err != nil {
+		return nil, err
+	} else if prefix != "" {
+		out = persistent.NewPrefix(out, prefix)
+	}
+
+	return out, nil
+}
+
+// connect returns the user's chosen storage provider, with retries if they're
+// configured.
+func (sp *StorageProvider) connect() (_ persistent.ObjectStorage, err error) {
+	if sp == nil || !sp.hasB2() && !sp.hasS3() && !sp.hasGCS() && !sp.hasDisk() && !sp.hasProvider() {
 		return nil, fmt.Errorf("no object storage provider defined")
 	} else if sp.hasMultiple() {
 		return nil, fmt.Errorf("only one object storage provider may be defined")
 	}
 
 	// Connect to the user's chosen storage provider.
-	var (
-		out persistent.ObjectStorage
-		err error
-	)
+	var out persistent.ObjectStorage
 	if sp.hasB2() {
 		out, err = persistent.NewB2(sp.B2AcctId, sp.B2KeyId, sp.B2AppKey, sp.B2Bucket, sp.B2Url)
 	} else if sp.hasS3() {
 		out, err = persistent.NewS3(sp.S3AppId, sp.S3AppKey, sp.S3Bucket, sp.S3Url, sp.S3Region)
 	} else if sp.hasGCS() {
-		out, err = persistent.NewGCS(sp.GCSBucketName, sp.GCSCredentialsPath)
+		var csek []byte
+		if sp.GCSCSEK != "" {
+			csek, err = base64.StdEncoding.DecodeString(sp.GCSCSEK)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse gcs-csek: %v", err)
+			}
+		}
+		out, err = persistent.NewGCS(sp.GCSBucketName, sp.GCSCredentialsPath, sp.GCSResumableThreshold, csek)
 	} else if sp.hasDisk() {
 		out, err = persistent.NewDisk(sp.DiskPath)
+	} else if sp.hasProvider() {
+		if sp.Provider.Type == "" {
+			return nil, fmt.Errorf("provider must have a type")
+		}
+		out, err = persistent.NewBackend(sp.Provider.Type, sp.Provider.Options)
 	}
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			out.Close()
+		}
+	}()
+	// Make sure deleted objects can be recovered for long enough, if the user
+	// wants.
+	if sp.B2RetentionDays > 0 {
+		prefix, err := sp.keyPrefix()
+		if err != nil {
+			return nil, err
+		} else if err := persistent.B2CheckRetention(context.Background(), out, prefix, sp.B2RetentionDays); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check every write by reading it back, if the user wants. This is beneath
+	// the retries, so that a write that reads back wrong is tried again.
+	if sp.VerifyWrites {
+		out = persistent.NewVerifyWrites(out)
+	}
 
 	// Configure retries if the user wants.
 	if sp.Retry > 1 {
-		out, err = persistent.NewRetry(out, sp.Retry)
+		retry, err := persistent.NewRetry(out, sp.Retry)
 		if err != nil {
 			return nil, err
 		}
-	}
-	// Configure a key prefix if the user wants.
-	if sp.Prefix != "" {
-		out = persistent.NewPrefix(out, sp.Prefix)
+		out = retry
 	}
 
 	return out, nil
 }
 
+// keyPrefix returns the prefix that's added to every key, which includes the
+// volume name if there is one.
+func (sp *StorageProvider) keyPrefix() (string, error) {
+	if sp.Volume != "" {
+		if strings.Contains(sp.Volume, "/") {
+			return "", fmt.Errorf("volume name may not contain a slash")
+		}
+		return sp.Prefix + sp.Volume + "/", nil
+	}
+	return sp.Prefix, nil
+}
+
+// VerifyShadow compares the objects in the storage provider against the copies
+// in shadow-path.
+func (sp *StorageProvider) VerifyShadow(ctx context.Context) (*persistent.TeeDiff, error) {
+	if sp == nil || sp.ShadowPath == "" {
+		return nil, fmt.Errorf("no shadow-path is configured")
+	}
+	prefix, err := sp.keyPrefix()
+	if err != nil {
+		return nil, err
+	}
+	store, err := sp.connect()
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := persistent.NewDisk(sp.ShadowPath)
+	if err != nil {
+		return nil, err
+	}
+	return persistent.NewTee(store, shadow).Verify(ctx, prefix)
+}
+
+// B2Versions returns every version of the objects under the storage provider's
+// prefix, including the ones that were hidden or overwritten. Only B2 is
+// supported.
+func (sp *StorageProvider) B2Versions(ctx context.Context) ([]persistent.B2Version, error) {
+	if sp == nil || !sp.hasB2() || sp.hasMultiple() {
+		return nil, fmt.Errorf("listing versions requires b2 to be the only storage provider")
+	}
+	prefix, err := sp.keyPrefix()
+	if err != nil {
+		return nil, err
+	}
+	store, err := persistent.NewB2(sp.B2AcctId, sp.B2KeyId, sp.B2AppKey, sp.B2Bucket, sp.B2Url)
+	if err != nil {
+		return nil, err
+	}
+	return persistent.B2Versions(ctx, store, prefix)
+}
+
+type KeyProvider struct {
+	WrappedKey string `yaml:"wrapped-key"` // The repository's key, encrypted by the key management service. Base64-encoded for AWS and Google Cloud, or as returned for Vault.
+
+	// AWS KMS
+	AWSKMSRegion string `yaml:"aws-kms-region"`
+	AWSKMSKeyId  string `yaml:"aws-kms-key-id"` // Id or ARN of the key that wrapped-key was encrypted with. Default: whichever key KMS says it was.
+
+	// Google Cloud KMS
+	GCPKMSKey             string `yaml:"gcp-kms-key"` // Resource name of the key, like projects/p/locations/l/keyRings/r/cryptoKeys/k.
+	GCPKMSCredentialsPath string `yaml:"gcp-kms-credentials-path"`
+
+	// HashiCorp Vault's transit secrets engine
+	VaultAddr      string `yaml:"vault-addr"`
+	VaultToken     string `yaml:"vault-token"`
+	VaultTokenEnv  string `yaml:"vault-token-env"`  // Name of an environment variable to read vault-token from, if it isn't set.
+	VaultTokenFile string `yaml:"vault-token-file"` // Path to a file to read vault-token from, if it isn't set in the config or environment.
+	VaultMount     string `yaml:"vault-mount"`      // Default: transit
+	VaultKey       string `yaml:"vault-key"`
+}
+
+func (kp *KeyProvider) hasAWS() bool { return kp.AWSKMSRegion != "" || kp.AWSKMSKeyId != "" }
+
+func (kp *KeyProvider) hasGCP() bool { return kp.GCPKMSKey != "" || kp.GCPKMSCredentialsPath != "" }
+
+func (kp *KeyProvider) hasVault() bool {
+	return kp.VaultAddr != "" || kp.VaultToken != "" || kp.VaultTokenEnv != "" || kp.VaultTokenFile != "" || kp.VaultMount != "" || kp.VaultKey != ""
+}
+
+func (kp *KeyProvider) Provider() (persistent.KeyProvider, error) {
+	count := 0
+	for _, has := range []bool{kp.hasAWS(), kp.hasGCP(), kp.hasVault()} {
+		if has {
+			count++
+		}
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no key management service defined")
+	} else if count > 1 {
+		return nil, fmt.Errorf("only one key management service may be defined")
+	} else if kp.WrappedKey == "" {
+		return nil, fmt.Errorf("no wrapped-key was given for key provider")
+	}
+
+	if kp.hasVault() {
+		token, err := readSecret("vault token", kp.VaultToken, kp.VaultTokenEnv, kp.VaultTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return persistent.NewVault(kp.VaultAddr, token, kp.VaultMount, kp.VaultKey, kp.WrappedKey)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(kp.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse wrapped-key: %v", err)
+	} else if kp.hasAWS() {
+		return persistent.NewAWSKMS(kp.AWSKMSRegion, kp.AWSKMSKeyId, wrapped)
+	}
+	return persistent.NewGCPKMS(kp.GCPKMSKey, kp.GCPKMSCredentialsPath, wrapped)
+}
+
 type RemoteServer struct {
-	URL          string `yaml:"url"`           // URL of server.
-	TransportKey string `yaml:"transport-key"` // Pre-shared key for authenticating client and server.
+	URL                  string `yaml:"url"`                   // URL of server.
+	Repo                 string `yaml:"repo"`                  // Name of the repository to use, if the server hosts several.
+	TransportKey         string `yaml:"transport-key"`         // Pre-shared key for authenticating client and server.
+	TransportKeyEnv      string `yaml:"transport-key-env"`     // Name of an environment variable to read transport-key from, if it isn't set.
+	TransportKeyFile     string `yaml:"transport-key-file"`    // Path to a file to read transport-key from, if it isn't set in the config or environment.
+	ClientCert           string `yaml:"client-cert"`           // Certificate from an existing PKI to authenticate to the server with, instead of transport-key. PEM-encoded.
+	ClientKey            string `yaml:"client-key"`            // Private key of client-cert. PEM-encoded.
+	ServerCA             string `yaml:"server-ca"`             // CA certificates that the server's certificate must be issued by, if client-cert is set. PEM-encoded.
+	ReadOnly             bool   `yaml:"read-only"`             // Share a snapshot with other read-only clients, instead of taking exclusive access. Writes will fail. Default: false.
+	TransportCompression bool   `yaml:"transport-compression"` // Compress requests to and responses from the server with gzip. Default: false.
+
+	IdleTimeout      int `yaml:"idle-timeout"`      // Number of seconds to keep an unused connection to the server open. Default: 90
+	HandshakeTimeout int `yaml:"handshake-timeout"` // Number of seconds to wait for a TLS handshake with the server. Default: 10
+	PingInterval     int `yaml:"ping-interval"`     // Number of seconds between pings of an open transaction. Must be less than half of the server's transaction-timeout. Default: 2
+}
+
+// certs returns the certificate files to authenticate to the server with, or
+// nil if the transport key should be used instead.
+func (rs *RemoteServer) certs() *persistent.TLSFiles {
+	if rs.ClientCert == "" && rs.ClientKey == "" && rs.ServerCA == "" {
+		return nil
+	}
+	return &persistent.TLSFiles{Cert: rs.ClientCert, Key: rs.ClientKey, CA: rs.ServerCA}
+}
+
+func (rs *RemoteServer) client(oramSize int64) (persistent.ReliableStorage, error) {
+	opts := persistent.RemoteClientOptions{
+		Repo:             rs.Repo,
+		ORAMSize:         oramSize,
+		ReadOnly:         rs.ReadOnly,
+		Compress:         rs.TransportCompression,
+		IdleTimeout:      time.Duration(rs.IdleTimeout) * time.Second,
+		HandshakeTimeout: time.Duration(rs.HandshakeTimeout) * time.Second,
+		PingInterval:     time.Duration(rs.PingInterval) * time.Second,
+	}
+	if certs := rs.certs(); certs != nil {
+		return persistent.NewRemoteClientWithCerts(*certs, rs.URL, opts)
+	}
+	return persistent.NewRemoteClient(rs.TransportKey, rs.URL, opts)
 }
 
 type Client struct {
 	DataDir string `yaml:"data-dir"` // Directory where the WAL and pin file should be kept. Default: .utahfs
 
 	StorageProvider *StorageProvider `yaml:"storage-provider"`
-	MaxWALSize      int              `yaml:"max-wal-size"`    // Max number of blocks to put in WAL before blocking on remote storage. Default: 128*1024 blocks
-	WALParallelism  int              `yaml:"wal-parallelism"` // Number of threads to use when draining the WAL. Default: 1
-	DiskCacheSize   int64            `yaml:"disk-cache-size"` // Size of on-disk LRU cache. Default: 320*1024 blocks, -1 to disable.
-	DiskCacheLoc    string           `yaml:"disk-cache-loc"`  // Special location for on-disk LRU cache. Default is to store cache inside data-dir.
-	MemCacheSize    int              `yaml:"mem-cache-size"`  // Size of in-memory LRU cache. Default: 32*1024 blocks, -1 to disable.
-	KeepMetadata    bool             `yaml:"keep-metadata"`   // Keep a local copy of metadata, always. Default: false.
+	MaxWALSize      int              `yaml:"max-wal-size"`         // Max number of blocks to put in WAL before blocking on remote storage. Default: 128*1024 blocks
+	WALParallelism  int              `yaml:"wal-parallelism"`      // Number of threads to use when draining the WAL. Default: 1
+	WALVerify       bool             `yaml:"wal-verify-on-replay"` // Verify entries left in the WAL against the integrity tree before replaying them. Default: false.
+	WALFull         string           `yaml:"wal-full-behavior"`    // What to do once the WAL reaches max-wal-size: block, error (ENOSPC), or throttle. Default: block.
+	DiskCacheSize   int64            `yaml:"disk-cache-size"`      // Size of on-disk LRU cache. Default: 320*1024 blocks, -1 to disable.
+	DiskCacheLoc    string           `yaml:"disk-cache-loc"`       // Special location for on-disk LRU cache. Default is to store cache inside data-dir.
+	MemCacheSize    int              `yaml:"mem-cache-size"`       // Size of in-memory LRU cache. Default: 32*1024 blocks, -1 to disable.
+	KeepMetadata    bool             `yaml:"keep-metadata"`        // Keep a local copy of metadata, always. Default: false.
+	WriteThrough    bool             `yaml:"write-through"`        // Update the local copy of metadata as soon as it's committed, instead of when the WAL drains. Requires keep-metadata. Default: false.
+	MaxDirtyBlocks  int              `yaml:"max-dirty-blocks"`     // Max number of blocks of buffered writes to modify in a transaction before committing part of it early. Default: 0, no limit.
+	DetectConflicts bool             `yaml:"detect-conflicts"`     // Detect changes committed by other clients of the same storage, and retry operations that conflict with them. Requires storage with conditional writes, like S3 or GCS. Disables the WAL and caches. Default: false.
+	WarmDepth       int              `yaml:"warm-depth"`           // Number of levels of folders to read into cache on mount. Default: 0, disabled.
+
+	BackgroundCommitInterval int `yaml:"background-commit-interval"` // Number of seconds that writes may be kept in memory before they're committed. Default: 0, disabled.
+	BackgroundCommitBlocks   int `yaml:"background-commit-blocks"`   // Number of blocks of writes to keep in memory before committing them early. Default: 0, the same 1 MiB limit as without background commits.
+	OpTimeout                int `yaml:"op-timeout"`                 // Number of seconds a filesystem operation may wait on storage before failing with an I/O error. Default: 0, no limit.
+
+	MetadataWriteBehind   int `yaml:"metadata-write-behind"`   // Max number of metadata blocks to queue in memory before updating the local copy of metadata. Requires keep-metadata. Default: 0, disabled.
+	MetadataFlushInterval int `yaml:"metadata-flush-interval"` // Number of seconds that metadata blocks may be queued before the local copy is updated. Default: 1.
+
+	AtimeMode       string `yaml:"atime-mode"`            // When reading a file updates its access time: off, relatime, or strict. Default: off.
+	InlineThreshold int    `yaml:"inline-file-threshold"` // Max size in bytes of a file to store in the same block as its metadata. Default: 0, disabled.
+	MaxNameLength   int    `yaml:"max-name-length"`       // Max length in bytes of the name of a file. Default: 255.
+	Subdir          string `yaml:"subdir"`                // Directory within the repository to mount, instead of its root. Default: the root.
+	DefaultDirMode  string `yaml:"default-dir-mode"`      // Permissions, in octal, to add to every new directory regardless of umask. Default: none.
+	DefaultFileMode string `yaml:"default-file-mode"`     // Permissions, in octal, to add to every new file regardless of umask. Default: none.
+	ForceMode       bool   `yaml:"force-mode"`            // Create new directories and files with exactly default-dir-mode and default-file-mode, instead of the mode asked for. Default: false.
+
+	AttrCacheTTL  *int `yaml:"attr-cache-ttl"`  // Number of seconds the kernel may cache the attributes of a file. Default: 60, 0 to disable.
+	EntryCacheTTL *int `yaml:"entry-cache-ttl"` // Number of seconds the kernel may cache the result of looking up a name in a directory. Default: 60, 0 to disable.
 
 	RemoteServer *RemoteServer `yaml:"remote-server"`
+	KeyProvider  *KeyProvider  `yaml:"key-provider"` // Fetch the key for encryption and integrity from a key management service, instead of deriving it from a password.
 
-	Password string `yaml:"password"` // Password for encryption and integrity. User will be prompted if not provided.
+	Password        string `yaml:"password"`          // Password for encryption and integrity. User will be prompted if not provided here, by password-env, or by password-file.
+	PasswordEnv     string `yaml:"password-env"`      // Name of an environment variable to read the password from, if it isn't set.
+	PasswordFile    string `yaml:"password-file"`     // Path to a file to read the password from, if it isn't set in the config or environment.
+	PinHistoryCount int    `yaml:"pin-history-count"` // Number of old copies of the pin file to keep. Default: 3, -1 to disable.
+	PinSaveInterval int    `yaml:"pin-save-interval"` // Number of seconds between checking the tree head against the pin file, and saving it, even without writes. Varies randomly by up to half. Default: 0, only when a transaction starts.
+	Integrity       *bool  `yaml:"integrity"`         // Whether or not to detect tampering with stored data. Default: true.
 
-	NumPtrs  int64 `yaml:"num-ptrs"`  // Number of pointers in a file's skiplist. Default: 12
-	DataSize int64 `yaml:"data-size"` // Amount of data kept in each of a file's blocks. Default: 32 KiB
+	KDFTime    uint32 `yaml:"kdf-time"`    // Number of passes Argon2 makes over memory when deriving the key from the password. Default: 1
+	KDFMemory  uint32 `yaml:"kdf-memory"`  // Amount of memory Argon2 uses when deriving the key from the password, in KiB. Default: 65536, 64 MiB
+	KDFThreads uint8  `yaml:"kdf-threads"` // Number of threads Argon2 uses when deriving the key from the password. Default: 4
 
-	Archive bool `yaml:"archive"` // Whether or not to enforce archive mode.
-	ORAM    bool `yaml:"oram"`    // Whether or not to use ORAM.
+	NumPtrs  int64  `yaml:"num-ptrs"`  // Number of pointers in a file's skiplist. Default: 12
+	DataSize int64  `yaml:"data-size"` // Amount of data kept in each of a file's blocks. Default: 32 KiB
+	RepoName string `yaml:"repo-name"` // Friendly name to record in the repository when it's created. Default: none.
+
+	UidMap map[uint32]uint32 `yaml:"uid-map"` // Translates the user ids that files are stored with, into local ids. Default: every file is owned by the current user.
+	GidMap map[uint32]uint32 `yaml:"gid-map"` // Translates the group ids that files are stored with, into local ids. Default: every file is owned by the current group.
+
+	Archive         bool   `yaml:"archive"`                 // Whether or not to enforce archive mode.
+	ORAM            bool   `yaml:"oram"`                    // Whether or not to use ORAM.
+	ORAMStashLimit  int    `yaml:"oram-stash-memory-limit"` // Max number of ORAM stash blocks to keep in memory, with the rest kept in data-dir. Default: 0, no limit.
+	Dedup           bool   `yaml:"dedup"`                   // Whether or not to store identical blocks of file content only once. Not compatible with ORAM. Default: false.
+	DedupHash       string `yaml:"dedup-hash"`              // Hash function to identify identical blocks with: sha256 or blake2b-256. Default: whatever the existing index uses, or blake2b-256 for a new one.
+	CaseInsensitive bool   `yaml:"case-insensitive"`        // Whether or not to match file names regardless of case, like macOS and Windows. Default: false.
 }
 
 func ClientFromFile(path string) (*Client, error) {
@@ -158,12 +444,31 @@ func ClientFromFile(path string) (*Client, error) {
 	return parsed, nil
 }
 
-func (c *Client) localStorage() (persistent.ReliableStorage, error) {
+func (c *Client) localStorage() (_ persistent.ReliableStorage, err error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
 	// Setup object storage.
 	store, err := c.StorageProvider.Store()
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			store.Close()
+		}
+	}()
+
+	// Conflicts are detected by reading the tree head from storage directly,
+	// so nothing can be cached or queued locally.
+	if c.DetectConflicts {
+		shared, err := persistent.NewSharedReliable(store)
+		if err != nil {
+			return nil, fmt.Errorf("detect-conflicts requires storage that supports conditional writes, like S3 or GCS: %v", err)
+		}
+		return shared, nil
+	}
 
 	// Setup on-disk caching if desired.
 	if c.DiskCacheSize == 0 {
@@ -178,15 +483,17 @@ func (c *Client) localStorage() (persistent.ReliableStorage, error) {
 		if c.KeepMetadata {
 			exclude = append(exclude, persistent.Metadata)
 		}
-		store, err = persistent.NewDiskCache(store, loc, c.DiskCacheSize, exclude)
+		cached, err := persistent.NewDiskCache(store, loc, c.DiskCacheSize, exclude)
 		if err != nil {
 			return nil, err
 		}
+		store = cached
 	}
 
 	// Setup tiered caching for metadata if desired.
+	var diskStore persistent.ObjectStorage
 	if c.KeepMetadata {
-		diskStore, err := persistent.NewDisk(path.Join(c.DataDir, "metadata"))
+		diskStore, err = persistent.NewDisk(path.Join(c.DataDir, "metadata"))
 		if err != nil {
 			return nil, err
 		}
@@ -200,10 +507,23 @@ func (c *Client) localStorage() (persistent.ReliableStorage, error) {
 	if c.WALParallelism == 0 {
 		c.WALParallelism = 1
 	}
-	relStore, err := persistent.NewLocalWAL(store, path.Join(c.DataDir, "wal"), c.MaxWALSize, c.WALParallelism)
+	fullMode, err := persistent.ParseWALFullMode(c.WALFull)
+	if err != nil {
+		return nil, err
+	}
+	relStore, err := persistent.NewLocalWALWithMode(store, path.Join(c.DataDir, "wal"), c.MaxWALSize, c.WALParallelism, c.WALVerify, fullMode)
 	if err != nil {
 		return nil, err
 	}
+	if c.WriteThrough {
+		relStore = persistent.NewWriteThroughCache(relStore, diskStore, persistent.Metadata)
+	} else if c.MetadataWriteBehind != 0 {
+		if c.MetadataFlushInterval == 0 {
+			c.MetadataFlushInterval = 1
+		}
+		interval := time.Duration(c.MetadataFlushInterval) * time.Second
+		relStore = persistent.NewWriteBehindCache(relStore, diskStore, c.MetadataWriteBehind, interval, persistent.Metadata)
+	}
 
 	// Setup caching if desired.
 	if c.MemCacheSize == 0 {
@@ -216,114 +536,600 @@ func (c *Client) localStorage() (persistent.ReliableStorage, error) {
 	return relStore, nil
 }
 
-func (c *Client) remoteStorage() (persistent.ReliableStorage, error) {
-	if c.StorageProvider != nil {
-		return nil, fmt.Errorf("cannot set storage-provider with remote-server")
+// validate returns an error if the config sets options that can't be used
+// together, or values that are out of range. It doesn't connect to anything,
+// so Check can reject the same configs that FS does without mounting.
+func (c *Client) validate() error {
+	if c.RemoteServer != nil {
+		if c.DetectConflicts {
+			return fmt.Errorf("cannot set detect-conflicts with remote-server")
+		}
+	} else {
+		if c.DetectConflicts {
+			if err := c.checkConflicts(); err != nil {
+				return err
+			}
+		}
+		if !c.KeepMetadata && c.WriteThrough {
+			return fmt.Errorf("write-through can only be set with keep-metadata")
+		} else if !c.KeepMetadata && (c.MetadataWriteBehind != 0 || c.MetadataFlushInterval != 0) {
+			return fmt.Errorf("metadata-write-behind can only be set with keep-metadata")
+		} else if c.MetadataWriteBehind < 0 || c.MetadataFlushInterval < 0 {
+			return fmt.Errorf("metadata-write-behind and metadata-flush-interval may not be negative")
+		} else if c.MetadataWriteBehind != 0 && c.WriteThrough {
+			return fmt.Errorf("cannot set both write-through and metadata-write-behind")
+		} else if c.MetadataFlushInterval != 0 && c.MetadataWriteBehind == 0 {
+			return fmt.Errorf("metadata-flush-interval can only be set with metadata-write-behind")
+		}
+		if fullMode, err := persistent.ParseWALFullMode(c.WALFull); err != nil {
+			return err
+		} else if fullMode == persistent.WALFullError && c.ORAM {
+			// ORAM's local state is committed before the WAL, so a commit that
+			// fails because the WAL is full would leave the two inconsistent.
+			return fmt.Errorf("wal-full-behavior can't be error with oram")
+		}
+		if c.ORAM && c.ORAMStashLimit < 0 {
+			return fmt.Errorf("oram-stash-memory-limit must not be negative")
+		}
+	}
+	if c.StorageProvider != nil && c.StorageProvider.B2RetentionDays < 0 {
+		return fmt.Errorf("b2-retention-days must not be negative")
+	}
+
+	if c.MaxDirtyBlocks < 0 {
+		return fmt.Errorf("max-dirty-blocks must not be negative")
+	} else if c.BackgroundCommitInterval < 0 || c.BackgroundCommitBlocks < 0 {
+		return fmt.Errorf("background-commit-interval and background-commit-blocks must not be negative")
+	} else if c.OpTimeout < 0 {
+		return fmt.Errorf("op-timeout must not be negative")
+	} else if c.PinSaveInterval < 0 {
+		return fmt.Errorf("pin-save-interval must not be negative")
+	} else if _, err := c.Atime(); err != nil {
+		return err
+	} else if c.InlineThreshold < 0 {
+		return fmt.Errorf("inline-file-threshold must not be negative")
+	} else if c.MaxNameLength < 0 {
+		return fmt.Errorf("max-name-length must not be negative")
+	} else if _, _, err := c.CacheTTLs(); err != nil {
+		return err
+	} else if _, _, err := c.Modes(); err != nil {
+		return err
+	} else if c.Dedup && c.ORAM {
+		return fmt.Errorf("dedup can't be used with oram")
+	}
+	return nil
+}
+
+// checkRemote returns an error if any options that only apply to local storage
+// are set alongside remote-server.
+func (c *Client) checkRemote() error {
+	if err := c.readSecrets(); err != nil {
+		return err
+	} else if c.StorageProvider != nil {
+		return fmt.Errorf("cannot set storage-provider with remote-server")
 	} else if c.MaxWALSize != 0 {
-		return nil, fmt.Errorf("cannot set max-wal-size with remote-server")
+		return fmt.Errorf("cannot set max-wal-size with remote-server")
 	} else if c.WALParallelism != 0 {
-		return nil, fmt.Errorf("cannot set wal-parallelism with remote-server")
+		return fmt.Errorf("cannot set wal-parallelism with remote-server")
+	} else if c.WALVerify {
+		return fmt.Errorf("cannot set wal-verify-on-replay with remote-server")
+	} else if c.WALFull != "" {
+		return fmt.Errorf("cannot set wal-full-behavior with remote-server")
 	} else if c.DiskCacheSize != 0 {
-		return nil, fmt.Errorf("cannot set disk-cache-size with remote-server")
+		return fmt.Errorf("cannot set disk-cache-size with remote-server")
 	} else if c.DiskCacheLoc != "" {
-		return nil, fmt.Errorf("cannot set disk-cache-loc with remote-server")
+		return fmt.Errorf("cannot set disk-cache-loc with remote-server")
 	} else if c.MemCacheSize != 0 {
-		return nil, fmt.Errorf("cannot set mem-cache-size with remote-server")
+		return fmt.Errorf("cannot set mem-cache-size with remote-server")
 	} else if c.KeepMetadata {
-		return nil, fmt.Errorf("cannot set keep-metadata with remote-server")
-	} else if c.RemoteServer.TransportKey == "" {
-		return nil, fmt.Errorf("no transport key was given for remote server")
-	} else if c.RemoteServer.TransportKey == c.Password {
-		return nil, fmt.Errorf("transport key should be generated independently of the encryption password")
+		return fmt.Errorf("cannot set keep-metadata with remote-server")
+	} else if c.WriteThrough {
+		return fmt.Errorf("cannot set write-through with remote-server")
+	} else if c.MetadataWriteBehind != 0 || c.MetadataFlushInterval != 0 {
+		return fmt.Errorf("cannot set metadata-write-behind with remote-server")
+	} else if c.MaxDirtyBlocks != 0 {
+		return fmt.Errorf("cannot set max-dirty-blocks with remote-server")
+	} else if c.RemoteServer.certs() != nil && c.RemoteServer.TransportKey != "" {
+		return fmt.Errorf("transport-key cannot be set along with client-cert, client-key, and server-ca")
+	} else if c.RemoteServer.TransportKey == "" && c.RemoteServer.certs() == nil {
+		return fmt.Errorf("no transport key was given for remote server")
+	} else if c.RemoteServer.TransportKey != "" && c.RemoteServer.TransportKey == c.Password {
+		return fmt.Errorf("transport key should be generated independently of the encryption password")
+	} else if c.RemoteServer.IdleTimeout < 0 || c.RemoteServer.HandshakeTimeout < 0 || c.RemoteServer.PingInterval < 0 {
+		return fmt.Errorf("remote server timeouts may not be negative")
 	}
-	return persistent.NewRemoteClient(c.RemoteServer.TransportKey, c.RemoteServer.URL, c.ORAM)
+	return nil
+}
+
+// checkConflicts returns an error if any options that keep data locally are set
+// alongside detect-conflicts.
+func (c *Client) checkConflicts() error {
+	if c.ORAM {
+		return fmt.Errorf("cannot set oram with detect-conflicts")
+	} else if c.MaxWALSize != 0 {
+		return fmt.Errorf("cannot set max-wal-size with detect-conflicts")
+	} else if c.WALParallelism != 0 {
+		return fmt.Errorf("cannot set wal-parallelism with detect-conflicts")
+	} else if c.WALVerify {
+		return fmt.Errorf("cannot set wal-verify-on-replay with detect-conflicts")
+	} else if c.WALFull != "" {
+		return fmt.Errorf("cannot set wal-full-behavior with detect-conflicts")
+	} else if c.DiskCacheSize > 0 {
+		return fmt.Errorf("cannot set disk-cache-size with detect-conflicts")
+	} else if c.DiskCacheLoc != "" {
+		return fmt.Errorf("cannot set disk-cache-loc with detect-conflicts")
+	} else if c.MemCacheSize > 0 {
+		return fmt.Errorf("cannot set mem-cache-size with detect-conflicts")
+	} else if c.KeepMetadata {
+		return fmt.Errorf("cannot set keep-metadata with detect-conflicts")
+	} else if c.WriteThrough {
+		return fmt.Errorf("cannot set write-through with detect-conflicts")
+	} else if c.MetadataWriteBehind != 0 || c.MetadataFlushInterval != 0 {
+		return fmt.Errorf("cannot set metadata-write-behind with detect-conflicts")
+	}
+	return nil
+}
+
+func (c *Client) remoteStorage() (persistent.ReliableStorage, error) {
+	if err := c.checkRemote(); err != nil {
+		return nil, err
+	}
+	oramSize, err := c.oramSize()
+	if err != nil {
+		return nil, err
+	}
+	return c.RemoteServer.client(oramSize)
+}
+
+// blockDefaults sets the defaults for the block-based filesystem.
+func (c *Client) blockDefaults() {
+	if c.NumPtrs == 0 {
+		c.NumPtrs = 12
+	}
+	if c.DataSize == 0 {
+		c.DataSize = 32 * 1024
+	}
+}
+
+// oramSize returns the size of ORAM blocks that the remote server must use, or
+// zero if ORAM isn't enabled.
+func (c *Client) oramSize() (int64, error) {
+	if !c.ORAM {
+		return 0, nil
+	}
+	c.blockDefaults()
+	return maxSize(c.NumPtrs, c.DataSize)
+}
+
+// Check validates the config and attempts to connect to the configured storage,
+// without mounting anything or modifying local state.
+func (c *Client) Check(ctx context.Context) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if c.RemoteServer != nil {
+		relStore, err := c.remoteStorage()
+		if err != nil {
+			return err
+		}
+		if _, err := relStore.Start(ctx, nil); err != nil {
+			return fmt.Errorf("failed to connect to remote server: %v", err)
+		}
+		// An empty commit has no effect, other than ending the transaction.
+		return relStore.Commit(ctx, nil)
+	}
+
+	store, err := c.StorageProvider.Store()
+	if err != nil {
+		return err
+	}
+	if _, err := store.Get(ctx, "utahfs-check"); err != nil && err != persistent.ErrObjectNotFound {
+		return fmt.Errorf("failed to connect to storage provider: %v", err)
+	}
+	return nil
+}
+
+// FS returns the filesystem described by the config, along with a closer that
+// releases the storage beneath it. The closer should be called once the
+// filesystem is no longer being used, like after it's been unmounted.
+func (c *Client) FS(mountPath string) (*utahfs.BlockFilesystem, io.Closer, error) {
+	return c.fs(mountPath, false)
+}
+
+// ReadOnlyFS is like FS, for tools that only read from the repository. Every
+// commit that has writes in it fails with ErrReadOnly, and the repository isn't
+// checked against the config's header or stamped with its info. Repositories
+// with local ORAM can't be opened this way, because reading from ORAM writes to
+// it.
+func (c *Client) ReadOnlyFS(mountPath string) (*utahfs.BlockFilesystem, io.Closer, error) {
+	return c.fs(mountPath, true)
 }
 
-func (c *Client) FS(mountPath string) (*utahfs.BlockFilesystem, error) {
+func (c *Client) fs(mountPath string, readOnly bool) (_ *utahfs.BlockFilesystem, _ io.Closer, err error) {
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	} else if readOnly && c.ORAM && c.RemoteServer == nil {
+		return nil, nil, fmt.Errorf("repositories with oram can't be opened read-only")
+	}
 	if c.DataDir == "" {
 		c.DataDir = path.Join(path.Dir(mountPath), ".utahfs")
 	}
 
 	// Stub out generation of the ReliableStorage interface, depending on if
 	// this client is standalone or backed by a server.
-	var (
-		relStore persistent.ReliableStorage
-		err      error
-	)
+	var relStore persistent.ReliableStorage
 	if c.RemoteServer == nil {
 		relStore, err = c.localStorage()
 	} else {
 		relStore, err = c.remoteStorage()
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if readOnly {
+		relStore = persistent.NewReadOnlyReliable(relStore)
 	}
+	closer := persistent.Closers{relStore}
+	defer func() {
+		if err != nil {
+			closer.Close()
+		}
+	}()
 
 	// Setup buffered block storage.
 	block := persistent.NewBufferedStorage(relStore)
 
 	// Setup encryption and integrity.
-	if c.Password == "" {
-		fmt.Print("Password: ")
-		password, err := terminal.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			return nil, fmt.Errorf("failed reading password from stdin")
-		} else if len(password) == 0 {
-			return nil, fmt.Errorf("no password given for encryption")
-		}
-		c.Password = string(password)
+	key, err := c.readKey()
+	if err != nil {
+		return nil, nil, err
 	}
 	if !c.ORAM || c.RemoteServer == nil {
-		block, err = persistent.WithIntegrity(block, c.Password, path.Join(c.DataDir, "pin.json"))
+		pinFile := path.Join(c.DataDir, "pin.json")
+		if c.Integrity == nil || *c.Integrity {
+			block, err = persistent.WithIntegrityKey(block, key, pinFile, pinHistory(c.PinHistoryCount))
+		} else {
+			logging.Warn("integrity is disabled, so tampering with stored data will not be detected")
+			block, err = persistent.WithRollbackProtectionKey(block, key, pinFile, pinHistory(c.PinHistoryCount))
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if err := persistent.CheckKey(context.Background(), block, key); err != nil {
+			return nil, nil, err
+		}
+		if c.WALVerify {
+			if err := persistent.VerifyWAL(context.Background(), block); err != nil {
+				return nil, nil, err
+			}
 		}
 	} else {
-		log.Println("WARNING: delegating rollback prevention to remote server because ORAM is enabled")
+		// The password can't be checked up-front here either, because the
+		// server's ORAM has no room for the verifier. Still start a transaction,
+		// so that the server can refuse it now if its ORAM parameters differ.
+		logging.Warn("delegating rollback prevention to remote server because ORAM is enabled")
+		if _, err := relStore.Start(context.Background(), nil); err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to remote server: %v", err)
+		} else if err := relStore.Commit(context.Background(), nil); err != nil {
+			return nil, nil, err
+		}
 	}
-	block = persistent.WithEncryption(block, c.Password)
+	block = persistent.WithEncryptionKey(block, key)
 
 	// Configure defaults for the block-based filesystem. Do this early because
 	// the numbers might be needed for ORAM.
-	if c.NumPtrs == 0 {
-		c.NumPtrs = 12
-	}
-	if c.DataSize == 0 {
-		c.DataSize = 32 * 1024
-	}
+	c.blockDefaults()
 
 	// Setup ORAM if desired.
 	if c.ORAM && c.RemoteServer == nil {
 		if c.StorageProvider.hasDisk() {
-			log.Println("WARNING: ORAM provides no security properties when used with disk storage")
+			logging.Warn("ORAM provides no security properties when used with disk storage")
 		}
-		ostore, err := persistent.NewLocalOblivious(path.Join(c.DataDir, "oram"))
+		ostore, err := persistent.NewLocalObliviousWithLimit(path.Join(c.DataDir, "oram"), c.ORAMStashLimit)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		block, err = persistent.WithORAM(block, ostore, maxSize(c.NumPtrs, c.DataSize))
+		closer = persistent.Closers{ostore, relStore}
+		size, err := maxSize(c.NumPtrs, c.DataSize)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		block, err = persistent.WithORAM(block, ostore, size)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
 	// Setup application storage.
-	appStore := persistent.NewAppStorage(block)
+	appStore := persistent.NewLimitedAppStorage(block, c.MaxDirtyBlocks)
+	if c.DetectConflicts {
+		if err := appStore.DetectConflicts(); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// Setup block-based filesystem.
-	bfs, err := utahfs.NewBlockFilesystem(appStore, c.NumPtrs, c.DataSize, !c.ORAM)
+	var bfs *utahfs.BlockFilesystem
+	if c.Dedup {
+		bfs, err = utahfs.NewDedupBlockFilesystemWithHash(appStore, c.NumPtrs, c.DataSize, c.DedupHash)
+	} else {
+		bfs, err = utahfs.NewBlockFilesystem(appStore, c.NumPtrs, c.DataSize, !c.ORAM)
+	}
+	if err != nil {
+		return nil, nil, err
+	} else if readOnly {
+		return bfs, closer, nil
+	} else if err := bfs.CheckHeader(context.Background(), key.KDF()); err != nil {
+		return nil, nil, err
+	} else if err := bfs.StampInfo(context.Background(), c.info()); err != nil {
+		return nil, nil, err
+	}
+
+	return bfs, closer, nil
+}
+
+// info returns the info to record in a new repository: repo-name, and who is
+// creating it with which release.
+func (c *Client) info() persistent.Info {
+	creator := "unknown"
+	if u, err := user.Current(); err == nil {
+		creator = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		creator += "@" + host
+	}
+	return persistent.Info{Name: c.RepoName, Creator: creator, Version: version.Release()}
+}
+
+// Probe returns a health check probe for the client's backend: the remote
+// server if there is one, or the storage provider otherwise. It uses its own
+// connection, separate from the one that FS sets up.
+func (c *Client) Probe() (persistent.Probe, error) {
+	if c.RemoteServer != nil {
+		relStore, err := c.remoteStorage()
+		if err != nil {
+			return nil, err
+		}
+		return persistent.RemoteProbe(relStore)
+	}
+	store, err := c.StorageProvider.Store()
 	if err != nil {
 		return nil, err
 	}
+	return persistent.ObjectProbe(store), nil
+}
+
+// Atime returns the filesystem's access time mode, from atime-mode.
+func (c *Client) Atime() (utahfs.AtimeMode, error) {
+	mode, err := utahfs.ParseAtimeMode(c.AtimeMode)
+	if err != nil {
+		return 0, fmt.Errorf("atime-mode must be off, relatime, or strict")
+	}
+	return mode, nil
+}
+
+// CacheTTLs returns how long the kernel may cache attributes and directory
+// entries for, from attr-cache-ttl and entry-cache-ttl, as utahfs.Options takes
+// them: a setting of zero is returned as utahfs.NoCacheTTL.
+func (c *Client) CacheTTLs() (attr, entry time.Duration, err error) {
+	ttl := func(name string, val *int) (time.Duration, error) {
+		if val == nil {
+			return utahfs.DefaultCacheTTL, nil
+		} else if *val < 0 {
+			return 0, fmt.Errorf("%v must not be negative", name)
+		} else if *val == 0 {
+			return utahfs.NoCacheTTL, nil
+		}
+		return time.Duration(*val) * time.Second, nil
+	}
+	if attr, err = ttl("attr-cache-ttl", c.AttrCacheTTL); err != nil {
+		return 0, 0, err
+	} else if entry, err = ttl("entry-cache-ttl", c.EntryCacheTTL); err != nil {
+		return 0, 0, err
+	}
+	return attr, entry, nil
+}
+
+// Modes returns the permissions to give new directories and files, from
+// default-dir-mode and default-file-mode.
+func (c *Client) Modes() (dir, file os.FileMode, err error) {
+	mode := func(name, val string) (os.FileMode, error) {
+		if val == "" {
+			return 0, nil
+		}
+		perm, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || os.FileMode(perm)&^os.ModePerm != 0 {
+			return 0, fmt.Errorf("%v must be permissions in octal, like 0775", name)
+		}
+		return os.FileMode(perm), nil
+	}
+	if dir, err = mode("default-dir-mode", c.DefaultDirMode); err != nil {
+		return 0, 0, err
+	} else if file, err = mode("default-file-mode", c.DefaultFileMode); err != nil {
+		return 0, 0, err
+	} else if c.ForceMode && (c.DefaultDirMode == "" || c.DefaultFileMode == "") {
+		return 0, 0, fmt.Errorf("force-mode requires default-dir-mode and default-file-mode")
+	}
+	return dir, file, nil
+}
+
+// ReadPin returns the most recent pin of the integrity tree that's stored
+// locally, by a client with the given mount path.
+func (c *Client) ReadPin(mountPath string) (*persistent.Pin, error) {
+	if c.DataDir == "" {
+		c.DataDir = path.Join(path.Dir(mountPath), ".utahfs")
+	}
+	key, err := c.readKey()
+	if err != nil {
+		return nil, err
+	}
+	return persistent.ReadPinKey(path.Join(c.DataDir, "pin.json"), key, pinHistory(c.PinHistoryCount))
+}
+
+// AcceptRemote recovers from remote storage having diverged from the local pin,
+// by pinning whatever tree head is in remote storage now. Local state that
+// could hold changes made on top of the old pin is deleted first: the WAL, and
+// any on-disk copies of remote data. The client must not be running.
+func (c *Client) AcceptRemote(ctx context.Context, mountPath string) (*persistent.Pin, error) {
+	if c.DataDir == "" {
+		c.DataDir = path.Join(path.Dir(mountPath), ".utahfs")
+	}
+	if c.ORAM {
+		// The ORAM's local state describes the tree that's being abandoned.
+		return nil, fmt.Errorf("can't accept remote state with oram")
+	}
+	key, err := c.readKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the remote tree head without going through the WAL or any caches.
+	var relStore persistent.ReliableStorage
+	if c.RemoteServer != nil {
+		if relStore, err = c.remoteStorage(); err != nil {
+			return nil, err
+		}
+	} else {
+		store, err := c.StorageProvider.Store()
+		if err != nil {
+			return nil, err
+		}
+		relStore = persistent.NewSimpleReliable(store)
+	}
+
+	discard := func() error {
+		if c.RemoteServer != nil {
+			return nil
+		}
+		cacheLoc := c.DiskCacheLoc
+		if cacheLoc == "" {
+			cacheLoc = path.Join(c.DataDir, "cache")
+		}
+		for _, loc := range []string{path.Join(c.DataDir, "wal"), path.Join(c.DataDir, "metadata"), cacheLoc} {
+			for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+				if err := os.Remove(loc + suffix); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return persistent.AcceptRemotePin(ctx, relStore, key, path.Join(c.DataDir, "pin.json"), pinHistory(c.PinHistoryCount), discard)
+}
+
+// readSecrets fills in the password and transport key from the environment or
+// a file, if the config says they should come from there.
+func (c *Client) readSecrets() (err error) {
+	c.Password, err = readSecret("password", c.Password, c.PasswordEnv, c.PasswordFile)
+	if err != nil {
+		return err
+	} else if c.RemoteServer == nil {
+		return nil
+	}
+	rs := c.RemoteServer
+	rs.TransportKey, err = readSecret("transport key", rs.TransportKey, rs.TransportKeyEnv, rs.TransportKeyFile)
+	return err
+}
+
+// readKey returns the key for encryption and integrity, either by fetching it
+// from the key provider or by deriving it from the user's password.
+func (c *Client) readKey() (persistent.Key, error) {
+	if c.KeyProvider == nil {
+		if err := c.readPassword(); err != nil {
+			return persistent.Key{}, err
+		}
+		return persistent.PasswordKeyWithParams(c.Password, c.kdf())
+	} else if c.Password != "" || c.PasswordEnv != "" || c.PasswordFile != "" {
+		return persistent.Key{}, fmt.Errorf("password can't be set alongside key-provider")
+	} else if c.KDFTime != 0 || c.KDFMemory != 0 || c.KDFThreads != 0 {
+		return persistent.Key{}, fmt.Errorf("kdf-time, kdf-memory, and kdf-threads can't be set alongside key-provider")
+	}
+	kp, err := c.KeyProvider.Provider()
+	if err != nil {
+		return persistent.Key{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return kp.Key(ctx)
+}
 
-	return bfs, nil
+// kdf returns the parameters to derive the key from the password with.
+func (c *Client) kdf() persistent.KDFParams {
+	params := persistent.DefaultKDFParams
+	if c.KDFTime != 0 {
+		params.Time = c.KDFTime
+	}
+	if c.KDFMemory != 0 {
+		params.Memory = c.KDFMemory
+	}
+	if c.KDFThreads != 0 {
+		params.Threads = c.KDFThreads
+	}
+	return params
+}
+
+// readPassword prompts the user for their password, if it isn't set in the
+// config file or given any other way.
+func (c *Client) readPassword() error {
+	if err := c.readSecrets(); err != nil {
+		return err
+	} else if c.Password != "" {
+		return nil
+	}
+	fmt.Print("Password: ")
+	password, err := terminal.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return fmt.Errorf("failed reading password from stdin")
+	} else if len(password) == 0 {
+		return fmt.Errorf("no password given for encryption")
+	}
+	c.Password = string(password)
+	return nil
+}
+
+// readSecret returns a secret from the first place it's given: `value` from the
+// config file, then the environment variable named `env`, then the file at
+// `file` with surrounding whitespace trimmed. It returns an empty string if
+// none of them are set, and an error if the variable or file named is empty or
+// can't be read, rather than falling back to anything else.
+func readSecret(name, value, env, file string) (string, error) {
+	if value != "" {
+		return value, nil
+	} else if env != "" {
+		if value = os.Getenv(env); value == "" {
+			return "", fmt.Errorf("%v was to be read from environment variable %v, but it isn't set", name, env)
+		}
+		return value, nil
+	} else if file != "" {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %v from file: %v", name, err)
+		} else if value = strings.TrimSpace(string(raw)); value == "" {
+			return "", fmt.Errorf("%v was to be read from %v, but the file is empty", name, file)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+// pinHistory returns the number of old pin files to keep, given the value of
+// the pin-history-count config setting.
+func pinHistory(count int) int {
+	if count == 0 {
+		return 3
+	} else if count < 0 {
+		return 0
+	}
+	return count
 }
 
 type ORAMConfig struct {
-	Key string `yaml:"key"` // Fixed key for encrypting ORAM blocks before being sent to the remote storage provider.
+	Key     string `yaml:"key"`      // Fixed key for encrypting ORAM blocks before being sent to the remote storage provider.
+	KeyEnv  string `yaml:"key-env"`  // Name of an environment variable to read key from, if it isn't set.
+	KeyFile string `yaml:"key-file"` // Path to a file to read key from, if it isn't set in the config or environment.
 
-	NumPtrs  int64 `yaml:"num-ptrs"`  // Should be the same as num-ptrs in the client-side config.
-	DataSize int64 `yaml:"data-size"` // Should be the same as data-size in the client-side config.
+	NumPtrs  int64 `yaml:"num-ptrs"`  // Must be the same as num-ptrs in the client-side config. Default: 12
+	DataSize int64 `yaml:"data-size"` // Must be the same as data-size in the client-side config. Default: 32 KiB
 }
 
 type Server struct {
@@ -338,9 +1144,18 @@ type Server struct {
 	MemCacheSize   int    `yaml:"mem-cache-size"`  // Size of in-memory LRU cache. Default: 32*1024 blocks, -1 to disable.
 	KeepMetadata   bool   `yaml:"keep-metadata"`   // Keep a local copy of metadata, always. Default: false.
 
-	ORAM *ORAMConfig `yaml:"oram"` // Provided if ORAM should be used on the server-side.
+	ORAM            *ORAMConfig `yaml:"oram"`              // Provided if ORAM should be used on the server-side.
+	PinHistoryCount int         `yaml:"pin-history-count"` // Number of old copies of the pin file to keep, if ORAM is used. Default: 3, -1 to disable.
+
+	TransportKey       string `yaml:"transport-key"`       // Pre-shared key for authenticating client and server.
+	TransportKeyEnv    string `yaml:"transport-key-env"`   // Name of an environment variable to read transport-key from, if it isn't set.
+	TransportKeyFile   string `yaml:"transport-key-file"`  // Path to a file to read transport-key from, if it isn't set in the config or environment.
+	ServerCert         string `yaml:"server-cert"`         // Certificate from an existing PKI to authenticate to clients with, instead of transport-key. PEM-encoded.
+	ServerKey          string `yaml:"server-key"`          // Private key of server-cert. PEM-encoded.
+	ServerCA           string `yaml:"server-ca"`           // CA certificates that clients' certificates must be issued by, if server-cert is set. PEM-encoded.
+	TransactionTimeout int    `yaml:"transaction-timeout"` // Number of seconds a client may go without pinging its transaction before it's ended. Default: 5
 
-	TransportKey string `yaml:"transport-key"` // Pre-shared key for authenticating client and server.
+	Repos map[string]*Server `yaml:"repos"` // Serve several repositories, each configured like a whole server, instead of one. Their data-dir defaults to a folder named after them in this data-dir.
 }
 
 func ServerFromFile(path string) (*Server, error) {
@@ -355,16 +1170,149 @@ func ServerFromFile(path string) (*Server, error) {
 	return parsed, nil
 }
 
-func (s *Server) Server() (*http.Server, error) {
+// Server returns the HTTP server described by the config, along with a closer
+// that releases the storage of every repo it serves. The closer should only be
+// called once the server has been shut down.
+func (s *Server) Server() (_ *http.Server, _ io.Closer, err error) {
 	if s.DataDir == "" {
 		s.DataDir = "./utahfs-data"
 	}
+	var closer persistent.Closers
+	defer func() {
+		if err != nil {
+			closer.Close()
+		}
+	}()
+	if len(s.Repos) == 0 {
+		relStore, repoCloser, err := s.storage()
+		if err != nil {
+			return nil, nil, err
+		}
+		closer = append(closer, repoCloser)
+		timeout := time.Duration(s.TransactionTimeout) * time.Second
+		var server *http.Server
+		if certs := s.certs(); certs != nil {
+			server, err = persistent.NewRemoteServerWithCerts(relStore, *certs, s.oramSize(), timeout)
+		} else {
+			server, err = persistent.NewRemoteServer(relStore, s.TransportKey, s.oramSize(), timeout)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return server, closer, nil
+	} else if s.StorageProvider != nil || s.TransportKey != "" || s.TransportKeyEnv != "" || s.TransportKeyFile != "" || s.certs() != nil || s.ORAM != nil {
+		return nil, nil, fmt.Errorf("storage-provider, transport-key, server-cert, and oram must be set for each repo instead")
+	}
+
+	repos := make(map[string]persistent.RemoteRepo)
+	for name, repo := range s.Repos {
+		if repo == nil {
+			return nil, nil, fmt.Errorf("repo %v: no config given", name)
+		} else if len(repo.Repos) > 0 {
+			return nil, nil, fmt.Errorf("repo %v: repos may not be nested", name)
+		} else if repo.DataDir == "" {
+			repo.DataDir = path.Join(s.DataDir, name)
+		}
+		relStore, repoCloser, err := repo.storage()
+		if err != nil {
+			return nil, nil, fmt.Errorf("repo %v: %v", name, err)
+		}
+		closer = append(closer, repoCloser)
+		repos[name] = persistent.RemoteRepo{
+			Base:         relStore,
+			TransportKey: repo.TransportKey,
+			Certs:        repo.certs(),
+			ORAMSize:     repo.oramSize(),
+			Timeout:      time.Duration(repo.TransactionTimeout) * time.Second,
+		}
+	}
+	server, err := persistent.NewMultiRemoteServer(repos)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, closer, nil
+}
+
+// Probe returns a health check probe for the server's storage provider, or
+// for the storage provider of every repo if there are several.
+func (s *Server) Probe() (persistent.Probe, error) {
+	if len(s.Repos) == 0 {
+		store, err := s.StorageProvider.Store()
+		if err != nil {
+			return nil, err
+		}
+		return persistent.ObjectProbe(store), nil
+	}
+
+	names := make([]string, 0, len(s.Repos))
+	probes := make(map[string]persistent.Probe)
+	for name, repo := range s.Repos {
+		if repo == nil {
+			return nil, fmt.Errorf("repo %v: no config given", name)
+		}
+		store, err := repo.StorageProvider.Store()
+		if err != nil {
+			return nil, fmt.Errorf("repo %v: %v", name, err)
+		}
+		names = append(names, name)
+		probes[name] = persistent.ObjectProbe(store)
+	}
+	sort.Strings(names)
+
+	return func(ctx context.Context) error {
+		for _, name := range names {
+			if err := probes[name](ctx); err != nil {
+				return fmt.Errorf("repo %v: %v", name, err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// certs returns the certificate files to authenticate to clients with, or nil
+// if the transport key should be used instead.
+func (s *Server) certs() *persistent.TLSFiles {
+	if s.ServerCert == "" && s.ServerKey == "" && s.ServerCA == "" {
+		return nil
+	}
+	return &persistent.TLSFiles{Cert: s.ServerCert, Key: s.ServerKey, CA: s.ServerCA}
+}
+
+// oramSize returns the size of the server's ORAM blocks, or zero if it doesn't
+// use ORAM. It must be called after storage, which validates the parameters.
+func (s *Server) oramSize() int64 {
+	if s.ORAM == nil {
+		return 0
+	}
+	size, _ := maxSize(s.ORAM.NumPtrs, s.ORAM.DataSize)
+	return size
+}
+
+// storage returns the storage that the server should expose to clients, after
+// checking the rest of its config, and a closer for everything beneath it.
+func (s *Server) storage() (_ persistent.ReliableStorage, _ io.Closer, err error) {
+	s.TransportKey, err = readSecret("transport key", s.TransportKey, s.TransportKeyEnv, s.TransportKeyFile)
+	if err != nil {
+		return nil, nil, err
+	} else if s.certs() != nil && s.TransportKey != "" {
+		return nil, nil, fmt.Errorf("transport-key cannot be set along with server-cert, server-key, and server-ca")
+	} else if s.TransportKey == "" && s.certs() == nil {
+		return nil, nil, fmt.Errorf("no transport key was given for remote clients")
+	} else if s.TransactionTimeout < 0 {
+		return nil, nil, fmt.Errorf("transaction-timeout may not be negative")
+	}
 
 	// Setup object storage.
 	store, err := s.StorageProvider.Store()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	closer := persistent.Closers{store}
+	defer func() {
+		if err != nil {
+			closer.Close()
+		}
+	}()
 
 	// Setup on-disk caching if desired.
 	if s.DiskCacheSize == 0 {
@@ -379,19 +1327,22 @@ func (s *Server) Server() (*http.Server, error) {
 		if s.KeepMetadata {
 			exclude = append(exclude, persistent.Metadata)
 		}
-		store, err = persistent.NewDiskCache(store, loc, s.DiskCacheSize, exclude)
+		cached, err := persistent.NewDiskCache(store, loc, s.DiskCacheSize, exclude)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		store = cached
+		closer = persistent.Closers{store}
 	}
 
 	// Setup tiered caching for metadata, if desired.
 	if s.KeepMetadata {
 		diskStore, err := persistent.NewDisk(path.Join(s.DataDir, "metadata"))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		store = persistent.NewTieredCache(persistent.Metadata, diskStore, store)
+		closer = persistent.Closers{store}
 	}
 
 	// Setup a local WAL.
@@ -401,10 +1352,11 @@ func (s *Server) Server() (*http.Server, error) {
 	if s.WALParallelism == 0 {
 		s.WALParallelism = 1
 	}
-	relStore, err := persistent.NewLocalWAL(store, path.Join(s.DataDir, "wal"), s.MaxWALSize, s.WALParallelism)
+	relStore, err := persistent.NewLocalWAL(store, path.Join(s.DataDir, "wal"), s.MaxWALSize, s.WALParallelism, false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	closer = persistent.Closers{relStore}
 
 	// Setup in-memory caching if desired.
 	if s.MemCacheSize == 0 {
@@ -412,12 +1364,17 @@ func (s *Server) Server() (*http.Server, error) {
 	}
 	if s.MemCacheSize != -1 {
 		relStore = persistent.NewCache(relStore, s.MemCacheSize)
+		closer = persistent.Closers{relStore}
 	}
 
 	// Setup ORAM if desired.
 	if s.ORAM != nil {
+		s.ORAM.Key, err = readSecret("oram key", s.ORAM.Key, s.ORAM.KeyEnv, s.ORAM.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
 		if s.StorageProvider.hasDisk() {
-			log.Println("WARNING: ORAM provides no security properties when used with disk storage")
+			logging.Warn("ORAM provides no security properties when used with disk storage")
 		}
 		// Setup defaults.
 		if s.ORAM.NumPtrs == 0 {
@@ -426,33 +1383,34 @@ func (s *Server) Server() (*http.Server, error) {
 		if s.ORAM.DataSize == 0 {
 			s.ORAM.DataSize = 32 * 1024
 		}
+		size, err := maxSize(s.ORAM.NumPtrs, s.ORAM.DataSize)
+		if err != nil {
+			return nil, nil, err
+		}
 
 		ostore, err := persistent.NewLocalOblivious(path.Join(s.DataDir, "oram"))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		closer = persistent.Closers{ostore, relStore}
 		block, err := persistent.WithIntegrity(
 			persistent.NewBufferedStorage(relStore),
 			s.ORAM.Key,
 			path.Join(s.DataDir, "pin.json"),
+			pinHistory(s.PinHistoryCount),
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		block, err = persistent.WithORAM(
-			persistent.WithEncryption(block, s.ORAM.Key),
-			ostore,
-			maxSize(s.ORAM.NumPtrs, s.ORAM.DataSize),
-		)
+		if err := persistent.CheckPassword(context.Background(), block, s.ORAM.Key); err != nil {
+			return nil, nil, err
+		}
+		block, err = persistent.WithORAM(persistent.WithEncryption(block, s.ORAM.Key), ostore, size)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		relStore = persistent.NewBlockReliable(block)
 	}
 
-	// Setup the server we want to expose.
-	if s.TransportKey == "" {
-		return nil, fmt.Errorf("no transport key was given for remote clients")
-	}
-	return persistent.NewRemoteServer(relStore, s.TransportKey, s.ORAM != nil)
+	return relStore, closer, nil
 }
@@ -0,0 +1,276 @@
+package config
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+func TestReadSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "secret")
+	if err := ioutil.WriteFile(file, []byte("  from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := path.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("UTAHFS_TEST_SECRET", "from-env")
+	defer os.Unsetenv("UTAHFS_TEST_SECRET")
+	os.Unsetenv("UTAHFS_TEST_UNSET")
+
+	tests := []struct {
+		value, env, file string
+		expected         string
+	}{
+		{"", "", "", ""},
+		{"from-config", "", "", "from-config"},
+		{"", "UTAHFS_TEST_SECRET", "", "from-env"},
+		{"", "", file, "from-file"},
+
+		{"from-config", "UTAHFS_TEST_SECRET", file, "from-config"},
+		{"", "UTAHFS_TEST_SECRET", file, "from-env"},
+	}
+	for _, test := range tests {
+		secret, err := readSecret("secret", test.value, test.env, test.file)
+		if err != nil {
+			t.Fatal(err)
+		} else if secret != test.expected {
+			t.Fatalf("expected %q, got %q", test.expected, secret)
+		}
+	}
+
+	if _, err := readSecret("secret", "", "UTAHFS_TEST_UNSET", file); err == nil {
+		t.Fatal("expected error from unset environment variable")
+	} else if _, err := readSecret("secret", "", "", empty); err == nil {
+		t.Fatal("expected error from empty file")
+	} else if _, err := readSecret("secret", "", "", path.Join(dir, "missing")); err == nil {
+		t.Fatal("expected error from missing file")
+	}
+}
+
+func TestClientSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "transport-key")
+	if err := ioutil.WriteFile(file, []byte("transport\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("UTAHFS_TEST_PASSWORD", "password")
+	defer os.Unsetenv("UTAHFS_TEST_PASSWORD")
+
+	c := &Client{
+		PasswordEnv:  "UTAHFS_TEST_PASSWORD",
+		RemoteServer: &RemoteServer{URL: "https://localhost", TransportKeyFile: file},
+	}
+	if err := c.checkRemote(); err != nil {
+		t.Fatal(err)
+	} else if c.Password != "password" {
+		t.Fatalf("unexpected password: %q", c.Password)
+	} else if c.RemoteServer.TransportKey != "transport" {
+		t.Fatalf("unexpected transport key: %q", c.RemoteServer.TransportKey)
+	}
+
+	// The transport key is still compared against the password after they've
+	// been read.
+	if err := ioutil.WriteFile(file, []byte("password"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c = &Client{
+		PasswordEnv:  "UTAHFS_TEST_PASSWORD",
+		RemoteServer: &RemoteServer{URL: "https://localhost", TransportKeyFile: file},
+	}
+	if err := c.checkRemote(); err == nil {
+		t.Fatal("expected error from transport key that's the same as the password")
+	}
+}
+
+func TestRemoteCerts(t *testing.T) {
+	remote := func(rs *RemoteServer) *Client {
+		rs.URL = "https://localhost:3002/"
+		return &Client{RemoteServer: rs, Password: "password"}
+	}
+
+	c := remote(&RemoteServer{ClientCert: "client.pem", ClientKey: "client-key.pem", ServerCA: "ca.pem"})
+	if err := c.checkRemote(); err != nil {
+		t.Fatal(err)
+	}
+	c = remote(&RemoteServer{TransportKey: "key", ClientCert: "client.pem", ClientKey: "client-key.pem", ServerCA: "ca.pem"})
+	if err := c.checkRemote(); err == nil {
+		t.Fatal("expected error from setting transport-key and client-cert")
+	}
+	c = remote(&RemoteServer{ClientCert: "client.pem"})
+	if _, err := c.RemoteServer.client(0); err == nil {
+		t.Fatal("expected error from incomplete certificate files")
+	}
+
+	s := &Server{TransportKey: "key", ServerCert: "server.pem", ServerKey: "server-key.pem", ServerCA: "ca.pem"}
+	if _, _, err := s.storage(); err == nil {
+		t.Fatal("expected error from setting transport-key and server-cert")
+	}
+}
+
+func TestReadOnlyFS(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := func(readOnly bool) persistent.Info {
+		cfg := &Client{
+			DataDir:         path.Join(dir, "data"),
+			StorageProvider: &StorageProvider{DiskPath: path.Join(dir, "storage")},
+			Password:        "password",
+			RepoName:        "photos",
+		}
+		open := cfg.FS
+		if readOnly {
+			open = cfg.ReadOnlyFS
+		}
+		bfs, closer, err := open("./")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closer.Close()
+
+		if readOnly {
+			if err := bfs.SetName(ctx, "other"); err != persistent.ErrReadOnly {
+				t.Fatalf("expected read-only error, got: %v", err)
+			}
+		}
+		_, info, err := bfs.Info(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	// Opening a new repository read-only shouldn't stamp it with any info, but
+	// opening it normally should.
+	if got := info(true); got != (persistent.Info{}) {
+		t.Fatalf("read-only open stamped repository: %v", got)
+	} else if got := info(false); got.Name != "photos" {
+		t.Fatalf("unexpected name: %q", got.Name)
+	} else if got := info(true); got.Name != "photos" {
+		t.Fatalf("unexpected name: %q", got.Name)
+	}
+}
+
+func TestReadOnlyFSVerifyWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, readOnly := range []bool{false, true} {
+		cfg := &Client{
+			DataDir:         path.Join(dir, "data"),
+			StorageProvider: &StorageProvider{DiskPath: path.Join(dir, "storage")},
+			Password:        "password",
+			WALVerify:       true,
+		}
+		open := cfg.FS
+		if readOnly {
+			open = cfg.ReadOnlyFS
+		}
+		_, closer, err := open("./")
+		if err != nil {
+			t.Fatalf("read-only %v: %v", readOnly, err)
+		}
+		closer.Close()
+	}
+}
+
+type closeCounter struct {
+	persistent.ObjectStorage
+	closed *int
+}
+
+func (cc closeCounter) Close() error {
+	*cc.closed++
+	return cc.ObjectStorage.Close()
+}
+
+func TestCloseOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opened, closed := 0, 0
+	name := fmt.Sprintf("config-test-close-%v", time.Now().UnixNano())
+	persistent.RegisterBackend(name, func(options map[string]string) (persistent.ObjectStorage, error) {
+		opened++
+		return closeCounter{persistent.NewMemory(), &closed}, nil
+	})
+	provider := func() *StorageProvider {
+		return &StorageProvider{Provider: &Provider{Type: name}}
+	}
+
+	// Options that are out of range are rejected before any storage is opened,
+	// and by Check as well as FS.
+	cfg := &Client{
+		DataDir:         path.Join(dir, "client"),
+		StorageProvider: provider(),
+		Password:        "password",
+		MaxDirtyBlocks:  -1,
+	}
+	if err := cfg.Check(context.Background()); err == nil {
+		t.Fatal("expected check to fail with negative max-dirty-blocks")
+	} else if _, _, err := cfg.FS("./"); err == nil {
+		t.Fatal("expected error from negative max-dirty-blocks")
+	} else if opened != 0 {
+		t.Fatalf("storage was opened %v times", opened)
+	}
+
+	// Storage that's opened before the config turns out to be invalid should
+	// be closed again.
+	cfg = &Client{
+		DataDir:         path.Join(dir, "client"),
+		StorageProvider: provider(),
+		Password:        "password",
+		KeyProvider:     &KeyProvider{},
+	}
+	if _, _, err := cfg.FS("./"); err == nil {
+		t.Fatal("expected error from password alongside key-provider")
+	} else if opened != 1 || closed != 1 {
+		t.Fatalf("storage was opened %v times and closed %v times", opened, closed)
+	}
+
+	// So should the storage of every repo that was set up before one fails.
+	opened, closed = 0, 0
+	srv := &Server{
+		DataDir: path.Join(dir, "server"),
+		Repos: map[string]*Server{
+			"a": {StorageProvider: provider(), TransportKey: "transport key"},
+			"b": {StorageProvider: provider(), TransportKey: "transport key"},
+			"c": {StorageProvider: provider(), TransportKey: "transport key", ORAM: &ORAMConfig{Key: "password", NumPtrs: -1}},
+		},
+	}
+	if _, _, err := srv.Server(); err == nil {
+		t.Fatal("expected error from invalid oram parameters")
+	} else if opened == 0 || closed != opened {
+		t.Fatalf("storage was opened %v times and closed %v times", opened, closed)
+	}
+}
@@ -0,0 +1,117 @@
+// Package fsutil implements helpers for reading a UtahFS repository through
+// its fuseutil.FileSystem interface, without mounting it.
+package fsutil
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Entry is a single entry of a directory.
+type Entry struct {
+	Name       string
+	Inode      fuseops.InodeID
+	Attributes fuseops.InodeAttributes
+}
+
+// ReadDir returns all of the entries of the directory `inode`, in the order
+// that the filesystem returns them.
+func ReadDir(ctx context.Context, fs fuseutil.FileSystem, inode fuseops.InodeID) ([]Entry, error) {
+	open := &fuseops.OpenDirOp{Inode: inode}
+	if err := fs.OpenDir(ctx, open); err != nil {
+		return nil, err
+	}
+	defer func() {
+		release := &fuseops.ReleaseDirHandleOp{Handle: open.Handle}
+		fs.ReleaseDirHandle(ctx, release)
+	}()
+
+	entries := make([]Entry, 0)
+	for {
+		// Read the next chunk of entries from the directory.
+		dst := make([]byte, 2048)
+		op := &fuseops.ReadDirOp{
+			Inode:  inode,
+			Handle: open.Handle,
+
+			Offset: fuseops.DirOffset(len(entries)),
+			Dst:    dst,
+		}
+		if err := fs.ReadDir(ctx, op); err != nil {
+			return nil, err
+		} else if op.BytesRead == 0 {
+			break
+		}
+		dst = dst[:op.BytesRead]
+
+		// Parse the names returned.
+		for len(dst) > 0 {
+			var (
+				de  fuseutil.Dirent
+				err error
+			)
+			dst, de, err = parseDirent(dst)
+			if err != nil {
+				return nil, err
+			}
+
+			// Look up the full info for the entry.
+			op := &fuseops.LookUpInodeOp{Parent: inode, Name: de.Name}
+			if err := fs.LookUpInode(ctx, op); err != nil {
+				return nil, err
+			}
+			entries = append(entries, Entry{de.Name, op.Entry.Child, op.Entry.Attributes})
+		}
+	}
+
+	return entries, nil
+}
+
+func parseDirent(buf []byte) ([]byte, fuseutil.Dirent, error) {
+	type fuse_dirent struct {
+		ino     uint64
+		off     uint64
+		namelen uint32
+		type_   uint32
+		name    [0]byte
+	}
+
+	const direntAlignment = 8
+	const direntSize = 8 + 8 + 4 + 4
+
+	if len(buf) < direntSize {
+		return nil, fuseutil.Dirent{}, fmt.Errorf("buffer is too short")
+	}
+	de := fuse_dirent{}
+
+	n := copy((*[direntSize]byte)(unsafe.Pointer(&de))[:], buf)
+	buf = buf[n:]
+
+	if len(buf) < int(de.namelen) {
+		return nil, fuseutil.Dirent{}, fmt.Errorf("buffer is too short")
+	}
+	name := string(buf[:de.namelen])
+	buf = buf[de.namelen:]
+
+	var padLen int
+	if len(name)%direntAlignment != 0 {
+		padLen = direntAlignment - (len(name) % direntAlignment)
+	}
+	if len(buf) < padLen {
+		return nil, fuseutil.Dirent{}, fmt.Errorf("buffer is too short")
+	}
+	buf = buf[padLen:]
+
+	return buf, fuseutil.Dirent{
+		Offset: fuseops.DirOffset(de.off),
+
+		Inode: fuseops.InodeID(de.ino),
+		Name:  name,
+
+		Type: fuseutil.DirentType(de.type_),
+	}, nil
+}
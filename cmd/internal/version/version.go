@@ -0,0 +1,63 @@
+// Package version reports which build of UtahFS is running. Release builds set
+// Version and Commit with the linker, like:
+//
+//	go build -ldflags "-X github.com/cloudflare/utahfs/cmd/internal/version.Version=v1.2.3 -X github.com/cloudflare/utahfs/cmd/internal/version.Commit=$(git rev-parse HEAD)" ./cmd/...
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Version is the release that this binary was built from.
+	Version = ""
+	// Commit is the git commit that this binary was built from.
+	Commit = ""
+)
+
+// BuildInfo is always 1, and has labels describing the build that's running.
+var BuildInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "build_info",
+		Help: "Always 1, labeled with the version, commit, and Go version of the running build.",
+	},
+	[]string{"version", "commit", "goversion"},
+)
+
+func init() {
+	BuildInfo.WithLabelValues(version(), commit(), runtime.Version()).Set(1)
+}
+
+// version returns Version, or if it wasn't set, the version of the module that
+// `go install` was given. Otherwise, it's "devel".
+func version() string {
+	if Version != "" {
+		return Version
+	} else if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+	return "unknown"
+}
+
+// Release returns the release that this binary was built from, like v1.2.3, or
+// "devel" if it isn't known.
+func Release() string {
+	return version()
+}
+
+// String returns a line describing the build, to be printed by -version and
+// logged at startup.
+func String() string {
+	return fmt.Sprintf("utahfs %v (commit %v, %v %v/%v)", version(), commit(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,59 @@
+// Command utahfs-b2-versions lists the old versions of objects that B2 is still
+// keeping under the prefix in a client's config file: the ones that were hidden
+// by deleting them, and the ones that were overwritten.
+// Each version's ID can be given to B2's tools to download or restore it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	all := flag.Bool("all", false, "Also list the current version of each object.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	} else if cfg.StorageProvider == nil {
+		log.Fatal("config file has no storage-provider section")
+	}
+	versions, err := cfg.StorageProvider.B2Versions(context.Background())
+	if err != nil {
+		log.Fatalf("failed to list versions: %v", err)
+	}
+
+	for _, v := range versions {
+		// The current version of an object that was deleted is the marker
+		// that hides it, which is always listed.
+		if v.Current && !v.Hidden && !*all {
+			continue
+		}
+		status := "old"
+		if v.Hidden {
+			status = "hidden"
+		} else if v.Current {
+			status = "current"
+		}
+		fmt.Printf("%v\t%-7v\t%8v\t%v\t%v\n", v.Uploaded.UTC().Format(time.RFC3339), status, v.Size, v.Name, v.ID)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv is set in the environment of the background process started by
+// daemonize, so that it knows not to start another one.
+const daemonEnv = "UTAHFS_DAEMON"
+
+// mountedMsg is written to the notify pipe by the background process once the
+// filesystem is mounted.
+const mountedMsg = "utahfs: mounted"
+
+// daemonize starts a copy of this process in the background, in a new session
+// so that it isn't attached to the terminal, and waits for it to mount the
+// filesystem. Anything the copy logs before then is printed here too. It exits
+// with status 0 if the filesystem was mounted, and 1 otherwise.
+//
+// The copy's stdin, stdout, and stderr go to /dev/null, or its stderr to
+// `logFile` if that isn't empty.
+func daemonize(logFile string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start daemon: %v\n", err)
+		os.Exit(1)
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start daemon: %v\n", err)
+		os.Exit(1)
+	}
+	stderr := devNull
+	if logFile != "" {
+		if stderr, err = openLog(logFile); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open log file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, devNull, stderr
+	cmd.ExtraFiles = []*os.File{w} // Becomes fd 3 in the child.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start daemon: %v\n", err)
+		os.Exit(1)
+	}
+	w.Close()
+
+	// Relay what the child logs until it says it's mounted, or exits.
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line == mountedMsg {
+			fmt.Fprintf(os.Stderr, "filesystem successfully mounted by daemon with pid %v\n", cmd.Process.Pid)
+			os.Exit(0)
+		} else {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "daemon exited before mounting the filesystem")
+	os.Exit(1)
+}
+
+// daemonChild returns the pipe to notify the parent process through, if this
+// process was started by daemonize.
+func daemonChild() io.WriteCloser {
+	if os.Getenv(daemonEnv) == "" {
+		return nil
+	}
+	return os.NewFile(3, "notify")
+}
+
+// notifyMounted tells the parent process that the filesystem is mounted, and
+// closes the pipe to it.
+func notifyMounted(notify io.WriteCloser) {
+	fmt.Fprintln(notify, mountedMsg)
+	notify.Close()
+}
+
+func openLog(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
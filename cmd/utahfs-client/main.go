@@ -5,14 +5,21 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/cloudflare/utahfs"
 	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/internal/logging"
+	"github.com/cloudflare/utahfs/persistent"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -24,10 +31,71 @@ func main() {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
 	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
 	mountPath := flag.String("mount", "./utahfs", "Directory to mount as remote drive.")
-	verbose := flag.Bool("v", false, "Enable debug logging.")
+	verbose := flag.Bool("v", false, "Enable debug logging. Same as -log-level debug.")
+	logLevel := flag.String("log-level", "info", "Minimum level of messages to log: error, warn, info, or debug.")
+	logJSON := flag.Bool("log-json", false, "Log messages as JSON objects, one per line.")
+	logFile := flag.String("log-file", "", "File to append log messages to, instead of stderr.")
+	daemon := flag.Bool("daemon", false, "Run in the background, detached from the terminal, once the filesystem is mounted.")
 	metricsAddr := flag.String("metrics-addr", "localhost:3001", "Address to serve metrics on.")
+	checkConfig := flag.Bool("check-config", false, "Validate the config file and storage connection, then exit without mounting.")
+	allowOther := flag.Bool("allow-other", false, "Allow users other than the one mounting the filesystem to access it.")
+	allowRoot := flag.Bool("allow-root", false, "Allow root, as well as the user mounting the filesystem, to access it.")
+	uid := flag.Int("uid", -1, "User to present as the owner of every file. Default is the current user.")
+	gid := flag.Int("gid", -1, "Group to present as the owner of every file. Default is the current user's group.")
+	subdir := flag.String("subdir", "", "Directory within the repository to mount, instead of its root. Overrides subdir in the config file.")
+	maxRead := flag.Int("max-read", 0, "Largest read, in bytes, that the kernel may ask for in one request. At most 128 KiB. Default is the kernel's.")
+	maxReadahead := flag.Int("max-readahead", 0, "Number of bytes ahead of a sequential read that the kernel may read. Requires root. Default: 1 MiB.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	if *verbose {
+		*logLevel = "debug"
+	}
+	if err := logging.Setup(*logLevel, *logJSON); err != nil {
+		log.Fatal(err)
+	}
+	notify := daemonChild()
+	if *daemon && notify == nil && !*checkConfig {
+		daemonize(*logFile)
+	}
+	// The daemon's stderr is already the log file, if there is one. Until
+	// it's mounted, everything it logs is relayed to the process that
+	// started it as well.
+	var logOut io.Writer = os.Stderr
+	if *logFile != "" && notify == nil {
+		f, err := openLog(*logFile)
+		if err != nil {
+			log.Fatalf("failed to open log file: %v", err)
+		}
+		logOut = f
+	}
+	if notify != nil {
+		setLogOutput(io.MultiWriter(logOut, notify))
+	} else {
+		setLogOutput(logOut)
+	}
+
+	logging.Info(version.String())
+
+	if *allowOther && *allowRoot {
+		log.Fatal("only one of -allow-other and -allow-root may be set")
+	} else if *maxRead < 0 || *maxRead > maxFuseRead {
+		log.Fatalf("max-read must be between 0 and %v", maxFuseRead)
+	} else if *maxReadahead < 0 || *maxReadahead%4096 != 0 {
+		log.Fatal("max-readahead must be a non-negative multiple of 4096")
+	}
+	if *uid < 0 {
+		*uid = os.Getuid()
+	}
+	if *gid < 0 {
+		*gid = os.Getgid()
+	}
+
 	fullMountPath, err := filepath.Abs(*mountPath)
 	if err != nil {
 		log.Fatalf("failed to resolve mount path: %v", err)
@@ -38,17 +106,70 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
-	bfs, err := cfg.FS(fullMountPath)
+	if *subdir != "" {
+		cfg.Subdir = *subdir
+	}
+	if *checkConfig {
+		if err := cfg.Check(context.Background()); err != nil {
+			log.Fatalf("config check failed: %v", err)
+		}
+		log.Println("config check passed")
+		return
+	}
+	bfs, closer, err := cfg.FS(fullMountPath)
 	if err != nil {
 		log.Fatalf("failed to initialize storage: %v", err)
 	}
-
-	var fs fuseutil.FileSystem
-	if cfg.Archive {
-		fs, err = utahfs.NewArchive(bfs)
-	} else {
-		fs, err = utahfs.NewFilesystem(bfs)
+	probe, err := cfg.Probe()
+	if err != nil {
+		log.Fatalf("failed to initialize health check: %v", err)
+	}
+	hc := persistent.NewHealthCheck(probe, 5*time.Second)
+	atime, err := cfg.Atime()
+	if err != nil {
+		log.Fatal(err)
 	}
+	attrTTL, entryTTL, err := cfg.CacheTTLs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dirMode, fileMode, err := cfg.Modes()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fs, err := utahfs.NewFilesystemWithOptions(bfs, utahfs.Options{
+		Archive: cfg.Archive,
+
+		Uid:    uint32(*uid),
+		Gid:    uint32(*gid),
+		UidMap: cfg.UidMap,
+		GidMap: cfg.GidMap,
+
+		CaseInsensitive: cfg.CaseInsensitive,
+		WarmDepth:       cfg.WarmDepth,
+
+		BackgroundCommit:       time.Duration(cfg.BackgroundCommitInterval) * time.Second,
+		BackgroundCommitBlocks: cfg.BackgroundCommitBlocks,
+		OpTimeout:              time.Duration(cfg.OpTimeout) * time.Second,
+		DetectConflicts:        cfg.DetectConflicts,
+
+		Atime:           atime,
+		InlineThreshold: cfg.InlineThreshold,
+		MaxNameLength:   cfg.MaxNameLength,
+		Subdir:          cfg.Subdir,
+
+		DirMode:   dirMode,
+		FileMode:  fileMode,
+		ForceMode: cfg.ForceMode,
+
+		Metrics: true,
+
+		AttrCacheTTL:  attrTTL,
+		EntryCacheTTL: entryTTL,
+
+		PinSaveInterval: time.Duration(cfg.PinSaveInterval) * time.Second,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -56,23 +177,43 @@ func main() {
 
 	mountCfg := &fuse.MountConfig{
 		FSName:      volume,
-		ErrorLogger: log.New(os.Stderr, "fuse: ", log.Flags()),
+		ErrorLogger: logging.New(logging.LevelError, "fuse: "),
 		VolumeName:  volume,
 		Subtype:     "utahfs",
+		Options:     make(map[string]string),
 	}
-	if *verbose {
-		mountCfg.DebugLogger = log.New(os.Stderr, "fuse-debug: ", log.Flags())
+	if *allowOther {
+		mountCfg.Options["allow_other"] = ""
+	} else if *allowRoot {
+		mountCfg.Options["allow_root"] = ""
+	}
+	if *maxRead > 0 {
+		mountCfg.Options["max_read"] = strconv.Itoa(*maxRead)
+	}
+	if logging.Enabled(logging.LevelDebug) {
+		mountCfg.DebugLogger = logging.New(logging.LevelDebug, "fuse-debug: ")
 	}
 	mfs, err := fuse.Mount(fullMountPath, server, mountCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *maxReadahead > 0 {
+		if err := setReadahead(mfs.Dir(), *maxReadahead); err != nil {
+			logging.Warnf("failed to set max-readahead: %v", err)
+		}
+	}
 	go handleInterrupt(mfs.Dir())
-	go metrics(*metricsAddr)
+	go metrics(*metricsAddr, hc, fullMountPath, bfs)
 
-	log.Println("filesystem successfully mounted")
+	logging.Info("filesystem successfully mounted")
+	if notify != nil {
+		setLogOutput(logOut)
+		notifyMounted(notify)
+	}
 	if err := mfs.Join(context.Background()); err != nil {
 		log.Fatal(err)
+	} else if err := closer.Close(); err != nil {
+		log.Fatalf("failed to close storage: %v", err)
 	}
 }
 
@@ -82,14 +223,21 @@ func handleInterrupt(mountPoint string) {
 
 	for {
 		<-signalChan
-		log.Println("Received SIGINT, attempting to unmount...")
+		logging.Info("Received SIGINT, attempting to unmount...")
 
 		err := fuse.Unmount(mountPoint)
 		if err != nil {
-			log.Printf("Failed to unmount in response to SIGINT: %v", err)
+			logging.Errorf("Failed to unmount in response to SIGINT: %v", err)
 		} else {
-			log.Printf("Successfully unmounted in response to SIGINT.")
+			logging.Info("Successfully unmounted in response to SIGINT.")
 			return
 		}
 	}
 }
+
+// setLogOutput sends the messages of both the standard logger and the leveled
+// one to `w`.
+func setLogOutput(w io.Writer) {
+	log.SetOutput(w)
+	logging.SetOutput(w)
+}
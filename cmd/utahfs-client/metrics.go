@@ -5,7 +5,13 @@ import (
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
 
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
 	"github.com/cloudflare/utahfs/persistent"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,16 +19,27 @@ import (
 )
 
 func init() {
+	prometheus.MustRegister(version.BuildInfo)
 	prometheus.MustRegister(persistent.AppStorageCommits)
 	prometheus.MustRegister(persistent.LocalWALSize)
+	prometheus.MustRegister(persistent.LocalWALPaused)
+	prometheus.MustRegister(persistent.WriteBehindDepth)
 	prometheus.MustRegister(persistent.DiskCacheSize)
 	prometheus.MustRegister(persistent.B2Ops)
 	prometheus.MustRegister(persistent.GCSOps)
 	prometheus.MustRegister(persistent.S3Ops)
+	prometheus.MustRegister(persistent.VerifiedWrites)
+	prometheus.MustRegister(persistent.RemoteHandshakes)
+	prometheus.MustRegister(utahfs.FuseOpDuration)
+	prometheus.MustRegister(utahfs.FuseOpErrors)
+	prometheus.MustRegister(utahfs.SkiplistSeekBlocks)
 }
 
-// metrics registers metrics with Prometheus and starts the server.
-func metrics(addr string) {
+// metrics registers metrics with Prometheus and starts the server. Liveness is
+// reported at /healthz by `hc`, and readiness at /readyz by checking that
+// `mountPath` is mounted. Uploads from the WAL of `bfs` are paused and resumed
+// by POSTing to /wal/pause and /wal/resume.
+func metrics(addr string, hc *persistent.HealthCheck, mountPath string, bfs *utahfs.BlockFilesystem) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/" {
@@ -32,6 +49,17 @@ func metrics(addr string) {
 		}
 	})
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", hc)
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, req *http.Request) {
+		if err := mounted(mountPath, 5*time.Second); err != nil {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(rw, "not ready: %v\n", err)
+			return
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.HandleFunc("/wal/pause", pauseHandler(bfs, true))
+	mux.HandleFunc("/wal/resume", pauseHandler(bfs, false))
 
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -45,3 +73,56 @@ func metrics(addr string) {
 	}
 	log.Fatal(server.ListenAndServe())
 }
+
+func pauseHandler(bfs *utahfs.BlockFilesystem, paused bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		} else if err := bfs.PauseSync(paused); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(rw, "ok")
+	}
+}
+
+// mounted returns nil if `dir` is the root of a mounted filesystem, which it is
+// if it's on a different device to its parent. The stat goes through FUSE, so
+// a filesystem that's stopped responding fails after `timeout`.
+func mounted(dir string, timeout time.Duration) error {
+	type result struct {
+		fi  os.FileInfo
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		fi, err := os.Stat(dir)
+		done <- result{fi, err}
+	}()
+
+	var fi os.FileInfo
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return res.err
+		}
+		fi = res.fi
+	case <-time.After(timeout):
+		return fmt.Errorf("stat of %v timed out after %v", dir, timeout)
+	}
+	parent, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	pst, pok := parent.Sys().(*syscall.Stat_t)
+	if !ok || !pok {
+		return fmt.Errorf("unable to determine device of %v", dir)
+	} else if st.Dev == pst.Dev {
+		return fmt.Errorf("%v is not mounted", dir)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxFuseRead is the largest read that the FUSE library can answer in one
+// request on Linux, and so the largest value allowed for -max-read.
+const maxFuseRead = 128 * 1024
+
+// setReadahead sets how many bytes ahead the kernel may read files in the
+// filesystem mounted at `dir`. The FUSE library always asks for 1 MiB when
+// mounting, and this changes it afterwards through the mount's entry in
+// /sys/class/bdi. That only exists on Linux, and usually can only be written
+// by root.
+func setReadahead(dir string, size int) error {
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return err
+	}
+	dev := uint64(st.Dev)
+	loc := fmt.Sprintf("/sys/class/bdi/%v:%v/read_ahead_kb", unix.Major(dev), unix.Minor(dev))
+	return ioutil.WriteFile(loc, []byte(strconv.Itoa(size/1024)), 0644)
+}
@@ -0,0 +1,62 @@
+// Command utahfs-compact shrinks a UtahFS repository's block address space by
+// moving every block that's in use into a dense range at the start of it, and
+// deleting the trash. It must be run while the repository isn't mounted.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	mountPath := flag.String("mount", "./utahfs", "Location the client mounts the filesystem.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	} else if cfg.RemoteServer != nil {
+		log.Fatal("a repository can't be compacted through a remote server")
+	} else if cfg.ORAM {
+		log.Fatal("a repository can't be compacted with oram")
+	} else if cfg.MaxDirtyBlocks != 0 {
+		log.Fatal("compaction has to be done in a single transaction, so max-dirty-blocks must not be set")
+	}
+	bfs, closer, err := cfg.FS(*mountPath)
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+
+	ctx := context.Background()
+	before, after, err := utahfs.Compact(ctx, bfs)
+	if err != nil {
+		log.Fatal(err)
+	} else if err := utahfs.CheckFilesystem(ctx, bfs); err != nil {
+		log.Fatalf("compacted repository failed check: %v", err)
+	}
+	log.Printf("compacted repository from %v blocks to %v, uploading changes", before, after)
+	if err := bfs.Sync(ctx); err != nil {
+		log.Fatal(err)
+	} else if err := closer.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("done")
+}
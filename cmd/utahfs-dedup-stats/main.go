@@ -0,0 +1,52 @@
+// Command utahfs-dedup-stats reports how much space dedup is saving in a UtahFS
+// repository, without mounting it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	bfs, closer, err := cfg.ReadOnlyFS("./")
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+	defer closer.Close()
+
+	stats, err := bfs.DedupStats(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	} else if stats == nil {
+		fmt.Println("repository has no dedup index")
+		return
+	}
+	fmt.Printf("hash:\t\t%v\n", stats.Hash)
+	fmt.Printf("shared copies:\t%v\n", stats.Shared)
+	fmt.Printf("references:\t%v\n", stats.Refs)
+	fmt.Printf("dedup ratio:\t%.2f\n", stats.Ratio())
+	fmt.Printf("bytes saved:\t%v\n", stats.Saved())
+}
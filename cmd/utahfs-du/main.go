@@ -0,0 +1,128 @@
+// Command utahfs-du reports the space used by each directory in a UtahFS
+// repository, without mounting it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/fsutil"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+type usage struct {
+	path  string
+	depth int
+	size  uint64
+}
+
+type walker struct {
+	fs fuseutil.FileSystem
+
+	// seen is the set of inodes that have already been counted, so that
+	// hardlinked files only contribute to usage once.
+	seen  map[fuseops.InodeID]struct{}
+	dirs  []usage
+	depth int
+}
+
+// walk returns the total size of everything under the directory `inode`, and
+// records the usage of each subdirectory.
+func (w *walker) walk(ctx context.Context, inode fuseops.InodeID, name string, depth int) (uint64, error) {
+	entries, err := fsutil.ReadDir(ctx, w.fs, inode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %v: %v", name, err)
+	}
+
+	total := uint64(0)
+	for _, entry := range entries {
+		if _, ok := w.seen[entry.Inode]; ok {
+			continue
+		}
+		w.seen[entry.Inode] = struct{}{}
+
+		if entry.Attributes.Mode.IsDir() {
+			size, err := w.walk(ctx, entry.Inode, path.Join(name, entry.Name), depth+1)
+			if err != nil {
+				return 0, err
+			}
+			total += size
+		} else {
+			total += entry.Attributes.Size
+		}
+	}
+
+	if w.depth < 0 || depth <= w.depth {
+		w.dirs = append(w.dirs, usage{name, depth, total})
+	}
+	return total, nil
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	depth := flag.Int("depth", -1, "Maximum depth of directories to report on. Negative for no limit.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	bfs, closer, err := cfg.ReadOnlyFS("./")
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+	err = du(context.Background(), bfs, *depth)
+	closer.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// du prints the usage of each directory in the repository, down to `depth`
+// levels below the root, largest first.
+func du(ctx context.Context, bfs *utahfs.BlockFilesystem, depth int) error {
+	fs, err := utahfs.NewArchive(bfs)
+	if err == persistent.ErrReadOnly {
+		// The repository is empty, and its root directory can't be created
+		// without writing to it.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	w := &walker{
+		fs:    fs,
+		seen:  make(map[fuseops.InodeID]struct{}),
+		depth: depth,
+	}
+	if _, err := w.walk(ctx, fuseops.RootInodeID, "/", 0); err != nil {
+		return err
+	}
+
+	sort.SliceStable(w.dirs, func(i, j int) bool { return w.dirs[i].size > w.dirs[j].size })
+	for _, dir := range w.dirs {
+		fmt.Printf("%v\t%v\n", dir.size, dir.path)
+	}
+	return nil
+}
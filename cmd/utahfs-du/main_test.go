@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"context"
+	"os"
+	"reflect"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// linkedFilesystem wraps a filesystem so that looking up some names returns
+// another entry in the same directory instead, like a hardlink would.
+type linkedFilesystem struct {
+	fuseutil.FileSystem
+	links map[string]string
+}
+
+func (lf *linkedFilesystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	if target, ok := lf.links[op.Name]; ok {
+		op.Name = target
+	}
+	return lf.FileSystem.LookUpInode(ctx, op)
+}
+
+func testFilesystem(t *testing.T) fuseutil.FileSystem {
+	ctx := context.Background()
+
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := utahfs.NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := utahfs.NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkdir := func(parent fuseops.InodeID, name string) fuseops.InodeID {
+		op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: os.ModeDir | 0755}
+		if err := fs.MkDir(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		return op.Entry.Child
+	}
+	create := func(parent fuseops.InodeID, name string, size int) {
+		op := &fuseops.CreateFileOp{Parent: parent, Name: name, Mode: 0644}
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		write := &fuseops.WriteFileOp{Inode: op.Entry.Child, Handle: op.Handle, Data: make([]byte, size)}
+		if err := fs.WriteFile(ctx, write); err != nil {
+			t.Fatal(err)
+		} else if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: op.Entry.Child, Handle: op.Handle}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create(fuseops.RootInodeID, "a", 100)
+	create(fuseops.RootInodeID, "b", 1000)
+	dir := mkdir(fuseops.RootInodeID, "dir")
+	create(dir, "c", 10)
+	sub := mkdir(dir, "sub")
+	create(sub, "d", 5)
+
+	// "b" is replaced by a link to "a", so that the same file is found twice.
+	return &linkedFilesystem{fs, map[string]string{"b": "a"}}
+}
+
+func TestWalk(t *testing.T) {
+	fs := testFilesystem(t)
+
+	for _, tc := range []struct {
+		depth    int
+		expected []usage
+	}{
+		{-1, []usage{{"/dir/sub", 2, 5}, {"/dir", 1, 15}, {"/", 0, 115}}},
+		{1, []usage{{"/dir", 1, 15}, {"/", 0, 115}}},
+		{0, []usage{{"/", 0, 115}}},
+	} {
+		w := &walker{
+			fs:    fs,
+			seen:  make(map[fuseops.InodeID]struct{}),
+			depth: tc.depth,
+		}
+		total, err := w.walk(context.Background(), fuseops.RootInodeID, "/", 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if total != 115 {
+			t.Fatalf("depth %v: expected linked file to be counted once, got total of %v", tc.depth, total)
+		} else if !reflect.DeepEqual(w.dirs, tc.expected) {
+			t.Fatalf("depth %v: unexpected usage: %+v", tc.depth, w.dirs)
+		}
+	}
+}
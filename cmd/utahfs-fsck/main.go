@@ -0,0 +1,95 @@
+// Command utahfs-fsck checks that the skiplists of every file in a UtahFS
+// repository are structurally consistent, without mounting it. With -orphans,
+// it also compares the objects in the storage provider against the blocks that
+// are in use, to find leaked objects and dangling references. With -shadow, it
+// compares them against the copies in the config's shadow-path.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	mountPath := flag.String("mount", "./utahfs", "Location the client mounts the filesystem.")
+	shadow := flag.Bool("shadow", false, "Also compare the storage provider's objects against the copies in shadow-path.")
+	orphans := flag.Bool("orphans", false, "Also list the storage provider's objects, and report leaked objects and dangling references.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	bfs, closer, err := cfg.ReadOnlyFS(*mountPath)
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+	defer closer.Close()
+	ctx := context.Background()
+	if err := utahfs.CheckFilesystem(ctx, bfs); err != nil {
+		log.Fatal(err)
+	}
+	if *orphans {
+		if cfg.RemoteServer != nil {
+			log.Fatal("-orphans can't be used with a remote server")
+		}
+		backend, err := cfg.StorageProvider.Store()
+		if err != nil {
+			log.Fatalf("failed to initialize storage: %v", err)
+		}
+		defer backend.Close()
+		leaked, dangling, err := utahfs.FindOrphans(ctx, bfs, backend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range leaked {
+			fmt.Printf("leaked: %v\n", key)
+		}
+		for _, key := range dangling {
+			fmt.Printf("dangling: %v\n", key)
+		}
+		if len(leaked) > 0 || len(dangling) > 0 {
+			log.Fatalf("found %v leaked objects and %v dangling references", len(leaked), len(dangling))
+		}
+	}
+	if *shadow {
+		if cfg.RemoteServer != nil {
+			log.Fatal("-shadow can't be used with a remote server")
+		}
+		diff, err := cfg.StorageProvider.VerifyShadow(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range diff.Missing {
+			fmt.Printf("missing from shadow: %v\n", key)
+		}
+		for _, key := range diff.Different {
+			fmt.Printf("different in shadow: %v\n", key)
+		}
+		for _, key := range diff.Extra {
+			fmt.Printf("extra in shadow: %v\n", key)
+		}
+		if n := len(diff.Missing) + len(diff.Different) + len(diff.Extra); n > 0 {
+			log.Fatalf("found %v objects that differ in the shadow", n)
+		}
+	}
+	log.Println("no problems found")
+}
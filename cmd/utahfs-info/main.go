@@ -0,0 +1,105 @@
+// Command utahfs-info prints what's recorded about a UtahFS repository, like
+// its name and the format it was created with, without mounting it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	name := flag.String("set-name", "", "Change the name recorded in the repository, instead of printing its info.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	// Only changing the name needs to write to the repository.
+	open := cfg.ReadOnlyFS
+	if *name != "" {
+		open = cfg.FS
+	}
+	bfs, closer, err := open("./")
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+	defer closer.Close()
+	ctx := context.Background()
+
+	if *name != "" {
+		if err := bfs.SetName(ctx, *name); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	header, info, err := bfs.Info(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unknown := func(val string) string {
+		if val == "" {
+			return "unknown"
+		}
+		return val
+	}
+	created := "unknown"
+	if info.Created != 0 {
+		created = time.Unix(info.Created, 0).Format(time.RFC3339)
+	}
+	fmt.Printf("name:\t\t%v\n", unknown(info.Name))
+	fmt.Printf("created:\t%v\n", created)
+	fmt.Printf("creator:\t%v\n", unknown(info.Creator))
+	fmt.Printf("version:\t%v\n", unknown(info.Version))
+	if header == (persistent.Header{}) {
+		fmt.Println("format:\t\tnot recorded")
+		return
+	}
+	fmt.Printf("num-ptrs:\t%v\n", header.NumPtrs)
+	fmt.Printf("data-size:\t%v\n", header.DataSize)
+	fmt.Printf("split-ptrs:\t%v\n", header.SplitPtrs)
+	fmt.Printf("cipher:\t\t%v\n", header.Cipher)
+	fmt.Printf("hash:\t\t%v\n", header.Hash)
+	if header.KDF == (persistent.KDFParams{}) {
+		fmt.Println("kdf:\t\tnone, raw key")
+	} else {
+		fmt.Printf("kdf:\t\targon2id, time %v, memory %v KiB, threads %v\n", header.KDF.Time, header.KDF.Memory, header.KDF.Threads)
+	}
+	features := []string{}
+	if header.Features&persistent.FeatureInline != 0 {
+		features = append(features, "inline")
+	}
+	if header.Features&persistent.FeatureHoles != 0 {
+		features = append(features, "holes")
+	}
+	if header.Features&persistent.FeatureDedup != 0 {
+		features = append(features, "dedup")
+	}
+	if unknown := header.Features &^ persistent.KnownFeatures; unknown != 0 {
+		features = append(features, fmt.Sprintf("unknown %#x", unknown))
+	} else if len(features) == 0 {
+		features = append(features, "none")
+	}
+	fmt.Printf("features:\t%v\n", strings.Join(features, ", "))
+}
@@ -0,0 +1,155 @@
+// Command utahfs-ls prints the paths of everything in a UtahFS repository, or
+// under one directory of it, without mounting it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/fsutil"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+type lister struct {
+	fs   fuseutil.FileSystem
+	long bool
+}
+
+// print writes one line describing the entry at `name`.
+func (l *lister) print(ctx context.Context, name string, inode fuseops.InodeID, attrs fuseops.InodeAttributes) error {
+	if attrs.Mode&os.ModeSymlink != 0 {
+		link := &fuseops.ReadSymlinkOp{Inode: inode}
+		if err := l.fs.ReadSymlink(ctx, link); err != nil {
+			return fmt.Errorf("failed to read link %v: %v", name, err)
+		}
+		name += " -> " + link.Target
+	}
+	if !l.long {
+		fmt.Println(name)
+		return nil
+	}
+	fmt.Printf("%v %12v %v %v\n", attrs.Mode, attrs.Size, attrs.Mtime.Format(time.RFC3339), name)
+	return nil
+}
+
+// walk prints every entry under the directory `inode`, which is at `name`,
+// depth-first and in order of name.
+func (l *lister) walk(ctx context.Context, inode fuseops.InodeID, name string) error {
+	entries, err := fsutil.ReadDir(ctx, l.fs, inode)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", name, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name)
+		if err := l.print(ctx, child, entry.Inode, entry.Attributes); err != nil {
+			return err
+		} else if entry.Attributes.Mode.IsDir() {
+			if err := l.walk(ctx, entry.Inode, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookup returns the inode and attributes of the entry at `name`. Symlinks
+// aren't followed.
+func lookup(ctx context.Context, fs fuseutil.FileSystem, name string) (fuseops.InodeID, fuseops.InodeAttributes, error) {
+	root := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := fs.GetInodeAttributes(ctx, root); err != nil {
+		return 0, fuseops.InodeAttributes{}, err
+	}
+	inode, attrs := fuseops.InodeID(fuseops.RootInodeID), root.Attributes
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		} else if !attrs.Mode.IsDir() {
+			return 0, fuseops.InodeAttributes{}, fmt.Errorf("%v: not a directory", name)
+		}
+		op := &fuseops.LookUpInodeOp{Parent: inode, Name: part}
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			return 0, fuseops.InodeAttributes{}, fmt.Errorf("%v: %v", name, err)
+		}
+		inode, attrs = op.Entry.Child, op.Entry.Attributes
+	}
+	return inode, attrs, nil
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	long := flag.Bool("l", false, "Print the mode, size, and modification time of each entry.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [path]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	name := path.Clean("/" + flag.Arg(0))
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	bfs, closer, err := cfg.ReadOnlyFS("./")
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+	err = list(context.Background(), bfs, name, *long)
+	closer.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// list prints the entry at `name`, and everything under it if it's a
+// directory.
+func list(ctx context.Context, bfs *utahfs.BlockFilesystem, name string, long bool) error {
+	fs, err := utahfs.NewArchive(bfs)
+	if err == persistent.ErrReadOnly {
+		// The repository is empty, and its root directory can't be created
+		// without writing to it.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	inode, attrs, err := lookup(ctx, fs, name)
+	if err != nil {
+		return err
+	}
+	l := &lister{fs: fs, long: long}
+	if !attrs.Mode.IsDir() {
+		return l.print(ctx, name, inode, attrs)
+	}
+	return l.walk(ctx, inode, name)
+}
@@ -0,0 +1,53 @@
+// Command utahfs-pin prints the state of the integrity tree that a client has
+// pinned locally, so that it can be compared against remote storage
+// out-of-band. With -accept-remote, it replaces the pin with the state of the
+// tree in remote storage instead, after remote storage has diverged from it.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	mountPath := flag.String("mount", "./utahfs", "Location the client mounts the filesystem.")
+	acceptRemote := flag.Bool("accept-remote", false, "Pin the current state of remote storage, discarding the WAL and local caches. The client must not be running.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	var pin *persistent.Pin
+	if *acceptRemote {
+		pin, err = cfg.AcceptRemote(context.Background(), *mountPath)
+	} else {
+		pin, err = cfg.ReadPin(*mountPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Version: %v\n", pin.Version)
+	fmt.Printf("Nodes:   %v\n", pin.Nodes)
+	fmt.Printf("Hash:    %v\n", hex.EncodeToString(pin.Hash))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// amzDateFormat is the format of the X-Amz-Date header.
+	amzDateFormat = "20060102T150405Z"
+	// maxClockSkew is how far the time a request was signed may be from the
+	// gateway's clock, like S3 allows.
+	maxClockSkew = 15 * time.Minute
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// authenticator checks the AWS Signature Version 4 in the Authorization header
+// of each request. There's only one set of credentials, and requests may be
+// signed for any region.
+type authenticator struct {
+	accessKey, secretKey string
+
+	now func() time.Time
+}
+
+func (a *authenticator) check(req *http.Request) *s3Error {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		if req.URL.Query().Get("X-Amz-Algorithm") != "" {
+			return &s3Error{http.StatusNotImplemented, "NotImplemented", "Presigned URLs are not supported."}
+		}
+		return &s3Error{http.StatusForbidden, "AccessDenied", "Anonymous access is not allowed."}
+	} else if !strings.HasPrefix(header, "AWS4-HMAC-SHA256 ") {
+		return errMalformedAuth
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(header[len("AWS4-HMAC-SHA256 "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return errMalformedAuth
+		}
+		fields[kv[0]] = kv[1]
+	}
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[4] != "aws4_request" || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return errMalformedAuth
+	} else if cred[0] != a.accessKey {
+		return &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist."}
+	}
+
+	amzDate := req.Header.Get("X-Amz-Date")
+	signed, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil || amzDate[:8] != cred[1] {
+		return errMalformedAuth
+	} else if skew := a.now().Sub(signed); skew > maxClockSkew || skew < -maxClockSkew {
+		return &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	}
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return &s3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header x-amz-content-sha256."}
+	} else if strings.HasPrefix(payloadHash, "STREAMING-") {
+		return &s3Error{http.StatusNotImplemented, "NotImplemented", "Chunked uploads are not supported."}
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	expected := a.signature(req, amzDate, cred[2], cred[3], signedHeaders, payloadHash)
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match."}
+	}
+	return nil
+}
+
+// checkPayload returns an error if the request was signed with the hash of a
+// body other than `body`.
+func (a *authenticator) checkPayload(req *http.Request, body []byte) *s3Error {
+	claimed := req.Header.Get("X-Amz-Content-Sha256")
+	if claimed == unsignedPayload {
+		return nil
+	} else if hash := sha256.Sum256(body); claimed != hex.EncodeToString(hash[:]) {
+		return &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match the body."}
+	}
+	return nil
+}
+
+// signature returns the hex-encoded signature of `req`, computed the way that S3
+// does, over the headers in `signedHeaders`.
+func (a *authenticator) signature(req *http.Request, amzDate, region, service string, signedHeaders []string, payloadHash string) string {
+	headers := make([]string, 0, len(signedHeaders))
+	for _, name := range signedHeaders {
+		var vals []string
+		switch name {
+		case "host":
+			vals = []string{req.Host}
+		case "content-length":
+			vals = []string{strconv.FormatInt(req.ContentLength, 10)}
+		default:
+			vals = req.Header.Values(name)
+		}
+		trimmed := make([]string, 0, len(vals))
+		for _, val := range vals {
+			trimmed = append(trimmed, strings.Join(strings.Fields(val), " "))
+		}
+		headers = append(headers, name+":"+strings.Join(trimmed, ",")+"\n")
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req),
+		strings.Join(headers, ""),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := fmt.Sprintf("%v/%v/%v/aws4_request", date, region, service)
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + a.secretKey)
+	for _, part := range []string{date, region, service, "aws4_request", toSign} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(key)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query string of `req` with its parameters sorted
+// and encoded, as it's included in the string that's signed.
+func canonicalQuery(req *http.Request) string {
+	params := make([][2]string, 0)
+	for key, vals := range req.URL.Query() {
+		for _, val := range vals {
+			params = append(params, [2]string{uriEncode(key, true), uriEncode(val, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+
+	out := make([]string, 0, len(params))
+	for _, param := range params {
+		out = append(out, param[0]+"="+param[1])
+	}
+	return strings.Join(out, "&")
+}
+
+// uriEncode percent-encodes every byte of `s` except the unreserved characters,
+// and slashes unless `encodeSlash` is true.
+func uriEncode(s string, encodeSlash bool) string {
+	out := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/internal/logging"
+)
+
+// s3Error is an error, as it's returned to S3 clients.
+type s3Error struct {
+	status        int
+	code, message string
+}
+
+var (
+	errMalformedAuth = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errNoSuchBucket  = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errNoSuchKey     = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errAccessDenied  = &s3Error{http.StatusForbidden, "AccessDenied", "Objects can't be overwritten or deleted in archive mode."}
+	errInvalidKey    = &s3Error{http.StatusBadRequest, "InvalidArgument", "The key is not a valid path, or conflicts with an existing object."}
+	errInternal      = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+)
+
+// maxListKeys is the most keys that are returned by one request to list a
+// bucket, which is also S3's limit.
+const maxListKeys = 1000
+
+// Gateway serves the files in a UtahFS volume as the objects of a single bucket,
+// with a subset of the S3 API: listing, getting, putting, and deleting objects,
+// without multipart uploads. The key of each object is the path of the file,
+// and directories are created and listed as needed.
+type Gateway struct {
+	v      *utahfs.Volume
+	bucket string
+	auth   *authenticator
+
+	// archive is true if objects may be added but not overwritten or deleted,
+	// like in a FUSE mount in archive mode.
+	archive bool
+	// maxObjectSize is the largest object that may be put, in bytes. Each
+	// object is held in memory until its body has been checked against the
+	// hash it was signed with.
+	maxObjectSize int64
+
+	// mu is held while a request changes or lists the volume, since that
+	// takes several transactions and a Volume doesn't stop them from
+	// interleaving. It isn't held while a request's body is read, or while
+	// an object is sent, so that a slow client doesn't hold up the others.
+	// Each read of an object is its own transaction, so an object that's
+	// overwritten while it's being sent may be sent partly old and partly new.
+	// If it's deleted, reads fail instead of returning whatever object reuses
+	// its inode, and the response is cut short.
+	mu sync.Mutex
+}
+
+func (g *Gateway) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if err := g.auth.check(req); err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	var err *s3Error
+	if bucket == "" && req.Method == "GET" {
+		err = g.listBuckets(rw)
+	} else if bucket != g.bucket {
+		err = errNoSuchBucket
+	} else if key == "" && req.Method == "GET" {
+		err = g.listObjects(rw, req)
+	} else if key == "" && req.Method == "HEAD" {
+		rw.WriteHeader(http.StatusOK)
+	} else if key != "" && (req.Method == "GET" || req.Method == "HEAD") {
+		err = g.getObject(rw, req, key)
+	} else if key != "" && req.Method == "PUT" {
+		err = g.putObject(rw, req, key)
+	} else if key != "" && req.Method == "DELETE" {
+		err = g.deleteObject(rw, key)
+	} else {
+		err = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	}
+	if err != nil {
+		writeError(rw, req, err)
+	}
+}
+
+type bucketsResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+type owner struct {
+	ID, DisplayName string
+}
+
+type bucketEntry struct {
+	Name         string
+	CreationDate string
+}
+
+func (g *Gateway) listBuckets(rw http.ResponseWriter) *s3Error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fi, err := g.v.Stat("")
+	if err != nil {
+		return fsError(err)
+	}
+	return writeXML(rw, &bucketsResult{
+		Owner:   owner{"utahfs", "utahfs"},
+		Buckets: []bucketEntry{{g.bucket, formatTime(fi.ModTime())}},
+	})
+}
+
+type listResult struct {
+	XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string
+	Prefix      string
+	Delimiter   string `xml:",omitempty"`
+	MaxKeys     int
+	IsTruncated bool
+
+	// Marker and NextMarker are only set by version 1 of ListObjects, and the
+	// rest of these by version 2.
+	Marker                string `xml:",omitempty"`
+	NextMarker            string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+
+	Contents       []objectEntry
+	CommonPrefixes []prefixEntry
+}
+
+type objectEntry struct {
+	Key          string
+	LastModified string
+	Size         int64
+	StorageClass string
+}
+
+type prefixEntry struct {
+	Prefix string
+}
+
+// listObjects implements both versions of ListObjects. The only delimiter that's
+// supported is a slash, which lists the directories under the prefix instead
+// of their contents.
+func (g *Gateway) listObjects(rw http.ResponseWriter, req *http.Request) *s3Error {
+	query := req.URL.Query()
+	res := &listResult{
+		Name:      g.bucket,
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		MaxKeys:   maxListKeys,
+	}
+	if res.Delimiter != "" && res.Delimiter != "/" {
+		return &s3Error{http.StatusNotImplemented, "NotImplemented", "The only supported delimiter is a slash."}
+	} else if max := query.Get("max-keys"); max != "" {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer."}
+		} else if n < res.MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+	v2 := query.Get("list-type") == "2"
+	after := query.Get("marker")
+	if v2 {
+		res.StartAfter, res.ContinuationToken = query.Get("start-after"), query.Get("continuation-token")
+		if after = res.StartAfter; res.ContinuationToken != "" {
+			after = res.ContinuationToken
+		}
+	} else {
+		res.Marker = after
+	}
+
+	// Everything under the prefix is in the directory that contains it.
+	dir := res.Prefix[:strings.LastIndex(res.Prefix, "/")+1]
+	entries := make([]listEntry, 0)
+	g.mu.Lock()
+	err := g.walk(dir, res.Delimiter == "", &entries)
+	g.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.key, res.Prefix) || entry.key <= after {
+			continue
+		} else if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			break
+		}
+		if entry.fi.IsDir() {
+			res.CommonPrefixes = append(res.CommonPrefixes, prefixEntry{entry.key})
+		} else {
+			res.Contents = append(res.Contents, objectEntry{
+				Key:          entry.key,
+				LastModified: formatTime(entry.fi.ModTime()),
+				Size:         entry.fi.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+		res.KeyCount++
+		if v2 {
+			res.NextContinuationToken = entry.key
+		} else {
+			res.NextMarker = entry.key
+		}
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken, res.NextMarker = "", ""
+	}
+	return writeXML(rw, res)
+}
+
+// listEntry is a regular file, or a directory with a trailing slash on its key.
+type listEntry struct {
+	key string
+	fi  os.FileInfo
+}
+
+// walk appends the entries of the directory `dir` to `out`, and the entries of
+// its subdirectories if `recurse` is true. Anything other than regular files
+// and directories is skipped, and a directory that doesn't exist is empty.
+func (g *Gateway) walk(dir string, recurse bool, out *[]listEntry) *s3Error {
+	fis, err := g.v.ReadDir(dir)
+	if os.IsNotExist(err) || isErrno(err, syscall.ENOTDIR) {
+		return nil
+	} else if err != nil {
+		return fsError(err)
+	}
+	for _, fi := range fis {
+		key := dir + fi.Name()
+		if fi.Mode().IsRegular() {
+			*out = append(*out, listEntry{key, fi})
+		} else if fi.IsDir() && recurse {
+			if err := g.walk(key+"/", true, out); err != nil {
+				return err
+			}
+		} else if fi.IsDir() {
+			*out = append(*out, listEntry{key + "/", fi})
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) getObject(rw http.ResponseWriter, req *http.Request, key string) *s3Error {
+	g.mu.Lock()
+	f, err := g.v.Open(key)
+	if err != nil {
+		g.mu.Unlock()
+		return fsError(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	g.mu.Unlock()
+	if err != nil {
+		return fsError(err)
+	}
+
+	ctype := mime.TypeByExtension(path.Ext(key))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	rw.Header().Set("Content-Type", ctype)
+	http.ServeContent(rw, req, key, fi.ModTime(), f)
+	return nil
+}
+
+func (g *Gateway) putObject(rw http.ResponseWriter, req *http.Request, key string) *s3Error {
+	if req.ContentLength > g.maxObjectSize {
+		return &s3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, g.maxObjectSize+1))
+	if err != nil {
+		return &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body could not be read."}
+	} else if int64(len(data)) > g.maxObjectSize {
+		return &s3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	} else if err := g.auth.checkPayload(req, data); err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	if claimed := req.Header.Get("Content-MD5"); claimed != "" && claimed != base64.StdEncoding.EncodeToString(sum[:]) {
+		return &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// A key with a trailing slash is a directory, like the ones that S3 clients
+	// create to represent empty folders.
+	if strings.HasSuffix(key, "/") {
+		if err := g.mkdirAll(key); err != nil {
+			return err
+		}
+		rw.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if g.archive {
+		if _, err := g.v.Stat(key); err == nil {
+			return errAccessDenied
+		}
+	}
+	if err := g.mkdirAll(path.Dir(key)); err != nil {
+		return err
+	}
+	// The object is replaced in one transaction, so that a failure can't leave
+	// it empty or half-written.
+	if err := g.v.WriteFile(key, data); isErrno(err, syscall.EISDIR) || isErrno(err, syscall.ENOTDIR) {
+		return errInvalidKey
+	} else if err != nil {
+		return fsError(err)
+	}
+
+	rw.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// mkdirAll creates the directory `dir`, and any of its parents that don't exist.
+func (g *Gateway) mkdirAll(dir string) *s3Error {
+	curr := ""
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		curr = path.Join(curr, part)
+		if err := g.v.Mkdir(curr); err != nil && !os.IsExist(err) {
+			return fsError(err)
+		}
+	}
+	return nil
+}
+
+// deleteObject removes the file at `key`. Like S3, it succeeds if there's
+// nothing to remove. Directories that are left empty aren't removed.
+func (g *Gateway) deleteObject(rw http.ResponseWriter, key string) *s3Error {
+	if g.archive {
+		return errAccessDenied
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fi, err := g.v.Stat(key)
+	if err == nil && (fi.IsDir() == strings.HasSuffix(key, "/")) {
+		err = g.v.Remove(key)
+	}
+	if err != nil && !os.IsNotExist(err) && !isErrno(err, syscall.ENOTDIR) && !isErrno(err, syscall.ENOTEMPTY) {
+		return fsError(err)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// fsError translates an error from the volume into one for the client.
+func fsError(err error) *s3Error {
+	if os.IsNotExist(err) || isErrno(err, syscall.EISDIR) || isErrno(err, syscall.ENOTDIR) {
+		return errNoSuchKey
+	} else if isErrno(err, syscall.EINVAL) || isErrno(err, syscall.ENAMETOOLONG) || isErrno(err, syscall.EEXIST) {
+		return errInvalidKey
+	}
+	logging.Errorf("s3gateway: %v", err)
+	return errInternal
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == errno
+}
+
+func formatTime(t time.Time) string { return t.UTC().Format("2006-01-02T15:04:05.000Z") }
+
+func writeXML(rw http.ResponseWriter, v interface{}) *s3Error {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		logging.Errorf("s3gateway: failed to marshal response: %v", err)
+		return errInternal
+	}
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.Write([]byte(xml.Header))
+	rw.Write(out)
+	return nil
+}
+
+type errorResult struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+func writeError(rw http.ResponseWriter, req *http.Request, err *s3Error) {
+	out, _ := xml.Marshal(&errorResult{Code: err.code, Message: err.message, Resource: req.URL.Path})
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(err.status)
+	if req.Method != "HEAD" {
+		rw.Write([]byte(xml.Header))
+		rw.Write(out)
+	}
+}
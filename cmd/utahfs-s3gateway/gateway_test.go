@@ -0,0 +1,213 @@
+package main
+
+import (
+	"testing"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+var testTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func testGateway(t *testing.T, archive bool) *Gateway {
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := utahfs.NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := utahfs.NewVolume(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Gateway{
+		v:      v,
+		bucket: "bucket",
+		auth:   &authenticator{"access", "secret", func() time.Time { return testTime }},
+
+		archive:       archive,
+		maxObjectSize: 1024,
+	}
+}
+
+// testRequest signs a request the way that S3 clients do, sends it to `g`, and
+// returns the response.
+func testRequest(g *Gateway, method, target, body string) *http.Response {
+	req := httptest.NewRequest(method, "http://localhost"+target, strings.NewReader(body))
+	testSign(req, body)
+
+	rw := httptest.NewRecorder()
+	g.ServeHTTP(rw, req)
+	return rw.Result()
+}
+
+// testSign signs `req` the way that S3 clients do, as having the body `body`.
+func testSign(req *http.Request, body string) {
+	hash := sha256.Sum256([]byte(body))
+	req.Header.Set("X-Amz-Date", testTime.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	client := &authenticator{secretKey: "secret"}
+	sig := client.signature(req, testTime.Format(amzDateFormat), "us-east-1", "s3", signed, hex.EncodeToString(hash[:]))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=access/%v/us-east-1/s3/aws4_request, SignedHeaders=%v, Signature=%v",
+		testTime.Format("20060102"), strings.Join(signed, ";"), sig))
+}
+
+func testBody(t *testing.T, resp *http.Response) string {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestAuth(t *testing.T) {
+	g := testGateway(t, false)
+
+	if resp := testRequest(g, "GET", "/bucket?list-type=2", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.StatusCode)
+	}
+	rw := httptest.NewRecorder()
+	g.ServeHTTP(rw, httptest.NewRequest("GET", "http://localhost/bucket", nil))
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("expected anonymous request to be rejected, got: %v", rw.Code)
+	}
+
+	g.auth.secretKey = "wrong"
+	if resp := testRequest(g, "GET", "/bucket", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected wrong signature to be rejected, got: %v", resp.StatusCode)
+	}
+	g.auth.secretKey = "secret"
+	g.auth.now = func() time.Time { return testTime.Add(time.Hour) }
+	if resp := testRequest(g, "GET", "/bucket", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected old request to be rejected, got: %v", resp.StatusCode)
+	}
+}
+
+func TestObjects(t *testing.T) {
+	g := testGateway(t, false)
+
+	for _, key := range []string{"a.txt", "docs/b.txt", "docs/sub/c.txt", "e e+f.txt"} {
+		target := (&url.URL{Path: "/bucket/" + key}).EscapedPath()
+		if resp := testRequest(g, "PUT", target, "hello "+key); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status putting %v: %v: %v", key, resp.StatusCode, testBody(t, resp))
+		}
+	}
+	if resp := testRequest(g, "GET", "/bucket/docs/sub/c.txt", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.StatusCode)
+	} else if body := testBody(t, resp); body != "hello docs/sub/c.txt" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	if resp := testRequest(g, "GET", "/bucket/docs", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected directory to not be an object, got: %v", resp.StatusCode)
+	} else if resp := testRequest(g, "PUT", "/bucket/a.txt/d", "x"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected key under a file to be rejected, got: %v", resp.StatusCode)
+	} else if resp := testRequest(g, "PUT", "/bucket/big", strings.Repeat("x", 2000)); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected large object to be rejected, got: %v", resp.StatusCode)
+	}
+
+	list := func(query string) listResult {
+		resp := testRequest(g, "GET", "/bucket?"+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %v", resp.StatusCode)
+		}
+		res := listResult{}
+		if err := xml.Unmarshal([]byte(testBody(t, resp)), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	keys := func(res listResult) string {
+		out := make([]string, 0)
+		for _, obj := range res.Contents {
+			out = append(out, obj.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			out = append(out, p.Prefix)
+		}
+		return strings.Join(out, ",")
+	}
+	if res := list("list-type=2"); keys(res) != "a.txt,docs/b.txt,docs/sub/c.txt,e e+f.txt" {
+		t.Fatalf("unexpected listing: %v", keys(res))
+	} else if res := list("list-type=2&delimiter=/"); keys(res) != "a.txt,e e+f.txt,docs/" {
+		t.Fatalf("unexpected listing: %v", keys(res))
+	} else if res := list("list-type=2&prefix=docs/s"); keys(res) != "docs/sub/c.txt" {
+		t.Fatalf("unexpected listing: %v", keys(res))
+	}
+	res := list("list-type=2&max-keys=2")
+	if keys(res) != "a.txt,docs/b.txt" || !res.IsTruncated {
+		t.Fatalf("unexpected listing: %v %v", keys(res), res.IsTruncated)
+	}
+	res = list("list-type=2&max-keys=2&continuation-token=" + res.NextContinuationToken)
+	if keys(res) != "docs/sub/c.txt,e e+f.txt" || res.IsTruncated {
+		t.Fatalf("unexpected listing: %v %v", keys(res), res.IsTruncated)
+	}
+
+	if resp := testRequest(g, "DELETE", "/bucket/docs/b.txt", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %v", resp.StatusCode)
+	} else if resp := testRequest(g, "DELETE", "/bucket/docs/b.txt", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected deleting a missing object to succeed, got: %v", resp.StatusCode)
+	} else if resp := testRequest(g, "GET", "/bucket/docs/b.txt", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected deleted object to be gone, got: %v", resp.StatusCode)
+	}
+}
+
+func TestSlowUpload(t *testing.T) {
+	g := testGateway(t, false)
+	if resp := testRequest(g, "PUT", "/bucket/a.txt", "a"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.StatusCode)
+	}
+
+	// An upload whose body hasn't arrived yet shouldn't stop other requests.
+	pr, pw := io.Pipe()
+	req := httptest.NewRequest("PUT", "http://localhost/bucket/b.txt", pr)
+	testSign(req, "b")
+	done := make(chan int)
+	go func() {
+		rw := httptest.NewRecorder()
+		g.ServeHTTP(rw, req)
+		done <- rw.Code
+	}()
+
+	if resp := testRequest(g, "GET", "/bucket/a.txt", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.StatusCode)
+	} else if body := testBody(t, resp); body != "a" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	if resp := testRequest(g, "GET", "/bucket?list-type=2", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.StatusCode)
+	}
+
+	pw.Write([]byte("b"))
+	pw.Close()
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", code)
+	}
+	if body := testBody(t, testRequest(g, "GET", "/bucket/b.txt", "")); body != "b" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestArchiveGateway(t *testing.T) {
+	g := testGateway(t, true)
+
+	if resp := testRequest(g, "PUT", "/bucket/a", "hello"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v", resp.StatusCode)
+	} else if resp := testRequest(g, "PUT", "/bucket/a", "world"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected overwrite to be rejected, got: %v", resp.StatusCode)
+	} else if resp := testRequest(g, "DELETE", "/bucket/a", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected delete to be rejected, got: %v", resp.StatusCode)
+	}
+}
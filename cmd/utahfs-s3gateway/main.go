@@ -0,0 +1,110 @@
+// Command utahfs-s3gateway provides access to a UtahFS repository through a
+// subset of the S3 API, so that tools which speak S3 can read and write files in
+// it without mounting it.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	serverAddr := flag.String("server-addr", "localhost:3006", "Address to serve the S3 API on.")
+	metricsAddr := flag.String("metrics-addr", "localhost:3007", "Address to serve metrics on.")
+	bucket := flag.String("bucket", "utahfs", "Name of the bucket that the repository is presented as.")
+	accessKey := flag.String("access-key", "utahfs", "Access key ID that requests must be signed with.")
+	secretKeyFile := flag.String("secret-key-file", "", "File containing the secret key that requests must be signed with. Default is the transport key of the remote server.")
+	maxObjectSize := flag.Int64("max-object-size", 128*1024*1024, "Largest object that may be uploaded, in bytes.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	if *bucket == "" || strings.Contains(*bucket, "/") {
+		log.Fatal("bucket must be non-empty, and can't contain a slash")
+	} else if *maxObjectSize <= 0 {
+		log.Fatal("max-object-size must be positive")
+	}
+
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	bfs, closer, err := cfg.FS("./")
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+	secretKey := ""
+	if *secretKeyFile != "" {
+		raw, err := ioutil.ReadFile(*secretKeyFile)
+		if err != nil {
+			log.Fatalf("failed to read secret key: %v", err)
+		}
+		secretKey = strings.TrimSpace(string(raw))
+	} else if cfg.RemoteServer != nil {
+		secretKey = cfg.RemoteServer.TransportKey
+	}
+	if secretKey == "" {
+		log.Fatal("no secret key: set -secret-key-file, or use a remote server with a transport key")
+	}
+	v, err := utahfs.NewVolume(bfs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &http.Server{
+		Addr: *serverAddr,
+		Handler: &Gateway{
+			v:      v,
+			bucket: *bucket,
+			auth:   &authenticator{accessKey: *accessKey, secretKey: secretKey, now: time.Now},
+
+			archive:       cfg.Archive,
+			maxObjectSize: *maxObjectSize,
+		},
+	}
+
+	go metrics(*metricsAddr)
+	done := make(chan struct{})
+	go func() {
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+		<-signalChan
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("failed to shut down gracefully: %v", err)
+		}
+		close(done)
+	}()
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	if err := closer.Close(); err != nil {
+		log.Fatalf("failed to close storage: %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Command utahfs-selftest checks that a client's storage provider works before
+// it's trusted with real data. It writes random blocks through the same layers
+// of encryption, integrity, and optionally ORAM that the client uses, under a
+// throwaway prefix, reads them back, checks that tampering with the stored
+// objects is detected, and then deletes everything it wrote.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+type selftest struct {
+	store  persistent.ObjectStorage // The storage provider, under the throwaway prefix.
+	dir    string                   // Temporary directory for the WAL, pin, and ORAM state.
+	key    persistent.Key
+	oram   bool
+	ostore persistent.ObliviousStorage
+
+	blocks map[uint64][]byte
+}
+
+// stack returns the layers of block storage that the client would set up on top
+// of `rel`.
+func (st *selftest) stack(rel persistent.ReliableStorage, size int) (persistent.BlockStorage, error) {
+	block := persistent.NewBufferedStorage(rel)
+	block, err := persistent.WithIntegrityKey(block, st.key, path.Join(st.dir, "pin.json"), 0)
+	if err != nil {
+		return nil, err
+	}
+	block = persistent.WithEncryptionKey(block, st.key)
+	if st.oram {
+		return persistent.WithORAM(block, st.ostore, int64(size))
+	}
+	return block, nil
+}
+
+// timed runs `fn` and prints how long it took, as the step called `name`.
+func timed(name string, fn func() error) error {
+	start := time.Now()
+	if err := fn(); err != nil {
+		fmt.Printf("%-20s FAILED\n", name)
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	fmt.Printf("%-20s %v\n", name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// objects checks that an object can be written, read, listed, and deleted
+// directly in the storage provider.
+func (st *selftest) objects(ctx context.Context) error {
+	data := make([]byte, 1024)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	} else if err := st.store.Set(ctx, "object", data, persistent.Content); err != nil {
+		return err
+	}
+	got, err := st.store.Get(ctx, "object")
+	if err != nil {
+		return err
+	} else if !bytes.Equal(got, data) {
+		return fmt.Errorf("object read back with different contents")
+	}
+	keys, err := st.store.List(ctx, "")
+	if err != nil {
+		return err
+	} else if len(keys) != 1 || keys[0] != "object" {
+		return fmt.Errorf("unexpected objects listed: %v", keys)
+	} else if err := st.store.Delete(ctx, "object"); err != nil {
+		return err
+	} else if _, err := st.store.Get(ctx, "object"); err != persistent.ErrObjectNotFound {
+		return fmt.Errorf("object still exists after being deleted: %v", err)
+	}
+	return nil
+}
+
+// write commits the random blocks through `block` in one transaction.
+func (st *selftest) write(ctx context.Context, block persistent.BlockStorage) error {
+	if _, err := block.Start(ctx, nil); err != nil {
+		return err
+	}
+	for ptr, data := range st.blocks {
+		if err := block.Set(ctx, ptr, data, persistent.Content); err != nil {
+			block.Rollback(ctx)
+			return err
+		}
+	}
+	return block.Commit(ctx)
+}
+
+// read checks that every block can be read back through `block` unchanged.
+func (st *selftest) read(ctx context.Context, block persistent.BlockStorage) error {
+	if _, err := block.Start(ctx, nil); err != nil {
+		return err
+	}
+	defer block.Rollback(ctx)
+
+	for ptr, data := range st.blocks {
+		got, err := block.Get(ctx, ptr)
+		if err != nil {
+			return fmt.Errorf("block %v: %v", ptr, err)
+		} else if !bytes.Equal(got, data) {
+			return fmt.Errorf("block %v read back with different contents", ptr)
+		}
+	}
+	return nil
+}
+
+// tamper flips a bit in every stored object, and then checks that reading the
+// blocks back through `block` fails. Reads that succeed must still return the
+// right contents; with ORAM, some blocks may be read from the local stash
+// without touching the tampered objects.
+func (st *selftest) tamper(ctx context.Context, block persistent.BlockStorage) error {
+	keys, err := st.store.List(ctx, "")
+	if err != nil {
+		return err
+	} else if len(keys) == 0 {
+		return fmt.Errorf("no objects were stored")
+	}
+	for _, key := range keys {
+		data, err := st.store.Get(ctx, key)
+		if err != nil {
+			return err
+		} else if len(data) == 0 {
+			continue
+		}
+		data[len(data)/2] ^= 1
+		if err := st.store.Set(ctx, key, data, persistent.Unknown); err != nil {
+			return err
+		}
+	}
+
+	if _, err := block.Start(ctx, nil); err != nil {
+		return nil // Tampering was detected before any blocks were read.
+	}
+	defer block.Rollback(ctx)
+
+	detected := false
+	for ptr, data := range st.blocks {
+		got, err := block.Get(ctx, ptr)
+		if err != nil {
+			detected = true
+		} else if !bytes.Equal(got, data) {
+			return fmt.Errorf("block %v was tampered with, but read without error", ptr)
+		}
+	}
+	if !detected {
+		return fmt.Errorf("every block was read without error after tampering")
+	}
+	return nil
+}
+
+// cleanup deletes every object under the throwaway prefix.
+func (st *selftest) cleanup(ctx context.Context) error {
+	keys, err := st.store.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := st.store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *selftest) run(ctx context.Context, size int) error {
+	if err := timed("object storage", func() error { return st.objects(ctx) }); err != nil {
+		return err
+	}
+
+	// Write through a WAL, like the client does, and wait for it to drain.
+	wal, err := persistent.NewLocalWAL(st.store, path.Join(st.dir, "wal"), 128*1024, 1, false)
+	if err != nil {
+		return err
+	}
+	block, err := st.stack(wal, size)
+	if err != nil {
+		return err
+	}
+	if err := timed("commit to wal", func() error { return st.write(ctx, block) }); err != nil {
+		return err
+	} else if err := timed("drain wal", func() error { return persistent.FlushWAL(ctx, block) }); err != nil {
+		return err
+	}
+
+	// Read back without the WAL, so that everything comes from the storage
+	// provider.
+	block, err = st.stack(persistent.NewSimpleReliable(st.store), size)
+	if err != nil {
+		return err
+	} else if err := timed("read and verify", func() error { return st.read(ctx, block) }); err != nil {
+		return err
+	}
+	block, err = st.stack(persistent.NewSimpleReliable(st.store), size)
+	if err != nil {
+		return err
+	}
+	return timed("detect tampering", func() error { return st.tamper(ctx, block) })
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	numBlocks := flag.Int("blocks", 16, "Number of random blocks to write.")
+	blockSize := flag.Int("size", 32*1024, "Size of each random block, in bytes.")
+	oram := flag.Bool("oram", false, "Write the blocks through ORAM, even if the config file doesn't enable it.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	} else if cfg.RemoteServer != nil {
+		log.Fatal("the self-test checks a storage provider, and can't be run through a remote server")
+	} else if *numBlocks < 1 || *blockSize < 1 {
+		log.Fatal("blocks and size must be positive")
+	}
+	store, err := cfg.StorageProvider.Store()
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+
+	id := make([]byte, 8)
+	raw := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatal(err)
+	} else if _, err := rand.Read(raw); err != nil {
+		log.Fatal(err)
+	}
+	key, err := persistent.RawKey(raw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "utahfs-selftest")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prefix := "utahfs-selftest-" + hex.EncodeToString(id) + "/"
+
+	st := &selftest{
+		store:  persistent.NewPrefix(store, prefix),
+		dir:    dir,
+		key:    key,
+		oram:   *oram || cfg.ORAM,
+		blocks: make(map[uint64][]byte),
+	}
+	if st.oram {
+		if st.ostore, err = persistent.NewLocalOblivious(path.Join(dir, "oram")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for i := 0; i < *numBlocks; i++ {
+		data := make([]byte, *blockSize)
+		if _, err := rand.Read(data); err != nil {
+			log.Fatal(err)
+		}
+		st.blocks[uint64(i+1)] = data
+	}
+
+	ctx := context.Background()
+	fmt.Printf("writing %v blocks of %v bytes under %v\n", *numBlocks, *blockSize, prefix)
+	runErr := st.run(ctx, *blockSize)
+	if err := timed("cleanup", func() error { return st.cleanup(ctx) }); err != nil {
+		log.Printf("objects may have been left under %v: %v", prefix, err)
+		if runErr == nil {
+			runErr = err
+		}
+	}
+	if runErr != nil {
+		os.RemoveAll(dir)
+		log.Fatal(runErr)
+	}
+	fmt.Println("self-test passed")
+}
@@ -6,11 +6,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+	"github.com/cloudflare/utahfs/internal/logging"
+	"github.com/cloudflare/utahfs/persistent"
 )
 
 func main() {
@@ -20,19 +29,63 @@ func main() {
 	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the server's config file.")
 	serverAddr := flag.String("server-addr", "0.0.0.0:3002", "Address to expose server on.")
 	metricsAddr := flag.String("metrics-addr", "localhost:3003", "Address to serve metrics on.")
+	logLevel := flag.String("log-level", "info", "Minimum level of messages to log: error, warn, info, or debug.")
+	logJSON := flag.Bool("log-json", false, "Log messages as JSON objects, one per line.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	if err := logging.Setup(*logLevel, *logJSON); err != nil {
+		log.Fatal(err)
+	}
+	logging.Info(version.String())
+
 	cfg, err := config.ServerFromFile(*configPath)
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
-	server, err := cfg.Server()
+	server, closer, err := cfg.Server()
 	if err != nil {
 		log.Fatalf("failed to initialize server: %v", err)
 	}
 	server.Addr = *serverAddr
+	probe, err := cfg.Probe()
+	if err != nil {
+		log.Fatalf("failed to initialize health check: %v", err)
+	}
+	hc := persistent.NewHealthCheck(probe, 5*time.Second)
 
-	log.Println("server successfully started")
-	go metrics(*metricsAddr)
-	log.Fatal(server.ListenAndServeTLS("", ""))
+	logging.Info("server successfully started")
+	go metrics(*metricsAddr, hc)
+	done := make(chan struct{})
+	go shutdownOnSignal(server, done)
+	if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	if err := closer.Close(); err != nil {
+		log.Fatalf("failed to close storage: %v", err)
+	}
+	logging.Info("server stopped")
+}
+
+// shutdownOnSignal stops `server` when the process is interrupted or
+// terminated, waiting a while for requests that are in progress to finish. It
+// closes `done` once the server has stopped, so that the storage can be closed.
+func shutdownOnSignal(server *http.Server, done chan struct{}) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	<-signalChan
+	logging.Info("received signal, shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logging.Errorf("failed to shut down server gracefully: %v", err)
+	}
+	close(done)
 }
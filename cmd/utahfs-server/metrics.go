@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/pprof"
 
+	"github.com/cloudflare/utahfs/cmd/internal/version"
 	"github.com/cloudflare/utahfs/persistent"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,16 +14,19 @@ import (
 )
 
 func init() {
+	prometheus.MustRegister(version.BuildInfo)
 	prometheus.MustRegister(persistent.AppStorageCommits)
 	prometheus.MustRegister(persistent.LocalWALSize)
 	prometheus.MustRegister(persistent.DiskCacheSize)
 	prometheus.MustRegister(persistent.B2Ops)
 	prometheus.MustRegister(persistent.GCSOps)
 	prometheus.MustRegister(persistent.S3Ops)
+	prometheus.MustRegister(persistent.VerifiedWrites)
 }
 
-// metrics registers metrics with Prometheus and starts the server.
-func metrics(addr string) {
+// metrics registers metrics with Prometheus and starts the server. Whether the
+// storage provider is reachable is reported at /healthz by `hc`.
+func metrics(addr string, hc *persistent.HealthCheck) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/" {
@@ -32,6 +36,7 @@ func metrics(addr string) {
 		}
 	})
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", hc)
 
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
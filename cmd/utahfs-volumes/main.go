@@ -0,0 +1,72 @@
+// Command utahfs-volumes lists the volumes stored under the prefix in a client's
+// config file, without mounting any of them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError) // Overwrite the fucking glog flags.
+	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+	log.Print(version.String())
+
+	cfg, err := config.ClientFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	} else if cfg.StorageProvider == nil {
+		log.Fatal("config file has no storage-provider section")
+	}
+	sp := *cfg.StorageProvider
+	sp.Volume = ""
+	store, err := sp.Store()
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %v", err)
+	}
+
+	keys, err := store.List(context.Background(), "")
+	if err != nil {
+		log.Fatalf("failed to list objects: %v", err)
+	}
+	// Objects of a volume are stored as "<volume>/<key>", while a repository
+	// that isn't in a volume stores its objects directly under the prefix.
+	counts := make(map[string]int)
+	for _, key := range keys {
+		name := ""
+		if i := strings.Index(key, "/"); i >= 0 {
+			name = key[:i]
+		}
+		counts[name]++
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" {
+			fmt.Printf("%v\t(no volume)\n", counts[name])
+		} else {
+			fmt.Printf("%v\t%v\n", counts[name], name)
+		}
+	}
+}
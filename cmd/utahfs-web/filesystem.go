@@ -2,58 +2,130 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
 	"time"
-	"unsafe"
+
+	"github.com/cloudflare/utahfs/cmd/internal/fsutil"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 )
 
+// maxSymlinks is the maximum number of symlinks that will be followed while
+// resolving a single path, before it's assumed that the path contains a loop.
+const maxSymlinks = 40
+
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
+
 type FileSystem struct {
 	fs fuseutil.FileSystem
+
+	// readaheadWorkers is the number of chunks of a file that are fetched ahead
+	// of the current position while it's read, or zero to only read on demand.
+	readaheadWorkers int
+	readaheadChunk   int64
 }
 
 func (fs *FileSystem) Open(name string) (http.File, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	if name == "/" {
-		op := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
-		if err := fs.fs.GetInodeAttributes(ctx, op); err != nil {
-			return nil, err
-		}
-		return &File{
-			fs: fs.fs,
+	inode, fi, err := fs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{
+		fs: fs.fs,
+
+		inode: inode,
+		fi:    fi,
+	}
+	if fs.readaheadWorkers > 0 && !fi.IsDir() {
+		f.ra = newPrefetcher(fs.fs, inode, fi.size, fs.readaheadChunk, fs.readaheadWorkers)
+	}
+	return f, nil
+}
 
-			inode: fuseops.RootInodeID,
-			fi:    newFileInfo("", op.Attributes),
-		}, nil
+// resolve walks `name` from the root of the repo, following any symlinks along
+// the way, and returns the inode and attributes of the final component.
+//
+// Symlinks are resolved relative to the directory containing them, and
+// absolute targets are resolved relative to the root of the repo. Traversal
+// never leaves the repo: going up from the root just stays at the root.
+func (fs *FileSystem) resolve(ctx context.Context, name string) (fuseops.InodeID, *FileInfo, error) {
+	root := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := fs.fs.GetInodeAttributes(ctx, root); err != nil {
+		return 0, nil, err
 	}
 
 	var (
-		inode = fuseops.InodeID(fuseops.RootInodeID)
-		fi    *FileInfo
+		parents = []fuseops.InodeID{} // Ancestors of the current inode.
+		inode   = fuseops.InodeID(fuseops.RootInodeID)
+		fi      = newFileInfo("", root.Attributes)
+
+		parts    = splitPath(name)
+		symlinks = 0
 	)
-	for _, part := range strings.Split(name, "/")[1:] {
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		if part == ".." {
+			if len(parents) > 0 {
+				inode = parents[len(parents)-1]
+				parents = parents[:len(parents)-1]
+			}
+			op := &fuseops.GetInodeAttributesOp{Inode: inode}
+			if err := fs.fs.GetInodeAttributes(ctx, op); err != nil {
+				return 0, nil, err
+			}
+			fi = newFileInfo(part, op.Attributes)
+			continue
+		}
+
 		op := &fuseops.LookUpInodeOp{Parent: inode, Name: part}
 		if err := fs.fs.LookUpInode(ctx, op); err != nil {
-			return nil, err
+			return 0, nil, err
+		} else if op.Entry.Attributes.Mode&os.ModeSymlink == 0 {
+			parents = append(parents, inode)
+			inode = op.Entry.Child
+			fi = newFileInfo(part, op.Entry.Attributes)
+			continue
+		}
+
+		// Follow the symlink by replacing it with its target in the list of
+		// remaining path components.
+		symlinks++
+		if symlinks > maxSymlinks {
+			return 0, nil, errSymlinkLoop
 		}
-		inode = op.Entry.Child
-		fi = newFileInfo(part, op.Entry.Attributes)
+		link := &fuseops.ReadSymlinkOp{Inode: op.Entry.Child}
+		if err := fs.fs.ReadSymlink(ctx, link); err != nil {
+			return 0, nil, err
+		}
+		if strings.HasPrefix(link.Target, "/") {
+			parents, inode = parents[:0], fuseops.RootInodeID
+		}
+		parts = append(splitPath(link.Target), parts...)
 	}
 
-	return &File{
-		fs: fs.fs,
+	return inode, fi, nil
+}
 
-		inode: inode,
-		fi:    fi,
-	}, nil
+// splitPath returns the non-empty components of a slash-separated path.
+func splitPath(name string) []string {
+	out := make([]string, 0)
+	for _, part := range strings.Split(name, "/") {
+		if part != "" && part != "." {
+			out = append(out, part)
+		}
+	}
+	return out
 }
 
 type File struct {
@@ -62,17 +134,32 @@ type File struct {
 	inode fuseops.InodeID
 	fi    *FileInfo
 	pos   int64
+	ra    *prefetcher
 }
 
-func (f *File) Close() error { return nil }
+func (f *File) Close() error {
+	if f.ra != nil {
+		return f.ra.Close()
+	}
+	return nil
+}
 
 func (f *File) Read(p []byte) (int, error) {
-	if f.pos == f.fi.size {
+	if f.pos >= f.fi.size {
 		return 0, io.EOF
+	} else if rem := f.fi.size - f.pos; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	if f.ra != nil {
+		n, err := f.ra.ReadAt(p, f.pos)
+		f.pos += int64(n)
+		return n, err
 	}
 	op := &fuseops.ReadFileOp{Inode: f.inode, Offset: f.pos, Dst: p}
 	if err := f.fs.ReadFile(context.Background(), op); err != nil {
 		return 0, err
+	} else if op.BytesRead == 0 {
+		return 0, io.ErrUnexpectedEOF
 	}
 	f.pos += int64(op.BytesRead)
 	return op.BytesRead, nil
@@ -84,12 +171,14 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	} else if whence == io.SeekCurrent {
 		offset += f.pos
 	} else if whence == io.SeekEnd {
-		offset = f.fi.size - offset
+		offset += f.fi.size
 	} else {
 		return 0, fmt.Errorf("unexpected value for whence")
 	}
 
-	if offset > f.fi.size {
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek past beginning of file")
+	} else if offset > f.fi.size {
 		return 0, fmt.Errorf("cannot seek past end of file")
 	}
 	f.pos = offset
@@ -103,51 +192,13 @@ func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	open := &fuseops.OpenDirOp{Inode: f.inode}
-	if err := f.fs.OpenDir(ctx, open); err != nil {
+	children, err := fsutil.ReadDir(ctx, f.fs, f.inode)
+	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		release := &fuseops.ReleaseDirHandleOp{Handle: open.Handle}
-		f.fs.ReleaseDirHandle(ctx, release)
-	}()
-
-	entries := make([]os.FileInfo, 0)
-	for {
-		// Read the next chunk of entries from the directory.
-		dst := make([]byte, 2048)
-		op := &fuseops.ReadDirOp{
-			Inode:  f.inode,
-			Handle: open.Handle,
-
-			Offset: fuseops.DirOffset(len(entries)),
-			Dst:    dst,
-		}
-		if err := f.fs.ReadDir(ctx, op); err != nil {
-			return nil, err
-		} else if op.BytesRead == 0 {
-			break
-		}
-		dst = dst[:op.BytesRead]
-
-		// Parse the names returned.
-		for len(dst) > 0 {
-			var (
-				de  fuseutil.Dirent
-				err error
-			)
-			dst, de, err = parseDirent(dst)
-			if err != nil {
-				return nil, err
-			}
-
-			// Look up the full info for the entry and convert it to a FileInfo.
-			op := &fuseops.LookUpInodeOp{Parent: f.inode, Name: de.Name}
-			if err := f.fs.LookUpInode(ctx, op); err != nil {
-				return nil, err
-			}
-			entries = append(entries, newFileInfo(de.Name, op.Entry.Attributes))
-		}
+	entries := make([]os.FileInfo, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, newFileInfo(child.Name, child.Attributes))
 	}
 
 	return entries, nil
@@ -177,48 +228,3 @@ func (fi *FileInfo) Mode() os.FileMode  { return fi.mode }
 func (fi *FileInfo) ModTime() time.Time { return fi.modTime }
 func (fi *FileInfo) IsDir() bool        { return fi.Mode().IsDir() }
 func (fi *FileInfo) Sys() interface{}   { return nil }
-
-func parseDirent(buf []byte) ([]byte, fuseutil.Dirent, error) {
-	type fuse_dirent struct {
-		ino     uint64
-		off     uint64
-		namelen uint32
-		type_   uint32
-		name    [0]byte
-	}
-
-	const direntAlignment = 8
-	const direntSize = 8 + 8 + 4 + 4
-
-	if len(buf) < direntSize {
-		return nil, fuseutil.Dirent{}, fmt.Errorf("buffer is too short")
-	}
-	de := fuse_dirent{}
-
-	n := copy((*[direntSize]byte)(unsafe.Pointer(&de))[:], buf)
-	buf = buf[n:]
-
-	if len(buf) < int(de.namelen) {
-		return nil, fuseutil.Dirent{}, fmt.Errorf("buffer is too short")
-	}
-	name := string(buf[:de.namelen])
-	buf = buf[de.namelen:]
-
-	var padLen int
-	if len(name)%direntAlignment != 0 {
-		padLen = direntAlignment - (len(name) % direntAlignment)
-	}
-	if len(buf) < padLen {
-		return nil, fuseutil.Dirent{}, fmt.Errorf("buffer is too short")
-	}
-	buf = buf[padLen:]
-
-	return buf, fuseutil.Dirent{
-		Offset: fuseops.DirOffset(de.off),
-
-		Inode: fuseops.InodeID(de.ino),
-		Name:  name,
-
-		Type: fuseutil.DirentType(de.type_),
-	}, nil
-}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/cloudflare/utahfs"
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func testFilesystem(t *testing.T) fuseutil.FileSystem {
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := utahfs.NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := utahfs.NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func testFile(t *testing.T, fs fuseutil.FileSystem, parent fuseops.InodeID, name string, data []byte) fuseops.InodeID {
+	ctx := context.Background()
+
+	op := &fuseops.CreateFileOp{Parent: parent, Name: name, Mode: 0644}
+	if err := fs.CreateFile(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+	write := &fuseops.WriteFileOp{Inode: op.Entry.Child, Handle: op.Handle, Data: data}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	}
+	return op.Entry.Child
+}
+
+func testDir(t *testing.T, fs fuseutil.FileSystem, parent fuseops.InodeID, name string) fuseops.InodeID {
+	op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: os.ModeDir | 0755}
+	if err := fs.MkDir(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	return op.Entry.Child
+}
+
+func testSymlink(t *testing.T, fs fuseutil.FileSystem, parent fuseops.InodeID, name, target string) {
+	op := &fuseops.CreateSymlinkOp{Parent: parent, Name: name, Target: target}
+	if err := fs.CreateSymlink(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testGet(t *testing.T, h http.Handler, loc string, header http.Header) (int, []byte) {
+	req := httptest.NewRequest("GET", loc, nil)
+	for key, vals := range header {
+		req.Header[key] = vals
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	body, err := ioutil.ReadAll(rw.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rw.Code, body
+}
+
+func TestSymlinks(t *testing.T) {
+	fs := testFilesystem(t)
+
+	testFile(t, fs, fuseops.RootInodeID, "a.txt", []byte("hello"))
+	dir := testDir(t, fs, fuseops.RootInodeID, "dir")
+	testSymlink(t, fs, fuseops.RootInodeID, "link", "a.txt")
+	testSymlink(t, fs, dir, "up", "../a.txt")
+	testSymlink(t, fs, dir, "abs", "/dir/up")
+	testSymlink(t, fs, dir, "escape", "../../../../a.txt")
+	testSymlink(t, fs, fuseops.RootInodeID, "loop", "loop")
+	testSymlink(t, fs, fuseops.RootInodeID, "dangling", "nope")
+
+	h := NewHandler(&FileSystem{fs: fs}, false)
+	for _, loc := range []string{"/a.txt", "/link", "/dir/up", "/dir/abs", "/dir/escape"} {
+		code, body := testGet(t, h, loc, nil)
+		if code != http.StatusOK {
+			t.Fatalf("%v: unexpected status: %v", loc, code)
+		} else if string(body) != "hello" {
+			t.Fatalf("%v: unexpected body: %q", loc, body)
+		}
+	}
+	if code, _ := testGet(t, h, "/dangling", nil); code != http.StatusNotFound {
+		t.Fatalf("dangling link: unexpected status: %v", code)
+	}
+	if code, _ := testGet(t, h, "/loop", nil); code != http.StatusLoopDetected {
+		t.Fatalf("symlink loop: unexpected status: %v", code)
+	}
+}
+
+func TestListing(t *testing.T) {
+	fs := testFilesystem(t)
+
+	testFile(t, fs, fuseops.RootInodeID, "b.txt", make([]byte, 2048))
+	testFile(t, fs, fuseops.RootInodeID, "a.txt", []byte("hello"))
+	testDir(t, fs, fuseops.RootInodeID, "c")
+
+	code, body := testGet(t, NewHandler(&FileSystem{fs: fs}, false), "/", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", code)
+	}
+	a := strings.Index(string(body), ">a.txt<")
+	b := strings.Index(string(body), ">b.txt<")
+	c := strings.Index(string(body), ">c/<")
+	if a == -1 || b == -1 || c == -1 || !(a < b && b < c) {
+		t.Fatalf("listing is missing entries or is not sorted:\n%s", body)
+	} else if !strings.Contains(string(body), "5 B") || !strings.Contains(string(body), "2.0 KiB") {
+		t.Fatalf("listing is missing file sizes:\n%s", body)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := utahfs.NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := utahfs.NewArchive(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace a.txt twice, so that archive mode keeps both older versions.
+	testFile(t, fs, fuseops.RootInodeID, "a.txt", []byte("first"))
+	for _, data := range []string{"second", "third"} {
+		testFile(t, fs, fuseops.RootInodeID, "new", []byte(data))
+		op := &fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID, OldName: "new",
+			NewParent: fuseops.RootInodeID, NewName: "a.txt",
+		}
+		if err := fs.Rename(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testFile(t, fs, fuseops.RootInodeID, "a.txt.~x~", []byte("unrelated"))
+
+	h := NewHandler(&FileSystem{fs: fs}, false)
+	code, body := testGet(t, h, "/a.txt?versions", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", code)
+	}
+	cur := strings.Index(string(body), `href="a.txt"`)
+	two := strings.Index(string(body), `href="a.txt.~2~"`)
+	one := strings.Index(string(body), `href="a.txt.~1~"`)
+	if cur == -1 || two == -1 || one == -1 || !(cur < two && two < one) {
+		t.Fatalf("versions are missing or not newest first:\n%s", body)
+	} else if strings.Contains(string(body), "~x~") {
+		t.Fatalf("versions include an unrelated file:\n%s", body)
+	}
+
+	// Each version can be downloaded from its link.
+	for loc, expected := range map[string]string{"/a.txt": "third", "/a.txt.~2~": "second", "/a.txt.~1~": "first"} {
+		if code, body := testGet(t, h, loc, nil); code != http.StatusOK {
+			t.Fatalf("%v: unexpected status: %v", loc, code)
+		} else if string(body) != expected {
+			t.Fatalf("%v: unexpected body: %q", loc, body)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	fs := testFilesystem(t)
+
+	data := make([]byte, 1100*1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	testFile(t, fs, fuseops.RootInodeID, "big.bin", data)
+
+	h := NewHandler(&FileSystem{fs: fs}, false)
+	code, body := testGet(t, h, "/big.bin", http.Header{"Range": []string{"bytes=1000000-1000100"}})
+	if code != http.StatusPartialContent {
+		t.Fatalf("unexpected status: %v", code)
+	} else if !bytes.Equal(body, data[1000000:1000101]) {
+		t.Fatalf("unexpected body: got %v bytes", len(body))
+	}
+
+	code, body = testGet(t, h, "/big.bin", http.Header{"Range": []string{"bytes=-10"}})
+	if code != http.StatusPartialContent {
+		t.Fatalf("unexpected status: %v", code)
+	} else if !bytes.Equal(body, data[len(data)-10:]) {
+		t.Fatalf("unexpected body: got %v bytes", len(body))
+	}
+}
+
+func TestContentType(t *testing.T) {
+	fs := testFilesystem(t)
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+	testFile(t, fs, fuseops.RootInodeID, "image.png", png)
+	testFile(t, fs, fuseops.RootInodeID, "image", png)
+	testFile(t, fs, fuseops.RootInodeID, "empty", nil)
+
+	contentType := func(h http.Handler, loc string) string {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", loc, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("unexpected response status: %v", rw.Code)
+		}
+		return rw.Header().Get("Content-Type")
+	}
+
+	plain, sniff := NewHandler(&FileSystem{fs: fs}, false), NewHandler(&FileSystem{fs: fs}, true)
+	for _, tc := range []struct {
+		h        http.Handler
+		loc      string
+		expected string
+	}{
+		{plain, "/image.png", "image/png"},
+		{plain, "/image", "application/octet-stream"},
+		{sniff, "/image", "image/png"},
+		{sniff, "/empty", "text/plain; charset=utf-8"},
+	} {
+		if got := contentType(tc.h, tc.loc); got != tc.expected {
+			t.Fatalf("%v: expected content type %q, got %q", tc.loc, tc.expected, got)
+		}
+	}
+}
+
+func TestReadahead(t *testing.T) {
+	fs := testFilesystem(t)
+
+	data := make([]byte, 300*1000+7)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	testFile(t, fs, fuseops.RootInodeID, "big.bin", data)
+
+	wfs := &FileSystem{fs: fs, readaheadWorkers: 3, readaheadChunk: 10000}
+	h := NewHandler(wfs, false)
+	if code, body := testGet(t, h, "/big.bin", nil); code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", code)
+	} else if !bytes.Equal(body, data) {
+		t.Fatalf("unexpected body: got %v bytes", len(body))
+	}
+	code, body := testGet(t, h, "/big.bin", http.Header{"Range": []string{"bytes=123456-234567"}})
+	if code != http.StatusPartialContent {
+		t.Fatalf("unexpected status: %v", code)
+	} else if !bytes.Equal(body, data[123456:234568]) {
+		t.Fatalf("unexpected body: got %v bytes", len(body))
+	}
+
+	// Seeking backwards in the middle of a read should discard what was read
+	// ahead.
+	f, err := wfs.Open("/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buff := make([]byte, 25000)
+	if _, err := io.ReadFull(f, buff); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buff, data[:25000]) {
+		t.Fatal("unexpected data read")
+	}
+	if _, err := f.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(f, buff); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buff, data[5:25005]) {
+		t.Fatal("unexpected data read after seeking")
+	}
+}
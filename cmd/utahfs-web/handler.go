@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var listingTmpl = template.Must(template.New("listing").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<table>
+<tr><th align="left">Name</th><th align="right">Size</th><th align="left">Modified</th></tr>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Link}}">{{.Name}}</a></td><td align="right">{{.Size}}</td><td>{{.Modified}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+var versionsTmpl = template.Must(template.New("versions").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Versions of {{.Path}}</title></head>
+<body>
+<h1>Versions of {{.Path}}</h1>
+<table>
+<tr><th align="left">Name</th><th align="right">Size</th><th align="left">Modified</th></tr>
+{{- range .Entries}}
+<tr><td><a href="{{.Link}}">{{.Name}}</a></td><td align="right">{{.Size}}</td><td>{{.Modified}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+type listingEntry struct {
+	Name, Link     string
+	Size, Modified string
+}
+
+// Handler serves the contents of a FileSystem over HTTP.
+type Handler struct {
+	fs    *FileSystem
+	files http.Handler
+	sniff bool
+}
+
+// NewHandler returns a new Handler serving files from `fs`. Files are given a
+// Content-Type based on their extension. If `sniff` is true, files without a
+// recognized extension have their first 512 bytes read to detect one;
+// otherwise they're served as application/octet-stream.
+func NewHandler(fs *FileSystem, sniff bool) *Handler {
+	return &Handler{
+		fs:    fs,
+		files: http.FileServer(fs),
+		sniff: sniff,
+	}
+}
+
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Resolve the requested path first, so that errors which http.FileServer
+	// doesn't know about can be reported properly.
+	name := path.Clean("/" + req.URL.Path)
+	f, err := h.fs.Open(name)
+	if err == errSymlinkLoop {
+		http.Error(rw, "508 loop detected", http.StatusLoopDetected)
+		return
+	} else if os.IsNotExist(err) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(rw, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, "500 internal server error", http.StatusInternalServerError)
+		return
+	} else if fi.IsDir() && strings.HasSuffix(req.URL.Path, "/") {
+		h.serveListing(rw, name, f)
+		return
+	} else if _, ok := req.URL.Query()["versions"]; ok && !fi.IsDir() {
+		h.serveVersions(rw, name, fi)
+		return
+	} else if !fi.IsDir() {
+		// Setting the Content-Type here stops http.FileServer from sniffing
+		// every file itself.
+		rw.Header().Set("Content-Type", h.contentType(name, f))
+	}
+
+	h.files.ServeHTTP(rw, req)
+}
+
+// contentType returns the Content-Type to serve the file `f` with.
+func (h *Handler) contentType(name string, f http.File) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	} else if !h.sniff {
+		return "application/octet-stream"
+	}
+
+	buff := make([]byte, 512)
+	n, err := io.ReadFull(f, buff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Println(err)
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(buff[:n])
+}
+
+// serveListing writes a sorted, human-readable listing of the directory `f`.
+func (h *Handler) serveListing(rw http.ResponseWriter, name string, f http.File) {
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+
+	entries := make([]listingEntry, 0, len(fis))
+	for _, fi := range fis {
+		entry := listingEntry{
+			Name:     fi.Name(),
+			Link:     (&url.URL{Path: fi.Name()}).String(),
+			Size:     humanSize(fi.Size()),
+			Modified: fi.ModTime().Format(time.RFC1123),
+		}
+		if fi.IsDir() {
+			entry.Name += "/"
+			entry.Link += "/"
+			entry.Size = "-"
+		}
+		entries = append(entries, entry)
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = listingTmpl.Execute(rw, struct {
+		Path    string
+		Entries []listingEntry
+	}{name, entries})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// serveVersions writes a listing of the file `name` and of the older versions
+// of it that archive mode kept when it was replaced, newest first. Older
+// versions are the files next to it called "name.~N~".
+func (h *Handler) serveVersions(rw http.ResponseWriter, name string, current os.FileInfo) {
+	dir, err := h.fs.Open(path.Dir(name))
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer dir.Close()
+	fis, err := dir.Readdir(-1)
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	base := path.Base(name)
+	versions := make(map[int]os.FileInfo)
+	for _, fi := range fis {
+		if n, ok := backupNumber(base, fi.Name()); ok && fi.Mode().IsRegular() {
+			versions[n] = fi
+		}
+	}
+	nums := make([]int, 0, len(versions))
+	for n := range versions {
+		nums = append(nums, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(nums)))
+
+	entries := []listingEntry{versionEntry(base, current)}
+	for _, n := range nums {
+		entries = append(entries, versionEntry(versions[n].Name(), versions[n]))
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = versionsTmpl.Execute(rw, struct {
+		Path    string
+		Entries []listingEntry
+	}{name, entries})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func versionEntry(name string, fi os.FileInfo) listingEntry {
+	return listingEntry{
+		Name:     name,
+		Link:     (&url.URL{Path: name}).String(),
+		Size:     humanSize(fi.Size()),
+		Modified: fi.ModTime().Format(time.RFC1123),
+	}
+}
+
+// backupNumber returns N if `name` is "base.~N~", the name archive mode gives
+// to the Nth file that was replaced by one called `base`.
+func backupNumber(base, name string) (int, bool) {
+	if !strings.HasPrefix(name, base+".~") || !strings.HasSuffix(name, "~") {
+		return 0, false
+	}
+	num := strings.TrimSuffix(strings.TrimPrefix(name, base+".~"), "~")
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 || strconv.Itoa(n) != num {
+		return 0, false
+	}
+	return n, true
+}
+
+// humanSize formats a number of bytes with a binary unit suffix.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
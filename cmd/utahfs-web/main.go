@@ -2,13 +2,19 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cloudflare/utahfs"
 	"github.com/cloudflare/utahfs/cmd/internal/config"
+	"github.com/cloudflare/utahfs/cmd/internal/version"
 )
 
 func main() {
@@ -18,13 +24,28 @@ func main() {
 	configPath := flag.String("cfg", "./utahfs.yaml", "Location of the client's config file.")
 	serverAddr := flag.String("server-addr", "localhost:3004", "Address to serve data on.")
 	metricsAddr := flag.String("metrics-addr", "localhost:3005", "Address to serve metrics on.")
+	sniff := flag.Bool("sniff-content-type", false, "Read the start of files without a known extension to detect their Content-Type.")
+	workers := flag.Int("readahead-workers", 4, "Number of chunks of a file to fetch ahead of a download. Zero to disable.")
+	chunkSize := flag.Int64("readahead-chunk", 256*1024, "Size of each chunk fetched ahead of a download, in bytes.")
+	showVersion := flag.Bool("version", false, "Print the version of this build and exit.")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	if *workers < 0 || *chunkSize <= 0 {
+		log.Fatal("readahead-workers may not be negative, and readahead-chunk must be positive")
+	}
+
+	log.Print(version.String())
+
 	cfg, err := config.ClientFromFile(*configPath)
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
 	}
-	bfs, err := cfg.FS("./")
+	bfs, closer, err := cfg.FS("./")
 	if err != nil {
 		log.Fatalf("failed to initialize storage: %v", err)
 	}
@@ -35,9 +56,29 @@ func main() {
 
 	s := &http.Server{
 		Addr:    *serverAddr,
-		Handler: http.FileServer(&FileSystem{fs}),
+		Handler: NewHandler(&FileSystem{fs: fs, readaheadWorkers: *workers, readaheadChunk: *chunkSize}, *sniff),
 	}
 
 	go metrics(*metricsAddr)
-	log.Fatal(s.ListenAndServe())
+	done := make(chan struct{})
+	go func() {
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+		<-signalChan
+
+		// Let downloads that are in progress finish, but not forever.
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("failed to shut down gracefully: %v", err)
+		}
+		close(done)
+	}()
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	if err := closer.Close(); err != nil {
+		log.Fatalf("failed to close storage: %v", err)
+	}
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/pprof"
 
+	"github.com/cloudflare/utahfs/cmd/internal/version"
 	"github.com/cloudflare/utahfs/persistent"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,12 +14,14 @@ import (
 )
 
 func init() {
+	prometheus.MustRegister(version.BuildInfo)
 	prometheus.MustRegister(persistent.AppStorageCommits)
 	prometheus.MustRegister(persistent.LocalWALSize)
 	prometheus.MustRegister(persistent.DiskCacheSize)
 	prometheus.MustRegister(persistent.B2Ops)
 	prometheus.MustRegister(persistent.GCSOps)
 	prometheus.MustRegister(persistent.S3Ops)
+	prometheus.MustRegister(persistent.RemoteHandshakes)
 }
 
 // metrics registers metrics with Prometheus and starts the server.
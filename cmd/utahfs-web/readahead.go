@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/google/readahead"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// fileReader reads from a file in the filesystem, with the semantics of
+// io.ReaderAt.
+type fileReader struct {
+	fs    fuseutil.FileSystem
+	inode fuseops.InodeID
+	size  int64
+}
+
+func (fr *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= fr.size {
+		return 0, io.EOF
+	} else if rem := fr.size - off; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+
+	n := 0
+	for n < len(p) {
+		op := &fuseops.ReadFileOp{Inode: fr.inode, Offset: off + int64(n), Dst: p[n:]}
+		if err := fr.fs.ReadFile(context.Background(), op); err != nil {
+			return n, err
+		} else if op.BytesRead == 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += op.BytesRead
+	}
+	if off+int64(n) == fr.size {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// prefetcher reads a file in fixed-size chunks, fetching up to `workers` of the
+// chunks after the current position in the background. Reads that aren't
+// sequential throw away the chunks that have already been fetched, and start
+// reading ahead again from the new position.
+//
+// The filesystem only handles one operation at a time, so the fetches mostly
+// overlap with sending earlier chunks to the client rather than with each other.
+type prefetcher struct {
+	fr *fileReader
+
+	chunkSize int
+	workers   int
+
+	r   io.ReadCloser // r reads ahead from pos, or is nil if nothing has been read yet.
+	pos int64
+}
+
+func newPrefetcher(fs fuseutil.FileSystem, inode fuseops.InodeID, size, chunkSize int64, workers int) *prefetcher {
+	return &prefetcher{
+		fr: &fileReader{fs, inode, size},
+
+		chunkSize: int(chunkSize),
+		workers:   workers,
+	}
+}
+
+// ReadAt reads from the file at `pos`, which is expected to be where the
+// previous read ended.
+func (pf *prefetcher) ReadAt(p []byte, pos int64) (int, error) {
+	if pos >= pf.fr.size {
+		return 0, io.EOF
+	}
+	if pf.r == nil || pf.pos != pos {
+		pf.Close()
+		section := io.NewSectionReader(pf.fr, pos, pf.fr.size-pos)
+		pf.r = readahead.NewConcurrentReader("utahfs-web", section, pf.chunkSize, pf.workers, pf.workers)
+		pf.pos = pos
+	}
+
+	n, err := pf.r.Read(p)
+	pf.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	} else if err != nil && err != io.EOF {
+		// The reader returns the same error forever afterwards, so start over
+		// with the next read.
+		pf.Close()
+	}
+	return n, err
+}
+
+// Close stops any fetches that are still running, and waits for them to exit.
+func (pf *prefetcher) Close() error {
+	if pf.r != nil {
+		pf.r.Close()
+		pf.r = nil
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package utahfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Compact moves every block that's in use into a dense range of pointers
+// starting from zero, and deletes everything else: the trash, and the gaps left
+// by it. Pointers in skiplists, inodes, and the dedup index are rewritten to
+// match, the root ends up at pointer zero, and the integrity tree is shrunk to
+// the new number of blocks.
+//
+// It all happens in one transaction, which has to be buffered in memory, so it
+// shouldn't be used with an AppStorage that commits transactions early. Inode
+// numbers change, so the filesystem mustn't be mounted while it runs. It
+// returns the number of blocks that were allocated before and after.
+func Compact(ctx context.Context, bfs *BlockFilesystem) (before, after uint64, err error) {
+	if err := CheckFilesystem(ctx, bfs); err != nil {
+		return 0, 0, err
+	}
+	nm := newNodeManager(bfs, 128, 0, 0, nil, nil)
+	if err := nm.Start(ctx); err != nil {
+		return 0, 0, err
+	}
+	defer nm.Rollback(ctx)
+
+	state, err := nm.State(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = state.NextPtr
+
+	// Decide where the first block of each file will be moved to, so that
+	// pointers to files can be rewritten before their blocks are moved.
+	remap := make(map[uint64]uint64)
+	moves := make([]uint64, 0)              // moves[new] is the old pointer of the block moved to new.
+	types := make([]persistent.DataType, 0) // types[new] is the type of data in the block moved to new.
+	assign := func(ptr uint64, dt persistent.DataType) {
+		if _, ok := remap[ptr]; !ok {
+			remap[ptr] = uint64(len(moves))
+			moves = append(moves, ptr)
+			types = append(types, dt)
+		}
+	}
+
+	nodes := make([]*node, 0)
+	if state.RootPtr != nilPtr {
+		queue := []uint64{state.RootPtr}
+		for len(queue) > 0 {
+			ptr := queue[0]
+			queue = queue[1:]
+			if _, ok := remap[ptr]; ok {
+				continue
+			}
+			assign(ptr, persistent.Metadata)
+
+			nd, err := nm.Open(ctx, ptr)
+			if err != nil {
+				return 0, 0, fmt.Errorf("utahfs: inode %v: %v", ptr-state.RootPtr+1, err)
+			}
+			nodes = append(nodes, nd)
+
+			names := make([]string, 0, len(nd.Children))
+			for name := range nd.Children {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				queue = append(queue, uint64(nd.Children[name])+state.RootPtr-1)
+			}
+		}
+	}
+	for _, nd := range nodes {
+		if nd.Data != nilPtr {
+			assign(nd.Data, persistent.Content)
+		}
+	}
+	var idx *persistent.DedupIndex
+	if state.DedupPtr != 0 {
+		assign(state.DedupPtr-1, persistent.Metadata)
+		if idx, err = bfs.index(ctx, false); err != nil {
+			return 0, 0, err
+		}
+		err = idx.Range(func(ptr, refs uint64) error {
+			assign(ptr, persistent.Content)
+			return nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("utahfs: dedup index: %v", err)
+		}
+	}
+
+	// Rewrite the pointers to files in place. Inode numbers are derived from
+	// pointers, and the root is moving to zero.
+	for _, nd := range nodes {
+		if nd.Data != nilPtr {
+			nd.Data = remap[nd.Data]
+		}
+		for name, id := range nd.Children {
+			nd.Children[name] = fuseops.InodeID(remap[uint64(id)+state.RootPtr-1] + 1)
+		}
+		if err := nd.Persist(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if idx != nil {
+		err = idx.Remap(func(ptr uint64) (uint64, error) { return remap[ptr], nil })
+		if err != nil {
+			return 0, 0, fmt.Errorf("utahfs: dedup index: %v", err)
+		}
+	}
+
+	// Find the rest of the blocks of each file. The skiplists of inodes may
+	// have been rearranged by persisting them, so this has to happen after.
+	files := len(moves)
+	for i := 0; i < files; i++ {
+		bf := &BlockFile{parent: bfs, ctx: ctx, start: moves[i], dt: types[i]}
+		ptr := moves[i]
+		for {
+			if err := bf.load(ptr, 0, false); err != nil {
+				return 0, 0, fmt.Errorf("blockfs: block %x: %v", ptr, err)
+			}
+			ptr = nextPtr(bf.curr.ptrs[0])
+			if ptr == nilPtr {
+				break
+			} else if _, ok := remap[ptr]; ok {
+				return 0, 0, fmt.Errorf("blockfs: block %x is used more than once", ptr)
+			}
+			assign(ptr, types[i])
+		}
+	}
+
+	// Read every block before writing any, because each may be overwritten by
+	// another being moved.
+	keys := make([]uint64, 0, 2*len(moves))
+	for _, ptr := range moves {
+		if bfs.splitPtrs {
+			keys = append(keys, p(ptr), d(ptr))
+		} else {
+			keys = append(keys, ptr)
+		}
+	}
+	raw := make(map[uint64][]byte, len(keys))
+	for len(keys) > 0 {
+		n := 256
+		if n > len(keys) {
+			n = len(keys)
+		}
+		data, err := bfs.store.GetMany(ctx, keys[:n])
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, key := range keys[:n] {
+			if data[key] == nil {
+				return 0, 0, persistent.ErrObjectNotFound
+			}
+			raw[key] = data[key]
+		}
+		keys = keys[n:]
+	}
+
+	move := func(ptr uint64) (uint64, error) {
+		if ptr == nilPtr || ptr == holePtr {
+			return ptr, nil
+		}
+		moved, ok := remap[ptr&^holeFlag]
+		if !ok {
+			return 0, fmt.Errorf("blockfs: pointer to block %x is outside the file", ptr&^holeFlag)
+		}
+		return moved | ptr&holeFlag, nil
+	}
+	for curr, prev := range moves {
+		b := &block{parent: bfs}
+		rawPtrs := raw[prev]
+		if bfs.splitPtrs {
+			rawPtrs = raw[p(prev)]
+		}
+		if err := b.UnmarshalPtrs(rawPtrs[:bfs.blockPtrsSize()]); err != nil {
+			return 0, 0, fmt.Errorf("blockfs: failed to parse block %x: %v", prev, err)
+		}
+		for i, ptr := range b.ptrs {
+			if b.ptrs[i], err = move(ptr); err != nil {
+				return 0, 0, fmt.Errorf("blockfs: block %x: %v", prev, err)
+			}
+		}
+
+		if !bfs.splitPtrs {
+			out := append(b.MarshalPtrs(), raw[prev][bfs.blockPtrsSize():]...)
+			if err := bfs.store.Set(ctx, uint64(curr), out, types[curr]); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+		data := raw[d(prev)]
+		if ref := parseRef(data); bfs.dedup && ref != nil {
+			moved, ok := remap[ref.ptr]
+			if !ok {
+				return 0, 0, fmt.Errorf("blockfs: block %x refers to shared data that isn't in the dedup index", prev)
+			}
+			ref.ptr = moved
+			data = ref.Marshal(bfs.blockDataSize())
+		}
+		if err := bfs.store.Set(ctx, p(uint64(curr)), b.MarshalPtrs(), persistent.Metadata); err != nil {
+			return 0, 0, err
+		} else if err := bfs.store.Set(ctx, d(uint64(curr)), data, types[curr]); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if state.RootPtr != nilPtr {
+		state.RootPtr = remap[state.RootPtr]
+	}
+	if state.DedupPtr != 0 {
+		state.DedupPtr = remap[state.DedupPtr-1] + 1
+	}
+	state.TrashPtr = nilPtr
+	state.NextPtr = uint64(len(moves))
+	after = state.NextPtr
+
+	end := after
+	if bfs.splitPtrs {
+		end = p(after)
+	}
+	if err := bfs.store.Truncate(ctx, end); err != nil {
+		return 0, 0, err
+	} else if err := nm.Commit(ctx); err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
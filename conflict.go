@@ -0,0 +1,85 @@
+package utahfs
+
+import (
+	"context"
+
+	"github.com/cloudflare/utahfs/internal/logging"
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// conflictAttempts is how many times something is tried when it keeps
+// conflicting with changes committed by other clients.
+const conflictAttempts = 5
+
+// retryConflicts calls `fn` again each time it fails with
+// persistent.ErrConflict, up to conflictAttempts times in total, and then
+// fails with EIO. Each call must start and commit its own transaction.
+func retryConflicts(name string, fn func() error) error {
+	for i := 0; i < conflictAttempts; i++ {
+		if err := fn(); err != persistent.ErrConflict {
+			return err
+		}
+	}
+	logging.Warnf("utahfs: %v conflicted with other clients %v times", name, conflictAttempts)
+	return fuse.EIO
+}
+
+// retries wraps a FUSE binding whose storage detects conflicts, and starts each
+// operation that commits changes over if another client committed first. Only
+// operations that modify nodes need it, because the buffered writes and access
+// times that others commit are retried where they're committed.
+type retries struct {
+	fuseutil.FileSystem
+}
+
+func (r retries) run(ctx context.Context, name string, fn func(context.Context) error) error {
+	return retryConflicts(name, func() error { return fn(ctx) })
+}
+
+func (r retries) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	return r.run(ctx, "SetInodeAttributes", func(ctx context.Context) error { return r.FileSystem.SetInodeAttributes(ctx, op) })
+}
+
+func (r retries) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
+	return r.run(ctx, "MkDir", func(ctx context.Context) error { return r.FileSystem.MkDir(ctx, op) })
+}
+
+func (r retries) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
+	return r.run(ctx, "MkNode", func(ctx context.Context) error { return r.FileSystem.MkNode(ctx, op) })
+}
+
+func (r retries) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	return r.run(ctx, "CreateFile", func(ctx context.Context) error { return r.FileSystem.CreateFile(ctx, op) })
+}
+
+func (r retries) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	return r.run(ctx, "CreateSymlink", func(ctx context.Context) error { return r.FileSystem.CreateSymlink(ctx, op) })
+}
+
+func (r retries) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	return r.run(ctx, "Rename", func(ctx context.Context) error { return r.FileSystem.Rename(ctx, op) })
+}
+
+func (r retries) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
+	return r.run(ctx, "RmDir", func(ctx context.Context) error { return r.FileSystem.RmDir(ctx, op) })
+}
+
+func (r retries) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	return r.run(ctx, "Unlink", func(ctx context.Context) error { return r.FileSystem.Unlink(ctx, op) })
+}
+
+func (r retries) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	return r.run(ctx, "WriteFile", func(ctx context.Context) error { return r.FileSystem.WriteFile(ctx, op) })
+}
+
+func (r retries) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	return r.run(ctx, "SetXattr", func(ctx context.Context) error { return r.FileSystem.SetXattr(ctx, op) })
+}
+
+func (r retries) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	return r.run(ctx, "RemoveXattr", func(ctx context.Context) error { return r.FileSystem.RemoveXattr(ctx, op) })
+}
@@ -0,0 +1,382 @@
+package utahfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/cloudflare/utahfs/persistent"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Names of the hash functions that a dedup index can be keyed by. BLAKE2b is
+// considerably faster than SHA-256 on machines without SHA instructions, which
+// matters on large sequential writes where every block is hashed. BLAKE3 would
+// be faster still, but there's no implementation of it among this module's
+// dependencies.
+const (
+	DedupSHA256  = "sha256"
+	DedupBLAKE2b = "blake2b-256"
+)
+
+var dedupHashes = map[string]func([]byte) [32]byte{
+	DedupSHA256:  sha256.Sum256,
+	DedupBLAKE2b: blake2b.Sum256,
+}
+
+const (
+	// refMarker is stored in the length field of a block's data section, in
+	// place of the data's length, when the block refers to a shared copy of its
+	// data instead of storing it.
+	refMarker = 1<<24 - 1
+	// blockRefSize is the size of a reference: the marker, the pointer to the
+	// shared copy, and the hash of the data.
+	blockRefSize = 3 + 8 + 32
+)
+
+// blockRef is a reference from a block to a shared copy of its data.
+type blockRef struct {
+	ptr  uint64
+	hash [32]byte
+}
+
+func (ref *blockRef) Marshal(size int64) []byte {
+	out := make([]byte, size)
+	writeInt(refMarker, out[:3])
+	writeInt(int(ref.ptr), out[3:11])
+	copy(out[11:43], ref.hash[:])
+	return out
+}
+
+// parseRef returns the reference stored in the data section `raw`, or nil if
+// the data is stored directly.
+func parseRef(raw []byte) *blockRef {
+	if len(raw) < blockRefSize || readInt(raw[:3]) != refMarker {
+		return nil
+	}
+	ref := &blockRef{ptr: uint64(readInt(raw[3:11]))}
+	copy(ref.hash[:], raw[11:43])
+	return ref
+}
+
+// marshalData returns the data section of the block `b`. If dedup is enabled and
+// `b` is a full block of file content, it refers to a shared copy of the data.
+// Any reference that `b` previously held and no longer needs is released.
+func (bfs *BlockFilesystem) marshalData(ctx context.Context, b *block, dt persistent.DataType) ([]byte, error) {
+	share := bfs.dedup && dt == persistent.Content && int64(len(b.data)) == bfs.dataSize
+
+	var hash [32]byte
+	if share {
+		sum, err := bfs.hasher(ctx)
+		if err != nil {
+			return nil, err
+		}
+		hash = sum(b.data)
+		if b.ref != nil && b.ref.hash == hash {
+			return b.ref.Marshal(bfs.blockDataSize()), nil
+		}
+	}
+	if b.ref != nil {
+		if err := bfs.release(ctx, b.ref); err != nil {
+			return nil, err
+		}
+		b.ref = nil
+	}
+	if !share {
+		return b.MarshalData(), nil
+	}
+
+	ref, err := bfs.share(ctx, hash, b.data)
+	if err != nil {
+		return nil, err
+	} else if ref == nil {
+		return b.MarshalData(), nil
+	} else if err := bfs.useFeature(ctx, persistent.FeatureDedup); err != nil {
+		return nil, err
+	}
+	b.ref = ref
+	return ref.Marshal(bfs.blockDataSize()), nil
+}
+
+// unmarshalData parses the data section `raw` into `b`, following a reference
+// to a shared copy of the data if there is one.
+func (bfs *BlockFilesystem) unmarshalData(ctx context.Context, b *block, raw []byte) error {
+	ref := parseRef(raw)
+	if ref == nil {
+		return b.UnmarshalData(raw)
+	}
+	shared, err := bfs.store.Get(ctx, d(ref.ptr))
+	if err != nil {
+		return err
+	} else if err := b.UnmarshalData(shared); err != nil {
+		return err
+	}
+	// The data may be modified in place before being persisted, which mustn't
+	// affect the shared copy.
+	b.data = append([]byte{}, b.data...)
+	b.ref = ref
+	return nil
+}
+
+// hashName returns the name of the hash function that the dedup index is keyed
+// by, or that a new index will be.
+func (bfs *BlockFilesystem) hashName(ctx context.Context) (string, error) {
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return "", err
+	} else if state.DedupPtr == 0 {
+		if bfs.dedupHash == "" {
+			return DedupBLAKE2b, nil
+		}
+		return bfs.dedupHash, nil
+	}
+
+	stored := state.DedupHash
+	if stored == "" {
+		stored = DedupSHA256
+	}
+	if bfs.dedupHash != "" && bfs.dedupHash != stored {
+		return "", fmt.Errorf("blockfs: dedup index is keyed by %v, but %v is configured", stored, bfs.dedupHash)
+	}
+	return stored, nil
+}
+
+// hasher returns the hash function that the dedup index is keyed by.
+func (bfs *BlockFilesystem) hasher(ctx context.Context) (func([]byte) [32]byte, error) {
+	name, err := bfs.hashName(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sum, ok := dedupHashes[name]
+	if !ok {
+		return nil, fmt.Errorf("blockfs: dedup index is keyed by unknown hash: %v", name)
+	}
+	return sum, nil
+}
+
+// index opens the dedup index. If there isn't one yet and `create` is true, it's
+// created. Otherwise, nil is returned. The index has one bucket for each byte of
+// a block, so that it always takes up the same number of blocks.
+func (bfs *BlockFilesystem) index(ctx context.Context, create bool) (*persistent.DedupIndex, error) {
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return nil, err
+	} else if state.DedupPtr == 0 {
+		if !create {
+			return nil, nil
+		}
+		name, err := bfs.hashName(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ptr, bf, err := bfs.Create(ctx, persistent.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		idx := persistent.NewDedupIndex(&indexFile{bf}, uint64(bfs.dataSize))
+		if err := bf.Truncate(idx.Size()); err != nil {
+			return nil, err
+		}
+		state.DedupPtr, state.DedupHash = ptr+1, name
+		return idx, nil
+	}
+
+	bf, err := bfs.Open(ctx, state.DedupPtr-1, persistent.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	idx := persistent.NewDedupIndex(&indexFile{bf}, uint64(bfs.dataSize))
+	bf.size = idx.Size()
+	return idx, nil
+}
+
+// share returns a reference to a shared copy of `data`, which has the given
+// hash, creating the copy if it doesn't exist yet. It returns nil if there's no
+// room in the index for a new copy.
+func (bfs *BlockFilesystem) share(ctx context.Context, hash [32]byte, data []byte) (*blockRef, error) {
+	idx, err := bfs.index(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	ptr, ok, err := idx.Lookup(hash)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		if _, err := idx.Ref(hash, 1); err != nil {
+			return nil, err
+		}
+		return &blockRef{ptr, hash}, nil
+	}
+
+	// Store the shared copy in a block of its own, which isn't part of any
+	// skiplist, so that it can be put in the trash once it's not needed.
+	ptr, err = bfs.allocate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := idx.Add(hash, ptr); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, bfs.free(ctx, ptr)
+	}
+	b := &block{parent: bfs, ptrs: make([]uint64, bfs.numPtrs), data: data}
+	for i := range b.ptrs {
+		b.ptrs[i] = nilPtr
+	}
+	if err := bfs.store.Set(ctx, p(ptr), b.MarshalPtrs(), persistent.Metadata); err != nil {
+		return nil, err
+	} else if err := bfs.store.Set(ctx, d(ptr), b.MarshalData(), persistent.Content); err != nil {
+		return nil, err
+	}
+	return &blockRef{ptr, hash}, nil
+}
+
+// release drops a reference to a shared copy of data, and moves the copy to the
+// trash if it was the last one.
+func (bfs *BlockFilesystem) release(ctx context.Context, ref *blockRef) error {
+	idx, err := bfs.index(ctx, false)
+	if err != nil {
+		return err
+	} else if idx == nil {
+		return fmt.Errorf("blockfs: block refers to shared data, but there's no dedup index")
+	}
+	refs, err := idx.Ref(ref.hash, -1)
+	if err != nil {
+		return err
+	} else if refs == 0 {
+		return bfs.free(ctx, ref.ptr)
+	}
+	return nil
+}
+
+// releaseAll releases every reference held by the blocks of the file at `ptr`.
+func (bfs *BlockFilesystem) releaseAll(ctx context.Context, ptr uint64) error {
+	for ptr != nilPtr {
+		raw, err := bfs.store.GetMany(ctx, []uint64{p(ptr), d(ptr)})
+		if err != nil {
+			return err
+		} else if raw[p(ptr)] == nil {
+			return persistent.ErrObjectNotFound
+		}
+		b := &block{parent: bfs}
+		if err := b.UnmarshalPtrs(raw[p(ptr)]); err != nil {
+			return fmt.Errorf("blockfs: failed to parse block %x: %v", ptr, err)
+		}
+		if ref := parseRef(raw[d(ptr)]); ref != nil {
+			if err := bfs.release(ctx, ref); err != nil {
+				return err
+			}
+		}
+		ptr = nextPtr(b.ptrs[0])
+	}
+	return nil
+}
+
+// free moves the single block at `ptr`, which isn't part of a skiplist, to the
+// trash.
+func (bfs *BlockFilesystem) free(ctx context.Context, ptr uint64) error {
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return err
+	}
+	b := &block{parent: bfs, ptrs: make([]uint64, bfs.numPtrs)}
+	for i := range b.ptrs {
+		b.ptrs[i] = nilPtr
+	}
+	b.ptrs[0] = state.TrashPtr
+	if err := bfs.store.Set(ctx, p(ptr), b.MarshalPtrs(), persistent.Metadata); err != nil {
+		return err
+	} else if err := bfs.store.Set(ctx, d(ptr), b.MarshalData(), persistent.Content); err != nil {
+		return err
+	}
+	state.TrashPtr = ptr
+	return nil
+}
+
+// DedupStats summarizes how much space is being saved by dedup.
+type DedupStats struct {
+	Hash string // Hash is the name of the hash function the index is keyed by.
+
+	Shared uint64 // Shared is the number of shared copies of blocks that are stored.
+	Refs   uint64 // Refs is the number of blocks that refer to a shared copy.
+
+	DataSize int64 // DataSize is the amount of data kept in each block.
+}
+
+// Ratio returns the number of blocks that refer to shared data, for each copy of
+// it that's actually stored.
+func (ds *DedupStats) Ratio() float64 {
+	if ds.Shared == 0 {
+		return 1
+	}
+	return float64(ds.Refs) / float64(ds.Shared)
+}
+
+// Saved returns the number of bytes of data that aren't stored because they're
+// shared.
+func (ds *DedupStats) Saved() int64 {
+	return int64(ds.Refs-ds.Shared) * ds.DataSize
+}
+
+// DedupStats reads the dedup index, and returns statistics about it. It returns
+// nil if there's no index.
+func (bfs *BlockFilesystem) DedupStats(ctx context.Context) (*DedupStats, error) {
+	if err := bfs.store.Start(ctx); err != nil {
+		return nil, err
+	}
+	defer bfs.store.Rollback(ctx)
+
+	idx, err := bfs.index(ctx, false)
+	if err != nil {
+		return nil, err
+	} else if idx == nil {
+		return nil, nil
+	}
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DedupStats{Hash: state.DedupHash, DataSize: bfs.dataSize}
+	if stats.Hash == "" {
+		stats.Hash = DedupSHA256
+	}
+	err = idx.Range(func(ptr, refs uint64) error {
+		stats.Shared++
+		stats.Refs += refs
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("blockfs: dedup index: %v", err)
+	}
+	return stats, nil
+}
+
+// indexFile adapts the file storing the dedup index for random access.
+type indexFile struct {
+	bf *BlockFile
+}
+
+func (f *indexFile) ReadAt(p []byte, offset int64) (int, error) {
+	if _, err := f.bf.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) {
+		m, err := f.bf.Read(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (f *indexFile) WriteAt(p []byte, offset int64) (int, error) {
+	if _, err := f.bf.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return f.bf.Write(p)
+}
@@ -4,15 +4,20 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
 	"os"
 	"os/user"
 	"runtime/debug"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/cloudflare/utahfs/internal/logging"
+	"github.com/cloudflare/utahfs/persistent"
+
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -27,10 +32,81 @@ import (
 // If there's an error path that could cause the function to return before
 // getting to commit(), then the function must manually forget the node.
 
+// maxWriteBuffer is the maximum number of bytes of contiguous writes to a file
+// that will be buffered in memory before they're committed.
+const maxWriteBuffer = 1 << 20
+
+// writeBufferDelay is the maximum amount of time that writes will be buffered
+// in memory before they're committed.
+const writeBufferDelay = time.Second
+
+// defaultMaxNameLength is the longest name that a file may have, in bytes, if
+// Options.MaxNameLength isn't set.
+const defaultMaxNameLength = 255
+
+// maxRenameSearch is the most directories that a rename searches through,
+// when it can't walk up from its destination, to check that a directory isn't
+// being moved beneath itself.
+const maxRenameSearch = 10000
+
+// relatimeInterval is how old a file's access time must be before reading it
+// updates the access time again, in relatime mode.
+const relatimeInterval = 24 * time.Hour
+
+// AtimeMode controls when reading a file updates its access time.
+type AtimeMode int
+
+const (
+	// AtimeOff never updates access times, except when they're set explicitly.
+	AtimeOff AtimeMode = iota
+	// AtimeRelatime updates a file's access time when it's read, if the access
+	// time is older than its modification or change time, or more than a day
+	// old. It's like the relatime mount option on Linux.
+	AtimeRelatime
+	// AtimeStrict updates a file's access time every time it's read.
+	AtimeStrict
+)
+
+// ParseAtimeMode returns the AtimeMode called `name`: off, relatime, or strict.
+// The empty string is the same as off.
+func ParseAtimeMode(name string) (AtimeMode, error) {
+	switch name {
+	case "", "off":
+		return AtimeOff, nil
+	case "relatime":
+		return AtimeRelatime, nil
+	case "strict":
+		return AtimeStrict, nil
+	}
+	return AtimeOff, fmt.Errorf("utahfs: unknown atime mode: %q", name)
+}
+
 type dirHandle struct {
 	inode    fuseops.InodeID
 	entries  []fuseutil.Dirent
 	children map[string]fuseops.ChildInodeEntry
+
+	// expires is when children become too old to answer LookUpInode and
+	// GetInodeAttributes with, which is as long as the kernel would've cached
+	// them for. It's zero if caching is disabled.
+	expires time.Time
+}
+
+type fileHandle struct {
+	inode fuseops.InodeID
+
+	// stale is true if the file was deleted while the handle was open, and its
+	// inode was given to a new file. Reads and writes through the handle fail
+	// with ESTALE instead of reaching the new file.
+	stale bool
+}
+
+// writeBuffer is a run of contiguous writes to a file that haven't been applied
+// yet.
+type writeBuffer struct {
+	inode  fuseops.InodeID
+	offset int64
+	data   []byte
 }
 
 func now() time.Time {
@@ -56,20 +132,47 @@ func myUserAndGroup() (uint32, uint32, error) {
 }
 
 func commit(ctx context.Context, nm *nodeManager, nds ...*node) error {
+	return persist(ctx, nm, nm.Commit, nds)
+}
+
+// commitEarly is like commit, except that it only commits if more blocks have
+// been modified than max-dirty-blocks allows, and the transaction continues
+// afterwards. Whatever it commits is kept even if the rest of the transaction
+// fails, so it must only be called where the changes so far are complete.
+func commitEarly(ctx context.Context, nm *nodeManager, nds ...*node) error {
+	if !nm.bfs.store.NeedsEarlyCommit() {
+		return nil
+	}
+	return persist(ctx, nm, nm.bfs.store.CommitEarly, nds)
+}
+
+// persist writes the nodes in `nds` to storage, and then calls `fn` to commit
+// them.
+func persist(ctx context.Context, nm *nodeManager, fn func(context.Context) error, nds []*node) error {
 	for _, nd := range nds {
 		if err := nd.Persist(); err != nil {
 			for _, nd := range nds {
 				nm.Forget(nd)
 			}
-			log.Println(err)
+			logging.Error(err)
 			return fuse.EIO
 		}
 	}
-	if err := nm.Commit(ctx); err != nil {
+	if err := fn(ctx); err == persistent.ErrWALFull {
+		for _, nd := range nds {
+			nm.Forget(nd)
+		}
+		return syscall.ENOSPC
+	} else if err == persistent.ErrConflict {
+		// Every node read in the transaction may be out of date, not just the
+		// ones that were modified, so the operation has to start over.
+		nm.cache.Flush()
+		return err
+	} else if err != nil {
 		for _, nd := range nds {
 			nm.Forget(nd)
 		}
-		log.Println(err)
+		logging.Error(err)
 		return fuse.EIO
 	}
 	return nil
@@ -80,24 +183,245 @@ type filesystem struct {
 
 	nm      *nodeManager
 	rootPtr uint64
+	// mountPtr is the pointer of the directory presented as the root of the
+	// filesystem. It's rootPtr unless a subdirectory is mounted.
+	mountPtr uint64
+
+	// caseInsensitive is true if names in a directory are matched regardless
+	// of case, but stored with the case they were created with.
+	caseInsensitive bool
+	// maxNameLength is the longest name that a new entry may have, in bytes.
+	maxNameLength int
+
+	// dirMode and fileMode are the permissions added to new directories and
+	// files, or that they're given if forceMode is true.
+	dirMode, fileMode os.FileMode
+	forceMode         bool
 
 	nextHandleID fuseops.HandleID
 	dirHandles   map[fuseops.HandleID]dirHandle
-	fileHandles  map[fuseops.HandleID]struct{}
+	fileHandles  map[fuseops.HandleID]*fileHandle
+
+	// writes is the buffer of writes that haven't been committed yet, and
+	// buffered is the number of bytes in it. writeErrs has the first error
+	// encountered committing buffered writes to each file, which will be
+	// returned by the next call to FlushFile or SyncFile for that file.
+	writes    []*writeBuffer
+	buffered  int
+	writeErrs map[fuseops.InodeID]error
+
+	// writeDelay and maxBuffered are how long, and how many bytes of, writes
+	// are buffered before they're committed. If background is true, writes to
+	// different files are buffered together, and are only committed early by
+	// operations that depend on them.
+	writeDelay  time.Duration
+	maxBuffered int
+	background  bool
+
+	// atime is when reads update access times. atimes are the access times
+	// that reads have updated but that haven't been committed yet, which are
+	// committed together after writeDelay.
+	atime  AtimeMode
+	atimes map[fuseops.InodeID]time.Time
+
+	// attrTTL and entryTTL are how long the kernel may cache attributes and
+	// directory entries for.
+	attrTTL, entryTTL time.Duration
+
+	// parents is the directory that each directory was last looked up in,
+	// created in, or moved to. Nodes don't record their parents, so it's only
+	// a hint, that renames use to walk up from their destination.
+	parents map[fuseops.InodeID]fuseops.InodeID
+
+	// stop is closed by Destroy, to stop the transactions that are started
+	// while idle.
+	stop chan struct{}
 
 	mu sync.Mutex
 }
 
 // NewFilesystem returns a FUSE binding that internally stores data in a
-// block-based filesystem.
+// block-based filesystem. Every file is presented as being owned by the current
+// user.
 func NewFilesystem(bfs *BlockFilesystem) (fuseutil.FileSystem, error) {
-	ctx := context.Background()
-
 	uid, gid, err := myUserAndGroup()
 	if err != nil {
 		return nil, err
 	}
-	nm := newNodeManager(bfs, 128, uid, gid)
+	return NewFilesystemAs(bfs, uid, gid, nil, nil)
+}
+
+// NewFilesystemAs is like NewFilesystem, but new files are created as being
+// owned by the user `uid` and group `gid`.
+//
+// The owner of each file is stored, and `uidMap` and `gidMap` translate stored
+// ids into local ones, so that a repository can be shared between machines
+// where the same user has different ids. Files whose owner isn't in the maps are
+// presented as being owned by `uid` and `gid`. With nil maps, every file is.
+func NewFilesystemAs(bfs *BlockFilesystem, uid, gid uint32, uidMap, gidMap map[uint32]uint32) (fuseutil.FileSystem, error) {
+	return NewFilesystemWithOptions(bfs, Options{Uid: uid, Gid: gid, UidMap: uidMap, GidMap: gidMap})
+}
+
+const (
+	// DefaultCacheTTL is how long the kernel caches attributes and directory
+	// entries for, unless Options says otherwise.
+	DefaultCacheTTL = time.Minute
+
+	// NoCacheTTL can be given as Options.AttrCacheTTL or EntryCacheTTL to stop
+	// the kernel from caching them at all.
+	NoCacheTTL time.Duration = -1
+)
+
+// Options configures the FUSE binding returned by NewFilesystemWithOptions.
+type Options struct {
+	// Archive enforces archive mode, like NewArchive.
+	Archive bool
+
+	// Uid, Gid, UidMap, and GidMap control the owner of files, like the
+	// arguments to NewFilesystemAs.
+	Uid, Gid       uint32
+	UidMap, GidMap map[uint32]uint32
+
+	// CaseInsensitive makes the names in a directory match regardless of case,
+	// like on macOS and Windows. Names are still stored and listed with the
+	// case that they were created with, but creating a name that differs from
+	// an existing one only by case fails with EEXIST.
+	CaseInsensitive bool
+
+	// WarmDepth is how many levels of directories beneath the root have their
+	// contents read into cache when the filesystem is created, so that browsing
+	// them doesn't have to wait on remote storage. Zero disables this.
+	WarmDepth int
+
+	// BackgroundCommit, if non-zero, is how long writes may be kept in memory
+	// before they're committed. Writes return immediately, and are committed
+	// together in one transaction once this much time has passed since the
+	// first of them, once BackgroundCommitBlocks blocks of data are buffered,
+	// or when an operation that depends on them needs to see them, like
+	// closing the file. Everything buffered is committed when the filesystem
+	// is unmounted, but writes that haven't been committed are lost if the
+	// process crashes, and only SyncFile guarantees that they've been
+	// committed. This doesn't apply to archive mode, where writes are always
+	// committed immediately.
+	BackgroundCommit time.Duration
+	// BackgroundCommitBlocks is the number of blocks of buffered writes that
+	// causes them to be committed early. If zero, the limit is the same as it
+	// is without background commits.
+	BackgroundCommitBlocks int
+
+	// OpTimeout, if non-zero, is how long an operation may wait on storage
+	// before it's abandoned and fails with EIO.
+	OpTimeout time.Duration
+
+	// DetectConflicts lets several clients write to the same repository without
+	// a remote server. A transaction that conflicts with changes another client
+	// committed after it started is rolled back, the node cache is flushed, and
+	// the operation is tried again from the start, failing with EIO after a few
+	// attempts. The storage must have been created with
+	// persistent.NewSharedReliable, with no caches or local WAL; see
+	// persistent.AppStorage.DetectConflicts.
+	DetectConflicts bool
+
+	// Atime controls whether reading a file updates its access time. Access
+	// times are only ever changed when they're set explicitly by default.
+	// Otherwise, the updates from reads are buffered like writes are, so that
+	// reading a file from start to end is committed once, but they cost an
+	// extra commit for files that are only being read.
+	Atime AtimeMode
+
+	// InlineThreshold is the size, in bytes, of the largest file whose data is
+	// stored in the same block as its metadata, instead of in a separate list of
+	// blocks. This saves a block and a round-trip for every small file. A file
+	// is moved out of its metadata when it grows past the threshold. The first
+	// file stored inline sets persistent.FeatureInline in the repository's
+	// header. Files that are stored inline can't be read by versions of UtahFS
+	// from before this option existed. Zero disables this.
+	InlineThreshold int
+
+	// MaxNameLength is the longest name, in bytes, that a file may be created
+	// or renamed with. Longer names fail with ENAMETOOLONG. If zero, the limit
+	// is 255 bytes, the same as most local filesystems, so that anything
+	// stored can be copied back out.
+	MaxNameLength int
+
+	// Subdir is a slash-separated path, within the repository, of a directory to
+	// present as the root of the filesystem instead of the repository's root.
+	// Nothing outside of it can be reached through the filesystem. It's
+	// resolved once, when the filesystem is created.
+	Subdir string
+
+	// DirMode and FileMode are permission bits that are added to the mode that
+	// new directories and files are created with, so that the umask of the
+	// process creating them can't take those bits away. For example, 0070 makes
+	// everything new accessible to its group. If ForceMode is true, new
+	// directories and files get exactly these permissions, whatever mode was
+	// asked for. Neither affects changing the mode of an existing file.
+	DirMode, FileMode os.FileMode
+	ForceMode         bool
+
+	// Metrics records the latency of each operation in FuseOpDuration, and the
+	// errors returned to the kernel in FuseOpErrors.
+	Metrics bool
+
+	// AttrCacheTTL and EntryCacheTTL are how long the kernel may cache the
+	// attributes of a file, and the result of looking up a name in a directory,
+	// before asking again. Changes made by other clients of the same repository
+	// can go unnoticed for this long. Zero means DefaultCacheTTL. NoCacheTTL
+	// disables caching, which is slower but means every operation sees the
+	// latest committed state.
+	AttrCacheTTL, EntryCacheTTL time.Duration
+
+	// PinSaveInterval, if non-zero, is roughly how often an empty transaction
+	// is started, even if nothing else is happening. Starting a transaction
+	// checks the tree head in remote storage against the pin file, and saves
+	// it to the pin file if that hasn't been done in the last ten seconds, so
+	// this keeps the pin from going stale on mounts that are rarely written to.
+	// The time between transactions is chosen randomly, between half and one
+	// and a half times the interval, so that many clients started together
+	// don't all make their requests at once. They stop once the filesystem is
+	// destroyed, when it's unmounted.
+	PinSaveInterval time.Duration
+}
+
+// cacheTTL returns how long the kernel should cache for, given a TTL from
+// Options. Zero means no caching.
+func cacheTTL(ttl time.Duration) time.Duration {
+	if ttl == 0 {
+		return DefaultCacheTTL
+	} else if ttl == NoCacheTTL {
+		return 0
+	}
+	return ttl
+}
+
+// NewFilesystemWithOptions returns a FUSE binding like NewFilesystem, configured
+// by `opts`.
+func NewFilesystemWithOptions(bfs *BlockFilesystem, opts Options) (fuseutil.FileSystem, error) {
+	ctx := context.Background()
+
+	if opts.InlineThreshold < 0 {
+		return nil, fmt.Errorf("utahfs: inline threshold must not be negative")
+	} else if opts.AttrCacheTTL < 0 && opts.AttrCacheTTL != NoCacheTTL || opts.EntryCacheTTL < 0 && opts.EntryCacheTTL != NoCacheTTL {
+		return nil, fmt.Errorf("utahfs: cache ttls must not be negative, other than NoCacheTTL")
+	} else if opts.PinSaveInterval < 0 {
+		return nil, fmt.Errorf("utahfs: pin save interval must not be negative")
+	} else if opts.MaxNameLength < 0 {
+		return nil, fmt.Errorf("utahfs: max name length must not be negative")
+	} else if (opts.DirMode|opts.FileMode)&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("utahfs: dir and file modes must only have permission bits")
+	} else if opts.ForceMode && (opts.DirMode == 0 || opts.FileMode == 0) {
+		return nil, fmt.Errorf("utahfs: forcing modes requires dir and file modes")
+	}
+	if opts.MaxNameLength == 0 {
+		opts.MaxNameLength = defaultMaxNameLength
+	}
+	if opts.DetectConflicts {
+		if err := bfs.store.DetectConflicts(); err != nil {
+			return nil, err
+		}
+	}
+	nm := newNodeManager(bfs, 128, opts.Uid, opts.Gid, opts.UidMap, opts.GidMap)
+	nm.inline = int64(opts.InlineThreshold)
 	if err := nm.Start(ctx); err != nil {
 		return nil, err
 	}
@@ -106,7 +430,9 @@ func NewFilesystem(bfs *BlockFilesystem) (fuseutil.FileSystem, error) {
 	state, err := nm.State(ctx)
 	if err != nil {
 		return nil, err
-	} else if state.RootPtr == nilPtr {
+	}
+	created := state.RootPtr == nilPtr
+	if created {
 		rootPtr, err := nm.Create(ctx, os.ModeDir|0777)
 		if err != nil {
 			return nil, err
@@ -115,15 +441,169 @@ func NewFilesystem(bfs *BlockFilesystem) (fuseutil.FileSystem, error) {
 		if err := nm.Commit(ctx); err != nil {
 			return nil, err
 		}
+	} else if err := bfs.checkLayout(ctx, state.RootPtr); err != nil {
+		return nil, err
 	}
 
-	return &filesystem{
-		nm:      nm,
-		rootPtr: state.RootPtr,
+	fs := &filesystem{
+		nm:       nm,
+		rootPtr:  state.RootPtr,
+		mountPtr: state.RootPtr,
+
+		caseInsensitive: opts.CaseInsensitive,
+		maxNameLength:   opts.MaxNameLength,
+
+		dirMode:   opts.DirMode,
+		fileMode:  opts.FileMode,
+		forceMode: opts.ForceMode,
 
 		dirHandles:  make(map[fuseops.HandleID]dirHandle),
-		fileHandles: make(map[fuseops.HandleID]struct{}),
-	}, nil
+		fileHandles: make(map[fuseops.HandleID]*fileHandle),
+
+		writeErrs:   make(map[fuseops.InodeID]error),
+		writeDelay:  writeBufferDelay,
+		maxBuffered: maxWriteBuffer,
+
+		atime:  opts.Atime,
+		atimes: make(map[fuseops.InodeID]time.Time),
+
+		attrTTL:  cacheTTL(opts.AttrCacheTTL),
+		entryTTL: cacheTTL(opts.EntryCacheTTL),
+
+		parents: make(map[fuseops.InodeID]fuseops.InodeID),
+
+		stop: make(chan struct{}),
+	}
+	if opts.Subdir != "" {
+		if fs.mountPtr, err = fs.resolveSubdir(ctx, opts.Subdir); err != nil {
+			return nil, err
+		}
+	}
+	if opts.BackgroundCommit > 0 {
+		fs.writeDelay, fs.background = opts.BackgroundCommit, true
+		if opts.BackgroundCommitBlocks > 0 {
+			fs.maxBuffered = opts.BackgroundCommitBlocks * int(bfs.dataSize)
+		}
+	}
+	// A new filesystem has nothing to warm, and its transaction has already
+	// been committed.
+	if opts.WarmDepth > 0 && !created {
+		if err := fs.warm(ctx, opts.WarmDepth); err != nil {
+			logging.Warnf("failed to warm cache: %v", err)
+		}
+	}
+	if opts.PinSaveInterval > 0 {
+		go fs.checkPins(opts.PinSaveInterval, time.After)
+	}
+	var out fuseutil.FileSystem = fs
+	if opts.Archive {
+		out = archive{fs}
+	}
+	if opts.DetectConflicts {
+		out = retries{out}
+	}
+	if opts.OpTimeout > 0 {
+		out = timeouts{out, opts.OpTimeout}
+	}
+	if opts.Metrics {
+		out = instrumented{out}
+	}
+	return out, nil
+}
+
+// resolveSubdir returns the pointer of the directory at `path`, relative to the
+// root of the repository.
+func (fs *filesystem) resolveSubdir(ctx context.Context, path string) (uint64, error) {
+	ptr := fs.rootPtr
+	for _, part := range splitPath(path) {
+		if part == ".." {
+			return 0, fmt.Errorf("utahfs: subdirectory must not contain ..")
+		}
+		nd, err := fs.nm.Open(ctx, ptr)
+		if err != nil {
+			return 0, err
+		}
+		name, ok := fs.childName(nd, part)
+		if !ok {
+			return 0, fmt.Errorf("utahfs: subdirectory %v not found", path)
+		}
+		ptr = fs.ptr(nd.Children[name])
+	}
+	nd, err := fs.nm.Open(ctx, ptr)
+	if err != nil {
+		return 0, err
+	} else if !nd.Attrs.Mode.IsDir() {
+		return 0, fmt.Errorf("utahfs: subdirectory %v is not a directory", path)
+	}
+	return ptr, nil
+}
+
+// checkPins calls checkPin at random times, between half and one and a half
+// times `interval` apart, until Destroy is called. `after` waits like
+// time.After, which it is outside of tests.
+func (fs *filesystem) checkPins(interval time.Duration, after func(time.Duration) <-chan time.Time) {
+	for {
+		delay := interval/2 + time.Duration(rand.Int63n(int64(interval)))
+		select {
+		case <-fs.stop:
+			return
+		case <-after(delay):
+		}
+		fs.checkPin()
+	}
+}
+
+// checkPin starts and rolls back an empty transaction, which checks the tree
+// head against the pin file. It holds fs.mu, so it never overlaps with another
+// transaction, and does nothing once Destroy has been called.
+func (fs *filesystem) checkPin() {
+	ctx := context.Background()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	select {
+	case <-fs.stop:
+		return
+	default:
+	}
+	if err := fs.nm.Start(ctx); err != nil {
+		logging.Warnf("utahfs: failed to check pin while idle: %v", err)
+		return
+	}
+	fs.nm.Rollback(ctx)
+}
+
+// warm reads the nodes within `depth` levels of the root, breadth-first, with
+// one batch of requests for each level. It's called in the transaction that the
+// filesystem was created in, before anything else can use it.
+func (fs *filesystem) warm(ctx context.Context, depth int) error {
+	seen := make(map[fuseops.InodeID]struct{})
+	level := []fuseops.InodeID{fuseops.RootInodeID}
+	for i := 0; i <= depth && len(level) > 0; i++ {
+		ptrs := make([]uint64, 0, len(level))
+		for _, id := range level {
+			ptrs = append(ptrs, fs.ptr(id))
+		}
+		if err := fs.nm.bfs.prefetch(ctx, ptrs); err != nil {
+			return err
+		}
+
+		next := make([]fuseops.InodeID, 0)
+		for _, id := range level {
+			nd, err := fs.nm.Open(ctx, fs.ptr(id))
+			if err != nil {
+				return err
+			}
+			for _, childID := range nd.Children {
+				if _, ok := seen[childID]; !ok {
+					seen[childID] = struct{}{}
+					next = append(next, childID)
+				}
+			}
+		}
+		level = next
+	}
+	return nil
 }
 
 func (fs *filesystem) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
@@ -145,18 +625,23 @@ func (fs *filesystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 	// When the filesystem is reading a directory, it issues LookUpInode ops for
 	// every entry it reads. Since we already looked up every node when we were
 	// first opening the directory, looking them all up again would be wasteful.
-	// Try to answer the query by getting this data from the open handle.
+	// Try to answer the query by getting this data from the open handle, as
+	// long as it's no older than what the kernel could've cached itself.
 	fs.mu.Lock()
 	for _, handle := range fs.dirHandles {
-		if handle.inode != op.Parent {
+		if handle.inode != op.Parent || !time.Now().Before(handle.expires) {
 			continue
 		}
-		child, ok := handle.children[op.Name]
+		child, ok := handle.children[fs.foldName(op.Name)]
 		if !ok {
 			fs.mu.Unlock()
 			return fuse.ENOENT
 		}
 		op.Entry = child
+		fs.pendingAttrs(child.Child, &op.Entry.Attributes)
+		if child.Attributes.Mode.IsDir() {
+			fs.parents[child.Child] = op.Parent
+		}
 		fs.mu.Unlock()
 		return nil
 	}
@@ -164,7 +649,7 @@ func (fs *filesystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 
 	// That failed. Answer the query normally: by starting a transaction and
 	// getting the data we need from the backend.
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Parent))
 	if err != nil {
@@ -172,19 +657,25 @@ func (fs *filesystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 	} else if nd.Children == nil {
 		return fuse.ENOTDIR
 	}
-	childID, ok := nd.Children[op.Name]
+	name, ok := fs.childName(nd, op.Name)
 	if !ok {
 		return fuse.ENOENT
 	}
+	childID := nd.Children[name]
 	child, err := fs.nm.Open(ctx, fs.ptr(childID))
 	if err != nil {
 		return err
 	}
 
 	op.Entry.Child = childID
+	op.Entry.Generation = fuseops.GenerationNumber(child.Generation)
 	op.Entry.Attributes = child.Attrs
-	op.Entry.AttributesExpiration = fs.expiration()
-	op.Entry.EntryExpiration = fs.expiration()
+	fs.pendingAttrs(childID, &op.Entry.Attributes)
+	op.Entry.AttributesExpiration = fs.attrExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
+	if child.Attrs.Mode.IsDir() {
+		fs.parents[childID] = op.Parent
+	}
 
 	return nil
 }
@@ -192,24 +683,29 @@ func (fs *filesystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 func (fs *filesystem) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
 	fs.mu.Lock()
 	for _, handle := range fs.dirHandles {
+		if !time.Now().Before(handle.expires) {
+			continue
+		}
 		for _, nd := range handle.children {
 			if nd.Child == op.Inode {
 				op.Attributes = nd.Attributes
-				op.AttributesExpiration = fs.expiration()
+				fs.pendingAttrs(op.Inode, &op.Attributes)
+				op.AttributesExpiration = fs.attrExpiration()
 				fs.mu.Unlock()
 				return nil
 			}
 		}
 	}
 	fs.mu.Unlock()
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
 	if err != nil {
 		return err
 	}
 	op.Attributes = nd.Attrs
-	op.AttributesExpiration = fs.expiration()
+	fs.pendingAttrs(op.Inode, &op.Attributes)
+	op.AttributesExpiration = fs.attrExpiration()
 
 	return nil
 }
@@ -219,14 +715,14 @@ func (fs *filesystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetIno
 }
 
 func (fs *filesystem) setInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp, archive bool) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx, op.Inode)()
 
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
 	if err != nil {
 		return err
 	} else if !nd.Attrs.Mode.IsRegular() {
 		op.Attributes = nd.Attrs
-		op.AttributesExpiration = fs.expiration()
+		op.AttributesExpiration = fs.attrExpiration()
 		return nil
 	}
 
@@ -243,9 +739,14 @@ func (fs *filesystem) setInodeAttributes(ctx context.Context, op *fuseops.SetIno
 	if op.Mtime != nil {
 		nd.Attrs.Mtime = *op.Mtime
 	}
-	// Silently ignore updates to atime.
+	// Updates to atime are silently ignored, unless access times are enabled.
+	atime := op.Atime != nil && fs.atime != AtimeOff
+	if atime {
+		nd.Attrs.Atime = *op.Atime
+		delete(fs.atimes, op.Inode)
+	}
 
-	if op.Size != nil || op.Mode != nil || op.Mtime != nil {
+	if op.Size != nil || op.Mode != nil || op.Mtime != nil || atime {
 		nd.Attrs.Ctime = now()
 	}
 
@@ -253,63 +754,74 @@ func (fs *filesystem) setInodeAttributes(ctx context.Context, op *fuseops.SetIno
 }
 
 func (fs *filesystem) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	delete(fs.parents, op.Inode)
+	fs.mu.Unlock()
 	return nil
 }
 
 func (fs *filesystem) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	parent, child, err := fs.mkNode(ctx, op.Parent, op.Name, op.Mode)
 	if err != nil {
 		return err
 	}
 	op.Entry.Child = parent.Children[op.Name]
+	op.Entry.Generation = fuseops.GenerationNumber(child.Generation)
 	op.Entry.Attributes = child.Attrs
-	op.Entry.AttributesExpiration = fs.expiration()
-	op.Entry.EntryExpiration = fs.expiration()
+	op.Entry.AttributesExpiration = fs.attrExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
+	fs.parents[op.Entry.Child] = op.Parent
 
 	return commit(ctx, fs.nm, parent)
 }
 
 func (fs *filesystem) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	parent, child, err := fs.mkNode(ctx, op.Parent, op.Name, op.Mode)
 	if err != nil {
 		return err
 	}
 	op.Entry.Child = parent.Children[op.Name]
+	op.Entry.Generation = fuseops.GenerationNumber(child.Generation)
 	op.Entry.Attributes = child.Attrs
-	op.Entry.AttributesExpiration = fs.expiration()
-	op.Entry.EntryExpiration = fs.expiration()
+	op.Entry.AttributesExpiration = fs.attrExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
 
 	return commit(ctx, fs.nm, parent)
 }
 
 func (fs *filesystem) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	parent, child, err := fs.mkNode(ctx, op.Parent, op.Name, op.Mode)
 	if err != nil {
 		return err
 	}
 	op.Entry.Child = parent.Children[op.Name]
+	op.Entry.Generation = fuseops.GenerationNumber(child.Generation)
 	op.Entry.Attributes = child.Attrs
-	op.Entry.AttributesExpiration = fs.expiration()
-	op.Entry.EntryExpiration = fs.expiration()
+	op.Entry.AttributesExpiration = fs.attrExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
 
 	// Issue the next handle ID. It doesn't mean anything.
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
-	fs.fileHandles[handleID] = struct{}{}
+	fs.fileHandles[handleID] = &fileHandle{inode: op.Entry.Child}
 	op.Handle = handleID
 
-	return commit(ctx, fs.nm, parent)
+	if err := commit(ctx, fs.nm, parent); err != nil {
+		delete(fs.fileHandles, handleID)
+		return err
+	}
+	return nil
 }
 
 func (fs *filesystem) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	parent, child, err := fs.mkNode(ctx, op.Parent, op.Name, os.ModeSymlink|0755)
 	if err != nil {
@@ -320,9 +832,10 @@ func (fs *filesystem) CreateSymlink(ctx context.Context, op *fuseops.CreateSymli
 		return err
 	}
 	op.Entry.Child = parent.Children[op.Name]
+	op.Entry.Generation = fuseops.GenerationNumber(child.Generation)
 	op.Entry.Attributes = child.Attrs
-	op.Entry.AttributesExpiration = fs.expiration()
-	op.Entry.EntryExpiration = fs.expiration()
+	op.Entry.AttributesExpiration = fs.attrExpiration()
+	op.Entry.EntryExpiration = fs.entryExpiration()
 
 	return commit(ctx, fs.nm, parent, child)
 }
@@ -336,34 +849,69 @@ func (fs *filesystem) rename(ctx context.Context, op *fuseops.RenameOp, archive
 
 	if op.OldParent == op.NewParent && op.OldName == op.NewName {
 		return nil
+	} else if err := fs.checkName(op.NewName); err != nil {
+		return err
 	}
 
 	oldParent, err := fs.nm.Open(ctx, fs.ptr(op.OldParent))
 	if err != nil {
 		return err
 	}
-	id, ok := oldParent.Children[op.OldName]
+	oldName, ok := fs.childName(oldParent, op.OldName)
 	if !ok {
 		return fuse.ENOENT
 	}
+	id := oldParent.Children[oldName]
 
 	if op.NewParent == id {
 		return fuse.EINVAL
+	} else if op.OldParent != op.NewParent {
+		// Moving a directory somewhere beneath itself would detach it from the
+		// rest of the tree, in a cycle.
+		if ok, err := fs.contains(ctx, id, op.NewParent); err != nil {
+			return err
+		} else if ok {
+			return fuse.EINVAL
+		}
 	}
 	newParent, err := fs.nm.Open(ctx, fs.ptr(op.NewParent))
 	if err != nil {
 		return err
-	} else if _, ok := newParent.Children[op.NewName]; ok {
-		if err := fs.rmNode(ctx, newParent, op.NewName, archive); err != nil {
+	}
+	// Renaming a file to a different case of its own name just changes how
+	// it's displayed.
+	newName, ok := fs.childName(newParent, op.NewName)
+	if ok && !(op.OldParent == op.NewParent && newName == oldName) {
+		// Like rename(2), a directory may only replace an empty directory,
+		// and anything else may only replace something that isn't one.
+		src, err := fs.nm.Open(ctx, fs.ptr(id))
+		if err != nil {
+			return err
+		}
+		dst, err := fs.nm.Open(ctx, fs.ptr(newParent.Children[newName]))
+		if err != nil {
+			return err
+		} else if src.Attrs.Mode.IsDir() && !dst.Attrs.Mode.IsDir() {
+			return fuse.ENOTDIR
+		} else if !src.Attrs.Mode.IsDir() && dst.Attrs.Mode.IsDir() {
+			return syscall.EISDIR
+		}
+
+		if archive {
+			err = fs.keepNode(ctx, newParent, newName)
+		} else {
+			err = fs.rmNode(ctx, newParent, newName, archive)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
 	if op.OldParent == op.NewParent {
-		delete(newParent.Children, op.OldName)
+		delete(newParent.Children, oldName)
 		newParent.Children[op.NewName] = id
 	} else {
-		delete(oldParent.Children, op.OldName)
+		delete(oldParent.Children, oldName)
 		newParent.Children[op.NewName] = id
 	}
 
@@ -371,12 +919,87 @@ func (fs *filesystem) rename(ctx context.Context, op *fuseops.RenameOp, archive
 	oldParent.Attrs.Ctime = now()
 	newParent.Attrs.Mtime = now()
 	newParent.Attrs.Ctime = now()
+	if _, ok := fs.parents[id]; ok {
+		fs.parents[id] = op.NewParent
+	}
 
 	return commit(ctx, fs.nm, oldParent, newParent)
 }
 
+// contains returns true if `target` is somewhere beneath the node `id`. It
+// walks up from `target` through the parents that lookups recorded, and checks
+// each step against the parent's children, so it reads one directory for each
+// level between `target` and the root. The kernel looks up every directory
+// above one before it can name it, so that's almost always enough.
+//
+// If a step is missing, or out of date because the directory was moved by
+// another client, it falls back to searching every directory under `id`
+// instead. That search gives up with EIO after maxRenameSearch directories,
+// rather than risk detaching part of the tree.
+func (fs *filesystem) contains(ctx context.Context, id, target fuseops.InodeID) (bool, error) {
+	for curr, steps := target, 0; steps < maxRenameSearch; steps++ {
+		if curr == id {
+			return true, nil
+		} else if curr == fuseops.RootInodeID {
+			return false, nil
+		}
+		parentID, ok := fs.parents[curr]
+		if !ok {
+			break
+		}
+		parent, err := fs.nm.Open(ctx, fs.ptr(parentID))
+		if err != nil {
+			return false, err
+		} else if !hasChild(parent, curr) {
+			break
+		}
+		curr = parentID
+	}
+
+	budget := maxRenameSearch
+	ok, err := fs.search(ctx, id, target, &budget)
+	if err == fuse.EIO {
+		logging.Warnf("utahfs: gave up checking that rename target isn't beneath the directory being moved, after searching %v directories", maxRenameSearch)
+	}
+	return ok, err
+}
+
+// search returns true if `target` is somewhere beneath the node `id`, by
+// searching every directory under `id`. It fails with EIO if that takes more
+// than `budget` directories.
+func (fs *filesystem) search(ctx context.Context, id, target fuseops.InodeID, budget *int) (bool, error) {
+	nd, err := fs.nm.Open(ctx, fs.ptr(id))
+	if err != nil {
+		return false, err
+	} else if !nd.Attrs.Mode.IsDir() {
+		return false, nil
+	} else if *budget == 0 {
+		return false, fuse.EIO
+	}
+	*budget--
+	for _, childID := range nd.Children {
+		if childID == target {
+			return true, nil
+		} else if ok, err := fs.search(ctx, childID, target, budget); err != nil {
+			return false, err
+		} else if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func hasChild(nd *node, id fuseops.InodeID) bool {
+	for _, childID := range nd.Children {
+		if childID == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (fs *filesystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
-	return fs.Unlink(ctx, &fuseops.UnlinkOp{op.Parent, op.Name, op.OpContext})
+	return fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: op.Parent, Name: op.Name, OpContext: op.OpContext})
 }
 
 func (fs *filesystem) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
@@ -397,7 +1020,7 @@ func (fs *filesystem) unlink(ctx context.Context, op *fuseops.UnlinkOp, archive
 }
 
 func (fs *filesystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
 	if err != nil {
@@ -423,13 +1046,20 @@ func (fs *filesystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error
 			return fmt.Errorf("failed to open inode for child: %v", err)
 		}
 
-		children[name] = fuseops.ChildInodeEntry{
+		entry := fuseops.ChildInodeEntry{
 			Child:                childID,
+			Generation:           fuseops.GenerationNumber(child.Generation),
 			Attributes:           child.Attrs,
-			AttributesExpiration: fs.expiration(),
+			AttributesExpiration: fs.attrExpiration(),
+			EntryExpiration:      fs.entryExpiration(),
 		}
+		fs.pendingAttrs(childID, &entry.Attributes)
+		children[fs.foldName(name)] = entry
 		entries = append(entries, fuseutil.Dirent{
-			fuseops.DirOffset(i + 1), childID, name, child.Type(),
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  childID,
+			Name:   name,
+			Type:   child.Type(),
 		})
 	}
 
@@ -437,10 +1067,19 @@ func (fs *filesystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
+	ttl := fs.attrTTL
+	if fs.entryTTL < ttl {
+		ttl = fs.entryTTL
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
 	fs.dirHandles[handleID] = dirHandle{
 		inode:    op.Inode,
 		children: children,
 		entries:  entries,
+		expires:  expires,
 	}
 	op.Handle = handleID
 
@@ -448,7 +1087,7 @@ func (fs *filesystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error
 }
 
 func (fs *filesystem) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	handle, ok := fs.dirHandles[op.Handle]
 	if !ok {
@@ -471,7 +1110,7 @@ func (fs *filesystem) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error
 }
 
 func (fs *filesystem) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	_, ok := fs.dirHandles[op.Handle]
 	if !ok {
@@ -483,7 +1122,7 @@ func (fs *filesystem) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseD
 }
 
 func (fs *filesystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
 	if err != nil {
@@ -496,15 +1135,18 @@ func (fs *filesystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) erro
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
-	fs.fileHandles[handleID] = struct{}{}
+	fs.fileHandles[handleID] = &fileHandle{inode: op.Inode}
 	op.Handle = handleID
 
 	return nil
 }
 
 func (fs *filesystem) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx, op.Inode)()
 
+	if fs.staleHandle(op.Handle) {
+		return syscall.ESTALE
+	}
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
 	if err != nil {
 		return err
@@ -512,28 +1154,160 @@ func (fs *filesystem) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) erro
 		return fuse.EINVAL
 	}
 
+	// Reading at or past the end of the file isn't an error, it just reads
+	// nothing. Any data returned along with io.EOF is kept.
 	n := 0
 	for n < len(op.Dst) {
 		m, err := nd.ReadAt(op.Dst[n:], op.Offset+int64(n))
+		n += m
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
-		n += m
 	}
 	op.BytesRead = n
+	fs.accessed(op.Inode, nd)
 
 	return nil
 }
 
+// staleHandle returns true if the file handle `id` is for a file that has
+// been replaced by a new one at the same inode. It must be called while
+// holding fs.mu.
+func (fs *filesystem) staleHandle(id fuseops.HandleID) bool {
+	handle, ok := fs.fileHandles[id]
+	return ok && handle.stale
+}
+
+// accessed records that the file `nd`, with inode `id`, was just read. If its
+// access time should be updated, the update is buffered to be committed later.
+// It must be called while holding fs.mu.
+func (fs *filesystem) accessed(id fuseops.InodeID, nd *node) {
+	t := now()
+	switch fs.atime {
+	case AtimeOff:
+		return
+	case AtimeRelatime:
+		if _, ok := fs.atimes[id]; ok {
+			return
+		}
+		atime := nd.Attrs.Atime
+		if atime.After(nd.Attrs.Mtime) && atime.After(nd.Attrs.Ctime) && t.Sub(atime) < relatimeInterval {
+			return
+		}
+	case AtimeStrict:
+		if fs.atimes[id].Equal(t) {
+			return
+		}
+	}
+
+	if len(fs.atimes) == 0 {
+		time.AfterFunc(fs.writeDelay, func() {
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			fs.flushAtimes(context.Background())
+		})
+	}
+	fs.atimes[id] = t
+}
+
+// flushAtimes commits any buffered updates to access times, in one transaction.
+// Like flush, it must be called while holding fs.mu, outside of a transaction.
+// Updates that fail to commit are logged and dropped, because they aren't worth
+// failing a later operation over.
+func (fs *filesystem) flushAtimes(ctx context.Context) {
+	atimes := fs.atimes
+	if len(atimes) == 0 {
+		return
+	}
+	fs.atimes = make(map[fuseops.InodeID]time.Time)
+
+	err := retryConflicts("committing access times", func() error { return fs.applyAtimes(ctx, atimes) })
+	if err != nil {
+		logging.Errorf("utahfs: failed to commit access times: %v", err)
+	}
+}
+
+func (fs *filesystem) applyAtimes(ctx context.Context, atimes map[fuseops.InodeID]time.Time) error {
+	if err := fs.nm.Start(ctx); err != nil {
+		return err
+	}
+	defer fs.nm.Rollback(ctx)
+
+	nds := make([]*node, 0, len(atimes))
+	for id, atime := range atimes {
+		nd, err := fs.nm.Open(ctx, fs.ptr(id))
+		if err != nil {
+			forget(fs.nm, nds)
+			return err
+		}
+		nds = append(nds, nd)
+		nd.Attrs.Atime = atime
+	}
+
+	return commit(ctx, fs.nm, nds...)
+}
+
 func (fs *filesystem) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
 	return fs.writeFile(ctx, op, false)
 }
 
 func (fs *filesystem) writeFile(ctx context.Context, op *fuseops.WriteFileOp, archive bool) error {
+	if archive {
+		return fs.writeFileNow(ctx, op, true)
+	}
+
+	// Writes are buffered so that a stream of small, contiguous writes to a
+	// file becomes one larger write. The buffer is applied before any other
+	// operation is processed, once it gets large enough, or after a short delay.
+	// In background-commit mode, writes that aren't contiguous start a new run
+	// in the buffer instead of applying it.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.staleHandle(op.Handle) {
+		return syscall.ESTALE
+	}
+	var wb *writeBuffer
+	if n := len(fs.writes); n > 0 {
+		wb = fs.writes[n-1]
+	}
+	if wb != nil && (wb.inode != op.Inode || wb.offset+int64(len(wb.data)) != op.Offset) {
+		if !fs.background {
+			fs.flush(ctx)
+		}
+		wb = nil
+	}
+	if wb == nil {
+		wb = &writeBuffer{inode: op.Inode, offset: op.Offset}
+		if len(fs.writes) == 0 {
+			first := wb
+			time.AfterFunc(fs.writeDelay, func() {
+				fs.mu.Lock()
+				defer fs.mu.Unlock()
+				if len(fs.writes) > 0 && fs.writes[0] == first {
+					fs.flush(context.Background())
+				}
+			})
+		}
+		fs.writes = append(fs.writes, wb)
+	}
+	wb.data = append(wb.data, op.Data...)
+	fs.buffered += len(op.Data)
+	if fs.buffered >= fs.maxBuffered {
+		fs.flush(ctx)
+	}
+
+	return nil
+}
+
+func (fs *filesystem) writeFileNow(ctx context.Context, op *fuseops.WriteFileOp, archive bool) error {
 	defer fs.synchronize(ctx)()
 
+	if fs.staleHandle(op.Handle) {
+		return syscall.ESTALE
+	}
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
 	if err != nil {
 		return err
@@ -556,28 +1330,173 @@ func (fs *filesystem) writeFile(ctx context.Context, op *fuseops.WriteFileOp, ar
 	return commit(ctx, fs.nm, nd)
 }
 
+// flush commits any buffered writes. It must be called while holding fs.mu,
+// outside of a transaction. If committing the writes fails, none of them are
+// kept, so the error is saved to be returned by the next call to FlushFile or
+// SyncFile for each of the files they were to.
+func (fs *filesystem) flush(ctx context.Context) {
+	wbs := fs.writes
+	if len(wbs) == 0 {
+		return
+	}
+	fs.writes, fs.buffered = nil, 0
+
+	err := retryConflicts("committing buffered writes", func() error { return fs.applyWrites(ctx, wbs) })
+	if err != nil {
+		logging.Errorf("utahfs: failed to commit buffered writes: %v", err)
+		for _, wb := range wbs {
+			if _, ok := fs.writeErrs[wb.inode]; !ok {
+				fs.writeErrs[wb.inode] = err
+			}
+		}
+	}
+}
+
+// applyWrites commits the runs of writes in `wbs`, in order, in one
+// transaction. If any of them fails, none of them are committed.
+func (fs *filesystem) applyWrites(ctx context.Context, wbs []*writeBuffer) error {
+	if err := fs.nm.Start(ctx); err != nil {
+		return err
+	}
+	defer fs.nm.Rollback(ctx)
+
+	nds := make([]*node, 0, len(wbs))
+	opened := make(map[fuseops.InodeID]bool)
+	for _, wb := range wbs {
+		nd, err := fs.nm.Open(ctx, fs.ptr(wb.inode))
+		if err != nil {
+			forget(fs.nm, nds)
+			return err
+		} else if !opened[wb.inode] {
+			opened[wb.inode] = true
+			nds = append(nds, nd)
+		}
+
+		if !nd.Attrs.Mode.IsRegular() {
+			forget(fs.nm, nds)
+			return fuse.EINVAL
+		}
+
+		// Large runs of writes are applied a block at a time, so that the
+		// transaction can be committed early in between.
+		for start := 0; start < len(wb.data); start += int(fs.nm.bfs.dataSize) {
+			end := start + int(fs.nm.bfs.dataSize)
+			if end > len(wb.data) {
+				end = len(wb.data)
+			}
+			if _, err := nd.WriteAt(wb.data[start:end], wb.offset+int64(start)); err != nil {
+				forget(fs.nm, nds)
+				return err
+			}
+			nd.Attrs.Mtime = now()
+			if err := commitEarly(ctx, fs.nm, nds...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return commit(ctx, fs.nm, nds...)
+}
+
+func forget(nm *nodeManager, nds []*node) {
+	for _, nd := range nds {
+		nm.Forget(nd)
+	}
+}
+
+// pendingAttrs updates `attrs`, the attributes of the node `id`, to reflect any
+// buffered writes to it and any buffered update to its access time.
+func (fs *filesystem) pendingAttrs(id fuseops.InodeID, attrs *fuseops.InodeAttributes) {
+	if atime, ok := fs.atimes[id]; ok {
+		attrs.Atime = atime
+	}
+	for _, wb := range fs.writes {
+		if wb.inode != id {
+			continue
+		} else if end := uint64(wb.offset) + uint64(len(wb.data)); end > attrs.Size {
+			attrs.Size = end
+		}
+		attrs.Mtime = now()
+	}
+}
+
+// writeError returns and clears the error from committing buffered writes to
+// the file `id`, if there was one.
+func (fs *filesystem) writeError(id fuseops.InodeID) error {
+	err := fs.writeErrs[id]
+	delete(fs.writeErrs, id)
+	return err
+}
+
+// SyncFile commits any buffered writes, and then waits for every committed
+// change to be flushed from the local WAL to remote storage. Changes to other
+// files are flushed as well, because the WAL isn't organized by file. If
+// uploads are paused, it succeeds once the writes are in the WAL, since they're
+// already on local disk by then.
 func (fs *filesystem) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
+	defer fs.synchronize(ctx)()
+
+	if err := fs.writeError(op.Inode); err != nil {
+		return err
+	} else if err := fs.nm.bfs.Sync(ctx); err == persistent.ErrWALPaused {
+		return nil
+	} else if err != nil {
+		logging.Errorf("utahfs: failed to sync: %v", err)
+		return fuse.EIO
+	}
 	return nil
 }
 
+// FlushFile commits any buffered writes to the file being closed, so that an
+// error committing them is returned by close.
 func (fs *filesystem) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
-	return nil
+	defer fs.synchronizeLazily(ctx, op.Inode)()
+	return fs.writeError(op.Inode)
 }
 
 func (fs *filesystem) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
-	defer fs.synchronize(ctx)()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	_, ok := fs.fileHandles[op.Handle]
+	handle, ok := fs.fileHandles[op.Handle]
 	if !ok {
 		return fmt.Errorf("failed to release unknown handle")
 	}
 	delete(fs.fileHandles, op.Handle)
+	id := handle.inode
+
+	// Writes made through a memory mapping can arrive after the file was
+	// flushed, so they're committed once nothing has the file open anymore.
+	for _, other := range fs.fileHandles {
+		if other.inode == id {
+			fs.flushLazily(ctx)
+			return nil
+		}
+	}
+	fs.flushLazily(ctx, id)
 
 	return nil
 }
 
+// Destroy commits any buffered writes and access times when the filesystem is
+// unmounted, so that they aren't lost when the process exits. It also stops the
+// transactions started by PinSaveInterval.
+func (fs *filesystem) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	select {
+	case <-fs.stop:
+	default:
+		close(fs.stop)
+	}
+	ctx := context.Background()
+	fs.flush(ctx)
+	fs.flushAtimes(ctx)
+}
+
 func (fs *filesystem) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
-	defer fs.synchronize(ctx)()
+	defer fs.synchronizeLazily(ctx)()
 
 	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
 	if err != nil {
@@ -595,18 +1514,29 @@ func (fs *filesystem) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp
 }
 
 func (fs *filesystem) mkNode(ctx context.Context, parentID fuseops.InodeID, name string, mode os.FileMode) (*node, *node, error) {
-	childPtr, err := fs.nm.Create(ctx, mode)
+	if err := fs.checkName(name); err != nil {
+		return nil, nil, err
+	}
+	childPtr, err := fs.nm.Create(ctx, fs.createMode(mode))
 	if err != nil {
 		return nil, nil, err
 	}
 	childID := fs.inode(childPtr)
 
+	// Any handle that's still open on this inode is for a file that was
+	// deleted, and whose pointer has been reused.
+	for _, handle := range fs.fileHandles {
+		if handle.inode == childID {
+			handle.stale = true
+		}
+	}
+
 	parent, err := fs.nm.Open(ctx, fs.ptr(parentID))
 	if err != nil {
 		return nil, nil, err
 	} else if !parent.Attrs.Mode.IsDir() {
 		return nil, nil, fuse.ENOTDIR
-	} else if _, ok := parent.Children[name]; ok {
+	} else if _, ok := fs.childName(parent, name); ok {
 		return nil, nil, fuse.EEXIST
 	}
 	child, err := fs.nm.Open(ctx, childPtr)
@@ -621,11 +1551,27 @@ func (fs *filesystem) mkNode(ctx context.Context, parentID fuseops.InodeID, name
 	return parent, child, nil
 }
 
+// createMode returns the mode that a node is created with, when `mode` was
+// asked for. Symlinks are left alone, since their permissions are never used.
+func (fs *filesystem) createMode(mode os.FileMode) os.FileMode {
+	perm := fs.fileMode
+	if mode&os.ModeSymlink != 0 {
+		return mode
+	} else if mode.IsDir() {
+		perm = fs.dirMode
+	}
+	if fs.forceMode {
+		return mode&^os.ModePerm | perm
+	}
+	return mode | perm
+}
+
 func (fs *filesystem) rmNode(ctx context.Context, parent *node, name string, archive bool) error {
-	childID, ok := parent.Children[name]
+	name, ok := fs.childName(parent, name)
 	if !ok {
 		return fuse.ENOENT
 	}
+	childID := parent.Children[name]
 
 	child, err := fs.nm.Open(ctx, fs.ptr(childID))
 	if err != nil {
@@ -637,10 +1583,12 @@ func (fs *filesystem) rmNode(ctx context.Context, parent *node, name string, arc
 	child.Attrs.Nlink--
 	if child.Attrs.Nlink == 0 {
 		if archive && child.Attrs.Mode.IsRegular() {
-			return fmt.Errorf("utahfs: refusing to delete archived file")
+			logging.Warn("utahfs: refusing to delete archived file")
+			return syscall.EACCES
 		} else if err := fs.nm.Unlink(ctx, fs.ptr(childID)); err != nil {
 			return err
 		}
+		delete(fs.atimes, childID)
 	} else {
 		child.Attrs.Ctime = now()
 		if err := child.Persist(); err != nil {
@@ -655,15 +1603,90 @@ func (fs *filesystem) rmNode(ctx context.Context, parent *node, name string, arc
 	return nil
 }
 
+// checkName returns an error if a new entry can't be called `name`:
+// ENAMETOOLONG if it's longer than the filesystem allows, or EINVAL if it's
+// empty, "." or "..", or has a slash or NUL byte in it. The kernel never asks
+// for names like that, but other callers, like Volume, might.
+func (fs *filesystem) checkName(name string) error {
+	if len(name) > fs.maxNameLength {
+		return syscall.ENAMETOOLONG
+	} else if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fuse.EINVAL
+	}
+	return nil
+}
+
+// foldName returns the form of `name` that's used to compare it to other names.
+// It's only different from `name` in case-insensitive mode.
+func (fs *filesystem) foldName(name string) string {
+	if !fs.caseInsensitive {
+		return name
+	}
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// childName returns the name that a child of the directory `nd` matching `name`
+// is stored under, and whether or not there is one.
+func (fs *filesystem) childName(nd *node, name string) (string, bool) {
+	if _, ok := nd.Children[name]; ok || !fs.caseInsensitive {
+		return name, ok
+	}
+	folded := fs.foldName(name)
+	for cand := range nd.Children {
+		if fs.foldName(cand) == folded {
+			return cand, true
+		}
+	}
+	return "", false
+}
+
+// synchronize takes fs.mu and starts a transaction, after committing any
+// buffered writes and access times. It returns a function that rolls back the
+// transaction, if it wasn't committed, and releases fs.mu.
 func (fs *filesystem) synchronize(ctx context.Context) func() {
 	fs.mu.Lock()
+	fs.flush(ctx)
+	fs.flushAtimes(ctx)
+	return fs.begin(ctx)
+}
+
+// synchronizeLazily is like synchronize, except that in background-commit mode
+// buffered writes are only committed if some of them are to one of `inodes`.
+// It's for operations that can't remove a node, and that don't depend on the
+// contents of any file other than `inodes`. Attributes they return must be
+// passed through pendingAttrs.
+func (fs *filesystem) synchronizeLazily(ctx context.Context, inodes ...fuseops.InodeID) func() {
+	fs.mu.Lock()
+	fs.flushLazily(ctx, inodes...)
+	return fs.begin(ctx)
+}
+
+// flushLazily commits any buffered writes, or in background-commit mode, only
+// if some of them are to one of `inodes`. It must be called while holding
+// fs.mu, outside of a transaction.
+func (fs *filesystem) flushLazily(ctx context.Context, inodes ...fuseops.InodeID) {
+	if !fs.background {
+		fs.flush(ctx)
+		return
+	}
+	for _, wb := range fs.writes {
+		for _, id := range inodes {
+			if wb.inode == id {
+				fs.flush(ctx)
+				return
+			}
+		}
+	}
+}
+
+func (fs *filesystem) begin(ctx context.Context) func() {
 	if err := fs.nm.Start(ctx); err != nil {
-		log.Println(err)
+		logging.Error(err)
 	}
 	return func() {
 		if r := recover(); r != nil {
-			log.Println(r)
-			log.Println(string(debug.Stack()))
+			logging.Error(r)
+			logging.Error(string(debug.Stack()))
 			panic(r)
 		}
 		fs.nm.Rollback(ctx)
@@ -671,7 +1694,14 @@ func (fs *filesystem) synchronize(ctx context.Context) func() {
 	}
 }
 
+// ptr returns the pointer of the node with the inode number `id`. Inode numbers
+// are stored relative to the root of the repository, except that RootInodeID
+// is always the directory that's mounted. Since nodes don't know their
+// parents, the directories above a mounted subdirectory can't be reached.
 func (fs *filesystem) ptr(id fuseops.InodeID) uint64 {
+	if id == fuseops.RootInodeID {
+		return fs.mountPtr
+	}
 	return uint64(id) + fs.rootPtr - 1
 }
 
@@ -679,6 +1709,15 @@ func (fs *filesystem) inode(ptr uint64) fuseops.InodeID {
 	return fuseops.InodeID(ptr - fs.rootPtr + 1)
 }
 
-func (fs *filesystem) expiration() time.Time {
-	return now().Add(time.Minute)
+func (fs *filesystem) attrExpiration() time.Time { return expiration(fs.attrTTL) }
+
+func (fs *filesystem) entryExpiration() time.Time { return expiration(fs.entryTTL) }
+
+// expiration returns when something cached for `ttl` expires, or the zero time
+// if it isn't to be cached at all.
+func expiration(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return now().Add(ttl)
 }
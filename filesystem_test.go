@@ -0,0 +1,2295 @@
+package utahfs
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTruncateToZero(t *testing.T) {
+	ctx := context.Background()
+	fs := testArchive(t, false).(*filesystem)
+	testCreate(t, fs, "a", strings.Repeat("a", 10*1024))
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	fs.nm.Start(ctx)
+	nd, err := fs.nm.Open(ctx, fs.ptr(lookup.Entry.Child))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPtr := nd.Data
+	fs.nm.Rollback(ctx)
+
+	// Truncating the file to zero, like the kernel does when a file is opened
+	// with O_TRUNC, should move all of its data to the trash in one step.
+	size := uint64(0)
+	op := &fuseops.SetInodeAttributesOp{Inode: lookup.Entry.Child, Size: &size}
+	if err := fs.SetInodeAttributes(ctx, op); err != nil {
+		t.Fatal(err)
+	} else if op.Attributes.Size != 0 {
+		t.Fatalf("unexpected size after truncation: %v", op.Attributes.Size)
+	}
+
+	fs.nm.Start(ctx)
+	state, err := fs.nm.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if state.TrashPtr != dataPtr {
+		t.Fatalf("file's data is not at the head of the trash list: %v != %v", state.TrashPtr, dataPtr)
+	}
+	fs.nm.Rollback(ctx)
+
+	// The file should still work normally afterwards.
+	if data, _ := testRead(t, fs, "a"); data != "" {
+		t.Fatalf("unexpected file contents: %q", data)
+	}
+	write := &fuseops.WriteFileOp{Inode: lookup.Entry.Child, Data: []byte("hello")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "a"); data != "hello" {
+		t.Fatalf("unexpected file contents: %q", data)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	ctx := context.Background()
+	fs := testArchive(t, false)
+
+	create := func(name string) fuseops.ChildInodeEntry {
+		op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: name, Mode: 0644}
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		return op.Entry
+	}
+	unlink := func(name string) {
+		op := &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: name}
+		if err := fs.Unlink(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deleting a file and creating another one should re-use the same inode,
+	// but with a different generation number. A client holding a reference to
+	// the old file can use this to tell it's stale.
+	seen := make(map[fuseops.GenerationNumber]bool)
+	old := create("a")
+	seen[old.Generation] = true
+	for i := 0; i < 3; i++ {
+		unlink("a")
+		entry := create("a")
+		if entry.Child != old.Child {
+			t.Fatalf("inode was not re-used: %v != %v", entry.Child, old.Child)
+		} else if seen[entry.Generation] {
+			t.Fatalf("generation number was re-used: %v", entry.Generation)
+		}
+		seen[entry.Generation] = true
+
+		lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+		if err := fs.LookUpInode(ctx, lookup); err != nil {
+			t.Fatal(err)
+		} else if lookup.Entry.Generation != entry.Generation {
+			t.Fatalf("lookup returned wrong generation: %v != %v", lookup.Entry.Generation, entry.Generation)
+		}
+	}
+
+	// New inodes that weren't taken from the trash are unaffected.
+	if entry := create("b"); entry.Child == old.Child || entry.Generation != 0 {
+		t.Fatalf("unexpected entry for new inode: %v %v", entry.Child, entry.Generation)
+	}
+}
+
+func TestStaleHandle(t *testing.T) {
+	ctx := context.Background()
+	fs := testArchive(t, false)
+	// The file is empty, so that the only block it had is the first one to be
+	// taken from the trash.
+	testCreate(t, fs, "a", "")
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	open := &fuseops.OpenFileOp{Inode: lookup.Entry.Child}
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the file with a new one that's given the same inode.
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatal(err)
+	} else if create.Entry.Child != lookup.Entry.Child {
+		t.Fatalf("inode was not re-used: %v != %v", create.Entry.Child, lookup.Entry.Child)
+	}
+	write := &fuseops.WriteFileOp{Inode: create.Entry.Child, Handle: create.Handle, Data: []byte("second")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old handle shouldn't be able to read or change the new file.
+	read := &fuseops.ReadFileOp{Inode: lookup.Entry.Child, Handle: open.Handle, Dst: make([]byte, 1024)}
+	if err := fs.ReadFile(ctx, read); err != syscall.ESTALE {
+		t.Fatalf("expected ESTALE reading through old handle, got: %v %q", err, read.Dst[:read.BytesRead])
+	}
+	write = &fuseops.WriteFileOp{Inode: lookup.Entry.Child, Handle: open.Handle, Data: []byte("third")}
+	if err := fs.WriteFile(ctx, write); err != syscall.ESTALE {
+		t.Fatalf("expected ESTALE writing through old handle, got: %v", err)
+	}
+
+	// The new handle works as usual, and the old one can still be released.
+	read = &fuseops.ReadFileOp{Inode: create.Entry.Child, Handle: create.Handle, Dst: make([]byte, 1024)}
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatal(err)
+	} else if data := string(read.Dst[:read.BytesRead]); data != "second" {
+		t.Fatalf("unexpected data read through new handle: %q", data)
+	} else if err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type commitCounter struct {
+	persistent.BlockStorage
+	commits int
+}
+
+func (cc *commitCounter) Commit(ctx context.Context) error {
+	cc.commits++
+	return cc.BlockStorage.Commit(ctx)
+}
+
+func TestWriteBuffering(t *testing.T) {
+	ctx := context.Background()
+	cc := &commitCounter{BlockStorage: persistent.NewBlockMemory()}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(cc), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stream of small writes should be committed all at once.
+	start := cc.commits
+	expected := ""
+	for i := 0; i < 100; i++ {
+		chunk := strings.Repeat(string('a'+byte(i%26)), 100)
+		write := &fuseops.WriteFileOp{Inode: op.Entry.Child, Offset: int64(len(expected)), Data: []byte(chunk)}
+		if err := fs.WriteFile(ctx, write); err != nil {
+			t.Fatal(err)
+		}
+		expected += chunk
+	}
+	if cc.commits != start {
+		t.Fatalf("writes were committed before being synced: %v commits", cc.commits-start)
+	}
+	sync := &fuseops.SyncFileOp{Inode: op.Entry.Child, Handle: op.Handle}
+	if err := fs.SyncFile(ctx, sync); err != nil {
+		t.Fatal(err)
+	} else if cc.commits != start+1 {
+		t.Fatalf("unexpected number of commits: %v", cc.commits-start)
+	}
+
+	read := &fuseops.ReadFileOp{Inode: op.Entry.Child, Dst: make([]byte, 2*len(expected))}
+	if err := fs.ReadFile(ctx, read); err != nil {
+		t.Fatal(err)
+	} else if string(read.Dst[:read.BytesRead]) != expected {
+		t.Fatal("unexpected file contents")
+	}
+
+	// Buffered writes are applied before any other operation.
+	write := &fuseops.WriteFileOp{Inode: op.Entry.Child, Offset: 0, Data: []byte("hello")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	} else if data, _ := testRead(t, fs, "a"); data[:5] != "hello" {
+		t.Fatalf("unexpected file contents: %q", data[:5])
+	}
+
+	// Errors from committing buffered writes are returned later, only for the
+	// file that was written to.
+	write = &fuseops.WriteFileOp{Inode: fuseops.RootInodeID, Data: []byte("hello")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	}
+	flush := &fuseops.FlushFileOp{Inode: op.Entry.Child, Handle: op.Handle}
+	if err := fs.FlushFile(ctx, flush); err != nil {
+		t.Fatalf("error was returned for the wrong file: %v", err)
+	} else if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: op.Entry.Child}); err != nil {
+		t.Fatalf("error was returned for the wrong file: %v", err)
+	}
+	flush = &fuseops.FlushFileOp{Inode: fuseops.RootInodeID}
+	if err := fs.FlushFile(ctx, flush); err == nil {
+		t.Fatal("expected error from flushing invalid write")
+	} else if err := fs.FlushFile(ctx, flush); err != nil {
+		t.Fatalf("error was returned twice: %v", err)
+	}
+}
+
+// BenchmarkWriteFile measures the throughput of sequential 4 KiB writes to a
+// file, similar to `dd bs=4k`.
+func BenchmarkWriteFile(b *testing.B) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 32*1024, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, op); err != nil {
+		b.Fatal(err)
+	}
+
+	data := make([]byte, 4096)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		write := &fuseops.WriteFileOp{
+			Inode:  op.Entry.Child,
+			Handle: op.Handle,
+			Offset: int64(i * len(data)),
+			Data:   data,
+		}
+		if err := fs.WriteFile(ctx, write); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: op.Entry.Child, Handle: op.Handle}); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkReadahead measures sequential reads of a file the way the kernel
+// makes them with utahfs-client's -max-readahead at 128 KiB and at the default
+// of 1 MiB: in 128 KiB requests, with as many in flight at once as fit in the
+// readahead window. Storage takes a millisecond to answer each request.
+func BenchmarkReadahead(b *testing.B) {
+	for _, readahead := range []int{128 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("readahead=%vKiB", readahead/1024), func(b *testing.B) {
+			benchmarkReadahead(b, readahead)
+		})
+	}
+}
+
+func benchmarkReadahead(b *testing.B, readahead int) {
+	const size, request = 4 * 1024 * 1024, 128 * 1024
+	ctx := context.Background()
+
+	remote := persistent.NewMemoryStorage(time.Millisecond)
+	store := persistent.NewAppStorage(persistent.NewBufferedStorage(persistent.NewSimpleReliable(remote)))
+	bfs, err := NewBlockFilesystem(store, 12, 32*1024, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, op); err != nil {
+		b.Fatal(err)
+	}
+	inode, handle := op.Entry.Child, op.Handle
+	for offset := 0; offset < size; offset += request {
+		write := &fuseops.WriteFileOp{Inode: inode, Handle: handle, Offset: int64(offset), Data: make([]byte, request)}
+		if err := fs.WriteFile(ctx, write); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: inode, Handle: handle}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		window := make(chan struct{}, readahead/request)
+		errs := make(chan error, size/request)
+		for offset := 0; offset < size; offset += request {
+			window <- struct{}{}
+			go func(offset int) {
+				defer func() { <-window }()
+				read := &fuseops.ReadFileOp{Inode: inode, Handle: handle, Offset: int64(offset), Dst: make([]byte, request)}
+				errs <- fs.ReadFile(ctx, read)
+			}(offset)
+		}
+		for j := 0; j < size/request; j++ {
+			if err := <-errs; err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", strings.Repeat("a", 20*1024))
+	testCreate(t, fs, "b", "hello")
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "c", Mode: 0755}); err != nil {
+		t.Fatal(err)
+	} else if err := CheckFilesystem(ctx, bfs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the first block of a file's data back at itself.
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fs.(*filesystem)
+	fsys.nm.Start(ctx)
+	nd, err := fsys.nm.Open(ctx, fsys.ptr(lookup.Entry.Child))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf := &BlockFile{parent: bfs, ctx: ctx, start: nd.Data}
+	if err := bf.load(nd.Data, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	bf.curr.ptrs[0] = nd.Data
+	if err := bf.persist(); err != nil {
+		t.Fatal(err)
+	} else if err := fsys.nm.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fsys.nm.Rollback(ctx)
+
+	if err := CheckFilesystem(ctx, bfs); err == nil {
+		t.Fatal("expected error from corrupted file")
+	}
+}
+
+// cappedStorage fails any commit with more than `max` writes, to simulate a
+// machine that doesn't have enough memory to buffer them.
+type cappedStorage struct {
+	persistent.ReliableStorage
+	max int
+}
+
+func (cs *cappedStorage) Commit(ctx context.Context, writes map[uint64]persistent.WriteData) error {
+	if len(writes) > cs.max {
+		cs.ReliableStorage.Commit(ctx, nil)
+		return fmt.Errorf("too many writes in one commit: %v", len(writes))
+	}
+	return cs.ReliableStorage.Commit(ctx, writes)
+}
+
+func TestMaxDirtyBlocks(t *testing.T) {
+	base := &cappedStorage{persistent.NewSimpleReliable(persistent.NewMemory()), 40}
+	store := persistent.NewLimitedAppStorage(persistent.NewBufferedStorage(base), 32)
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Repeat("abcdefghijklmnopqrstuvwxyz", 10*1024)
+	testCreate(t, fs, "a", data)
+	if got := testReadAll(t, fs, "a"); got != data {
+		t.Fatalf("unexpected file contents: got %v bytes", len(got))
+	} else if err := CheckFilesystem(context.Background(), bfs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingStorage fails every commit with writes once `left` more have
+// succeeded, if `left` isn't negative.
+type failingStorage struct {
+	persistent.ReliableStorage
+	left int
+}
+
+func (f *failingStorage) Commit(ctx context.Context, writes map[uint64]persistent.WriteData) error {
+	if f.left == 0 && len(writes) > 0 {
+		f.ReliableStorage.Commit(ctx, nil)
+		return fmt.Errorf("failed to commit")
+	} else if f.left > 0 && len(writes) > 0 {
+		f.left--
+	}
+	return f.ReliableStorage.Commit(ctx, writes)
+}
+
+func TestMaxDirtyBlocksFailure(t *testing.T) {
+	ctx := context.Background()
+
+	base := &failingStorage{persistent.NewSimpleReliable(persistent.NewMemory()), -1}
+	store := persistent.NewLimitedAppStorage(persistent.NewBufferedStorage(base), 32)
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatal(err)
+	}
+
+	// Buffer enough writes that committing them takes several early commits,
+	// and let only the first of those succeed.
+	data := strings.Repeat("abcdefghijklmnopqrstuvwxyz", 4*1024)
+	for offset := 0; offset < len(data); offset += 4096 {
+		end := offset + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		write := &fuseops.WriteFileOp{Inode: create.Entry.Child, Offset: int64(offset), Data: []byte(data[offset:end])}
+		if err := fs.WriteFile(ctx, write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base.left = 1
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: create.Entry.Child}); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+	base.left = -1
+
+	// What was committed early is kept, and is a complete prefix of the file.
+	if err := CheckFilesystem(ctx, bfs); err != nil {
+		t.Fatal(err)
+	}
+	got := testReadAll(t, fs, "a")
+	if len(got) == 0 || len(got) == len(data) {
+		t.Fatalf("expected part of the file to be committed, got %v bytes", len(got))
+	} else if got != data[:len(got)] {
+		t.Fatal("unexpected file contents")
+	}
+}
+
+func TestMaxDirtyBlocksRestart(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	remote := &countingStorage{base: persistent.NewMemory()}
+	open := func() (persistent.ReliableStorage, *failingStorage, fuseutil.FileSystem) {
+		t.Helper()
+		wal, err := persistent.NewLocalWAL(remote, path.Join(name, "wal"), 1024, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		failing := &failingStorage{wal, -1}
+		integ, err := persistent.WithIntegrity(persistent.NewBufferedStorage(failing), "password", path.Join(name, "pin.json"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bfs, err := NewBlockFilesystem(persistent.NewLimitedAppStorage(integ, 32), 12, 1024, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := NewFilesystemWithOptions(bfs, Options{BackgroundCommit: time.Hour, BackgroundCommitBlocks: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wal, failing, fs
+	}
+	write := func(fs fuseutil.FileSystem, inode fuseops.InodeID, data string, offset int) {
+		t.Helper()
+		for ; offset < len(data); offset += 4096 {
+			end := offset + 4096
+			if end > len(data) {
+				end = len(data)
+			}
+			op := &fuseops.WriteFileOp{Inode: inode, Offset: int64(offset), Data: []byte(data[offset:end])}
+			if err := fs.WriteFile(ctx, op); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Buffer one large write, with uploads from the WAL paused so that none of
+	// it reaches remote storage. Committing it fails after a few parts have
+	// been committed early, and the client is stopped.
+	wal, failing, fs := open()
+	if err := persistent.PauseWAL(persistent.NewBufferedStorage(wal), true); err != nil {
+		t.Fatal(err)
+	}
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("abcdefghijklmnopqrstuvwxyz", 8*1024)
+	write(fs, create.Entry.Child, data, 0)
+	failing.left = 3
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: create.Entry.Child}); err == nil {
+		t.Fatal("expected commit to fail")
+	} else if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	} else if remote.sets != 0 {
+		t.Fatalf("expected nothing to be uploaded, got %v objects", remote.sets)
+	}
+
+	// After restarting, the file holds everything that was committed, which is
+	// uploaded from the WAL. The rest can be written from the file's size.
+	wal, _, fs = open()
+	got := testReadAll(t, fs, "a")
+	if len(got) == 0 || len(got) == len(data) {
+		t.Fatalf("expected part of the file to be kept, got %v bytes", len(got))
+	} else if got != data[:len(got)] {
+		t.Fatal("unexpected file contents")
+	}
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	write(fs, lookup.Entry.Child, data, len(got))
+	if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: lookup.Entry.Child}); err != nil {
+		t.Fatal(err)
+	} else if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remote storage has the whole file, without the WAL.
+	integ, err := persistent.WithIntegrity(persistent.NewBufferedStorage(persistent.NewSimpleReliable(remote)), "password", path.Join(name, "pin.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(integ), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := testReadAll(t, fs, "a"); got != data {
+		t.Fatalf("unexpected file contents after writing the rest: got %v bytes", len(got))
+	} else if err := CheckFilesystem(ctx, bfs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundCommit(t *testing.T) {
+	ctx := context.Background()
+
+	base := &commitCounter{BlockStorage: persistent.NewBlockMemory()}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(base), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{BackgroundCommit: time.Hour, BackgroundCommitBlocks: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes to different files should be buffered together, without being
+	// committed by operations that don't depend on them.
+	testCreate(t, fs, "a", "hello")
+	testCreate(t, fs, "b", "world")
+	commits := base.commits
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	} else if lookup.Entry.Attributes.Size != 5 {
+		t.Fatalf("unexpected size of file with buffered writes: %v", lookup.Entry.Attributes.Size)
+	} else if base.commits != commits {
+		t.Fatalf("buffered writes were committed early: %v commits", base.commits-commits)
+	}
+
+	// Reading a file with buffered writes should commit all of them at once.
+	if got := testReadAll(t, fs, "b"); got != "world" {
+		t.Fatalf("unexpected file contents: %q", got)
+	} else if base.commits != commits+1 {
+		t.Fatalf("expected one commit, got %v", base.commits-commits)
+	} else if got := testReadAll(t, fs, "a"); got != "hello" {
+		t.Fatalf("unexpected file contents: %q", got)
+	}
+
+	// Buffering more than the configured number of blocks should commit them,
+	// in addition to the commit that creates the file.
+	commits = base.commits
+	testCreate(t, fs, "c", strings.Repeat("c", 5000))
+	if base.commits != commits+2 {
+		t.Fatalf("expected large write to be committed, got %v commits", base.commits-commits)
+	} else if err := CheckFilesystem(ctx, bfs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackgroundCommitClose(t *testing.T) {
+	ctx := context.Background()
+
+	base := &commitCounter{BlockStorage: persistent.NewBlockMemory()}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(base), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{BackgroundCommit: time.Hour, Atime: AtimeStrict})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing a file should commit the writes to it, but not writes to files
+	// that are still open.
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "a", Mode: 0644}
+	if err := fs.CreateFile(ctx, create); err != nil {
+		t.Fatal(err)
+	}
+	write := &fuseops.WriteFileOp{Inode: create.Entry.Child, Handle: create.Handle, Data: []byte("hello")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "b", "world")
+	commits := base.commits
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: create.Entry.Child + 1}); err != nil {
+		t.Fatal(err)
+	} else if base.commits != commits+1 {
+		t.Fatalf("expected one commit, got %v", base.commits-commits)
+	}
+
+	// Releasing a file's last handle should commit writes made after it was
+	// flushed.
+	open := &fuseops.OpenFileOp{Inode: create.Entry.Child}
+	if err := fs.OpenFile(ctx, open); err != nil {
+		t.Fatal(err)
+	}
+	write.Offset, write.Data = 5, []byte(" there")
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	}
+	commits = base.commits
+	if err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: create.Handle}); err != nil {
+		t.Fatal(err)
+	} else if base.commits != commits {
+		t.Fatalf("write to open file was committed early: %v commits", base.commits-commits)
+	} else if err := fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}); err != nil {
+		t.Fatal(err)
+	} else if base.commits != commits+1 {
+		t.Fatalf("expected one commit, got %v", base.commits-commits)
+	}
+
+	// Unmounting should commit buffered writes and access times.
+	old := time.Now().Add(-time.Hour).Round(time.Second)
+	if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: create.Entry.Child, Atime: &old}); err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "c", "!")
+	if got := testReadAll(t, fs, "a"); got != "hello there" {
+		t.Fatalf("unexpected file contents: %q", got)
+	}
+	getattr := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+	if err := fs.GetInodeAttributes(ctx, getattr); err != nil {
+		t.Fatal(err)
+	} else if !getattr.Attributes.Atime.After(old) {
+		t.Fatalf("atime wasn't updated by reads: %v", getattr.Attributes.Atime)
+	}
+	fs.Destroy()
+
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := testReadAll(t, fs, "c"); got != "!" {
+		t.Fatalf("buffered write was lost: %q", got)
+	}
+	atime := getattr.Attributes.Atime
+	if err := fs.GetInodeAttributes(ctx, getattr); err != nil {
+		t.Fatal(err)
+	} else if !getattr.Attributes.Atime.Equal(atime) {
+		t.Fatalf("access time was lost: %v != %v", getattr.Attributes.Atime, atime)
+	}
+}
+
+func TestAtime(t *testing.T) {
+	ctx := context.Background()
+
+	base := &commitCounter{BlockStorage: persistent.NewBlockMemory()}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(base), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A long background commit interval keeps access times from being
+	// committed by the timer while the test is running.
+	fs, err := NewFilesystemWithOptions(bfs, Options{BackgroundCommit: time.Hour, Atime: AtimeStrict})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", strings.Repeat("a", 100*1024))
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	id := lookup.Entry.Child
+	old := time.Now().Add(-time.Hour).Round(time.Second)
+	setattr := &fuseops.SetInodeAttributesOp{Inode: id, Atime: &old}
+	if err := fs.SetInodeAttributes(ctx, setattr); err != nil {
+		t.Fatal(err)
+	}
+	getattr := &fuseops.GetInodeAttributesOp{Inode: id}
+	if err := fs.GetInodeAttributes(ctx, getattr); err != nil {
+		t.Fatal(err)
+	} else if !getattr.Attributes.Atime.Equal(old) {
+		t.Fatalf("atime wasn't set: %v", getattr.Attributes.Atime)
+	}
+
+	// Reading the whole file in several chunks should update the access time
+	// without committing anything until it's synced, and then commit once.
+	commits := base.commits
+	if got := testReadAll(t, fs, "a"); len(got) != 100*1024 {
+		t.Fatalf("unexpected file length: %v", len(got))
+	} else if base.commits != commits {
+		t.Fatalf("reads were committed early: %v commits", base.commits-commits)
+	} else if err := fs.GetInodeAttributes(ctx, getattr); err != nil {
+		t.Fatal(err)
+	} else if !getattr.Attributes.Atime.After(old) {
+		t.Fatalf("atime wasn't updated by reads: %v", getattr.Attributes.Atime)
+	}
+	read := getattr.Attributes.Atime
+	if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: id}); err != nil {
+		t.Fatal(err)
+	} else if base.commits != commits+1 {
+		t.Fatalf("expected one commit, got %v", base.commits-commits)
+	}
+
+	// The access time should have been persisted.
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := fs.GetInodeAttributes(ctx, getattr); err != nil {
+		t.Fatal(err)
+	} else if !getattr.Attributes.Atime.Equal(read) {
+		t.Fatalf("atime wasn't persisted: %v != %v", getattr.Attributes.Atime, read)
+	}
+}
+
+func TestRelatime(t *testing.T) {
+	ctx := context.Background()
+
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(persistent.NewBlockMemory()), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{BackgroundCommit: time.Hour, Atime: AtimeRelatime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", "hello")
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	id := lookup.Entry.Child
+
+	// An access time that's recent and newer than the file's modification is
+	// left alone, and one that's more than a day old is updated.
+	for _, tc := range []struct {
+		atime   time.Time
+		updated bool
+	}{
+		{time.Now().Add(time.Hour).Round(time.Second), false},
+		{time.Now().Add(-48 * time.Hour).Round(time.Second), true},
+	} {
+		setattr := &fuseops.SetInodeAttributesOp{Inode: id, Atime: &tc.atime}
+		if err := fs.SetInodeAttributes(ctx, setattr); err != nil {
+			t.Fatal(err)
+		} else if got := testReadAll(t, fs, "a"); got != "hello" {
+			t.Fatalf("unexpected file contents: %q", got)
+		}
+		getattr := &fuseops.GetInodeAttributesOp{Inode: id}
+		if err := fs.GetInodeAttributes(ctx, getattr); err != nil {
+			t.Fatal(err)
+		} else if updated := !getattr.Attributes.Atime.Equal(tc.atime); updated != tc.updated {
+			t.Fatalf("atime %v: expected update %v, got %v", tc.atime, tc.updated, getattr.Attributes.Atime)
+		}
+	}
+}
+
+func testReadAll(t *testing.T, fs fuseutil.FileSystem, name string) string {
+	ctx := context.Background()
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, 0)
+	for {
+		read := &fuseops.ReadFileOp{Inode: lookup.Entry.Child, Offset: int64(len(out)), Dst: make([]byte, 32*1024)}
+		if err := fs.ReadFile(ctx, read); err != nil {
+			t.Fatal(err)
+		} else if read.BytesRead == 0 {
+			return string(out)
+		}
+		out = append(out, read.Dst[:read.BytesRead]...)
+	}
+}
+
+func TestFilesystemAs(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemAs(bfs, 1234, 5678, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", "hello")
+
+	for _, inode := range []fuseops.InodeID{fuseops.RootInodeID, 2} {
+		op := &fuseops.GetInodeAttributesOp{Inode: inode}
+		if err := fs.GetInodeAttributes(ctx, op); err != nil {
+			t.Fatal(err)
+		} else if op.Attributes.Uid != 1234 || op.Attributes.Gid != 5678 {
+			t.Fatalf("unexpected owner: %v %v", op.Attributes.Uid, op.Attributes.Gid)
+		}
+	}
+}
+
+func TestIDMap(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := func(fs fuseutil.FileSystem, name string) (uint32, uint32) {
+		lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		if err := fs.LookUpInode(ctx, lookup); err != nil {
+			t.Fatal(err)
+		}
+		return lookup.Entry.Attributes.Uid, lookup.Entry.Attributes.Gid
+	}
+
+	// Create a file on one "machine", where the user is 1000:1000, and another
+	// on a second, where the same user is 501:20.
+	first, err := NewFilesystemAs(bfs, 1000, 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, first, "a", "hello")
+	second, err := NewFilesystemAs(bfs, 501, 20, map[uint32]uint32{1000: 501}, map[uint32]uint32{1000: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, second, "b", "hello")
+
+	// Both files should be stored as owned by 1000:1000.
+	third, err := NewFilesystemAs(bfs, 0, 0, map[uint32]uint32{1000: 42}, map[uint32]uint32{1000: 43})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if uid, gid := owner(second, name); uid != 501 || gid != 20 {
+			t.Fatalf("%v: unexpected owner: %v:%v", name, uid, gid)
+		} else if uid, gid := owner(third, name); uid != 42 || gid != 43 {
+			t.Fatalf("%v: unexpected owner: %v:%v", name, uid, gid)
+		}
+	}
+
+	// Unmapped ids are shown as the current user.
+	fourth, err := NewFilesystemAs(bfs, 7, 8, map[uint32]uint32{2000: 42}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid := owner(fourth, "a"); uid != 7 || gid != 8 {
+		t.Fatalf("unexpected owner: %v:%v", uid, gid)
+	}
+}
+
+func TestSyncFile(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	remote := persistent.NewMemory()
+	wal, err := persistent.NewLocalWAL(remote, path.Join(name, "wal"), 1024, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(persistent.NewBufferedStorage(wal)), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", "hello world")
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	} else if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: lookup.Entry.Child}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the process being killed and the WAL being lost, by remounting
+	// directly from remote storage.
+	bfs, err = NewBlockFilesystem(persistent.NewAppStorage(persistent.NewBufferedStorage(persistent.NewSimpleReliable(remote))), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	} else if data, ok := testRead(t, fs, "a"); !ok || data != "hello world" {
+		t.Fatalf("unexpected file contents after remount: %q", data)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	remote := persistent.NewMemory()
+	block, err := persistent.WithIntegrity(persistent.NewBufferedStorage(persistent.NewSimpleReliable(remote)), "password", path.Join(name, "pin.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := persistent.NewAppStorage(persistent.WithEncryption(block, "password"))
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", strings.Repeat("a", 20*1024))
+	testCreate(t, fs, "b", "hello")
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "c", strings.Repeat("c", 5*1024))
+
+	leaked, dangling, err := FindOrphans(ctx, bfs, remote)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(leaked) != 0 || len(dangling) != 0 {
+		t.Fatalf("unexpected orphans: leaked=%v dangling=%v", leaked, dangling)
+	}
+
+	// Find the key of the last block of c's data, and delete it.
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "c"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fs.(*filesystem)
+	fsys.nm.Start(ctx)
+	nd, err := fsys.nm.Open(ctx, fsys.ptr(lookup.Entry.Child))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := bfs.blocks(ctx, nd.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := store.Keys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := store.Keys(blocks[len(blocks)-1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.nm.Rollback(ctx)
+	var missing string
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			missing = key
+		}
+	}
+
+	if err := remote.Delete(ctx, missing); err != nil {
+		t.Fatal(err)
+	} else if err := remote.Set(ctx, "ffffffff", []byte("junk"), persistent.Unknown); err != nil {
+		t.Fatal(err)
+	}
+	leaked, dangling, err = FindOrphans(ctx, bfs, remote)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(leaked) != 1 || leaked[0] != "ffffffff" {
+		t.Fatalf("unexpected leaked objects: %v", leaked)
+	} else if len(dangling) != 1 || dangling[0] != missing {
+		t.Fatalf("unexpected dangling references: %v", dangling)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		testCompact(t, dedup)
+	}
+}
+
+func testCompact(t *testing.T, dedup bool) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	remote := persistent.NewMemory()
+	block, err := persistent.WithIntegrity(persistent.NewBufferedStorage(persistent.NewSimpleReliable(remote)), "password", path.Join(name, "pin.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := persistent.NewAppStorage(persistent.WithEncryption(block, "password"))
+	var bfs *BlockFilesystem
+	if dedup {
+		bfs, err = NewDedupBlockFilesystem(store, 12, 1024)
+	} else {
+		bfs, err = NewBlockFilesystem(store, 12, 1024, false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", strings.Repeat("a", 20*1024))
+	testCreate(t, fs, "b", "hello")
+	testCreate(t, fs, "c", strings.Repeat("a", 10*1024))
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "d", Mode: os.ModeDir | 0755}); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "e", strings.Repeat("e", 3*1024))
+	testReadAll(t, fs, "e")
+
+	// A sparse file's holes should survive its blocks being moved.
+	testCreate(t, fs, "g", "head")
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "g"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	} else if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: lookup.Entry.Child, Offset: 100 * 1024, Data: []byte("tail")}); err != nil {
+		t.Fatal(err)
+	}
+	testReadAll(t, fs, "g")
+	sparse := "head" + strings.Repeat("\x00", 100*1024-4) + "tail"
+
+	before, after, err := Compact(ctx, bfs)
+	if err != nil {
+		t.Fatal(err)
+	} else if after >= before {
+		t.Fatalf("compaction didn't shrink the filesystem: %v blocks before, %v after", before, after)
+	} else if err := CheckFilesystem(ctx, bfs); err != nil {
+		t.Fatal(err)
+	}
+	leaked, dangling, err := FindOrphans(ctx, bfs, remote)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(leaked) != 0 || len(dangling) != 0 {
+		t.Fatalf("unexpected orphans: leaked=%v dangling=%v", leaked, dangling)
+	}
+
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := testReadAll(t, fs, "b"); data != "hello" {
+		t.Fatalf("unexpected contents of b: %q", data)
+	} else if data := testReadAll(t, fs, "c"); data != strings.Repeat("a", 10*1024) {
+		t.Fatal("unexpected contents of c")
+	} else if data := testReadAll(t, fs, "e"); data != strings.Repeat("e", 3*1024) {
+		t.Fatal("unexpected contents of e")
+	} else if data := testReadAll(t, fs, "g"); data != sparse {
+		t.Fatal("unexpected contents of g")
+	}
+	lookup = &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "d"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	} else if !lookup.Entry.Attributes.Mode.IsDir() {
+		t.Fatal("d is no longer a directory")
+	}
+
+	// New blocks should be allocated after the compacted ones.
+	testCreate(t, fs, "f", strings.Repeat("f", 5*1024))
+	if data := testReadAll(t, fs, "f"); data != strings.Repeat("f", 5*1024) {
+		t.Fatal("unexpected contents of f")
+	} else if err := CheckFilesystem(ctx, bfs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{CaseInsensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func() []string {
+		op := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+		if err := fs.OpenDir(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		defer fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{Handle: op.Handle})
+
+		out := make([]string, 0)
+		for _, entry := range fs.(*filesystem).dirHandles[op.Handle].entries {
+			out = append(out, entry.Name)
+		}
+		// Lookups are answered from the open handle, which should also
+		// ignore case.
+		if data, ok := testRead(t, fs, "readme.txt"); ok && data != "hello" {
+			t.Fatalf("unexpected file contents: %q", data)
+		}
+		return out
+	}
+
+	testCreate(t, fs, "Readme.txt", "hello")
+	for _, name := range []string{"Readme.txt", "readme.txt", "README.TXT"} {
+		if data, ok := testRead(t, fs, name); !ok {
+			t.Fatalf("file not found: %v", name)
+		} else if data != "hello" {
+			t.Fatalf("unexpected file contents: %q", data)
+		}
+	}
+	if got := names(); len(got) != 1 || got[0] != "Readme.txt" {
+		t.Fatalf("unexpected directory entries: %v", got)
+	}
+
+	op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "readme.txt", Mode: 0644}
+	if err := fs.CreateFile(ctx, op); err != syscall.EEXIST {
+		t.Fatalf("expected file exists error, got: %v", err)
+	}
+
+	// Renaming to a different case only changes the name that's displayed.
+	if err := testRename(fs, "readme.TXT", "README.txt"); err != nil {
+		t.Fatal(err)
+	} else if got := names(); len(got) != 1 || got[0] != "README.txt" {
+		t.Fatalf("unexpected directory entries: %v", got)
+	} else if data, _ := testRead(t, fs, "readme.txt"); data != "hello" {
+		t.Fatalf("unexpected file contents: %q", data)
+	}
+
+	if err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "readme.txt"}); err != nil {
+		t.Fatal(err)
+	} else if got := names(); len(got) != 0 {
+		t.Fatalf("unexpected directory entries: %v", got)
+	}
+}
+
+func TestLayoutMismatch(t *testing.T) {
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	open := func(numPtrs, dataSize int64) error {
+		bfs, err := NewBlockFilesystem(store, numPtrs, dataSize, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewFilesystem(bfs)
+		return err
+	}
+
+	if err := open(12, 1024); err != nil {
+		t.Fatal(err)
+	} else if err := open(12, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(8, 1024); err == nil {
+		t.Fatal("opened repository with the wrong number of pointers")
+	} else if err := open(12, 2048); err == nil {
+		t.Fatal("opened repository with the wrong data size")
+	}
+}
+
+func TestRenameIntoDescendant(t *testing.T) {
+	ctx := context.Background()
+	fs := testArchive(t, false)
+
+	mkdir := func(parent fuseops.InodeID, name string) fuseops.InodeID {
+		op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: os.ModeDir | 0755}
+		if err := fs.MkDir(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		return op.Entry.Child
+	}
+	a := mkdir(fuseops.RootInodeID, "a")
+	b := mkdir(a, "b")
+	c := mkdir(b, "c")
+	testCreate(t, fs, "d", "hello")
+
+	// mv a a/b/c, first walking up from the destination, and then searching
+	// beneath a after the kernel has forgotten the directories.
+	for _, forget := range []bool{false, true} {
+		if forget {
+			for _, id := range []fuseops.InodeID{a, b, c} {
+				if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: id, N: 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, parent := range []fuseops.InodeID{c, b, a} {
+			op := &fuseops.RenameOp{OldParent: fuseops.RootInodeID, OldName: "a", NewParent: parent, NewName: "a"}
+			if err := fs.Rename(ctx, op); err != fuse.EINVAL {
+				t.Fatalf("expected EINVAL, got: %v", err)
+			}
+		}
+	}
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	} else if lookup.Entry.Child != a {
+		t.Fatal("directory was moved")
+	}
+	for _, parent := range []fuseops.InodeID{a, b, c} {
+		lookup := &fuseops.LookUpInodeOp{Parent: parent, Name: "a"}
+		if err := fs.LookUpInode(ctx, lookup); err != fuse.ENOENT {
+			t.Fatalf("expected ENOENT, got: %v", err)
+		}
+	}
+
+	// Moving things into a directory that's elsewhere in the tree still works.
+	op := &fuseops.RenameOp{OldParent: a, OldName: "b", NewParent: fuseops.RootInodeID, NewName: "b"}
+	if err := fs.Rename(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+	op = &fuseops.RenameOp{OldParent: fuseops.RootInodeID, OldName: "d", NewParent: c, NewName: "d"}
+	if err := fs.Rename(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+	op = &fuseops.RenameOp{OldParent: fuseops.RootInodeID, OldName: "a", NewParent: c, NewName: "a"}
+	if err := fs.Rename(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenameOverExisting(t *testing.T) {
+	ctx := context.Background()
+
+	for _, isArchive := range []bool{false, true} {
+		fs := testArchive(t, isArchive)
+		mkdir := func(name string) fuseops.InodeID {
+			op := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: name, Mode: os.ModeDir | 0755}
+			if err := fs.MkDir(ctx, op); err != nil {
+				t.Fatal(err)
+			}
+			return op.Entry.Child
+		}
+		testCreate(t, fs, "file1", "hello")
+		testCreate(t, fs, "file2", "world")
+		mkdir("dir1")
+		mkdir("empty1")
+		mkdir("empty2")
+		full := mkdir("full")
+		if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: full, Name: "child", Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			from, to string
+			err      error
+		}{
+			{"file1", "dir1", syscall.EISDIR},
+			{"dir1", "file1", fuse.ENOTDIR},
+			{"dir1", "full", fuse.ENOTEMPTY},
+			{"empty1", "empty2", nil},
+			{"file1", "file2", nil},
+		} {
+			if err := testRename(fs, tc.from, tc.to); err != tc.err {
+				t.Fatalf("archive=%v: %v -> %v: expected %v, got: %v", isArchive, tc.from, tc.to, tc.err, err)
+			}
+		}
+
+		// Every failed rename should have left both names as they were.
+		if _, ok := testRead(t, fs, "file1"); ok {
+			t.Fatal("renamed file still exists")
+		} else if data, _ := testRead(t, fs, "file2"); data != "hello" {
+			t.Fatalf("unexpected data in renamed file: %q", data)
+		}
+		for _, name := range []string{"dir1", "full", "empty2"} {
+			lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+			if err := fs.LookUpInode(ctx, lookup); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			} else if !lookup.Entry.Attributes.Mode.IsDir() {
+				t.Fatalf("%v is no longer a directory", name)
+			}
+		}
+		lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "empty1"}
+		if err := fs.LookUpInode(ctx, lookup); err != fuse.ENOENT {
+			t.Fatalf("expected ENOENT, got: %v", err)
+		}
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	ctx := context.Background()
+	long := strings.Repeat("a", 256)
+
+	for _, isArchive := range []bool{false, true} {
+		fs := testArchive(t, isArchive)
+		testCreate(t, fs, "file", "hello")
+		testCreate(t, fs, long[:255], "hello")
+
+		for _, tc := range []struct {
+			name string
+			err  error
+		}{
+			{long, syscall.ENAMETOOLONG},
+			{"", fuse.EINVAL},
+			{".", fuse.EINVAL},
+			{"..", fuse.EINVAL},
+			{"a/b", fuse.EINVAL},
+			{"a\x00b", fuse.EINVAL},
+		} {
+			if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: tc.name, Mode: os.ModeDir | 0755}); err != tc.err {
+				t.Fatalf("archive=%v: mkdir %q: expected %v, got: %v", isArchive, tc.name, tc.err, err)
+			} else if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: tc.name, Mode: 0644}); err != tc.err {
+				t.Fatalf("archive=%v: create %q: expected %v, got: %v", isArchive, tc.name, tc.err, err)
+			} else if err := fs.CreateSymlink(ctx, &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: tc.name, Target: "file"}); err != tc.err {
+				t.Fatalf("archive=%v: symlink %q: expected %v, got: %v", isArchive, tc.name, tc.err, err)
+			} else if err := fs.MkNode(ctx, &fuseops.MkNodeOp{Parent: fuseops.RootInodeID, Name: tc.name, Mode: 0644}); err != tc.err {
+				t.Fatalf("archive=%v: mknod %q: expected %v, got: %v", isArchive, tc.name, tc.err, err)
+			} else if err := testRename(fs, "file", tc.name); err != tc.err {
+				t.Fatalf("archive=%v: rename to %q: expected %v, got: %v", isArchive, tc.name, tc.err, err)
+			}
+		}
+		if data, _ := testRead(t, fs, "file"); data != "hello" {
+			t.Fatalf("archive=%v: file was changed by a failed rename: %q", isArchive, data)
+		}
+	}
+
+	// The limit can be lowered.
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{MaxNameLength: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "abcd", "hello")
+	if err := fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "abcde", Mode: 0644}); err != syscall.ENAMETOOLONG {
+		t.Fatalf("expected name over the limit to be rejected, got: %v", err)
+	} else if err := testRename(fs, "abcd", "abcde"); err != syscall.ENAMETOOLONG {
+		t.Fatalf("expected rename over the limit to be rejected, got: %v", err)
+	}
+}
+
+// countingStorage is an ObjectStorage implementation that counts the number of
+// objects read from and written to it.
+type countingStorage struct {
+	base        persistent.ObjectStorage
+	reads, sets int
+}
+
+func (cs *countingStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	cs.reads++
+	return cs.base.Get(ctx, key)
+}
+
+func (cs *countingStorage) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	cs.reads += len(keys)
+	return cs.base.(persistent.BatchObjectStorage).GetMany(ctx, keys)
+}
+
+func (cs *countingStorage) Set(ctx context.Context, key string, data []byte, dt persistent.DataType) error {
+	cs.sets++
+	return cs.base.Set(ctx, key, data, dt)
+}
+
+func (cs *countingStorage) Delete(ctx context.Context, key string) error {
+	return cs.base.Delete(ctx, key)
+}
+
+func (cs *countingStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	return cs.base.List(ctx, prefix)
+}
+
+func (cs *countingStorage) Close() error { return cs.base.Close() }
+
+func TestWarmCache(t *testing.T) {
+	ctx := context.Background()
+	mem := persistent.NewMemory()
+	open := func(base persistent.ObjectStorage, opts Options) fuseutil.FileSystem {
+		relStore := persistent.NewCache(persistent.NewSimpleReliable(base), 1024)
+		store := persistent.NewAppStorage(persistent.NewBufferedStorage(relStore))
+		bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := NewFilesystemWithOptions(bfs, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+
+	fs := open(mem, Options{})
+	parent := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range []string{"a", "b", "c"} {
+		op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: os.ModeDir | 0755}
+		if err := fs.MkDir(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		parent = op.Entry.Child
+	}
+	testCreate(t, fs, "d", strings.Repeat("d", 5000))
+
+	browse := func(fs fuseutil.FileSystem) {
+		parent := fuseops.InodeID(fuseops.RootInodeID)
+		for _, name := range []string{"a", "b", "c"} {
+			op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+			if err := fs.LookUpInode(ctx, op); err != nil {
+				t.Fatal(err)
+			}
+			parent = op.Entry.Child
+		}
+	}
+	for _, tc := range []struct {
+		depth int
+		warm  bool
+	}{{0, false}, {2, false}, {3, true}} {
+		counter := &countingStorage{base: mem}
+		fs := open(counter, Options{WarmDepth: tc.depth})
+		counter.reads = 0
+		browse(fs)
+		if warm := counter.reads == 0; warm != tc.warm {
+			t.Fatalf("depth %v: unexpected number of reads after mounting: %v", tc.depth, counter.reads)
+		}
+	}
+}
+
+// hangingStorage is a BlockStorage implementation where reads block until the
+// context is cancelled, once `hang` is set.
+type hangingStorage struct {
+	persistent.BlockStorage
+	hang bool
+}
+
+func (hs *hangingStorage) Get(ctx context.Context, key uint64) ([]byte, error) {
+	if hs.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return hs.BlockStorage.Get(ctx, key)
+}
+
+func (hs *hangingStorage) GetMany(ctx context.Context, keys []uint64) (map[uint64][]byte, error) {
+	if hs.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return hs.BlockStorage.GetMany(ctx, keys)
+}
+
+func TestOpTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	store := &hangingStorage{BlockStorage: persistent.NewBlockMemory()}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(store), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", "hello")
+	if got := testReadAll(t, fs, "a"); got != "hello" {
+		t.Fatalf("unexpected file contents: %q", got)
+	}
+
+	// Open the filesystem again, so that nothing is cached.
+	fs, err = NewFilesystemWithOptions(bfs, Options{OpTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.hang = true
+	start := time.Now()
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != fuse.EIO {
+		t.Fatalf("expected I/O error, got: %v", err)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("operation took too long to time out: %v", elapsed)
+	}
+	xattr := &fuseops.GetXattrOp{Inode: fuseops.RootInodeID, Name: "user.a", Dst: make([]byte, 16)}
+	if err := fs.GetXattr(ctx, xattr); err != fuse.EIO {
+		t.Fatalf("expected I/O error, got: %v", err)
+	}
+
+	store.hang = false
+	if got := testReadAll(t, fs, "a"); got != "hello" {
+		t.Fatalf("unexpected file contents: %q", got)
+	}
+}
+
+func TestSparseWrite(t *testing.T) {
+	testSparseWrite(t, false)
+	testSparseWrite(t, true)
+}
+
+func testSparseWrite(t *testing.T, isArchive bool) {
+	ctx := context.Background()
+	fs := testArchive(t, isArchive)
+	var inner *filesystem
+	if isArchive {
+		inner = fs.(archive).filesystem
+	} else {
+		inner = fs.(*filesystem)
+	}
+	blocks := func() uint64 {
+		inner.nm.Start(ctx)
+		defer inner.nm.Rollback(ctx)
+		state, err := inner.nm.State(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.NextPtr
+	}
+	testCreate(t, fs, "a", "header")
+	before := blocks()
+
+	// Writing far past the end of the file, like restoring a sparse image
+	// does, should only allocate the blocks needed to reach the new data.
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(10*1024*1024 + 3)
+	write := &fuseops.WriteFileOp{Inode: lookup.Entry.Child, Offset: offset, Data: []byte("tail")}
+	if err := fs.WriteFile(ctx, write); err != nil {
+		t.Fatal(err)
+	} else if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: lookup.Entry.Child}); err != nil {
+		t.Fatal(err)
+	} else if n := blocks() - before; n > 20 {
+		t.Fatalf("write past end of file allocated too many blocks: %v", n)
+	}
+
+	read := func(offset int64, n int) string {
+		op := &fuseops.ReadFileOp{Inode: lookup.Entry.Child, Offset: offset, Dst: make([]byte, n)}
+		if err := fs.ReadFile(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		return string(op.Dst[:op.BytesRead])
+	}
+	if got := read(0, 8); got != "header\x00\x00" {
+		t.Fatalf("unexpected start of file: %q", got)
+	} else if got := read(5*1024*1024, 4); got != "\x00\x00\x00\x00" {
+		t.Fatalf("unexpected middle of file: %q", got)
+	} else if got := read(offset-2, 10); got != "\x00\x00tail" {
+		t.Fatalf("unexpected end of file: %q", got)
+	} else if err := CheckFilesystem(ctx, inner.nm.bfs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hole marked the repository as using holes, so that a version which
+	// doesn't know about them refuses to open it.
+	header, _, err := inner.nm.bfs.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if header.Features&persistent.FeatureHoles == 0 {
+		t.Fatalf("unexpected header: %+v", header)
+	} else if err := checkFeatures(header.Features, persistent.KnownFeatures); err != nil {
+		t.Fatal(err)
+	} else if err := checkFeatures(header.Features, persistent.KnownFeatures&^persistent.FeatureHoles); err == nil {
+		t.Fatal("expected repository with holes to be refused by a version without them")
+	}
+}
+
+func TestLongSymlink(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The target spans several blocks, and ends part way through one.
+	target := strings.Repeat("0123456789/", 350)
+	create := &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "link", Target: target}
+	if err := fs.CreateSymlink(ctx, create); err != nil {
+		t.Fatal(err)
+	} else if create.Entry.Attributes.Size != uint64(len(target)) {
+		t.Fatalf("unexpected size: %v", create.Entry.Attributes.Size)
+	}
+
+	// Read it back through a new filesystem, so that nothing is cached.
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := &fuseops.ReadSymlinkOp{Inode: create.Entry.Child}
+	if err := fs.ReadSymlink(ctx, read); err != nil {
+		t.Fatal(err)
+	} else if read.Target != target {
+		t.Fatalf("target read back with %v bytes, expected %v", len(read.Target), len(target))
+	}
+}
+
+func testInline(t testing.TB, threshold int) (*filesystem, func() uint64) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 32*1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{InlineThreshold: threshold})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := fs.(*filesystem)
+	blocks := func() uint64 {
+		inner.nm.Start(ctx)
+		defer inner.nm.Rollback(ctx)
+		state, err := inner.nm.State(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.NextPtr
+	}
+	return inner, blocks
+}
+
+func TestInlineFiles(t *testing.T) {
+	ctx := context.Background()
+	fs, blocks := testInline(t, 100)
+
+	// A small file should only take up the block with its metadata.
+	before := blocks()
+	testCreate(t, fs, "a", "hello")
+	if n := blocks() - before; n != 1 {
+		t.Fatalf("small file used %v blocks", n)
+	}
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	inode := lookup.Entry.Child
+
+	// Growing it past the threshold should move its data out of its metadata,
+	// and nothing should be lost either way.
+	write := func(offset int64, data string) {
+		op := &fuseops.WriteFileOp{Inode: inode, Offset: offset, Data: []byte(data)}
+		if err := fs.WriteFile(ctx, op); err != nil {
+			t.Fatal(err)
+		} else if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: inode}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	truncate := func(size uint64) {
+		if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: inode, Size: &size}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.nm.cache.Delete(fs.ptr(inode))
+	write(8, "world")
+	if data, _ := testRead(t, fs, "a"); data != "hello\x00\x00\x00world" {
+		t.Fatalf("unexpected data in inline file: %q", data)
+	}
+	truncate(90)
+	if data, _ := testRead(t, fs, "a"); len(data) != 90 || data[:13] != "hello\x00\x00\x00world" {
+		t.Fatalf("unexpected data after growing inline file: %q", data)
+	} else if n := blocks() - before; n != 1 {
+		t.Fatalf("inline file used %v blocks", n)
+	}
+	long := strings.Repeat("x", 200)
+	write(5, long)
+	fs.nm.cache.Delete(fs.ptr(inode))
+	if data, _ := testRead(t, fs, "a"); data != "hello"+long {
+		t.Fatalf("unexpected data after growing past threshold: %q", data)
+	} else if n := blocks() - before; n != 2 {
+		t.Fatalf("file past threshold used %v blocks", n)
+	}
+	truncate(3)
+	if data, _ := testRead(t, fs, "a"); data != "hel" {
+		t.Fatalf("unexpected data after truncating: %q", data)
+	} else if err := CheckFilesystem(ctx, fs.nm.bfs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing the file inline marked the repository as using inline files,
+	// which survives the header being stamped, and a repository with features
+	// that aren't known is refused.
+	bfs := fs.nm.bfs
+	if err := bfs.CheckHeader(ctx, persistent.KDFParams{}); err != nil {
+		t.Fatal(err)
+	} else if header, _, err := bfs.Info(ctx); err != nil {
+		t.Fatal(err)
+	} else if header.Features != persistent.FeatureInline || header.NumPtrs == 0 {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	if err := bfs.store.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Header.Features |= 1 << 63
+	if err := bfs.store.Commit(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := bfs.CheckHeader(ctx, persistent.KDFParams{}); err == nil {
+		t.Fatal("expected repository with unknown features to be refused")
+	}
+}
+
+// BenchmarkCreateTree measures creating a tree of many small files, similar to
+// unpacking a node_modules folder, with and without small files being stored
+// inline with their metadata.
+func BenchmarkCreateTree(b *testing.B) {
+	for _, threshold := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("inline=%v", threshold), func(b *testing.B) {
+			benchmarkCreateTree(b, threshold)
+		})
+	}
+}
+
+func benchmarkCreateTree(b *testing.B, threshold int) {
+	ctx := context.Background()
+	fs, blocks := testInline(b, threshold)
+	before := blocks()
+
+	// Most files in a package are a few hundred bytes to a few KiB, with the
+	// occasional larger bundle.
+	sizes := []int{120, 350, 800, 1500, 2500, 4000, 600, 90, 12000, 3000}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkg := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: fmt.Sprintf("pkg%v", i), Mode: os.ModeDir | 0755}
+		if err := fs.MkDir(ctx, pkg); err != nil {
+			b.Fatal(err)
+		}
+		for j, size := range sizes {
+			op := &fuseops.CreateFileOp{Parent: pkg.Entry.Child, Name: fmt.Sprintf("file%v.js", j), Mode: 0644}
+			if err := fs.CreateFile(ctx, op); err != nil {
+				b.Fatal(err)
+			}
+			write := &fuseops.WriteFileOp{Inode: op.Entry.Child, Handle: op.Handle, Data: make([]byte, size)}
+			if err := fs.WriteFile(ctx, write); err != nil {
+				b.Fatal(err)
+			} else if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: op.Entry.Child, Handle: op.Handle}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(blocks()-before)/float64(b.N), "blocks/op")
+}
+
+func TestMetrics(t *testing.T) {
+	// The metrics are global, so clear out whatever earlier runs left in them.
+	FuseOpDuration.Reset()
+	FuseOpErrors.Reset()
+
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(persistent.NewBlockMemory()), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{Metrics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", "hello")
+	if _, ok := testRead(t, fs, "b"); ok {
+		t.Fatal("unexpected file found")
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(FuseOpDuration, FuseOpErrors)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed, failed := make(map[string]uint64), make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := "" // Label values, in order of label name.
+			for _, label := range m.GetLabel() {
+				labels += label.GetValue() + " "
+			}
+			if family.GetName() == "fuse_op_duration_seconds" {
+				observed[labels] = m.GetHistogram().GetSampleCount()
+			} else {
+				failed[labels] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	if observed["CreateFile "] != 1 || observed["WriteFile "] != 1 || observed["LookUpInode "] != 1 {
+		t.Fatalf("unexpected operations observed: %v", observed)
+	} else if len(failed) != 1 || failed["ENOENT LookUpInode "] != 1 {
+		t.Fatalf("unexpected errors counted: %v", failed)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+
+	for _, ttl := range []time.Duration{NoCacheTTL, 0, time.Hour} {
+		bfs, err := NewBlockFilesystem(persistent.NewAppStorage(persistent.NewBlockMemory()), 12, 1024, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := NewFilesystemWithOptions(bfs, Options{AttrCacheTTL: ttl, EntryCacheTTL: ttl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCreate(t, fs, "a", "hello")
+
+		lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+		if err := fs.LookUpInode(ctx, lookup); err != nil {
+			t.Fatal(err)
+		}
+		attrs, entry := lookup.Entry.AttributesExpiration, lookup.Entry.EntryExpiration
+		expected := cacheTTL(ttl)
+		if expected == 0 && (!attrs.IsZero() || !entry.IsZero()) {
+			t.Fatalf("expected no caching, got expirations: %v, %v", attrs, entry)
+		} else if expected > 0 && (attrs.Before(now().Add(expected-time.Second)) || entry.Before(now().Add(expected-time.Second))) {
+			t.Fatalf("expected expirations in %v, got: %v, %v", expected, attrs, entry)
+		}
+
+		// A file created while the directory is open is only missed by
+		// lookups if they're answered from the open handle, which shouldn't
+		// happen without caching.
+		op := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+		if err := fs.OpenDir(ctx, op); err != nil {
+			t.Fatal(err)
+		}
+		testCreate(t, fs, "b", "world")
+		_, ok := testRead(t, fs, "b")
+		if expected == 0 && !ok {
+			t.Fatal("file created while directory was open not found")
+		} else if expected > 0 && ok {
+			t.Fatal("expected lookup to be answered from open directory")
+		}
+		if err := fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{Handle: op.Handle}); err != nil {
+			t.Fatal(err)
+		} else if _, ok := testRead(t, fs, "b"); !ok {
+			t.Fatal("file not found after directory was closed")
+		}
+	}
+
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(persistent.NewBlockMemory()), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := NewFilesystemWithOptions(bfs, Options{AttrCacheTTL: -time.Second}); err == nil {
+		t.Fatal("expected negative ttl to be rejected")
+	}
+}
+
+type startCounter struct {
+	persistent.BlockStorage
+	starts int
+}
+
+func (sc *startCounter) Start(ctx context.Context, prefetch []uint64) (map[uint64][]byte, error) {
+	sc.starts++
+	return sc.BlockStorage.Start(ctx, prefetch)
+}
+
+func TestPinSaveInterval(t *testing.T) {
+	sc := &startCounter{BlockStorage: persistent.NewBlockMemory()}
+	bfs, err := NewBlockFilesystem(persistent.NewAppStorage(sc), 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts := func() int {
+		fs.(*filesystem).mu.Lock()
+		defer fs.(*filesystem).mu.Unlock()
+		return sc.starts
+	}
+
+	// `after` hands each delay to the test, and waits to be told that it has
+	// passed. It's called again once the previous transaction is done.
+	delays, ticks := make(chan time.Duration), make(chan time.Time)
+	after := func(delay time.Duration) <-chan time.Time {
+		delays <- delay
+		return ticks
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fs.(*filesystem).checkPins(10*time.Second, after)
+	}()
+
+	delay := <-delays
+	for i := 0; i < 3; i++ {
+		if delay < 5*time.Second || delay >= 15*time.Second {
+			t.Fatalf("unexpected delay: %v", delay)
+		}
+		before := starts()
+		ticks <- time.Now()
+		delay = <-delays
+		if n := starts() - before; n != 1 {
+			t.Fatalf("expected one transaction to be started, got: %v", n)
+		}
+	}
+
+	// Destroying the filesystem stops them.
+	fs.Destroy()
+	<-done
+}
+
+func TestSubdir(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "projects", Mode: os.ModeDir | 0755}
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "top", "hello")
+
+	for _, subdir := range []string{"missing", "top", "projects/../top"} {
+		if _, err := NewFilesystemWithOptions(bfs, Options{Subdir: subdir}); err == nil {
+			t.Fatalf("expected error mounting %v", subdir)
+		}
+	}
+	sub, err := NewFilesystemWithOptions(bfs, Options{Subdir: "/projects/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, sub, "a", "hello")
+	if _, ok := testRead(t, sub, "top"); ok {
+		t.Fatal("file outside of subdirectory should not be visible")
+	} else if data, ok := testRead(t, sub, "a"); !ok || data != "hello" {
+		t.Fatalf("unexpected contents: %q", data)
+	}
+
+	attrs := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := sub.GetInodeAttributes(ctx, attrs); err != nil {
+		t.Fatal(err)
+	} else if !attrs.Attributes.Mode.IsDir() {
+		t.Fatalf("unexpected mode of root: %v", attrs.Attributes.Mode)
+	}
+
+	// The file is in the subdirectory when the whole repository is mounted.
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := &fuseops.LookUpInodeOp{Parent: mkdir.Entry.Child, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateModes(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFilesystemWithOptions(bfs, Options{ForceMode: true, DirMode: 0775}); err == nil {
+		t.Fatal("expected forcing modes without a file mode to fail")
+	} else if _, err := NewFilesystemWithOptions(bfs, Options{FileMode: os.ModeDir | 0664}); err == nil {
+		t.Fatal("expected mode with more than permission bits to fail")
+	}
+
+	for _, force := range []bool{false, true} {
+		fs, err := NewFilesystemWithOptions(bfs, Options{DirMode: 0070, FileMode: 0060, ForceMode: force})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("%v", force)
+		mkdir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: name, Mode: os.ModeDir | 0755}
+		if err := fs.MkDir(ctx, mkdir); err != nil {
+			t.Fatal(err)
+		}
+		create := &fuseops.CreateFileOp{Parent: mkdir.Entry.Child, Name: "a", Mode: 0644}
+		if err := fs.CreateFile(ctx, create); err != nil {
+			t.Fatal(err)
+		}
+		symlink := &fuseops.CreateSymlinkOp{Parent: mkdir.Entry.Child, Name: "b", Target: "a"}
+		if err := fs.CreateSymlink(ctx, symlink); err != nil {
+			t.Fatal(err)
+		}
+
+		dirMode, fileMode := os.ModeDir|0775, os.FileMode(0664)
+		if force {
+			dirMode, fileMode = os.ModeDir|0070, 0060
+		}
+		if mode := mkdir.Entry.Attributes.Mode; mode != dirMode {
+			t.Fatalf("unexpected mode of directory: %v", mode)
+		} else if mode := create.Entry.Attributes.Mode; mode != fileMode {
+			t.Fatalf("unexpected mode of file: %v", mode)
+		} else if mode := symlink.Entry.Attributes.Mode; mode != os.ModeSymlink|0755 {
+			t.Fatalf("unexpected mode of symlink: %v", mode)
+		}
+
+		// Changing the mode of an existing file isn't affected.
+		mode := os.FileMode(0600)
+		setattr := &fuseops.SetInodeAttributesOp{Inode: create.Entry.Child, Mode: &mode}
+		attrs := &fuseops.GetInodeAttributesOp{Inode: create.Entry.Child}
+		if err := fs.SetInodeAttributes(ctx, setattr); err != nil {
+			t.Fatal(err)
+		} else if err := fs.GetInodeAttributes(ctx, attrs); err != nil {
+			t.Fatal(err)
+		} else if attrs.Attributes.Mode != 0600 {
+			t.Fatalf("unexpected mode after chmod: %v", attrs.Attributes.Mode)
+		}
+	}
+}
+
+func TestReadAtEOF(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystemWithOptions(bfs, Options{InlineThreshold: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[fuseops.InodeID][]byte)
+	create := func(name string, size int) fuseops.InodeID {
+		data := make([]byte, size)
+		rand.Read(data)
+		op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: name, Mode: 0644}
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatal(err)
+		} else if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: op.Entry.Child, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		files[op.Entry.Child] = data
+		return op.Entry.Child
+	}
+	truncate := func(id fuseops.InodeID, size int) {
+		sz := uint64(size)
+		if err := fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: id, Size: &sz}); err != nil {
+			t.Fatal(err)
+		}
+		data := files[id]
+		if size < len(data) {
+			files[id] = data[:size]
+		} else {
+			files[id] = append(data, make([]byte, size-len(data))...)
+		}
+	}
+	create("empty", 0)
+	create("inline", 50)
+	create("partial", 1000)
+	create("block", 1024)
+	create("blocks", 3*1024)
+	create("tail", 2*1024+500)
+	// The old data past the new end of the file mustn't come back when it
+	// grows again.
+	truncate(create("shrunk", 2*1024+500), 1500)
+	grown := create("grown", 1500)
+	truncate(grown, 1024)
+	truncate(grown, 3000)
+	truncate(create("inline-grown", 50), 80)
+	truncate(create("inline-shrunk", 80), 20)
+	sparse := create("sparse", 10)
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: sparse, Offset: 2500, Data: []byte("end")}); err != nil {
+		t.Fatal(err)
+	}
+	files[sparse] = append(append(files[sparse], make([]byte, 2490)...), "end"...)
+
+	for id, data := range files {
+		size := int64(len(data))
+		offsets := []int64{0, 1, size - 1, size, size + 1, size + 1024, 1 << 40}
+		for b := int64(1024); b <= size+1024; b += 1024 {
+			offsets = append(offsets, b-1, b, b+1)
+		}
+		for _, offset := range offsets {
+			if offset < 0 {
+				continue
+			}
+			for _, length := range []int{0, 1, 100, 1024, 1500, 5000} {
+				read := &fuseops.ReadFileOp{Inode: id, Offset: offset, Dst: make([]byte, length)}
+				if err := fs.ReadFile(ctx, read); err != nil {
+					t.Fatalf("size=%v offset=%v length=%v: %v", size, offset, length, err)
+				}
+				var expected []byte
+				if offset < size {
+					end := offset + int64(length)
+					if end > size {
+						end = size
+					}
+					expected = data[offset:end]
+				}
+				if got := read.Dst[:read.BytesRead]; !bytes.Equal(got, expected) {
+					t.Fatalf("size=%v offset=%v length=%v: read %v bytes, expected %v", size, offset, length, len(got), len(expected))
+				}
+			}
+		}
+	}
+}
+
+// interruptingStorage is an ObjectStorage implementation that calls `fn` once,
+// after the next read, like another client committing changes in the middle of
+// a transaction. `fn` may set itself again.
+type interruptingStorage struct {
+	persistent.AtomicObjectStorage
+	fn func()
+}
+
+func (is *interruptingStorage) interrupt() {
+	if fn := is.fn; fn != nil {
+		is.fn = nil
+		fn()
+	}
+}
+
+func (is *interruptingStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	defer is.interrupt()
+	return is.AtomicObjectStorage.Get(ctx, key)
+}
+
+func TestDetectConflicts(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(store persistent.ObjectStorage, pinFile string) fuseutil.FileSystem {
+		t.Helper()
+		shared, err := persistent.NewSharedReliable(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		integ, err := persistent.WithIntegrity(persistent.NewBufferedStorage(shared), "password", pinFile, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bfs, err := NewBlockFilesystem(persistent.NewAppStorage(integ), 12, 1024, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := NewFilesystemWithOptions(bfs, Options{DetectConflicts: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+	mkdir := func(fs fuseutil.FileSystem, name string) error {
+		return fs.MkDir(ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: name, Mode: os.ModeDir | 0755})
+	}
+	lookup := func(fs fuseutil.FileSystem, name string) error {
+		return fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name})
+	}
+
+	remote := persistent.NewMemory().(persistent.AtomicObjectStorage)
+	interrupting := &interruptingStorage{AtomicObjectStorage: remote}
+	a := open(remote, dir+"/a.json")
+	b := open(interrupting, dir+"/b.json")
+
+	// Changes committed by one client are seen by the other, even once it has
+	// the root directory cached.
+	if err := lookup(b, "a"); err != fuse.ENOENT {
+		t.Fatalf("expected lookup of missing directory to fail, got: %v", err)
+	} else if err := mkdir(a, "a"); err != nil {
+		t.Fatal(err)
+	} else if err := lookup(b, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first client commits in the middle of the second's operation, so the
+	// second's operation is started over, and both changes are kept.
+	interrupting.fn = func() {
+		if err := mkdir(a, "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mkdir(b, "c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := lookup(a, name); err != nil {
+			t.Fatal(err)
+		} else if err := lookup(b, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An operation that conflicts every time it's tried eventually fails, and
+	// isn't committed.
+	n := 0
+	var interrupt func()
+	interrupt = func() {
+		n++
+		if err := mkdir(a, fmt.Sprintf("d%v", n)); err != nil {
+			t.Fatal(err)
+		}
+		interrupting.fn = interrupt
+	}
+	interrupting.fn = interrupt
+	if err := mkdir(b, "e"); err != fuse.EIO {
+		t.Fatalf("expected I/O error, got: %v", err)
+	}
+	interrupting.fn = nil
+	if err := lookup(a, "e"); err != fuse.ENOENT {
+		t.Fatalf("expected lookup of uncommitted directory to fail, got: %v", err)
+	} else if err := lookup(b, fmt.Sprintf("d%v", n)); err != nil {
+		t.Fatal(err)
+	}
+}
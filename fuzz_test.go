@@ -0,0 +1,41 @@
+//go:build go1.18
+// +build go1.18
+
+package utahfs
+
+import (
+	"testing"
+
+	"bytes"
+)
+
+func FuzzBlockUnmarshal(f *testing.F) {
+	bfs := &BlockFilesystem{numPtrs: 3, dataSize: 32}
+
+	b := &block{parent: bfs, ptrs: []uint64{5, nilPtr, holePtr}, data: []byte("hello")}
+	f.Add(b.Marshal())
+	f.Add(make([]byte, bfs.blockSize()))
+	f.Add(bytes.Repeat([]byte{0xff}, int(bfs.blockSize())))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		b := &block{parent: bfs}
+		if err := b.Unmarshal(raw); err != nil {
+			return
+		} else if len(b.ptrs) != int(bfs.numPtrs) {
+			t.Fatalf("unexpected number of pointers: %v", len(b.ptrs))
+		} else if int64(len(b.data)) > bfs.dataSize {
+			t.Fatalf("data is larger than the block: %v", len(b.data))
+		}
+
+		out := b.Marshal()
+		if !bytes.Equal(out[:bfs.blockPtrsSize()], raw[:bfs.blockPtrsSize()]) {
+			t.Fatal("pointers changed after being marshaled again")
+		}
+		parsed := &block{parent: bfs}
+		if err := parsed.Unmarshal(out); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(parsed.data, b.data) {
+			t.Fatal("data changed after being marshaled again")
+		}
+	})
+}
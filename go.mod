@@ -5,12 +5,14 @@ go 1.16
 require (
 	cloud.google.com/go/storage v1.16.0
 	github.com/aws/aws-sdk-go v1.39.0
-	github.com/google/readahead v0.0.0-20161222183148-eaceba169032 // indirect
+	github.com/google/readahead v0.0.0-20161222183148-eaceba169032
 	github.com/jacobsa/fuse v0.0.0-20210606185441-fac69e018fad
 	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/pquerna/ffjson v0.0.0-20190930134022-aa0246cd15f7 // indirect
 	github.com/prometheus/client_golang v1.11.0
 	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22
+	google.golang.org/api v0.49.0
 	gopkg.in/kothar/go-backblaze.v0 v0.0.0-20210124194846-35409b867216
 	gopkg.in/yaml.v2 v2.4.0
 )
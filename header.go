@@ -0,0 +1,221 @@
+package utahfs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/utahfs/internal/logging"
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+// header returns the repository header that describes this filesystem, with a
+// key derived with `kdf`.
+func (bfs *BlockFilesystem) header(kdf persistent.KDFParams) persistent.Header {
+	return persistent.Header{
+		NumPtrs:   bfs.numPtrs,
+		DataSize:  bfs.dataSize,
+		SplitPtrs: bfs.splitPtrs,
+
+		Cipher: persistent.EncryptionCipher,
+		Hash:   persistent.IntegrityHash,
+
+		KDF: kdf,
+	}
+}
+
+// CheckHeader compares the header stored in the repository against the format
+// parameters of this filesystem, and returns an error if they don't match. A
+// repository that doesn't have a header yet is stamped with one, after checking
+// that its root block has the expected layout. With dedup, the configured hash
+// function is also checked against the dedup index. Repositories that use
+// features this version doesn't know about are refused.
+//
+// `kdf` is the parameters that the repository's key was derived with, from
+// Key.KDF. Headers written before they were recorded are updated to include
+// them.
+//
+// Whether pointers are split from data isn't really a choice made by whoever
+// opens the repository, since it's decided by whether ORAM was used when the
+// repository was created. If the header, or the layout of the root block when
+// there's no header, shows that the repository uses the other layout, this
+// filesystem is switched to it.
+func (bfs *BlockFilesystem) CheckHeader(ctx context.Context, kdf persistent.KDFParams) error {
+	if err := bfs.store.Start(ctx); err != nil {
+		return err
+	}
+	defer bfs.store.Rollback(ctx)
+
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return err
+	}
+	if bfs.dedup {
+		if _, err := bfs.hasher(ctx); err != nil {
+			return err
+		}
+	}
+	stored := state.Header
+	if err := checkFeatures(stored.Features, persistent.KnownFeatures); err != nil {
+		return err
+	}
+	// Features can be recorded before the rest of the header, if files were
+	// written before the repository was checked.
+	unstamped := stored == persistent.Header{Features: stored.Features}
+	if unstamped {
+		if state.RootPtr != nilPtr {
+			if err := bfs.detectLayout(ctx, state.RootPtr); err != nil {
+				return err
+			}
+		}
+	} else if stored.SplitPtrs != bfs.splitPtrs {
+		if err := bfs.useLayout(stored.SplitPtrs); err != nil {
+			return err
+		}
+	}
+	expected := bfs.header(kdf)
+	expected.Features = stored.Features
+	if !unstamped {
+		// The key has already been used to read the header, so it was derived
+		// with the right parameters, and they're checked against the ones
+		// recorded next to the password verifier before that. They're only kept
+		// here so that they can be displayed.
+		stored.KDF = expected.KDF
+		if err := compareHeaders(stored, expected); err != nil {
+			return err
+		} else if stored == state.Header {
+			return nil
+		}
+	}
+	state.Header = expected
+	if err := bfs.store.Commit(ctx); err == persistent.ErrReadOnly {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("blockfs: failed to write repository header: %v", err)
+	}
+	return nil
+}
+
+// checkFeatures returns an error if `features`, from a repository's header,
+// has anything set that isn't in `known`.
+func checkFeatures(features, known uint64) error {
+	if unknown := features &^ known; unknown != 0 {
+		return fmt.Errorf("blockfs: repository uses features that this version doesn't support (%#x), so it needs a newer version of utahfs", unknown)
+	}
+	return nil
+}
+
+// useFeature records in the repository's header that `feature` is used, as part
+// of the current transaction, so that versions of UtahFS that don't know about
+// it refuse to open the repository.
+func (bfs *BlockFilesystem) useFeature(ctx context.Context, feature uint64) error {
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return err
+	}
+	state.Header.Features |= feature
+	return nil
+}
+
+// StampInfo records `info` in the repository if nothing has been stored in it
+// yet, so that it describes how the repository was created. If Created is zero,
+// it's set to the current time. A repository that already has info, or that
+// already has files in it, is left alone.
+func (bfs *BlockFilesystem) StampInfo(ctx context.Context, info persistent.Info) error {
+	if err := bfs.store.Start(ctx); err != nil {
+		return err
+	}
+	defer bfs.store.Rollback(ctx)
+
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return err
+	} else if state.RootPtr != nilPtr || state.Info != (persistent.Info{}) {
+		return nil
+	}
+	if info.Created == 0 {
+		info.Created = time.Now().Unix()
+	}
+	state.Info = info
+	if err := bfs.store.Commit(ctx); err == persistent.ErrReadOnly {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("blockfs: failed to write repository info: %v", err)
+	}
+	return nil
+}
+
+// Info returns the header and info stored in the repository. Either is zero if
+// it hasn't been recorded.
+func (bfs *BlockFilesystem) Info(ctx context.Context) (persistent.Header, persistent.Info, error) {
+	if err := bfs.store.Start(ctx); err != nil {
+		return persistent.Header{}, persistent.Info{}, err
+	}
+	defer bfs.store.Rollback(ctx)
+
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return persistent.Header{}, persistent.Info{}, err
+	}
+	return state.Header, state.Info, nil
+}
+
+// SetName changes the name recorded in the repository's info.
+func (bfs *BlockFilesystem) SetName(ctx context.Context, name string) error {
+	if err := bfs.store.Start(ctx); err != nil {
+		return err
+	}
+	defer bfs.store.Rollback(ctx)
+
+	state, err := bfs.store.State(ctx)
+	if err != nil {
+		return err
+	}
+	state.Info.Name = name
+	return bfs.store.Commit(ctx)
+}
+
+// detectLayout checks the layout of the block at `ptr` like checkLayout does.
+// If it doesn't match, but would if pointers were or weren't split from data,
+// the filesystem is switched to that layout instead.
+func (bfs *BlockFilesystem) detectLayout(ctx context.Context, ptr uint64) error {
+	err := bfs.checkLayout(ctx, ptr)
+	if err == nil {
+		return nil
+	}
+	other := *bfs
+	other.splitPtrs = !bfs.splitPtrs
+	if other.checkLayout(ctx, ptr) != nil {
+		return err
+	}
+	return bfs.useLayout(other.splitPtrs)
+}
+
+// useLayout switches the filesystem to storing pointers separately from data if
+// `splitPtrs` is true, or together with it if not, because that's the layout
+// the repository was created with.
+func (bfs *BlockFilesystem) useLayout(splitPtrs bool) error {
+	if !splitPtrs && bfs.dedup {
+		return fmt.Errorf("blockfs: repository was created with oram, which stores pointers and data together, but dedup needs them stored separately")
+	}
+	if splitPtrs {
+		logging.Warn("blockfs: repository was created without oram, so pointers are stored separately from data and each block takes two oram accesses")
+	} else {
+		logging.Info("blockfs: repository was created with oram, so pointers are stored together with data")
+	}
+	bfs.splitPtrs = splitPtrs
+	return nil
+}
+
+func compareHeaders(stored, expected persistent.Header) error {
+	if stored.NumPtrs != expected.NumPtrs {
+		return fmt.Errorf("blockfs: repository was created with num-ptrs %v, but %v is configured", stored.NumPtrs, expected.NumPtrs)
+	} else if stored.DataSize != expected.DataSize {
+		return fmt.Errorf("blockfs: repository was created with data-size %v, but %v is configured", stored.DataSize, expected.DataSize)
+	} else if stored.Cipher != expected.Cipher {
+		return fmt.Errorf("blockfs: repository was encrypted with %v, but only %v is supported", stored.Cipher, expected.Cipher)
+	} else if stored.Hash != expected.Hash {
+		return fmt.Errorf("blockfs: repository's integrity tree uses %v, but only %v is supported", stored.Hash, expected.Hash)
+	}
+	return nil
+}
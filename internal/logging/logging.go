@@ -0,0 +1,161 @@
+// Package logging implements the leveled logger that's shared by the
+// filesystem, the storage layers, and the commands that run them.
+//
+// Messages are written to stderr by default, either as text in the same format
+// as the standard library's logger with the level added, or as one JSON object
+// per line. Messages below the configured level are dropped.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelWarn:
+		return "warn"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel returns the level called `name`: error, warn, info, or debug.
+func ParseLevel(name string) (Level, error) {
+	for l := LevelError; l <= LevelDebug; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("logging: unknown log level: %q", name)
+}
+
+var (
+	mu     sync.Mutex
+	level            = LevelInfo
+	asJSON           = false
+	out    io.Writer = os.Stderr
+)
+
+// Setup sets the minimum level of messages to log, by name, and whether they
+// should be formatted as JSON.
+func Setup(name string, json bool) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	level, asJSON = l, json
+	mu.Unlock()
+	return nil
+}
+
+// SetOutput sets where messages are written to, which is stderr by default.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	out = w
+	mu.Unlock()
+}
+
+// Enabled returns true if messages at level `l` are being logged.
+func Enabled(l Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return l <= level
+}
+
+// output writes `msg` at level `l`. `caller` is the location of the code that
+// logged it, or empty if it isn't known.
+func output(l Level, caller, msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if l > level {
+		return
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+	now := time.Now()
+
+	if asJSON {
+		entry := struct {
+			Time   string `json:"time"`
+			Level  string `json:"level"`
+			Caller string `json:"caller,omitempty"`
+			Msg    string `json:"msg"`
+		}{now.Format(time.RFC3339Nano), l.String(), caller, msg}
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		out.Write(append(raw, '\n'))
+		return
+	}
+
+	line := now.Format("2006/01/02 15:04:05 ")
+	if caller != "" {
+		line += caller + ": "
+	}
+	line += strings.ToUpper(l.String()) + " " + msg + "\n"
+	io.WriteString(out, line)
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	caller := ""
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%v:%v", filepath.Base(file), line)
+	}
+	output(l, caller, fmt.Sprintf(format, args...))
+}
+
+func Errorf(format string, args ...interface{}) { logf(LevelError, format, args...) }
+func Warnf(format string, args ...interface{})  { logf(LevelWarn, format, args...) }
+func Infof(format string, args ...interface{})  { logf(LevelInfo, format, args...) }
+func Debugf(format string, args ...interface{}) { logf(LevelDebug, format, args...) }
+
+// Error logs its arguments at LevelError, formatted like fmt.Sprint. The other
+// levels have equivalent functions.
+func Error(args ...interface{}) { logf(LevelError, "%v", fmt.Sprint(args...)) }
+func Warn(args ...interface{})  { logf(LevelWarn, "%v", fmt.Sprint(args...)) }
+func Info(args ...interface{})  { logf(LevelInfo, "%v", fmt.Sprint(args...)) }
+func Debug(args ...interface{}) { logf(LevelDebug, "%v", fmt.Sprint(args...)) }
+
+type writer struct {
+	level  Level
+	prefix string
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	output(w.level, "", w.prefix+string(p))
+	return len(p), nil
+}
+
+// New returns a standard library logger that logs everything written to it at
+// level `l`, for libraries that take one, like the FUSE error and debug loggers.
+func New(l Level, prefix string) *log.Logger {
+	return log.New(writer{l, prefix}, "", 0)
+}
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"testing"
+
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+func TestLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	if err := Setup("warn", false); err != nil {
+		t.Fatal(err)
+	}
+
+	Errorf("a %v", 1)
+	Warn("b")
+	Info("c")
+	Debugf("d")
+	New(LevelWarn, "lib: ").Println("e")
+	New(LevelDebug, "lib: ").Println("f")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected number of lines logged: %q", buf.String())
+	} else if !strings.Contains(lines[0], " logging_test.go:") || !strings.HasSuffix(lines[0], ": ERROR a 1") {
+		t.Fatalf("unexpected line: %q", lines[0])
+	} else if !strings.HasSuffix(lines[1], ": WARN b") {
+		t.Fatalf("unexpected line: %q", lines[1])
+	} else if !strings.HasSuffix(lines[2], " WARN lib: e") {
+		t.Fatalf("unexpected line: %q", lines[2])
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("expected error from unknown level")
+	} else if l, err := ParseLevel("DEBUG"); err != nil || l != LevelDebug {
+		t.Fatalf("unexpected result from parsing level: %v %v", l, err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	if err := Setup("debug", true); err != nil {
+		t.Fatal(err)
+	}
+	Debugf("hello %q", "world")
+
+	entry := make(map[string]string)
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	} else if entry["level"] != "debug" || entry["msg"] != `hello "world"` || !strings.HasPrefix(entry["caller"], "logging_test.go:") || entry["time"] == "" {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+}
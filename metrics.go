@@ -0,0 +1,187 @@
+package utahfs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	FuseOpDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "fuse_op_duration_seconds",
+			Help:    "How long FUSE operations take to be processed.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"op"},
+	)
+	FuseOpErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "fuse_op_errors",
+			Help: "The number of FUSE operations that failed, by the errno returned to the kernel.",
+		},
+		[]string{"op", "errno"},
+	)
+	SkiplistSeekBlocks = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "skiplist_seek_blocks",
+			Help:    "The number of blocks loaded to seek to a position in a file.",
+			Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64},
+		},
+	)
+)
+
+// errnoNames are the names of the errors that the FUSE binding returns.
+var errnoNames = map[syscall.Errno]string{
+	syscall.EACCES:       "EACCES",
+	syscall.EEXIST:       "EEXIST",
+	syscall.EINVAL:       "EINVAL",
+	syscall.EIO:          "EIO",
+	syscall.EISDIR:       "EISDIR",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+	syscall.ENODATA:      "ENODATA",
+	syscall.ENOENT:       "ENOENT",
+	syscall.ENOSPC:       "ENOSPC",
+	syscall.ENOSYS:       "ENOSYS",
+	syscall.ENOTDIR:      "ENOTDIR",
+	syscall.ENOTEMPTY:    "ENOTEMPTY",
+	syscall.EPERM:        "EPERM",
+	syscall.EXDEV:        "EXDEV",
+}
+
+// errnoName returns the name of the errno that the kernel will be given for
+// `err`. Errors that aren't an errno are given to it as EIO.
+func errnoName(err error) string {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return "EIO"
+	} else if name, ok := errnoNames[errno]; ok {
+		return name
+	}
+	return fmt.Sprintf("errno %d", int(errno))
+}
+
+// instrumented wraps a FUSE binding, and records how long each operation takes
+// and which ones fail in FuseOpDuration and FuseOpErrors.
+type instrumented struct {
+	fuseutil.FileSystem
+}
+
+func (in instrumented) run(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	FuseOpDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		FuseOpErrors.WithLabelValues(name, errnoName(err)).Inc()
+	}
+	return err
+}
+
+func (in instrumented) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	return in.run("StatFS", func() error { return in.FileSystem.StatFS(ctx, op) })
+}
+
+func (in instrumented) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	return in.run("LookUpInode", func() error { return in.FileSystem.LookUpInode(ctx, op) })
+}
+
+func (in instrumented) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
+	return in.run("GetInodeAttributes", func() error { return in.FileSystem.GetInodeAttributes(ctx, op) })
+}
+
+func (in instrumented) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	return in.run("SetInodeAttributes", func() error { return in.FileSystem.SetInodeAttributes(ctx, op) })
+}
+
+func (in instrumented) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) error {
+	return in.run("ForgetInode", func() error { return in.FileSystem.ForgetInode(ctx, op) })
+}
+
+func (in instrumented) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
+	return in.run("MkDir", func() error { return in.FileSystem.MkDir(ctx, op) })
+}
+
+func (in instrumented) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
+	return in.run("MkNode", func() error { return in.FileSystem.MkNode(ctx, op) })
+}
+
+func (in instrumented) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	return in.run("CreateFile", func() error { return in.FileSystem.CreateFile(ctx, op) })
+}
+
+func (in instrumented) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	return in.run("CreateSymlink", func() error { return in.FileSystem.CreateSymlink(ctx, op) })
+}
+
+func (in instrumented) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	return in.run("Rename", func() error { return in.FileSystem.Rename(ctx, op) })
+}
+
+func (in instrumented) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
+	return in.run("RmDir", func() error { return in.FileSystem.RmDir(ctx, op) })
+}
+
+func (in instrumented) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	return in.run("Unlink", func() error { return in.FileSystem.Unlink(ctx, op) })
+}
+
+func (in instrumented) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
+	return in.run("OpenDir", func() error { return in.FileSystem.OpenDir(ctx, op) })
+}
+
+func (in instrumented) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	return in.run("ReadDir", func() error { return in.FileSystem.ReadDir(ctx, op) })
+}
+
+func (in instrumented) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) error {
+	return in.run("ReleaseDirHandle", func() error { return in.FileSystem.ReleaseDirHandle(ctx, op) })
+}
+
+func (in instrumented) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
+	return in.run("OpenFile", func() error { return in.FileSystem.OpenFile(ctx, op) })
+}
+
+func (in instrumented) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	return in.run("ReadFile", func() error { return in.FileSystem.ReadFile(ctx, op) })
+}
+
+func (in instrumented) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	return in.run("WriteFile", func() error { return in.FileSystem.WriteFile(ctx, op) })
+}
+
+func (in instrumented) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
+	return in.run("SyncFile", func() error { return in.FileSystem.SyncFile(ctx, op) })
+}
+
+func (in instrumented) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
+	return in.run("FlushFile", func() error { return in.FileSystem.FlushFile(ctx, op) })
+}
+
+func (in instrumented) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
+	return in.run("ReleaseFileHandle", func() error { return in.FileSystem.ReleaseFileHandle(ctx, op) })
+}
+
+func (in instrumented) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	return in.run("ReadSymlink", func() error { return in.FileSystem.ReadSymlink(ctx, op) })
+}
+
+func (in instrumented) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
+	return in.run("GetXattr", func() error { return in.FileSystem.GetXattr(ctx, op) })
+}
+
+func (in instrumented) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
+	return in.run("ListXattr", func() error { return in.FileSystem.ListXattr(ctx, op) })
+}
+
+func (in instrumented) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	return in.run("SetXattr", func() error { return in.FileSystem.SetXattr(ctx, op) })
+}
+
+func (in instrumented) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	return in.run("RemoveXattr", func() error { return in.FileSystem.RemoveXattr(ctx, op) })
+}
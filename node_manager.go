@@ -21,9 +21,25 @@ type node struct {
 	self *BlockFile
 	data *BlockFile
 
+	// uid and gid are the ids of the node's owner as they're stored, before
+	// being translated into the local ids in Attrs.
+	uid, gid uint32
+	// inline is the largest file whose data may be kept in Inline.
+	inline int64
+
 	Attrs    fuseops.InodeAttributes
 	Children map[string]fuseops.InodeID
 	Data     uint64
+	// Inline holds all of the file's data, if it's small enough to be stored
+	// with the node instead of in a skiplist of its own. It's only used while
+	// Data is nilPtr.
+	Inline []byte
+	// Xattrs are the node's extended attributes, by name.
+	Xattrs map[string][]byte
+
+	// Generation distinguishes this node from earlier nodes that were stored
+	// at the same pointer, and were deleted.
+	Generation uint64
 }
 
 func (nd *node) open(create bool) error {
@@ -50,9 +66,25 @@ func (nd *node) open(create bool) error {
 	return nil
 }
 
+// unpack moves the file's inline data into a skiplist of its own, before it
+// grows past the size that can be kept inline.
+func (nd *node) unpack() error {
+	if nd.Data != nilPtr || len(nd.Inline) == 0 {
+		return nil
+	} else if err := nd.open(true); err != nil {
+		return err
+	} else if _, err := nd.data.Write(nd.Inline); err != nil {
+		return err
+	}
+	nd.Inline = nil
+	return nil
+}
+
 func (nd *node) ReadAt(p []byte, offset int64) (int, error) {
 	if offset >= int64(nd.Attrs.Size) {
 		return 0, io.EOF
+	} else if nd.Data == nilPtr && nd.Inline != nil {
+		return copy(p, nd.Inline[offset:]), nil
 	} else if err := nd.open(false); err != nil {
 		return 0, err
 	}
@@ -66,7 +98,9 @@ func (nd *node) ReadAt(p []byte, offset int64) (int, error) {
 }
 
 func (nd *node) ReadAll() ([]byte, error) {
-	if err := nd.open(false); err != nil {
+	if nd.Data == nilPtr && nd.Inline != nil {
+		return append([]byte{}, nd.Inline...), nil
+	} else if err := nd.open(false); err != nil {
 		return nil, err
 	} else if _, err := nd.data.Seek(0, io.SeekStart); err != nil {
 		return nil, err
@@ -76,33 +110,45 @@ func (nd *node) ReadAll() ([]byte, error) {
 	for {
 		buff := make([]byte, 1024)
 		n, err := nd.ReadAt(buff, int64(len(acc)))
+		acc = append(acc, buff[:n]...)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return nil, err
 		}
-		acc = append(acc, buff[:n]...)
 	}
 	return acc, nil
 }
 
 func (nd *node) WriteAt(p []byte, offset int64) (int, error) {
-	if err := nd.open(true); err != nil {
+	end := offset + int64(len(p))
+	if end < int64(nd.Attrs.Size) {
+		end = int64(nd.Attrs.Size)
+	}
+	if nd.Data == nilPtr && end <= nd.inline {
+		if grow := end - int64(len(nd.Inline)); grow > 0 {
+			nd.Inline = append(nd.Inline, make([]byte, grow)...)
+		}
+		n := copy(nd.Inline[offset:], p)
+		nd.Attrs.Size = uint64(len(nd.Inline))
+		return n, nil
+	} else if err := nd.unpack(); err != nil {
+		return 0, err
+	} else if err := nd.open(true); err != nil {
 		return 0, err
 	}
 	defer func() {
 		nd.Attrs.Size = uint64(nd.data.size)
 	}()
 
-	// If we're trying to write past the end of the file, pad with null bytes.
+	// If we're trying to write past the end of the file, grow it first. The gap
+	// is left as a hole, so that restoring a sparse file doesn't allocate
+	// blocks for all the zeros in it. Growing the file marks the repository as
+	// using holes.
 	if uint64(offset) > nd.Attrs.Size {
-		if _, err := nd.data.Seek(0, io.SeekEnd); err != nil {
+		if err := nd.data.Truncate(offset); err != nil {
 			return 0, err
 		}
-		n, err := nd.data.Write(make([]byte, uint64(offset)-nd.Attrs.Size))
-		if err != nil {
-			return n, err
-		}
 	}
 
 	if _, err := nd.data.Seek(offset, io.SeekStart); err != nil {
@@ -117,17 +163,34 @@ func (nd *node) WriteAt(p []byte, offset int64) (int, error) {
 }
 
 func (nd *node) Truncate(size int64) error {
-	if err := nd.open(true); err != nil {
+	if size == 0 {
+		// Discarding all of a file's data is common, like when it's opened with
+		// O_TRUNC, so move the whole skiplist to the trash at once rather than
+		// truncating it. A new one is created when the file is next written.
+		if nd.Data != nilPtr {
+			if err := nd.bfs.Unlink(nd.ctx, nd.Data); err != nil {
+				return err
+			}
+		}
+		nd.Data, nd.data, nd.Inline = nilPtr, nil, nil
+		nd.Attrs.Size = 0
+		return nil
+	} else if nd.Data == nilPtr && (size <= nd.inline || size <= int64(len(nd.Inline))) {
+		if size > int64(len(nd.Inline)) {
+			nd.Inline = append(nd.Inline, make([]byte, size-int64(len(nd.Inline)))...)
+		}
+		nd.Inline = nd.Inline[:size]
+		nd.Attrs.Size = uint64(size)
+		return nil
+	} else if err := nd.unpack(); err != nil {
+		return err
+	} else if err := nd.open(true); err != nil {
 		return err
 	}
 	defer func() {
 		nd.Attrs.Size = uint64(nd.data.size)
 	}()
 
-	if uint64(size) > nd.Attrs.Size {
-		_, err := nd.data.Write(make([]byte, uint64(size)-nd.Attrs.Size))
-		return err
-	}
 	return nd.data.Truncate(size)
 }
 
@@ -153,11 +216,16 @@ func (nd *node) Type() fuseutil.DirentType {
 // fields.
 func (nd *node) Persist() error {
 	uid, gid := nd.Attrs.Uid, nd.Attrs.Gid
-	nd.Attrs.Uid, nd.Attrs.Gid = 0, 0
+	nd.Attrs.Uid, nd.Attrs.Gid = nd.uid, nd.gid
 	defer func() {
 		nd.Attrs.Uid, nd.Attrs.Gid = uid, gid
 	}()
 
+	if len(nd.Inline) > 0 {
+		if err := nd.bfs.useFeature(nd.ctx, persistent.FeatureInline); err != nil {
+			return err
+		}
+	}
 	if _, err := nd.self.Seek(0, io.SeekStart); err != nil {
 		return err
 	} else if err := gob.NewEncoder(nd.self).Encode(nd); err != nil {
@@ -177,24 +245,66 @@ func (nd *node) Persist() error {
 //
 // The prefix of each block file is a gob-encoded structure containing metadata,
 // links to children, and the rest is the node's raw data.
+//
+// The owner of each node is stored, and translated into a local user and group
+// with uidMap and gidMap. Nodes whose owner isn't in the maps are presented as
+// being owned by uid and gid, which is also who new nodes are created as.
 type nodeManager struct {
 	bfs   *BlockFilesystem
 	cache *cache.Cache
 
-	uid, gid uint32
+	uid, gid       uint32
+	uidMap, gidMap map[uint32]uint32
+
+	// inline is the largest file whose data is stored with its node. Zero
+	// disables this.
+	inline int64
 }
 
-func newNodeManager(bfs *BlockFilesystem, cacheSize int, uid, gid uint32) *nodeManager {
+func newNodeManager(bfs *BlockFilesystem, cacheSize int, uid, gid uint32, uidMap, gidMap map[uint32]uint32) *nodeManager {
 	return &nodeManager{
 		bfs:   bfs,
 		cache: cache.New(30*time.Second, 5*time.Second, cacheSize),
 
 		uid: uid,
 		gid: gid,
+
+		uidMap: uidMap,
+		gidMap: gidMap,
+	}
+}
+
+// localID returns the local id for the stored id `id`, according to `m`.
+func localID(m map[uint32]uint32, id, fallback uint32) uint32 {
+	if local, ok := m[id]; ok {
+		return local
+	}
+	return fallback
+}
+
+// storedID returns the id that the local id `id` should be stored as, which is
+// the reverse of localID.
+func storedID(m map[uint32]uint32, id uint32) uint32 {
+	for stored, local := range m {
+		if local == id {
+			return stored
+		}
 	}
+	return id
+}
+
+func (nm *nodeManager) Start(ctx context.Context) error {
+	if err := nm.bfs.store.Start(ctx); err != nil {
+		return err
+	}
+	// Nodes cached by earlier transactions are out of date if another client
+	// has committed changes since.
+	if nm.bfs.store.Changed() {
+		nm.cache.Flush()
+	}
+	return nil
 }
 
-func (nm *nodeManager) Start(ctx context.Context) error  { return nm.bfs.store.Start(ctx) }
 func (nm *nodeManager) Commit(ctx context.Context) error { return nm.bfs.store.Commit(ctx) }
 func (nm *nodeManager) Rollback(ctx context.Context)     { nm.bfs.store.Rollback(ctx) }
 
@@ -220,14 +330,28 @@ func (nm *nodeManager) Create(ctx context.Context, mode os.FileMode) (uint64, er
 		Children: nil,
 		Data:     nilPtr,
 	}
+	nd.Attrs.Uid = storedID(nm.uidMap, nm.uid)
+	nd.Attrs.Gid = storedID(nm.gidMap, nm.gid)
 	if nd.Attrs.Mode.IsDir() {
 		nd.Children = make(map[string]fuseops.InodeID)
 	}
 
+	state, err := nm.State(ctx)
+	if err != nil {
+		return nilPtr, err
+	}
+	trash := state.TrashPtr
+
 	ptr, bf, err := nm.bfs.Create(ctx, persistent.Metadata)
 	if err != nil {
 		return nilPtr, err
-	} else if err := gob.NewEncoder(bf).Encode(nd); err != nil {
+	} else if ptr == trash {
+		// The pointer was recycled from the trash, so it may still be known to
+		// the kernel as a deleted inode.
+		state.Generation++
+		nd.Generation = state.Generation
+	}
+	if err := gob.NewEncoder(bf).Encode(nd); err != nil {
 		return nilPtr, err
 	}
 	return ptr, nil
@@ -237,6 +361,7 @@ func (nm *nodeManager) Open(ctx context.Context, ptr uint64) (*node, error) {
 	if val, ok := nm.cache.Get(ptr); ok {
 		nd := val.(*node)
 		nd.ctx, nd.self.ctx = ctx, ctx
+		nd.inline = nm.inline
 		if nd.data != nil {
 			nd.data.ctx = ctx
 		}
@@ -254,8 +379,10 @@ func (nm *nodeManager) Open(ctx context.Context, ptr uint64) (*node, error) {
 	nd.ctx = ctx
 	nd.bfs = nm.bfs
 	nd.self = bf
-	nd.Attrs.Uid = nm.uid
-	nd.Attrs.Gid = nm.gid
+	nd.inline = nm.inline
+	nd.uid, nd.gid = nd.Attrs.Uid, nd.Attrs.Gid
+	nd.Attrs.Uid = localID(nm.uidMap, nd.uid, nm.uid)
+	nd.Attrs.Gid = localID(nm.gidMap, nd.gid, nm.gid)
 
 	nm.cache.Set(ptr, nd, cache.DefaultExpiration)
 	return nd, nil
@@ -265,7 +392,11 @@ func (nm *nodeManager) Unlink(ctx context.Context, ptr uint64) error {
 	nd, err := nm.Open(ctx, ptr)
 	if err != nil {
 		return err
-	} else if err := nm.bfs.Unlink(ctx, ptr); err != nil {
+	}
+	// Drop the node from cache, so it's not mistaken for whatever is stored at
+	// this pointer next.
+	nm.Forget(nd)
+	if err := nm.bfs.Unlink(ctx, ptr); err != nil {
 		return err
 	} else if nd.Data != nilPtr {
 		return nm.bfs.Unlink(ctx, nd.Data)
@@ -24,6 +24,72 @@ type State struct {
 	TrashPtr uint64
 	// NextPtr will be the pointer of the next block which is allocated.
 	NextPtr uint64
+
+	// Generation is incremented each time a block is taken from the trash to
+	// store a new inode, so that stale references to the old inode can be told
+	// apart from the new one.
+	Generation uint64
+
+	// DedupPtr points to the file storing the dedup index, plus one, so that
+	// zero means there isn't an index yet.
+	DedupPtr uint64
+	// DedupHash is the name of the hash function that the dedup index is keyed
+	// by. It's empty for indexes created before it was recorded, which are
+	// keyed by SHA-256.
+	DedupHash string
+
+	// Header records the format of the repository. It's zero until the
+	// repository has been stamped with one.
+	Header Header
+	// Info describes the repository. It's zero for repositories created before
+	// it was recorded.
+	Info Info
+}
+
+// Header records the parameters that a repository's blocks were written with,
+// all of which every client has to agree on to read them correctly.
+type Header struct {
+	NumPtrs   int64 // NumPtrs is the number of pointers in each block's skiplist.
+	DataSize  int64 // DataSize is the amount of data kept in each block.
+	SplitPtrs bool  // SplitPtrs is true if each block's pointers are stored separately from its data.
+
+	Cipher string // Cipher is the name of the cipher blocks are encrypted with.
+	Hash   string // Hash is the name of the hash function the integrity tree is built with.
+
+	// KDF is the parameters that the repository's key was derived from its
+	// password with, or zero if the key isn't derived from a password. It's
+	// recorded so that the same parameters can be configured elsewhere.
+	KDF KDFParams
+
+	// Features is the set of optional parts of the format that the repository
+	// has used, like FeatureInline. A client refuses to open a repository with
+	// features it doesn't know about, rather than misreading it.
+	Features uint64
+}
+
+const (
+	// FeatureInline is set once a file's data has been stored in the same
+	// block as its metadata.
+	FeatureInline uint64 = 1 << iota
+	// FeatureHoles is set once a file has had a hole left in it, which is
+	// recorded in its skiplist with pointers that older versions would follow
+	// as if they were real blocks.
+	FeatureHoles
+	// FeatureDedup is set once a block has referred to a shared copy of its
+	// data, instead of storing the data itself.
+	FeatureDedup
+
+	// KnownFeatures is every feature that this version understands.
+	KnownFeatures = FeatureInline | FeatureHoles | FeatureDedup
+)
+
+// Info describes a repository to the people using it, so that several can be
+// told apart. None of it affects how the repository is read.
+type Info struct {
+	Name    string // Name is a friendly name for the repository.
+	Created int64  // Created is when the repository was created, in seconds since the Unix epoch.
+	Creator string // Creator is who created the repository, like user@host.
+	Version string // Version is the release of UtahFS that created the repository.
 }
 
 func NewState() *State {
@@ -41,20 +107,45 @@ func (s *State) Clone() *State {
 
 		TrashPtr: s.TrashPtr,
 		NextPtr:  s.NextPtr,
+
+		Generation: s.Generation,
+		DedupPtr:   s.DedupPtr,
+		DedupHash:  s.DedupHash,
+
+		Header: s.Header,
+		Info:   s.Info,
 	}
 }
 
 // AppStorage is an extension of the BlockStorage interface that provides shared
 // state.
 type AppStorage struct {
-	base BlockStorage
+	base     BlockStorage
+	maxDirty int
 
 	active          bool
+	dirty           int
 	original, state *State
+
+	// integ is the integrity layer that's detecting conflicts, if
+	// DetectConflicts has been called.
+	integ *integrity
 }
 
 func NewAppStorage(base BlockStorage) *AppStorage {
-	return &AppStorage{base: base}
+	return NewLimitedAppStorage(base, 0)
+}
+
+// NewLimitedAppStorage returns an AppStorage where a transaction should be
+// committed early, and then continued as a new transaction, once more than
+// `maxDirty` blocks have been modified. This bounds the amount of memory needed
+// to buffer a large transaction, at the cost of it no longer being atomic: if
+// it's rolled back or interrupted, any changes committed early are kept. It's
+// up to the caller to check NeedsEarlyCommit at points where what's been
+// written so far is consistent, and call CommitEarly. If `maxDirty` is zero,
+// transactions never need to be committed early.
+func NewLimitedAppStorage(base BlockStorage, maxDirty int) *AppStorage {
+	return &AppStorage{base: base, maxDirty: maxDirty}
 }
 
 func (as *AppStorage) Start(ctx context.Context) error {
@@ -66,6 +157,7 @@ func (as *AppStorage) Start(ctx context.Context) error {
 		return err
 	}
 	as.active = true
+	as.dirty = 0
 
 	return nil
 }
@@ -96,6 +188,14 @@ func (as *AppStorage) State(ctx context.Context) (*State, error) {
 	return as.state, nil
 }
 
+// StateChanged returns true if the shared global state has been modified since
+// the current transaction started, meaning that it will be written when the
+// transaction is committed. The state is only read once per transaction, and
+// only written once, no matter how many times it's changed.
+func (as *AppStorage) StateChanged() bool {
+	return as.original != nil && *as.original != *as.state
+}
+
 func (as *AppStorage) Get(ctx context.Context, ptr uint64) ([]byte, error) {
 	if !as.active {
 		return nil, fmt.Errorf("app: transaction not active")
@@ -129,15 +229,50 @@ func (as *AppStorage) Set(ctx context.Context, ptr uint64, data []byte, dt DataT
 	if !as.active {
 		return fmt.Errorf("app: transaction not active")
 	}
-	return as.base.Set(ctx, ptr+1, data, dt)
+	if err := as.base.Set(ctx, ptr+1, data, dt); err != nil {
+		return err
+	}
+	as.dirty++
+	return nil
 }
 
-func (as *AppStorage) Commit(ctx context.Context) error {
+// NeedsEarlyCommit returns true if more blocks have been modified in the
+// current transaction than the limit given to NewLimitedAppStorage.
+func (as *AppStorage) NeedsEarlyCommit() bool {
+	return as.active && as.maxDirty > 0 && as.dirty > as.maxDirty
+}
+
+// CommitEarly commits the changes made in the current transaction so far, and
+// starts a new transaction to continue it in. It must only be called when the
+// changes so far leave storage consistent, because they're kept even if the
+// rest of the transaction is rolled back.
+func (as *AppStorage) CommitEarly(ctx context.Context) error {
 	if !as.active {
 		return fmt.Errorf("app: transaction not active")
+	} else if err := as.persistState(ctx); err != nil {
+		as.Rollback(ctx)
+		return err
+	} else if err := as.base.Commit(ctx); err != nil {
+		as.Rollback(ctx)
+		return err
 	}
+	AppStorageCommits.Inc()
 
-	if as.original != nil && *as.original != *as.state {
+	if _, err := as.base.Start(ctx, nil); err != nil {
+		as.active = false
+		as.original, as.state = nil, nil
+		return err
+	}
+	as.dirty = 0
+	if as.state != nil {
+		as.original = as.state.Clone()
+	}
+	return nil
+}
+
+// persistState writes the shared global state to storage, if it was changed.
+func (as *AppStorage) persistState(ctx context.Context) error {
+	if as.StateChanged() {
 		buff := &bytes.Buffer{}
 		if err := gob.NewEncoder(buff).Encode(as.state); err != nil {
 			return err
@@ -145,7 +280,24 @@ func (as *AppStorage) Commit(ctx context.Context) error {
 			return err
 		}
 	}
+	return nil
+}
+
+// Commit persists the changes made in the current transaction, including any
+// changes to the shared global state, atomically. If it fails, the transaction
+// is rolled back, so that the state isn't left pointing at blocks that were
+// never written.
+func (as *AppStorage) Commit(ctx context.Context) error {
+	if !as.active {
+		return fmt.Errorf("app: transaction not active")
+	}
+
+	if err := as.persistState(ctx); err != nil {
+		as.Rollback(ctx)
+		return err
+	}
 	if err := as.base.Commit(ctx); err != nil {
+		as.Rollback(ctx)
 		return err
 	}
 	as.active = false
@@ -160,3 +312,168 @@ func (as *AppStorage) Rollback(ctx context.Context) {
 	as.active = false
 	as.original, as.state = nil, nil
 }
+
+// DetectConflicts makes Commit fail with ErrConflict, instead of overwriting
+// another client's changes, if the tree head in storage has changed since the
+// transaction started. This lets several clients share a bucket without a
+// remote server, as long as they rarely write at the same time.
+//
+// Commits are made atomic across clients by the storage beneath the integrity
+// layer, which has to be created with NewSharedReliable, with no caches or
+// local WAL in between. A read that overlaps another client's commit may find
+// blocks that don't match the tree head yet; that fails with ErrConflict too,
+// so that it's retried.
+func (as *AppStorage) DetectConflicts() error {
+	var integ *integrity
+	base := as.base
+	for {
+		switch s := base.(type) {
+		case *encryption:
+			base = s.base
+		case *integrity:
+			integ, base = s, s.base
+		case *BufferedStorage:
+			if integ == nil {
+				return fmt.Errorf("app: can't detect conflicts without an integrity layer")
+			}
+			shared, ok := s.base.(*sharedReliable)
+			if !ok {
+				return fmt.Errorf("app: can't detect conflicts through storage layer: %T", s.base)
+			}
+			integ.detectConflicts, integ.shared = true, shared
+			as.integ = integ
+			return nil
+		default:
+			return fmt.Errorf("app: can't detect conflicts with storage layer: %T", base)
+		}
+	}
+}
+
+// Changed returns true if the current transaction started from changes that
+// another client committed since this client's previous transaction, in which
+// case anything cached from earlier transactions may be out of date. It's
+// always false unless DetectConflicts has been called.
+func (as *AppStorage) Changed() bool {
+	return as.integ != nil && as.integ.changed
+}
+
+// Transact runs `fn` in a new transaction and commits it. If either fails, the
+// transaction is rolled back. When the failure is ErrConflict, `fn` is run
+// again in a new transaction, so that it sees the other client's changes, up to
+// `attempts` times in total. Anything that `fn` committed with CommitEarly is
+// kept when it's run again.
+func (as *AppStorage) Transact(ctx context.Context, attempts int, fn func(ctx context.Context) error) error {
+	if attempts <= 0 {
+		return fmt.Errorf("app: attempts must be greater than zero")
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		} else if err = as.Start(ctx); err != nil {
+			return err
+		}
+		if err = fn(ctx); err == nil {
+			err = as.Commit(ctx)
+		} else if as.active {
+			as.Rollback(ctx)
+		}
+		if err != ErrConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// Sync blocks until all committed changes have reached remote storage. See
+// FlushWAL.
+func (as *AppStorage) Sync(ctx context.Context) error {
+	return FlushWAL(ctx, as.base)
+}
+
+// PauseSync stops or resumes uploading committed changes to remote storage.
+// See PauseWAL.
+func (as *AppStorage) PauseSync(paused bool) error {
+	return PauseWAL(as.base, paused)
+}
+
+// Keys returns the keys in object storage that the blocks at `ptrs` are stored
+// under, along with the keys of blocks used internally by the storage stack,
+// like the shared state and integrity checksums. Each key maps to true if the
+// object must exist, or false if it's allowed to exist but might not. It must be
+// called during a transaction, and fails with ORAM or a remote server, where
+// blocks don't have fixed keys that can be listed.
+func (as *AppStorage) Keys(ptrs []uint64) (map[string]bool, error) {
+	if !as.active {
+		return nil, fmt.Errorf("app: transaction not active")
+	}
+	keys := map[uint64]bool{0: true}
+	for _, ptr := range ptrs {
+		keys[ptr+1] = true
+	}
+
+	base := as.base
+	for {
+		switch s := base.(type) {
+		case *encryption:
+			base = s.base
+		case *integrity:
+			keys = s.keys(keys)
+			base = s.base
+		case *BufferedStorage:
+			if _, ok := unwrapCache(s.base).(*remoteClient); ok {
+				return nil, fmt.Errorf("app: can't list keys of remote server")
+			}
+			out := make(map[string]bool, len(keys))
+			for key, required := range keys {
+				out[hex(key)] = required
+			}
+			return out, nil
+		default:
+			return nil, fmt.Errorf("app: can't list keys of storage layer: %T", base)
+		}
+	}
+}
+
+// Truncate deletes every block at or past `ptr`, as part of the current
+// transaction, and shrinks the integrity tree to match. It's meant for after
+// the blocks that are still needed have been moved below `ptr`. Like Keys, it
+// fails with ORAM or a remote server.
+func (as *AppStorage) Truncate(ctx context.Context, ptr uint64) error {
+	if !as.active {
+		return fmt.Errorf("app: transaction not active")
+	}
+
+	var (
+		stale     []uint64
+		truncated bool
+	)
+	base := as.base
+	for {
+		switch s := base.(type) {
+		case *encryption:
+			base = s.base
+		case *integrity:
+			var err error
+			stale, err = s.truncate(ctx, ptr+1)
+			if err != nil {
+				return err
+			}
+			truncated, base = true, s.base
+		case *BufferedStorage:
+			if _, ok := unwrapCache(s.base).(*remoteClient); ok {
+				return fmt.Errorf("app: can't truncate storage of remote server")
+			} else if !truncated {
+				return fmt.Errorf("app: can't truncate storage without an integrity layer")
+			}
+			for _, key := range stale {
+				if err := s.Delete(ctx, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		default:
+			return fmt.Errorf("app: can't truncate storage layer: %T", base)
+		}
+	}
+}
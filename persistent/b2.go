@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -42,11 +43,20 @@ var (
 	}
 )
 
+// b2Parallelism is the number of downloads that GetMany will do at once.
+const b2Parallelism = 8
+
 type b2 struct {
 	pool *sync.Pool
 	url  string
 }
 
+// b2Conn is a connection to B2, along with the bucket being used.
+type b2Conn struct {
+	conn   *backblaze.B2
+	bucket *backblaze.Bucket
+}
+
 // NewB2 returns object storage backed by Backblaze B2. `acctId` and `appKey`
 // are the Account ID and Application Key of a B2 bucket. `bucketName` is the
 // name of the bucket. Keys other than the master key can be used by omitting
@@ -69,16 +79,55 @@ func NewB2(acctId, keyId, appKey, bucketName, url string) (ObjectStorage, error)
 			if err != nil {
 				return err
 			}
+			// Requests are retried by b2.do instead, which also re-authorizes.
+			conn.NoRetry = true
 			bucket, err := conn.Bucket(bucketName)
 			if err != nil {
 				return err
+			} else if bucket == nil {
+				return fmt.Errorf("storage: b2 bucket not found: %v", bucketName)
 			}
-			return bucket
+			return &b2Conn{conn, bucket}
 		},
 	}
 	return &b2{pool, url}, nil
 }
 
+// do calls `fn` with a bucket from the pool. If it fails with an error that B2
+// says is temporary, like an expired auth token or an unavailable server, the
+// connection is re-authorized and `fn` is retried once. This happens even
+// without NewRetry, so that an auth token expiring mid-transaction doesn't
+// cause the transaction to fail.
+func (b *b2) do(fn func(bucket *backblaze.Bucket) error) error {
+	item := b.pool.Get()
+	if err, ok := item.(error); ok {
+		return err
+	}
+	defer b.pool.Put(item)
+	c := item.(*b2Conn)
+
+	err := fn(c.bucket)
+	var b2err *backblaze.B2Error
+	if !errors.As(err, &b2err) || b2err.IsFatal() {
+		return err
+	}
+	if err := c.conn.AuthorizeAccount(); err != nil {
+		return err
+	}
+	// A failed upload can leave its upload URL in the bucket's pool even
+	// though it's no longer valid, so clear those out before retrying.
+	for {
+		auth, err := c.bucket.GetUploadAuth()
+		if err != nil {
+			return err
+		} else if auth.Valid {
+			c.bucket.ReturnUploadAuth(auth)
+			break
+		}
+	}
+	return fn(c.bucket)
+}
+
 // Fetches encrypted chunks from B2 using Backblaze's API. If a url is passed to
 // the B2 constructor, this method instead attempts to fetch chunks from a file
 // server at the configured url. Requesting data through configured urls does not
@@ -114,17 +163,17 @@ func (b *b2) Get(ctx context.Context, key string) ([]byte, error) {
 	return data, nil
 }
 
-func (b *b2) Set(ctx context.Context, key string, data []byte, _ DataType) error {
-	bucket := b.pool.Get()
-	if err, ok := bucket.(error); ok {
-		return err
-	}
-	defer b.pool.Put(bucket)
+func (b *b2) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	return parallelGetMany(ctx, b, keys, b2Parallelism)
+}
 
+func (b *b2) Set(ctx context.Context, key string, data []byte, _ DataType) error {
 	meta := make(map[string]string)
-	buff := bytes.NewReader(data)
 
-	_, err := bucket.(*backblaze.Bucket).UploadTypedFile(key, "application/octet-string", meta, buff)
+	err := b.do(func(bucket *backblaze.Bucket) error {
+		_, err := bucket.UploadTypedFile(key, "application/octet-string", meta, bytes.NewReader(data))
+		return err
+	})
 	if err != nil {
 		B2Ops.WithLabelValues("set", "false").Inc()
 		return err
@@ -135,13 +184,11 @@ func (b *b2) Set(ctx context.Context, key string, data []byte, _ DataType) error
 }
 
 func (b *b2) Delete(ctx context.Context, key string) error {
-	bucket := b.pool.Get()
-	if err, ok := bucket.(error); ok {
+	err := b.do(func(bucket *backblaze.Bucket) error {
+		_, err := bucket.HideFile(key)
 		return err
-	}
-	defer b.pool.Put(bucket)
-
-	if _, err := bucket.(*backblaze.Bucket).HideFile(key); err != nil {
+	})
+	if err != nil {
 		B2Ops.WithLabelValues("delete", "false").Inc()
 		return err
 	}
@@ -150,14 +197,145 @@ func (b *b2) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
-func (b *b2) getWithAuth(key string) (io.ReadCloser, error) {
-	bucket := b.pool.Get()
-	if err, ok := bucket.(error); ok {
-		return nil, err
+// B2Version is one version of an object stored in B2.
+type B2Version struct {
+	Name     string
+	ID       string
+	Hidden   bool // Whether this version marks the object as deleted, rather than holding data.
+	Current  bool // Whether this is the newest version of the object.
+	Size     int64
+	Uploaded time.Time
+}
+
+// B2Versions returns every version of the objects whose keys start with
+// `prefix`, including hidden and overwritten ones, in order of key and then
+// newest first. `store` must have been returned by NewB2.
+func B2Versions(ctx context.Context, store ObjectStorage, prefix string) ([]B2Version, error) {
+	b, ok := store.(*b2)
+	if !ok {
+		return nil, fmt.Errorf("storage: listing versions is only supported by b2")
+	}
+	return b.versions(ctx, prefix)
+}
+
+// B2CheckRetention returns an error unless the bucket's lifecycle rules keep
+// hidden and overwritten versions of the objects whose keys start with
+// `prefix` for at least `minDays` days, so that they can be recovered in that
+// time. Rules that hide current versions are never allowed, because they'd
+// remove blocks that are still in use. `store` must have been returned by
+// NewB2.
+func B2CheckRetention(ctx context.Context, store ObjectStorage, prefix string, minDays int) error {
+	b, ok := store.(*b2)
+	if !ok {
+		return fmt.Errorf("storage: checking retention is only supported by b2")
+	}
+	var rules []backblaze.LifecycleRule
+	err := b.do(func(bucket *backblaze.Bucket) error {
+		rules = bucket.LifecycleRules
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if !strings.HasPrefix(prefix, rule.FileNamePrefix) && !strings.HasPrefix(rule.FileNamePrefix, prefix) {
+			continue
+		} else if rule.DaysFromUploadingToHiding != 0 {
+			return fmt.Errorf("storage: bucket has a lifecycle rule for prefix %q that hides current versions", rule.FileNamePrefix)
+		} else if rule.DaysFromHidingToDeleting != 0 && rule.DaysFromHidingToDeleting < minDays {
+			return fmt.Errorf("storage: bucket has a lifecycle rule for prefix %q that deletes old versions after %v days, but %v are required", rule.FileNamePrefix, rule.DaysFromHidingToDeleting, minDays)
+		}
+	}
+	return nil
+}
+
+// versions lists the versions of objects whose keys start with `prefix`.
+func (b *b2) versions(ctx context.Context, prefix string) ([]B2Version, error) {
+	out := make([]B2Version, 0)
+	nextName, nextId := prefix, ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var resp *backblaze.ListFileVersionsResponse
+		err := b.do(func(bucket *backblaze.Bucket) (err error) {
+			resp, err = bucket.ListFileVersions(nextName, nextId, 1000)
+			return
+		})
+		if err != nil {
+			B2Ops.WithLabelValues("list-versions", "false").Inc()
+			return nil, err
+		}
+		for _, file := range resp.Files {
+			// Results are in order of name, so the first one that doesn't
+			// match is past the end of what's wanted.
+			if !strings.HasPrefix(file.Name, prefix) {
+				B2Ops.WithLabelValues("list-versions", "true").Inc()
+				return out, nil
+			}
+			out = append(out, B2Version{
+				Name:     file.Name,
+				ID:       file.ID,
+				Hidden:   file.Action == backblaze.Hide,
+				Current:  len(out) == 0 || out[len(out)-1].Name != file.Name,
+				Size:     file.ContentLength,
+				Uploaded: time.Unix(0, file.UploadTimestamp*int64(time.Millisecond)),
+			})
+		}
+		if resp.NextFileName == "" {
+			break
+		}
+		nextName, nextId = resp.NextFileName, resp.NextFileID
 	}
-	defer b.pool.Put(bucket)
 
-	_, reader, err := bucket.(*backblaze.Bucket).DownloadFileByName(key)
+	B2Ops.WithLabelValues("list-versions", "true").Inc()
+	return out, nil
+}
+
+func (b *b2) List(ctx context.Context, prefix string) ([]string, error) {
+	out := make([]string, 0)
+	next := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var resp *backblaze.ListFilesResponse
+		err := b.do(func(bucket *backblaze.Bucket) (err error) {
+			resp, err = bucket.ListFileNamesWithPrefix(next, 1000, prefix, "")
+			return
+		})
+		if err != nil {
+			B2Ops.WithLabelValues("list", "false").Inc()
+			return nil, err
+		}
+		for _, file := range resp.Files {
+			out = append(out, file.Name)
+		}
+		if resp.NextFileName == "" {
+			break
+		}
+		next = resp.NextFileName
+	}
+
+	B2Ops.WithLabelValues("list", "true").Inc()
+	return out, nil
+}
+
+// Close drops the idle connections to B2. Connections are made with the
+// default HTTP client, or the one used for `url`, so there's nothing else to
+// release.
+func (b *b2) Close() error {
+	http.DefaultClient.CloseIdleConnections()
+	client.CloseIdleConnections()
+	return nil
+}
+
+func (b *b2) getWithAuth(key string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := b.do(func(bucket *backblaze.Bucket) (err error) {
+		_, reader, err = bucket.DownloadFileByName(key)
+		return
+	})
 	if err != nil {
 		if b2err, ok := err.(*backblaze.B2Error); ok {
 			if b2err.Status == 404 {
@@ -0,0 +1,286 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeB2 implements enough of the B2 API for NewB2 to work against it. Auth
+// tokens stop working when expire is called, like they do after a day in B2.
+// Every upload and hide is kept in `versions`, like in a bucket that keeps all
+// versions, while `files` has the current contents of each file. The bucket has
+// the lifecycle rules in `rules`.
+type fakeB2 struct {
+	mu       sync.Mutex
+	tokens   int
+	token    string
+	files    map[string][]byte
+	versions []fakeVersion
+	rules    []map[string]interface{}
+}
+
+type fakeVersion struct {
+	seq    int
+	name   string
+	hidden bool
+	data   []byte
+}
+
+func (fv fakeVersion) id() string { return fmt.Sprint(fv.seq) }
+
+// update sets the current contents of the file `name` from its newest version.
+func (fb *fakeB2) update(name string) {
+	delete(fb.files, name)
+	for _, fv := range fb.versions {
+		if fv.name != name {
+			continue
+		} else if fv.hidden {
+			delete(fb.files, name)
+		} else {
+			fb.files[name] = fv.data
+		}
+	}
+}
+
+func (fb *fakeB2) expire() {
+	fb.mu.Lock()
+	fb.token = ""
+	fb.mu.Unlock()
+}
+
+func (fb *fakeB2) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	fb.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func (fb *fakeB2) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	reply := func(status int, body interface{}) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(body)
+	}
+	if req.URL.Path == "/b2api/v1/b2_authorize_account" {
+		fb.tokens++
+		fb.token = fmt.Sprintf("token%v", fb.tokens)
+		reply(200, map[string]string{
+			"accountId":          "account",
+			"apiUrl":             "https://api.b2.test",
+			"authorizationToken": fb.token,
+			"downloadUrl":        "https://download.b2.test",
+		})
+		return
+	} else if fb.token == "" || req.Header.Get("Authorization") != fb.token {
+		reply(401, map[string]interface{}{"code": "expired_auth_token", "message": "expired", "status": 401})
+		return
+	}
+
+	switch {
+	case req.URL.Path == "/b2api/v1/b2_list_buckets":
+		reply(200, map[string]interface{}{"buckets": []map[string]interface{}{{
+			"accountId":      "account",
+			"bucketId":       "bucket-id",
+			"bucketName":     "bucket",
+			"bucketType":     "allPrivate",
+			"lifecycleRules": fb.rules,
+		}}})
+	case req.URL.Path == "/b2api/v1/b2_get_upload_url":
+		reply(200, map[string]string{
+			"bucketId":           "bucket-id",
+			"uploadUrl":          "https://upload.b2.test/upload",
+			"authorizationToken": fb.token,
+		})
+	case req.URL.Path == "/upload":
+		name, _ := url.QueryUnescape(req.Header.Get("X-Bz-File-Name"))
+		data, _ := ioutil.ReadAll(req.Body)
+		fv := fakeVersion{seq: len(fb.versions), name: name, data: data}
+		fb.versions = append(fb.versions, fv)
+		fb.files[name] = data
+		reply(200, map[string]interface{}{
+			"fileId":        fv.id(),
+			"fileName":      name,
+			"contentLength": len(data),
+			"contentSha1":   req.Header.Get("X-Bz-Content-Sha1"),
+		})
+	case strings.HasPrefix(req.URL.Path, "/file/bucket/"):
+		data, ok := fb.files[strings.TrimPrefix(req.URL.Path, "/file/bucket/")]
+		if !ok {
+			reply(404, map[string]interface{}{"code": "not_found", "message": "not found", "status": 404})
+			return
+		}
+		rw.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		rw.WriteHeader(200)
+		rw.Write(data)
+	case req.URL.Path == "/b2api/v1/b2_hide_file":
+		var body struct {
+			FileName string `json:"fileName"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		fv := fakeVersion{seq: len(fb.versions), name: body.FileName, hidden: true}
+		fb.versions = append(fb.versions, fv)
+		fb.update(body.FileName)
+		reply(200, map[string]interface{}{"fileId": fv.id(), "fileName": fv.name, "action": "hide"})
+	case req.URL.Path == "/b2api/v1/b2_list_file_versions":
+		var body struct {
+			StartFileName string `json:"startFileName"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		versions := make([]fakeVersion, 0)
+		for _, fv := range fb.versions {
+			if fv.name >= body.StartFileName {
+				versions = append(versions, fv)
+			}
+		}
+		sort.Slice(versions, func(i, j int) bool {
+			if versions[i].name != versions[j].name {
+				return versions[i].name < versions[j].name
+			}
+			return versions[i].seq > versions[j].seq
+		})
+		files := make([]map[string]interface{}, 0)
+		for _, fv := range versions {
+			action := "upload"
+			if fv.hidden {
+				action = "hide"
+			}
+			files = append(files, map[string]interface{}{
+				"fileId":          fv.id(),
+				"fileName":        fv.name,
+				"action":          action,
+				"contentLength":   len(fv.data),
+				"uploadTimestamp": 1000 * fv.seq,
+			})
+		}
+		reply(200, map[string]interface{}{"files": files})
+	default:
+		reply(400, map[string]interface{}{"code": "bad_request", "message": req.URL.Path, "status": 400})
+	}
+}
+
+func TestB2TokenExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	// The B2 client library always uses the default transport.
+	fb := &fakeB2{files: make(map[string][]byte)}
+	orig := http.DefaultTransport
+	http.DefaultTransport = fb
+	defer func() { http.DefaultTransport = orig }()
+
+	store, err := NewB2("account", "", "key", "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(ctx, "a", []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	}
+
+	fb.expire()
+	if data, err := store.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+
+	fb.expire()
+	if err := store.Set(ctx, "b", []byte("world"), Content); err != nil {
+		t.Fatal(err)
+	} else if data, err := store.Get(ctx, "b"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "world" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+
+	if _, err := store.Get(ctx, "c"); err != ErrObjectNotFound {
+		t.Fatalf("expected object not found error, got: %v", err)
+	}
+}
+
+func TestB2Versions(t *testing.T) {
+	ctx := context.Background()
+
+	fb := &fakeB2{files: make(map[string][]byte)}
+	orig := http.DefaultTransport
+	http.DefaultTransport = fb
+	defer func() { http.DefaultTransport = orig }()
+
+	store, err := NewB2("account", "", "key", "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, val := range []string{"one", "two"} {
+		if err := store.Set(ctx, "a", []byte(val), Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set(ctx, "ab", []byte("three"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	} else if _, err := store.Get(ctx, "a"); err != ErrObjectNotFound {
+		t.Fatalf("expected object not found error, got: %v", err)
+	}
+
+	versions, err := B2Versions(ctx, store, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, v := range versions {
+		got = append(got, fmt.Sprintf("%v:%v:%v:%v", v.Name, v.Hidden, v.Current, v.Size))
+	}
+	if expected := "a:true:true:0 a:false:false:3 a:false:false:3 ab:false:true:5"; strings.Join(got, " ") != expected {
+		t.Fatalf("unexpected versions: %v", got)
+	}
+}
+
+func TestB2CheckRetention(t *testing.T) {
+	ctx := context.Background()
+
+	fb := &fakeB2{files: make(map[string][]byte)}
+	orig := http.DefaultTransport
+	http.DefaultTransport = fb
+	defer func() { http.DefaultTransport = orig }()
+
+	check := func(prefix string, rules ...map[string]interface{}) error {
+		fb.rules = rules
+		store, err := NewB2("account", "", "key", "bucket", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return B2CheckRetention(ctx, store, prefix, 7)
+	}
+	rule := func(prefix string, hiding, deleting int) map[string]interface{} {
+		return map[string]interface{}{
+			"fileNamePrefix":            prefix,
+			"daysFromUploadingToHiding": hiding,
+			"daysFromHidingToDeleting":  deleting,
+		}
+	}
+
+	if err := check("utahfs/"); err != nil {
+		t.Fatal(err)
+	} else if err := check("utahfs/", rule("other/", 0, 1)); err != nil {
+		t.Fatal(err)
+	} else if err := check("utahfs/", rule("", 0, 7)); err != nil {
+		t.Fatal(err)
+	} else if err := check("utahfs/", rule("", 0, 30)); err != nil {
+		t.Fatal(err)
+	} else if err := check("utahfs/", rule("", 0, 1)); err == nil {
+		t.Fatal("expected rule that deletes hidden versions too soon to be rejected")
+	} else if err := check("utahfs/", rule("utahfs/blocks", 30, 0)); err == nil {
+		t.Fatal("expected rule that hides current versions to be rejected")
+	}
+}
@@ -0,0 +1,58 @@
+package persistent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// BackendFactory returns object storage configured by `options`, which are
+// the key-value pairs given in the config file.
+type BackendFactory func(options map[string]string) (ObjectStorage, error)
+
+var (
+	backendsMu sync.Mutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a kind of object storage available under `name`, so it
+// can be used by config files without the config package knowing about it. It's
+// meant to be called from the init function of the package that implements the
+// backend, and panics if `name` is already registered, like sql.Register.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("storage: backend factory is nil")
+	} else if _, ok := backends[name]; ok {
+		panic("storage: backend registered twice: " + name)
+	}
+	backends[name] = factory
+}
+
+// NewBackend returns object storage from the backend registered as `name`,
+// configured by `options`.
+func NewBackend(name string, options map[string]string) (ObjectStorage, error) {
+	backendsMu.Lock()
+	factory, ok := backends[name]
+	backendsMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown backend %q, registered backends are: %v", name, Backends())
+	}
+	return factory(options)
+}
+
+// Backends returns the names of the registered backends, in sorted order.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	out := make([]string, 0, len(backends))
+	for name := range backends {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,49 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	ctx := context.Background()
+
+	// Names can't be registered twice, so use a new one every time the test
+	// is run.
+	name := fmt.Sprintf("test-memory-%v", time.Now().UnixNano())
+	RegisterBackend(name, func(options map[string]string) (ObjectStorage, error) {
+		ms, err := strconv.Atoi(options["latency-ms"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency: %v", err)
+		}
+		return NewMemoryStorage(time.Duration(ms) * time.Millisecond), nil
+	})
+
+	store, err := NewBackend(name, map[string]string{"latency-ms": "1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := store.Set(ctx, "a", []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	} else if data, err := store.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+
+	if _, err := NewBackend(name, nil); err == nil {
+		t.Fatal("expected error from factory to be returned")
+	} else if _, err := NewBackend("test-unknown", nil); err == nil {
+		t.Fatal("expected unknown backend to be refused")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a name twice to panic")
+		}
+	}()
+	RegisterBackend(name, func(map[string]string) (ObjectStorage, error) { return NewMemory(), nil })
+}
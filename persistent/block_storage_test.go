@@ -0,0 +1,104 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	benchBlocks    = 32
+	benchBlockSize = 4096
+)
+
+// benchmarkWrites measures how quickly blocks can be written to the storage
+// stack returned by `setup`, which is built on top of `base`.
+func benchmarkWrites(b *testing.B, base ReliableStorage, setup func(b *testing.B, dir string, base BlockStorage) BlockStorage) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := setup(b, dir, NewBufferedStorage(base))
+
+	data := make([]byte, benchBlockSize)
+	rand.Read(data)
+
+	b.SetBytes(benchBlocks * benchBlockSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Start(ctx, nil); err != nil {
+			b.Fatal(err)
+		}
+		for ptr := uint64(0); ptr < benchBlocks; ptr++ {
+			if err := store.Set(ctx, ptr, data, Content); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := store.Commit(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchPlain(b *testing.B, dir string, base BlockStorage) BlockStorage {
+	return base
+}
+
+func benchEncryption(b *testing.B, dir string, base BlockStorage) BlockStorage {
+	return WithEncryption(base, "password")
+}
+
+func benchIntegrity(b *testing.B, dir string, base BlockStorage) BlockStorage {
+	store, err := WithIntegrity(base, "password", path.Join(dir, "pin.json"), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return WithEncryption(store, "password")
+}
+
+func benchORAM(b *testing.B, dir string, base BlockStorage) BlockStorage {
+	ostore, err := NewLocalOblivious(path.Join(dir, "oram"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	store, err := WithORAM(benchIntegrity(b, dir, base), ostore, benchBlockSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return store
+}
+
+func BenchmarkWritePlain(b *testing.B) {
+	benchmarkWrites(b, NewSimpleReliable(NewMemory()), benchPlain)
+}
+
+func BenchmarkWriteEncryption(b *testing.B) {
+	benchmarkWrites(b, NewSimpleReliable(NewMemory()), benchEncryption)
+}
+
+func BenchmarkWriteIntegrity(b *testing.B) {
+	benchmarkWrites(b, NewSimpleReliable(NewMemory()), benchIntegrity)
+}
+
+func BenchmarkWriteORAM(b *testing.B) {
+	benchmarkWrites(b, NewSimpleReliable(NewMemory()), benchORAM)
+}
+
+func BenchmarkWriteCache(b *testing.B) {
+	benchmarkWrites(b, NewCache(NewSimpleReliable(NewMemory()), 1024), benchIntegrity)
+}
+
+// BenchmarkWriteRemote is like BenchmarkWriteIntegrity, but each request to the
+// storage provider takes a millisecond.
+func BenchmarkWriteRemote(b *testing.B) {
+	benchmarkWrites(b, NewSimpleReliable(NewMemoryStorage(time.Millisecond)), benchIntegrity)
+}
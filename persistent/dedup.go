@@ -0,0 +1,192 @@
+package persistent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// dedupSlots is the number of entries that fit in each bucket of a dedup
+	// index.
+	dedupSlots = 8
+
+	// dedupEntrySize is the size of an entry: a hash, a pointer, and a count.
+	dedupEntrySize  = 32 + 8 + 8
+	dedupBucketSize = dedupSlots * dedupEntrySize
+)
+
+// ReaderWriterAt is the interface for a file that supports random access.
+type ReaderWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// DedupIndex is a hash table stored in a file, that maps the hash of a block of
+// data to the pointer of a shared copy of it and the number of references to
+// that copy.
+//
+// The table has a fixed number of buckets with a fixed number of entries each,
+// so it never needs to be resized. A bucket being full just means that new
+// blocks which hash to it can't be shared. The file is Size() bytes, but bytes
+// that have never been written are expected to read as zeros, so it can be
+// sparse.
+type DedupIndex struct {
+	file    ReaderWriterAt
+	buckets uint64
+}
+
+// NewDedupIndex returns a dedup index stored in `file`, with the given number of
+// buckets. The number of buckets must be the same every time the index is
+// opened.
+func NewDedupIndex(file ReaderWriterAt, buckets uint64) *DedupIndex {
+	return &DedupIndex{file, buckets}
+}
+
+// Size returns the size of the file that the index is stored in.
+func (di *DedupIndex) Size() int64 {
+	return int64(di.buckets * dedupBucketSize)
+}
+
+type dedupEntry struct {
+	hash [32]byte
+	ptr  uint64
+	refs uint64
+}
+
+func (di *DedupIndex) readBucket(hash [32]byte) (int64, []dedupEntry, error) {
+	offset := int64(binary.LittleEndian.Uint64(hash[:8])%di.buckets) * dedupBucketSize
+
+	raw := make([]byte, dedupBucketSize)
+	if _, err := di.file.ReadAt(raw, offset); err != nil {
+		return 0, nil, err
+	}
+	entries := make([]dedupEntry, dedupSlots)
+	for i := range entries {
+		e := raw[i*dedupEntrySize:]
+		copy(entries[i].hash[:], e[:32])
+		entries[i].ptr = binary.LittleEndian.Uint64(e[32:40])
+		entries[i].refs = binary.LittleEndian.Uint64(e[40:48])
+	}
+	return offset, entries, nil
+}
+
+func (di *DedupIndex) writeEntry(offset int64, slot int, entry dedupEntry) error {
+	raw := make([]byte, dedupEntrySize)
+	copy(raw[:32], entry.hash[:])
+	binary.LittleEndian.PutUint64(raw[32:40], entry.ptr)
+	binary.LittleEndian.PutUint64(raw[40:48], entry.refs)
+
+	_, err := di.file.WriteAt(raw, offset+int64(slot*dedupEntrySize))
+	return err
+}
+
+// Lookup returns the pointer of the shared copy of the data with the given hash,
+// and whether or not there is one.
+func (di *DedupIndex) Lookup(hash [32]byte) (uint64, bool, error) {
+	_, entries, err := di.readBucket(hash)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, entry := range entries {
+		if entry.refs > 0 && entry.hash == hash {
+			return entry.ptr, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Add records that a shared copy of the data with the given hash is at `ptr`,
+// with one reference. It returns false if the hash's bucket is full.
+func (di *DedupIndex) Add(hash [32]byte, ptr uint64) (bool, error) {
+	offset, entries, err := di.readBucket(hash)
+	if err != nil {
+		return false, err
+	}
+	for i, entry := range entries {
+		if entry.refs > 0 && entry.hash == hash {
+			return false, fmt.Errorf("dedup: hash is already in index")
+		} else if entry.refs == 0 {
+			return true, di.writeEntry(offset, i, dedupEntry{hash, ptr, 1})
+		}
+	}
+	return false, nil
+}
+
+// Ref adds `delta` to the number of references to the shared copy of the data
+// with the given hash, and returns the new number. The entry is removed once
+// there are no references left.
+func (di *DedupIndex) Ref(hash [32]byte, delta int) (uint64, error) {
+	offset, entries, err := di.readBucket(hash)
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if entry.refs == 0 || entry.hash != hash {
+			continue
+		} else if delta < 0 && uint64(-delta) > entry.refs {
+			return 0, fmt.Errorf("dedup: reference count would be negative")
+		}
+		entry.refs = uint64(int64(entry.refs) + int64(delta))
+		if entry.refs == 0 {
+			entry = dedupEntry{}
+		}
+		return entry.refs, di.writeEntry(offset, i, entry)
+	}
+	return 0, fmt.Errorf("dedup: hash is not in index")
+}
+
+// Range calls `fn` with the pointer and number of references of every shared
+// copy of data in the index.
+func (di *DedupIndex) Range(fn func(ptr, refs uint64) error) error {
+	raw := make([]byte, dedupBucketSize)
+	empty := make([]byte, dedupEntrySize)
+
+	for offset := int64(0); offset < di.Size(); offset += dedupBucketSize {
+		if _, err := di.file.ReadAt(raw, offset); err != nil {
+			return err
+		}
+		for i := 0; i < dedupSlots; i++ {
+			e := raw[i*dedupEntrySize : (i+1)*dedupEntrySize]
+			if bytes.Equal(e, empty) {
+				continue
+			} else if err := fn(binary.LittleEndian.Uint64(e[32:40]), binary.LittleEndian.Uint64(e[40:48])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remap replaces the pointer of every shared copy of data in the index with the
+// one returned by `fn`, for when the copies have been moved.
+func (di *DedupIndex) Remap(fn func(ptr uint64) (uint64, error)) error {
+	raw := make([]byte, dedupBucketSize)
+	empty := make([]byte, dedupEntrySize)
+
+	for offset := int64(0); offset < di.Size(); offset += dedupBucketSize {
+		if _, err := di.file.ReadAt(raw, offset); err != nil {
+			return err
+		}
+		changed := false
+		for i := 0; i < dedupSlots; i++ {
+			e := raw[i*dedupEntrySize : (i+1)*dedupEntrySize]
+			if bytes.Equal(e, empty) {
+				continue
+			}
+			ptr, err := fn(binary.LittleEndian.Uint64(e[32:40]))
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint64(e[32:40], ptr)
+			changed = true
+		}
+		if changed {
+			if _, err := di.file.WriteAt(raw, offset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -5,15 +5,26 @@ import (
 	"database/sql"
 	"os"
 	"path"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// diskBatchSize is the maximum number of keys that GetMany looks up in one
+// query. SQLite limits the number of parameters a query can have.
+const diskBatchSize = 500
+
 type disk struct {
 	db *sql.DB
+
+	// afterBatch, if set, is called by GetMany after each batch is read. It
+	// lets tests interrupt GetMany at a known point.
+	afterBatch func()
 }
 
 // NewDisk returns object storage backed by an on-disk database stored at `loc`.
+// Each Set is its own SQLite transaction, so a write that's interrupted by a
+// crash is either fully applied or not at all.
 func NewDisk(loc string) (ObjectStorage, error) {
 	if err := os.MkdirAll(path.Dir(loc), 0744); err != nil {
 		return nil, err
@@ -27,7 +38,7 @@ func NewDisk(loc string) (ObjectStorage, error) {
 		return nil, err
 	}
 
-	return &disk{db}, nil
+	return &disk{db: db}, nil
 }
 
 func (d *disk) Get(ctx context.Context, key string) ([]byte, error) {
@@ -41,6 +52,49 @@ func (d *disk) Get(ctx context.Context, key string) ([]byte, error) {
 	return data, nil
 }
 
+func (d *disk) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > diskBatchSize {
+			batch = batch[:diskBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		args := make([]interface{}, 0, len(batch))
+		for _, key := range batch {
+			args = append(args, key)
+		}
+		query := "SELECT key, val FROM db WHERE key IN (?" + strings.Repeat(", ?", len(batch)-1) + ")"
+		if err := d.getMany(ctx, query, args, out); err != nil {
+			return nil, err
+		} else if d.afterBatch != nil {
+			d.afterBatch()
+		}
+	}
+	return out, nil
+}
+
+func (d *disk) getMany(ctx context.Context, query string, args []interface{}, out map[string][]byte) error {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key  string
+			data []byte
+		)
+		if err := rows.Scan(&key, &data); err != nil {
+			return err
+		}
+		out[key] = data
+	}
+	return rows.Err()
+}
+
 func (d *disk) Set(ctx context.Context, key string, data []byte, _ DataType) error {
 	_, err := d.db.ExecContext(ctx, "INSERT OR REPLACE INTO db (key, val) VALUES (?, ?)", key, data)
 	return err
@@ -50,3 +104,23 @@ func (d *disk) Delete(ctx context.Context, key string) error {
 	_, err := d.db.ExecContext(ctx, "DELETE FROM db WHERE key = ?", key)
 	return err
 }
+
+func (d *disk) List(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT key FROM db WHERE substr(key, 1, ?) = ? ORDER BY key", len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		out = append(out, key)
+	}
+	return out, rows.Err()
+}
+
+func (d *disk) Close() error { return d.db.Close() }
@@ -2,15 +2,19 @@ package persistent
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
-	"log"
+	"fmt"
 	"math/rand"
 	"os"
 	"path"
+	"sort"
 	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/cloudflare/utahfs/internal/logging"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -22,6 +26,10 @@ var DiskCacheSize = prometheus.NewGaugeVec(
 	[]string{"path"},
 )
 
+// epochKey is the key of the object that the cache's epoch is taken from. It's
+// where the tree head is stored, which changes with every commit.
+const epochKey = "0"
+
 type diskCache struct {
 	mu    sync.Mutex
 	mapMu MapMutex
@@ -31,12 +39,25 @@ type diskCache struct {
 	size    int64
 	exclude []DataType
 
-	n  int64
-	db *sql.DB
+	n       int64
+	db      *sql.DB
+	checked map[string]struct{} // Keys in the cache whose entry is known to be current.
 }
 
 // NewDiskCache wraps a base object storage backend with a large on-disk cache
 // stored at `loc`.
+//
+// If `base` implements ConditionalObjectStorage, the ETag of each object read
+// from it is kept with the cached entry. The first time an entry is read after
+// the cache is opened, it's revalidated with a conditional request instead of
+// being downloaded again, so that a change made by another client isn't hidden
+// by a restart. Entries that were written through the cache have no ETag and
+// are always trusted.
+//
+// The cache also records a hash of the tree head that was last written through
+// it, or found in storage when it was opened. If the tree head in storage is
+// different when the cache is opened again, the repository was changed without
+// going through the cache, so every entry is removed.
 func NewDiskCache(base ObjectStorage, loc string, size int64, exclude []DataType) (ObjectStorage, error) {
 	if err := os.MkdirAll(path.Dir(loc), 0744); err != nil {
 		return nil, err
@@ -45,9 +66,17 @@ func NewDiskCache(base ObjectStorage, loc string, size int64, exclude []DataType
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS cache (key text not null primary key, val bytea)")
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS cache (key text not null primary key, val bytea, etag text)")
 	if err != nil {
 		return nil, err
+	} else if err := migrateDiskCache(db); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS epoch (id integer not null primary key, hash text not null)")
+	if err != nil {
+		return nil, err
+	} else if err := checkEpoch(db, base, loc); err != nil {
+		return nil, err
 	}
 
 	// Get the max rowid in the cache.
@@ -68,18 +97,107 @@ func NewDiskCache(base ObjectStorage, loc string, size int64, exclude []DataType
 		size:    size,
 		exclude: exclude,
 
-		n:  *n,
-		db: db,
+		n:       *n,
+		db:      db,
+		checked: make(map[string]struct{}),
 	}, nil
 }
 
-func (dc *diskCache) addToCache(ctx context.Context, key string, data []byte) {
+// migrateDiskCache adds the etag column to a cache created by an older version.
+func migrateDiskCache(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(cache)")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, kind       string
+			def              interface{}
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &def, &pk); err != nil {
+			return err
+		} else if name == "etag" {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE cache ADD COLUMN etag text")
+	return err
+}
+
+// checkEpoch compares the epoch recorded in the cache's database with the
+// current tree head in `base`, and removes every entry from the cache if they
+// differ. A cache without an epoch, from an older version, is cleared as well
+// since it can't be checked.
+func checkEpoch(db *sql.DB, base ObjectStorage, loc string) error {
+	ctx := context.Background()
+
+	head, err := base.Get(ctx, epochKey)
+	if err == ErrObjectNotFound {
+		head = nil
+	} else if err != nil {
+		return err
+	}
+	var stored string
+	err = db.QueryRow("SELECT hash FROM epoch WHERE id = 1").Scan(&stored)
+	if err == sql.ErrNoRows {
+		stored = ""
+	} else if err != nil {
+		return err
+	}
+
+	if curr := epochHash(head); stored != curr {
+		var n int64
+		if err := db.QueryRow("SELECT COUNT(*) FROM cache").Scan(&n); err != nil {
+			return err
+		} else if n > 0 {
+			logging.Warnf("disk cache: repository was changed since %v was last used, clearing %v entries", loc, n)
+		}
+		if _, err := db.Exec("DELETE FROM cache"); err != nil {
+			return err
+		}
+		return setEpoch(ctx, db, curr)
+	}
+	return nil
+}
+
+// epochHash returns the epoch of a cache whose base has the tree head `head`.
+func epochHash(head []byte) string {
+	if head == nil {
+		return "none"
+	}
+	h := sha256.Sum256(head)
+	return fmt.Sprintf("%x", h)
+}
+
+func setEpoch(ctx context.Context, db *sql.DB, hash string) error {
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO epoch (id, hash) VALUES (1, ?)", hash)
+	return err
+}
+
+// updateEpoch records that the tree head in the base is now `head`. If it fails,
+// the cache is cleared the next time it's opened.
+func (dc *diskCache) updateEpoch(ctx context.Context, head []byte) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if err := setEpoch(ctx, dc.db, epochHash(head)); err != nil {
+		logging.Warn(err)
+	}
+}
+
+func (dc *diskCache) addToCache(ctx context.Context, key string, data []byte, etag string) {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
 
 	tx, err := dc.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 	defer tx.Rollback()
@@ -88,44 +206,69 @@ func (dc *diskCache) addToCache(ctx context.Context, key string, data []byte) {
 	i := rand.Int63n(n) + 1
 
 	// Move a random existing entry into the next rowid slot.
-	if i != dc.n {
+	if i != n {
 		_, err := tx.ExecContext(ctx, "UPDATE cache SET rowid = ? WHERE rowid = ?", n, i)
 		if err != nil {
-			log.Println(err)
+			logging.Warn(err)
 			return
 		}
 	}
 	// Add the new row to the cache.
-	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO cache (rowid, key, val) VALUES (?, ?, ?)", i, key, data)
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO cache (rowid, key, val, etag) VALUES (?, ?, ?, ?)", i, key, data, etag)
 	if err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 	// Evict from the cache until we're back at/below the target size.
+	evicted := make([]string, 0, 1)
 	for n > dc.size {
-		if _, err := tx.ExecContext(ctx, "DELETE FROM cache WHERE rowid = ?", n); err != nil {
-			log.Println(err)
+		var old string
+		if err := tx.QueryRowContext(ctx, "SELECT key FROM cache WHERE rowid = ?", n).Scan(&old); err != nil {
+			logging.Warn(err)
+			return
+		} else if _, err := tx.ExecContext(ctx, "DELETE FROM cache WHERE rowid = ?", n); err != nil {
+			logging.Warn(err)
 			return
 		}
+		evicted = append(evicted, old)
 		n -= 1
 	}
 
 	// Commit the transaction.
 	if err := tx.Commit(); err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 	dc.n = n
+	dc.checked[key] = struct{}{}
+	for _, old := range evicted {
+		delete(dc.checked, old)
+	}
 	DiskCacheSize.WithLabelValues(dc.loc).Set(float64(n))
 }
 
+// updateCache replaces the cached entry for `key`, after it's been found to be
+// out-of-date.
+func (dc *diskCache) updateCache(ctx context.Context, key string, data []byte, etag string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	_, err := dc.db.ExecContext(ctx, "UPDATE cache SET val = ?, etag = ? WHERE key = ?", data, etag, key)
+	if err != nil {
+		logging.Warn(err)
+		return
+	}
+	dc.checked[key] = struct{}{}
+}
+
 func (dc *diskCache) removeFromCache(ctx context.Context, key string) {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
+	delete(dc.checked, key)
 
 	tx, err := dc.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 	defer tx.Rollback()
@@ -136,23 +279,23 @@ func (dc *diskCache) removeFromCache(ctx context.Context, key string) {
 	if err == sql.ErrNoRows {
 		return
 	} else if err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 	// Delete the row.
 	if _, err := tx.ExecContext(ctx, "DELETE FROM cache WHERE rowid = ?", rowid); err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 	// Move something into this rowid gap.
 	if _, err := tx.ExecContext(ctx, "UPDATE cache SET rowid = ? WHERE rowid = ?", rowid, dc.n); err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 
 	// Commit the transaction.
 	if err := tx.Commit(); err != nil {
-		log.Println(err)
+		logging.Warn(err)
 		return
 	}
 	dc.n -= 1
@@ -163,21 +306,116 @@ func (dc *diskCache) Get(ctx context.Context, key string) ([]byte, error) {
 	dc.mapMu.Lock(key)
 	defer dc.mapMu.Unlock(key)
 
-	var data []byte
-	dc.mu.Lock()
-	err := dc.db.QueryRowContext(ctx, "SELECT val FROM cache WHERE key = ?", key).Scan(&data)
-	dc.mu.Unlock()
-	if err == sql.ErrNoRows {
-		data, err = dc.base.Get(ctx, key)
-		if err != nil {
+	data, ok, err := dc.getCached(ctx, key)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		return data, nil
+	}
+	data, etag, err := getIfChanged(ctx, dc.base, key, "")
+	if err != nil {
+		return nil, err
+	}
+	dc.addToCache(ctx, key, data, etag)
+	return data, nil
+}
+
+// GetMany answers what it can from the cache, and fetches everything else from
+// the base in one batch. GetMany doesn't return ETags, so objects fetched that
+// way are cached without one, and are trusted after a restart like the ones
+// written through the cache.
+func (dc *diskCache) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	// Lock the keys in order, so that two batches can't deadlock.
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]struct{})
+	for _, key := range keys {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		dc.mapMu.Lock(key)
+	}
+	defer func() {
+		for _, key := range sorted {
+			dc.mapMu.Unlock(key)
+		}
+	}()
+
+	out := make(map[string][]byte)
+	missing := make([]string, 0)
+	for _, key := range sorted {
+		data, ok, err := dc.getCached(ctx, key)
+		if err == ErrObjectNotFound {
+			continue
+		} else if err != nil {
 			return nil, err
+		} else if ok {
+			out[key] = data
+		} else {
+			missing = append(missing, key)
 		}
-		dc.addToCache(ctx, key, data)
-		return data, nil
+	}
+	if len(missing) == 0 {
+		return out, nil
+	}
+
+	data, err := getMany(ctx, dc.base, missing)
+	if pe, ok := err.(*PartialError); ok {
+		for key, val := range pe.Data {
+			dc.addToCache(ctx, key, val, "")
+			out[key] = val
+		}
+		return nil, &PartialError{out, pe.Failed, pe.Err}
 	} else if err != nil {
 		return nil, err
 	}
-	return data, nil
+	for key, val := range data {
+		dc.addToCache(ctx, key, val, "")
+		out[key] = val
+	}
+	return out, nil
+}
+
+// getCached returns the cached entry for `key`, or false if there isn't one.
+// An entry that was cached before the cache was opened is revalidated first,
+// and ErrObjectNotFound is returned if its object has since been deleted. The
+// caller must hold the lock for `key`.
+func (dc *diskCache) getCached(ctx context.Context, key string) ([]byte, bool, error) {
+	var (
+		data []byte
+		etag sql.NullString
+	)
+	dc.mu.Lock()
+	err := dc.db.QueryRowContext(ctx, "SELECT val, etag FROM cache WHERE key = ?", key).Scan(&data, &etag)
+	_, checked := dc.checked[key]
+	dc.mu.Unlock()
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	} else if checked || etag.String == "" {
+		return data, true, nil
+	}
+
+	// Check that the entry is still current, since it was cached before the
+	// cache was opened.
+	newData, newEtag, err := getIfChanged(ctx, dc.base, key, etag.String)
+	if err == ErrNotModified {
+		dc.mu.Lock()
+		dc.checked[key] = struct{}{}
+		dc.mu.Unlock()
+		return data, true, nil
+	} else if err == ErrObjectNotFound {
+		dc.removeFromCache(ctx, key)
+		return nil, false, err
+	} else if err != nil {
+		return nil, false, err
+	}
+	dc.updateCache(ctx, key, newData, newEtag)
+	return newData, true, nil
 }
 
 func (dc *diskCache) Set(ctx context.Context, key string, data []byte, dt DataType) error {
@@ -187,6 +425,8 @@ func (dc *diskCache) Set(ctx context.Context, key string, data []byte, dt DataTy
 	if err := dc.base.Set(ctx, key, data, dt); err != nil {
 		dc.removeFromCache(ctx, key)
 		return err
+	} else if key == epochKey {
+		dc.updateEpoch(ctx, data)
 	}
 
 	// Check if this key has an excluded data type and skip caching if so.
@@ -196,7 +436,7 @@ func (dc *diskCache) Set(ctx context.Context, key string, data []byte, dt DataTy
 		}
 	}
 	// Type isn't excluded; good to cache.
-	dc.addToCache(ctx, key, data)
+	dc.addToCache(ctx, key, data, "")
 	return nil
 }
 
@@ -206,5 +446,20 @@ func (dc *diskCache) Delete(ctx context.Context, key string) error {
 
 	err := dc.base.Delete(ctx, key)
 	dc.removeFromCache(ctx, key)
+	if err == nil && key == epochKey {
+		dc.updateEpoch(ctx, nil)
+	}
 	return err
 }
+
+func (dc *diskCache) List(ctx context.Context, prefix string) ([]string, error) {
+	return dc.base.List(ctx, prefix)
+}
+
+// Close closes the cache's database, and then the base.
+func (dc *diskCache) Close() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	return Closers{dc.db, dc.base}.Close()
+}
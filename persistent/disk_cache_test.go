@@ -0,0 +1,243 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// countingConditional counts the requests made to a conditional backend, and
+// how many of them downloaded an object.
+type countingConditional struct {
+	ConditionalObjectStorage
+	reqs, downloads int
+}
+
+func (cc *countingConditional) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	cc.reqs++
+	data, newEtag, err := cc.ConditionalObjectStorage.GetIfChanged(ctx, key, etag)
+	if err == nil {
+		cc.downloads++
+	}
+	return data, newEtag, err
+}
+
+func (cc *countingConditional) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return cc.GetIfChanged(ctx, key, "")
+}
+
+// countingBatch counts the calls to Get and GetMany made to a backend.
+type countingBatch struct {
+	ObjectStorage
+	gets, batches int
+}
+
+func (cb *countingBatch) Get(ctx context.Context, key string) ([]byte, error) {
+	cb.gets++
+	return cb.ObjectStorage.Get(ctx, key)
+}
+
+func (cb *countingBatch) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	cb.batches++
+	return getMany(ctx, cb.ObjectStorage, keys)
+}
+
+func TestDiskCacheRevalidate(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	loc := path.Join(tempDir, "cache")
+
+	base := &countingConditional{ConditionalObjectStorage: NewMemory().(ConditionalObjectStorage)}
+	if err := base.Set(ctx, "a", []byte("1"), Metadata); err != nil {
+		t.Fatal(err)
+	}
+	get := func(expected string, reqs, downloads int) {
+		t.Helper()
+		cache, err := NewDiskCache(base, loc, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base.reqs, base.downloads = 0, 0
+		for i := 0; i < 2; i++ {
+			data, err := cache.Get(ctx, "a")
+			if expected == "" && err != ErrObjectNotFound {
+				t.Fatalf("expected object not found, got: %v", err)
+			} else if expected != "" && err != nil {
+				t.Fatal(err)
+			} else if string(data) != expected {
+				t.Fatalf("unexpected value: %q", data)
+			}
+		}
+		if base.reqs != reqs || base.downloads != downloads {
+			t.Fatalf("expected %v requests and %v downloads, got %v and %v", reqs, downloads, base.reqs, base.downloads)
+		}
+	}
+
+	get("1", 1, 1) // The object is downloaded once, and then read from the cache.
+	get("1", 1, 0) // After a restart, it's revalidated without being downloaded.
+	if err := base.Set(ctx, "a", []byte("2"), Metadata); err != nil {
+		t.Fatal(err)
+	}
+	get("2", 1, 1) // A change made behind the cache's back is noticed.
+	if err := base.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	get("", 2, 0) // As is a deletion, which also evicts the entry.
+}
+
+func TestDiskCacheEpoch(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	loc := path.Join(tempDir, "cache")
+
+	base := NewMemory()
+	open := func() ObjectStorage {
+		t.Helper()
+		cache, err := NewDiskCache(base, loc, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+	get := func(cache ObjectStorage, expected string) {
+		t.Helper()
+		if data, err := cache.Get(ctx, "a"); err != nil {
+			t.Fatal(err)
+		} else if string(data) != expected {
+			t.Fatalf("unexpected value: %q", data)
+		}
+	}
+
+	cache := open()
+	if err := cache.Set(ctx, "a", []byte("1"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := cache.Set(ctx, epochKey, []byte("head 1"), Metadata); err != nil {
+		t.Fatal(err)
+	} else if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries written through the cache are trusted after a restart, as long
+	// as the tree head hasn't changed.
+	if err := base.Set(ctx, "a", []byte("2"), Content); err != nil {
+		t.Fatal(err)
+	}
+	cache = open()
+	get(cache, "1")
+	if err := cache.Set(ctx, epochKey, []byte("head 2"), Metadata); err != nil {
+		t.Fatal(err)
+	} else if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cache = open()
+	get(cache, "1")
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the tree head is changed behind the cache's back, it's cleared.
+	if err := base.Set(ctx, epochKey, []byte("head 3"), Metadata); err != nil {
+		t.Fatal(err)
+	}
+	get(open(), "2")
+}
+
+func TestDiskCacheGetMany(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	base := &countingBatch{ObjectStorage: NewMemory()}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := base.Set(ctx, key, []byte(key), Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache, err := NewDiskCache(base, path.Join(tempDir, "cache"), 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := cache.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the objects that aren't cached are fetched, in one batch, and after
+	// that they're cached too. Objects that don't exist are left out.
+	for i, keys := range [][]string{{"a", "b", "c", "d"}, {"a", "b", "c"}} {
+		base.gets, base.batches = 0, 0
+		data, err := cache.(BatchObjectStorage).GetMany(ctx, keys)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(data) != 3 {
+			t.Fatalf("unexpected number of objects: %v", len(data))
+		} else if base.gets != 0 || base.batches != 1-i {
+			t.Fatalf("unexpected requests: %v gets, %v batches", base.gets, base.batches)
+		}
+		for key, val := range data {
+			if string(val) != key {
+				t.Fatalf("unexpected value for %v: %q", key, val)
+			}
+		}
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewDiskCache(NewMemory(), path.Join(tempDir, "cache"), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := cache.(*diskCache)
+
+	// Every entry is kept until the cache is full, and after that each new
+	// entry evicts exactly one, which may be itself.
+	for i := 1; i <= 30; i++ {
+		key := fmt.Sprint(i)
+		if err := cache.Set(ctx, key, []byte(key), Content); err != nil {
+			t.Fatal(err)
+		}
+		expected := int64(i)
+		if expected > 10 {
+			expected = 10
+		}
+
+		var count, max int64
+		if err := dc.db.QueryRow("SELECT COUNT(*), MAX(rowid) FROM cache").Scan(&count, &max); err != nil {
+			t.Fatal(err)
+		} else if count != expected || max != expected || dc.n != expected {
+			t.Fatalf("unexpected cache size after %v entries: %v rows, max rowid %v, n = %v", i, count, max, dc.n)
+		}
+		if len(dc.checked) != int(count) {
+			t.Fatalf("expected %v checked keys after %v entries, got %v", count, i, len(dc.checked))
+		}
+		if i > 10 {
+			continue
+		}
+		var val []byte
+		if err := dc.db.QueryRow("SELECT val FROM cache WHERE key = ?", key).Scan(&val); err != nil {
+			t.Fatal(err)
+		} else if string(val) != key {
+			t.Fatalf("unexpected value for %v: %q", key, val)
+		}
+	}
+}
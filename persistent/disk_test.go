@@ -0,0 +1,100 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+func TestDiskGetMany(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewDisk(path.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use more keys than fit in one query, with every third one missing.
+	keys := make([]string, 0)
+	for i := 0; i < 2*diskBatchSize; i++ {
+		key := fmt.Sprintf("%x", i)
+		keys = append(keys, key)
+		if i%3 == 0 {
+			continue
+		} else if err := store.Set(ctx, key, []byte(key), Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := store.(BatchObjectStorage).GetMany(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		if val, ok := data[key]; i%3 == 0 && ok {
+			t.Fatalf("missing key %v should not be in results", key)
+		} else if i%3 != 0 && string(val) != key {
+			t.Fatalf("wrong value for key %v: %q", key, val)
+		}
+	}
+	if _, err := store.Get(ctx, keys[0]); err != ErrObjectNotFound {
+		t.Fatalf("expected object not found, got: %v", err)
+	}
+}
+
+func TestDiskGetManyInterrupted(t *testing.T) {
+	ctx := context.Background()
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := NewDisk(path.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	for i := 0; i < 2*diskBatchSize; i++ {
+		key := fmt.Sprintf("%x", i)
+		keys = append(keys, key)
+		if err := store.Set(ctx, key, []byte(key), Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Cancel the request after the first batch has been read. It must fail
+	// without returning what it had read so far.
+	cancelled, cancel := context.WithCancel(ctx)
+	defer cancel()
+	batches := 0
+	store.(*disk).afterBatch = func() {
+		batches++
+		cancel()
+	}
+	data, err := store.(BatchObjectStorage).GetMany(cancelled, keys)
+	if err != context.Canceled {
+		t.Fatalf("expected interrupted request to fail, got: %v", err)
+	} else if data != nil {
+		t.Fatalf("interrupted request returned %v objects", len(data))
+	} else if batches != 1 {
+		t.Fatalf("expected 1 batch to be read before the request was interrupted, got %v", batches)
+	}
+
+	// Without being interrupted, every object is returned.
+	store.(*disk).afterBatch = nil
+	data, err = store.(BatchObjectStorage).GetMany(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != len(keys) {
+		t.Fatalf("request returned %v of %v objects", len(data), len(keys))
+	}
+}
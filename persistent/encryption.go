@@ -10,10 +10,16 @@ import (
 	"fmt"
 	"io"
 
-	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/hkdf"
 )
 
+// EncryptionCipher is the name of the cipher used by WithEncryption.
+const EncryptionCipher = "aes-256-gcm"
+
+// EncryptionOverhead is the number of bytes that WithEncryption adds to each
+// block: a 12 byte nonce and a 16 byte authentication tag.
+const EncryptionOverhead = 28
+
 type encryption struct {
 	base BlockStorage
 	key  []byte
@@ -24,11 +30,13 @@ type encryption struct {
 //
 // The encryption key is derived with Argon2 from `password`.
 func WithEncryption(base BlockStorage, password string) BlockStorage {
-	// NOTE: The fixed salt to Argon2 is intentional. Its purpose is domain
-	// separation, not to frustrate a password cracker.
-	key := argon2.IDKey([]byte(password), []byte("7fedd6d671beec56"), 1, 64*1024, 4, 32)
+	return WithEncryptionKey(base, PasswordKey(password))
+}
 
-	return &encryption{base, key}
+// WithEncryptionKey is like WithEncryption, but the encryption key is derived
+// from `key`.
+func WithEncryptionKey(base BlockStorage, key Key) BlockStorage {
+	return &encryption{base, key.derive("7fedd6d671beec56")}
 }
 
 func (e *encryption) encrypt(ptr uint64, data []byte) ([]byte, error) {
@@ -0,0 +1,60 @@
+//go:build go1.18
+// +build go1.18
+
+package persistent
+
+import (
+	"testing"
+)
+
+func FuzzUnmarshalTreeHead(f *testing.F) {
+	mac := integrityMAC(PasswordKey("password"))
+
+	raw, err := marshalTreeHead(&treeHead{Version: 3, Nodes: 12, Hash: make([]byte, 32)}, mac)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(raw)
+	f.Add([]byte(`{"Version":1,"Nodes":1}`))
+	f.Add([]byte(`{"Hash":"%%%","Tag":null}`))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		head, err := unmarshalTreeHead(raw, mac)
+		if err != nil {
+			return
+		}
+		out, err := marshalTreeHead(head.clone(), mac)
+		if err != nil {
+			t.Fatal(err)
+		} else if parsed, err := unmarshalTreeHead(out, mac); err != nil {
+			t.Fatal(err)
+		} else if !parsed.equals(head) {
+			t.Fatal("tree head changed after being marshaled again")
+		}
+	})
+}
+
+func FuzzUnmarshalBucket(f *testing.F) {
+	const maxSize = 16
+
+	f.Add(marshalBucket(nil, maxSize))
+	f.Add(marshalBucket(map[uint64][]byte{1: []byte("hello"), 7: make([]byte, maxSize)}, maxSize))
+	f.Add(make([]byte, 2*blockSize*(8+4+maxSize)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		bucket, err := unmarshalBucket(data, maxSize)
+		if err != nil {
+			return
+		} else if len(bucket) > blockSize {
+			t.Fatalf("bucket has too many items: %v", len(bucket))
+		}
+		for ptr, val := range bucket {
+			if len(val) > maxSize {
+				t.Fatalf("item %v is larger than max size: %v", ptr, len(val))
+			}
+		}
+		if _, err := unmarshalBucket(marshalBucket(bucket, maxSize), maxSize); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -2,11 +2,16 @@ package persistent
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
 
 	"cloud.google.com/go/storage"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
 var (
@@ -20,13 +25,26 @@ var (
 )
 
 type gcs struct {
+	client *storage.Client
 	bucket *storage.BucketHandle
+
+	resumableThreshold int
+	csek               []byte
 }
 
 // NewGCS returns object storage backed by Google Compute Storage. `bucketName`
 // is the name of the bucket to use. Authentication credentials should be stored
 // in a file, and the path to that file is `credentialsPath`.
-func NewGCS(bucketName, credentialsPath string) (ObjectStorage, error) {
+//
+// If `resumableThreshold` is greater than zero, objects smaller than that many
+// bytes are uploaded in a single request, and larger objects are uploaded with
+// a resumable upload session. Otherwise, the client library's default is used.
+// If `csek` is non-nil, it's a 32-byte customer-supplied encryption key that
+// GCS will use to encrypt objects at rest.
+func NewGCS(bucketName, credentialsPath string, resumableThreshold int, csek []byte) (ObjectStorage, error) {
+	if csek != nil && len(csek) != 32 {
+		return nil, fmt.Errorf("gcs: customer-supplied encryption key must be 32 bytes")
+	}
 	if credentialsPath != "" {
 		if err := os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentialsPath); err != nil {
 			return nil, err
@@ -39,36 +57,112 @@ func NewGCS(bucketName, credentialsPath string) (ObjectStorage, error) {
 	}
 	bucket := client.Bucket(bucketName)
 
-	return &gcs{bucket}, nil
+	return &gcs{client, bucket, resumableThreshold, csek}, nil
 }
 
-func (g *gcs) Get(ctx context.Context, key string) ([]byte, error) {
-	r, err := g.bucket.Object(key).NewReader(ctx)
+func (g *gcs) object(key string) *storage.ObjectHandle {
+	obj := g.bucket.Object(key)
+	if g.csek != nil {
+		obj = obj.Key(g.csek)
+	}
+	return obj
+}
+
+// isNotFound returns true if `err` indicates that an object doesn't exist.
+func isNotFound(err error) bool {
 	if err == storage.ErrObjectNotExist {
+		return true
+	} else if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == http.StatusNotFound || e.Code == http.StatusGone
+	}
+	return false
+}
+
+func (g *gcs) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := g.GetIfChanged(ctx, key, "")
+	return data, err
+}
+
+// The ETag of a GCS object is its generation number, which changes every time
+// the object is written.
+func (g *gcs) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return g.GetIfChanged(ctx, key, "")
+}
+
+func (g *gcs) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	obj := g.object(key)
+	if etag != "" {
+		gen, err := strconv.ParseInt(etag, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("gcs: malformed etag: %v", err)
+		}
+		obj = obj.If(storage.Conditions{GenerationNotMatch: gen})
+	}
+	r, err := obj.NewReader(ctx)
+	if isNotFound(err) {
+		GCSOps.WithLabelValues("get", "true").Inc()
+		return nil, "", ErrObjectNotFound
+	} else if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotModified {
 		GCSOps.WithLabelValues("get", "true").Inc()
-		return nil, ErrObjectNotFound
+		return nil, "", ErrNotModified
 	} else if err != nil {
 		GCSOps.WithLabelValues("get", "false").Inc()
-		return nil, err
+		return nil, "", err
 	}
 	defer r.Close()
 
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		GCSOps.WithLabelValues("get", "false").Inc()
-		return nil, err
+		return nil, "", err
+	} else if r.Attrs.Size != int64(len(data)) {
+		GCSOps.WithLabelValues("get", "false").Inc()
+		return nil, "", fmt.Errorf("gcs: object %v was truncated: expected %v bytes, got %v", key, r.Attrs.Size, len(data))
 	}
 	GCSOps.WithLabelValues("get", "true").Inc()
-	return data, nil
+	return data, strconv.FormatInt(r.Attrs.Generation, 10), nil
 }
 
 func (g *gcs) Set(ctx context.Context, key string, data []byte, _ DataType) error {
-	w := g.bucket.Object(key).NewWriter(ctx)
+	return g.set(ctx, g.object(key), data)
+}
+
+func (g *gcs) SetIfMatch(ctx context.Context, key string, data []byte, _ DataType, etag string) error {
+	obj := g.object(key)
+	if etag == "" {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	} else {
+		gen, err := strconv.ParseInt(etag, 10, 64)
+		if err != nil {
+			return fmt.Errorf("gcs: malformed etag: %v", err)
+		}
+		obj = obj.If(storage.Conditions{GenerationMatch: gen})
+	}
+	err := g.set(ctx, obj, data)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+		return ErrPreconditionFailed
+	}
+	return err
+}
+
+func (g *gcs) set(ctx context.Context, obj *storage.ObjectHandle, data []byte) error {
+	w := obj.NewWriter(ctx)
+	if g.resumableThreshold > 0 {
+		if len(data) < g.resumableThreshold {
+			w.ChunkSize = 0
+		} else {
+			w.ChunkSize = googleapi.DefaultUploadChunkSize
+		}
+	}
 	if _, err := w.Write(data); err != nil {
 		GCSOps.WithLabelValues("set", "false").Inc()
 		return err
 	} else if err := w.Close(); err != nil {
-		GCSOps.WithLabelValues("set", "false").Inc()
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+			GCSOps.WithLabelValues("set", "true").Inc()
+		} else {
+			GCSOps.WithLabelValues("set", "false").Inc()
+		}
 		return err
 	}
 	GCSOps.WithLabelValues("set", "true").Inc()
@@ -76,10 +170,32 @@ func (g *gcs) Set(ctx context.Context, key string, data []byte, _ DataType) erro
 }
 
 func (g *gcs) Delete(ctx context.Context, key string) error {
-	if err := g.bucket.Object(key).Delete(ctx); err != nil {
+	if err := g.bucket.Object(key).Delete(ctx); isNotFound(err) {
+		// Deleting an object that doesn't exist isn't an error for any other
+		// storage provider.
+	} else if err != nil {
 		GCSOps.WithLabelValues("delete", "false").Inc()
 		return err
 	}
 	GCSOps.WithLabelValues("delete", "true").Inc()
 	return nil
 }
+
+func (g *gcs) List(ctx context.Context, prefix string) ([]string, error) {
+	out := make([]string, 0)
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			GCSOps.WithLabelValues("list", "false").Inc()
+			return nil, err
+		}
+		out = append(out, attrs.Name)
+	}
+	GCSOps.WithLabelValues("list", "true").Inc()
+	return out, nil
+}
+
+func (g *gcs) Close() error { return g.client.Close() }
@@ -0,0 +1,110 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Probe checks whether a storage backend is reachable, without starting a
+// transaction or changing anything.
+type Probe func(ctx context.Context) error
+
+// ObjectProbe returns a Probe that reads a key from `store` that's never
+// written. Being told that the key doesn't exist means the backend is up.
+func ObjectProbe(store ObjectStorage) Probe {
+	return func(ctx context.Context) error {
+		if _, err := store.Get(ctx, "utahfs-healthz"); err != nil && err != ErrObjectNotFound {
+			return err
+		}
+		return nil
+	}
+}
+
+// RemoteProbe returns a Probe that checks that the server behind `store`, a
+// ReliableStorage from NewRemoteClient, is up and accepts the client's transport
+// key. The server answers without waiting for the current transaction to end,
+// so the probe isn't held up by clients using the repository.
+func RemoteProbe(store ReliableStorage) (Probe, error) {
+	rc, ok := unwrapCache(store).(*remoteClient)
+	if !ok {
+		return nil, fmt.Errorf("health: storage isn't a remote client")
+	}
+	return func(ctx context.Context) error {
+		loc := *rc.serverUrl
+		loc.Path += "healthz"
+		req, err := http.NewRequestWithContext(ctx, "GET", loc.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := rc.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("remote: unexpected response status: %v", resp.Status)
+		}
+		return nil
+	}, nil
+}
+
+// HealthCheck is an http.Handler that runs a Probe on each request, responding
+// 200 if it succeeds and 503 if it fails or takes longer than a timeout. The
+// body contains the round-trip time of the most recent successful probe, and
+// how long ago it was.
+type HealthCheck struct {
+	probe   Probe
+	timeout time.Duration
+
+	mu       sync.Mutex
+	lastRTT  time.Duration
+	lastSeen time.Time
+}
+
+// NewHealthCheck returns a HealthCheck that gives each run of `probe` at most
+// `timeout` to finish.
+func NewHealthCheck(probe Probe, timeout time.Duration) *HealthCheck {
+	return &HealthCheck{probe: probe, timeout: timeout}
+}
+
+// Check runs the probe once, and returns its round-trip time if it succeeded.
+func (hc *HealthCheck) Check(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := hc.probe(ctx); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	hc.mu.Lock()
+	hc.lastRTT, hc.lastSeen = rtt, time.Now()
+	hc.mu.Unlock()
+
+	return rtt, nil
+}
+
+func (hc *HealthCheck) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rtt, err := hc.Check(req.Context())
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err == nil {
+		fmt.Fprintf(rw, "ok\nbackend round-trip: %v\n", rtt)
+		return
+	}
+
+	hc.mu.Lock()
+	lastRTT, lastSeen := hc.lastRTT, hc.lastSeen
+	hc.mu.Unlock()
+
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(rw, "unhealthy: %v\n", err)
+	if lastSeen.IsZero() {
+		fmt.Fprintln(rw, "no successful backend round-trip yet")
+	} else {
+		fmt.Fprintf(rw, "last successful backend round-trip: %v, %v ago\n", lastRTT, time.Since(lastSeen).Round(time.Second))
+	}
+}
@@ -0,0 +1,91 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var down error
+	probe := ObjectProbe(NewMemoryStorage(10 * time.Millisecond))
+	hc := NewHealthCheck(func(ctx context.Context) error {
+		if down != nil {
+			return down
+		}
+		return probe(ctx)
+	}, time.Second)
+
+	check := func(status int, body string) {
+		rec := httptest.NewRecorder()
+		hc.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != status {
+			t.Fatalf("unexpected status: %v", rec.Code)
+		} else if !strings.Contains(rec.Body.String(), body) {
+			t.Fatalf("unexpected body: %q", rec.Body.String())
+		}
+	}
+
+	down = fmt.Errorf("backend is down")
+	check(http.StatusServiceUnavailable, "no successful backend round-trip yet")
+	down = nil
+	check(http.StatusOK, "backend round-trip: 1")
+	down = fmt.Errorf("backend is down")
+	check(http.StatusServiceUnavailable, "last successful backend round-trip: 1")
+
+	// A probe that hangs fails once the timeout passes.
+	hc = NewHealthCheck(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, 50*time.Millisecond)
+	check(http.StatusServiceUnavailable, "deadline exceeded")
+}
+
+func TestRemoteProbe(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Hold a transaction open, which the probe shouldn't wait for.
+	client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := client.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Commit(ctx, nil)
+
+	other, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe, err := RemoteProbe(other)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := NewHealthCheck(probe, time.Second).Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong, err := NewRemoteClient("wrongPassword", ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe, err = RemoteProbe(wrong)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := NewHealthCheck(probe, time.Second).Check(ctx); err == nil {
+		t.Fatal("expected probe with the wrong transport key to fail")
+	}
+}
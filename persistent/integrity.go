@@ -10,14 +10,17 @@ import (
 	"fmt"
 	"hash"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
+	"sort"
 	"time"
 
-	"golang.org/x/crypto/argon2"
+	"github.com/cloudflare/utahfs/internal/logging"
 )
 
+// IntegrityHash is the name of the hash function used by WithIntegrity.
+const IntegrityHash = "sha256"
+
 // treeHead is the authenticated head of the Merkle tree built over the user's
 // data.
 type treeHead struct {
@@ -46,18 +49,131 @@ func unmarshalTreeHead(raw []byte, mac hash.Hash) (*treeHead, error) {
 	return head, nil
 }
 
+// pinFileName returns the name of the `n`-th most recent copy of the pin file.
+func pinFileName(pinFile string, n int) string {
+	if n == 0 {
+		return pinFile
+	}
+	return fmt.Sprintf("%v.%v", pinFile, n)
+}
+
 // readPinFile reads the pin file from disk as a starting point. Keeping a file
 // on disk helps detect when there has been a malicious rollback or the state
 // has been forked.
-func readPinFile(pinFile string, mac hash.Hash) (*treeHead, error) {
-	data, err := ioutil.ReadFile(pinFile)
-	if os.IsNotExist(err) {
-		log.Println("integrity: local pin file not found, will accept whatever remote storage returns")
-		return &treeHead{}, nil
-	} else if err != nil {
+//
+// Up to `history` older copies of the pin file are read as well, in case the
+// newest one is missing or corrupted, and the most recent valid pin is
+// returned. If there are no pin files, it returns nil.
+func readPinFile(pinFile string, history int, mac hash.Hash) (*treeHead, error) {
+	var (
+		newest  *treeHead
+		lastErr error
+	)
+	for n := 0; n <= history; n++ {
+		name := pinFileName(pinFile, n)
+		data, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			logging.Warnf("integrity: failed to read pin file %v: %v", name, err)
+			lastErr = err
+			continue
+		}
+		head, err := unmarshalTreeHead(data, mac)
+		if err != nil {
+			logging.Warnf("integrity: ignoring invalid pin file %v: %v", name, err)
+			lastErr = err
+			continue
+		}
+		if newest == nil || head.Version > newest.Version {
+			newest = head
+		}
+	}
+	if newest == nil && lastErr != nil {
+		return nil, lastErr
+	}
+	return newest, nil
+}
+
+// Pin is the state of the integrity tree recorded in a pin file.
+type Pin struct {
+	Version uint64 // Version is a counter of the number of modifications made to the tree.
+	Nodes   uint64 // Nodes is the number of nodes in the tree.
+	Hash    []byte // Hash is the root of the Merkle tree.
+}
+
+// ReadPin returns the most recent valid pin kept in `pinFile`, or in one of the
+// `pinHistory` older copies of it, by storage created with WithIntegrity.
+func ReadPin(pinFile, password string, pinHistory int) (*Pin, error) {
+	return ReadPinKey(pinFile, PasswordKey(password), pinHistory)
+}
+
+// ReadPinKey is like ReadPin, for storage created with WithIntegrityKey.
+func ReadPinKey(pinFile string, key Key, pinHistory int) (*Pin, error) {
+	head, err := readPinFile(pinFile, pinHistory, integrityMAC(key))
+	if err != nil {
+		return nil, err
+	} else if head == nil {
+		return nil, fmt.Errorf("integrity: no pin file found at %v", pinFile)
+	}
+	return &Pin{head.Version, head.Nodes, head.Hash}, nil
+}
+
+// ForkError is returned when the tree head in remote storage has the same
+// version as the one pinned locally, but a different root hash. This happens
+// when two clients have each committed changes on top of the same state, or
+// when remote storage has been replaced with a different copy of the archive.
+type ForkError struct {
+	Local, Remote *Pin
+}
+
+func (fe *ForkError) Error() string {
+	return fmt.Sprintf("integrity: remote diverged from local pin at version %v (local root %x, remote root %x)",
+		fe.Local.Version, fe.Local.Hash, fe.Remote.Hash)
+}
+
+// AcceptRemotePin replaces the pin kept in `pinFile` with the tree head
+// currently in `base`, which must be the reliable storage that the integrity
+// layer was on top of. It's how a client recovers from a ForkError or rollback
+// by taking the remote side. The remote tree head must still be authenticated
+// by `key`. If `discard` isn't nil, it's called once the remote tree head has
+// been read, and before the pin is replaced, to delete any local state that
+// depends on the old pin.
+//
+// The previous pin is kept as `pinFile`.rejected, and older copies of it are
+// removed so that they aren't used in its place.
+func AcceptRemotePin(ctx context.Context, base ReliableStorage, key Key, pinFile string, pinHistory int, discard func() error) (*Pin, error) {
+	data, err := base.Start(ctx, []uint64{0})
+	if err != nil {
+		return nil, err
+	}
+	base.Commit(ctx, nil)
+	if data[0] == nil {
+		return nil, fmt.Errorf("integrity: no tree head found in remote storage")
+	}
+	head, err := unmarshalTreeHead(data[0], integrityMAC(key))
+	if err != nil {
+		return nil, fmt.Errorf("integrity: failed to authenticate remote tree head: %v", err)
+	} else if discard != nil {
+		if err := discard(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(pinFile, pinFile+".rejected"); err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-	return unmarshalTreeHead(data, mac)
+	for n := 1; n <= pinHistory; n++ {
+		if err := os.Remove(pinFileName(pinFile, n)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(path.Dir(pinFile), 0744); err != nil {
+		return nil, err
+	} else if err := ioutil.WriteFile(pinFile, data[0], 0744); err != nil {
+		return nil, err
+	}
+	return &Pin{head.Version, head.Nodes, head.Hash}, nil
 }
 
 // expectedTag returns the expected value of the `Tag` field.
@@ -102,6 +218,15 @@ func (th *treeHead) equals(other *treeHead) bool {
 		bytes.Equal(th.Tag, other.Tag)
 }
 
+const (
+	// maxLevels is the maximum number of levels of checksum blocks in the tree.
+	maxLevels = 20
+	// maxNodes is the maximum number of data blocks the tree can hold. It's
+	// chosen so that the pointer to every data and checksum block fits in a
+	// uint64.
+	maxNodes = 1 << (3 * maxLevels)
+)
+
 // dataPtr returns the pointer to the `ptr`-th data block. It adjusts `ptr` for
 // the blocks of integrity-related metadata.
 func dataPtr(ptr uint64) uint64 {
@@ -110,11 +235,12 @@ func dataPtr(ptr uint64) uint64 {
 	// Every 8 blocks we have 1 first-level block containing the hashes of the
 	// previous 8 data blocks. Then every 64 blocks, we have 1 second-level
 	// block containing the hashes of the previous 8 first-level blocks. And so
-	// on...
-	n := uint64(8)
-	for level := uint64(0); level < 21; level++ {
+	// on, until the levels are too large to have any blocks before `ptr`.
+	for n := uint64(8); n <= ptr; n = 8 * n {
 		offset += ptr / n
-		n = 8 * n
+		if n > ptr/8 { // Stop before 8*n can overflow.
+			break
+		}
 	}
 
 	return ptr + offset
@@ -138,7 +264,7 @@ func checksumPtr(level int, offset uint64) uint64 {
 func checksumBlocks(ptr, nodes uint64) (out [][2]uint64) {
 	max := nodes - 1
 
-	for level := uint64(0); level < 21; level++ {
+	for level := 0; level < maxLevels; level++ {
 		out = append(out, [2]uint64{ptr / 8, ptr % 8})
 
 		max = max / 8
@@ -163,32 +289,105 @@ func intermediateHash(data []byte) [32]byte {
 }
 
 type integrity struct {
-	base BlockStorage
-	mac  hash.Hash
-
-	pinned *treeHead
-	curr   *treeHead
+	base      BlockStorage
+	mac       hash.Hash
+	checksums bool // Whether or not to maintain the Merkle tree.
+
+	pinned  *treeHead
+	curr    *treeHead
+	pending map[uint64][32]byte // Leaf hashes not yet reflected in the tree.
+
+	pinFile    string
+	pinHistory int
+	lastSave   time.Time
+
+	// detectConflicts is true if the tree head is read again before each
+	// commit, to check that no other client has changed it. shared is the
+	// storage that commits are made to, which holds a lock while a commit is
+	// being applied. last is the tree head as of the end of this client's
+	// previous transaction, and changed is true if the current transaction
+	// started from a different one.
+	detectConflicts bool
+	shared          *sharedReliable
+	last            *treeHead
+	changed         bool
+}
 
-	pinFile  string
-	lastSave time.Time
+// integrityMAC returns the MAC used to authenticate tree heads.
+func integrityMAC(key Key) hash.Hash {
+	return hmac.New(sha256.New, key.derive("534ffca65b68a9b3"))
 }
 
 // WithIntegrity wraps a BlockStorage implementation and builds a Merkle tree
 // over the data stored.
 //
 // The root of the Merkle tree is authenticated by `password`, and a copy of the
-// root and other metadata is kept in `pinFile`.
-func WithIntegrity(base BlockStorage, password, pinFile string) (BlockStorage, error) {
-	// NOTE: The fixed salt to Argon2 is intentional. Its purpose is domain
-	// separation, not to frustrate a password cracker.
-	key := argon2.IDKey([]byte(password), []byte("534ffca65b68a9b3"), 1, 64*1024, 4, 32)
-	mac := hmac.New(sha256.New, key)
-
-	pinned, err := readPinFile(pinFile, mac)
+// root and other metadata is kept in `pinFile`. Each time the pin file is
+// updated, the previous copy is moved to `pinFile`.1, and so on, keeping up to
+// `pinHistory` old copies.
+func WithIntegrity(base BlockStorage, password, pinFile string, pinHistory int) (BlockStorage, error) {
+	return newIntegrity(base, true, PasswordKey(password), pinFile, pinHistory)
+}
+
+// WithIntegrityKey is like WithIntegrity, but the root of the Merkle tree is
+// authenticated by `key`.
+func WithIntegrityKey(base BlockStorage, key Key, pinFile string, pinHistory int) (BlockStorage, error) {
+	return newIntegrity(base, true, key, pinFile, pinHistory)
+}
+
+// WithRollbackProtection is like WithIntegrity, but doesn't build a Merkle tree.
+// Only the number of modifications made to the data is authenticated and kept
+// in the pin file, which is enough to notice when remote storage has been
+// rolled back, but not when individual blocks have been tampered with.
+//
+// Blocks are laid out the same way as with WithIntegrity. Data written with
+// WithIntegrity can be read with WithRollbackProtection, but once it's been
+// modified, it can't be opened with WithIntegrity again.
+func WithRollbackProtection(base BlockStorage, password, pinFile string, pinHistory int) (BlockStorage, error) {
+	return newIntegrity(base, false, PasswordKey(password), pinFile, pinHistory)
+}
+
+// WithRollbackProtectionKey is like WithRollbackProtection, but the number of
+// modifications is authenticated by `key`.
+func WithRollbackProtectionKey(base BlockStorage, key Key, pinFile string, pinHistory int) (BlockStorage, error) {
+	return newIntegrity(base, false, key, pinFile, pinHistory)
+}
+
+func newIntegrity(base BlockStorage, checksums bool, key Key, pinFile string, pinHistory int) (BlockStorage, error) {
+	mac := integrityMAC(key)
+
+	pinned, err := readPinFile(pinFile, pinHistory, mac)
 	if err != nil {
 		return nil, err
+	} else if pinned == nil {
+		logging.Warn("integrity: local pin file not found, will accept whatever remote storage returns")
+		pinned = &treeHead{}
 	}
-	return &integrity{base, mac, pinned, nil, pinFile, time.Time{}}, nil
+	return &integrity{base, mac, checksums, pinned, nil, nil, pinFile, pinHistory, time.Time{}, false, nil, nil, false}, nil
+}
+
+// savePin writes `data` to the pin file, after moving the older copies of the
+// pin file down by one. Errors are only logged, because the data being saved
+// has already been committed.
+func (i *integrity) savePin(data []byte) {
+	if old, err := ioutil.ReadFile(i.pinFile); err == nil && bytes.Equal(old, data) {
+		i.lastSave = time.Now()
+		return
+	} else if err := os.MkdirAll(path.Dir(i.pinFile), 0744); err != nil {
+		logging.Errorf("integrity: failed to create directory for pin file: %v", err)
+		return
+	}
+	for n := i.pinHistory; n > 0; n-- {
+		err := os.Rename(pinFileName(i.pinFile, n-1), pinFileName(i.pinFile, n))
+		if err != nil && !os.IsNotExist(err) {
+			logging.Warnf("integrity: failed to rotate pin file: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(i.pinFile, data, 0744); err != nil {
+		logging.Errorf("integrity: failed to write pin file: %v", err)
+		return
+	}
+	i.lastSave = time.Now()
 }
 
 func (i *integrity) Start(ctx context.Context, prefetch []uint64) (map[uint64][]byte, error) {
@@ -202,8 +401,10 @@ func (i *integrity) Start(ctx context.Context, prefetch []uint64) (map[uint64][]
 
 	// Read the tree head from storage and validate it against the one we have
 	// pinned.
+	i.pending = make(map[uint64][32]byte)
 	if data[0] == nil {
 		i.pinned, i.curr = &treeHead{}, &treeHead{}
+		i.started(i.pinned)
 		return nil, nil
 	} else if err != nil {
 		i.Rollback(ctx)
@@ -215,24 +416,26 @@ func (i *integrity) Start(ctx context.Context, prefetch []uint64) (map[uint64][]
 		return nil, err
 	} else if pinned.Version < i.pinned.Version {
 		i.Rollback(ctx)
-		return nil, fmt.Errorf("integrity: tree head read from remote storage is older than expected")
+		return nil, fmt.Errorf("integrity: tree head read from remote storage is older than expected: version %v, but version %v is pinned", pinned.Version, i.pinned.Version)
 	} else if pinned.Version == i.pinned.Version {
 		if !bytes.Equal(pinned.Hash, i.pinned.Hash) {
 			i.Rollback(ctx)
-			return nil, fmt.Errorf("integrity: tree head read from remote storage has unexpected root hash")
+			return nil, &ForkError{
+				Local:  &Pin{i.pinned.Version, i.pinned.Nodes, i.pinned.Hash},
+				Remote: &Pin{pinned.Version, pinned.Nodes, pinned.Hash},
+			}
 		}
 	}
+	if i.checksums && pinned.Nodes > 0 && len(pinned.Hash) == 0 {
+		i.Rollback(ctx)
+		return nil, fmt.Errorf("integrity: data was modified while integrity was disabled, so it can't be verified")
+	}
 	i.pinned, i.curr = pinned, pinned.clone()
+	i.started(pinned)
 
 	// If a new integrity pin hasn't been saved to disk in some time, do that.
 	if time.Since(i.lastSave) > 10*time.Second {
-		if err := os.MkdirAll(path.Dir(i.pinFile), 0744); err != nil {
-			log.Printf("integrity: failed to create directory for pin file: %v", err)
-		} else if err := ioutil.WriteFile(i.pinFile, data[0], 0744); err != nil {
-			log.Printf("integrity: failed to write pin file: %v", err)
-		} else {
-			i.lastSave = time.Now()
-		}
+		i.savePin(data[0])
 	}
 
 	return nil, nil
@@ -281,6 +484,20 @@ func (i *integrity) Get(ctx context.Context, ptr uint64) ([]byte, error) {
 }
 
 func (i *integrity) GetMany(ctx context.Context, ptrs []uint64) (map[uint64][]byte, error) {
+	data, err := i.getMany(ctx, ptrs)
+	if err != nil {
+		return nil, i.checkFailure(ctx, err)
+	}
+	return data, nil
+}
+
+func (i *integrity) getMany(ctx context.Context, ptrs []uint64) (map[uint64][]byte, error) {
+	if !i.checksums {
+		return i.getManyUnchecked(ctx, ptrs)
+	} else if err := i.flush(ctx); err != nil {
+		return nil, err
+	}
+
 	// Calculate the pointers to fetch and checks to perform for each Get.
 	ptrRef := make([]uint64, 0, len(ptrs))
 	allPtrs := make([][]uint64, 0, len(ptrs))
@@ -315,6 +532,13 @@ func (i *integrity) GetMany(ctx context.Context, ptrs []uint64) (map[uint64][]by
 	if err != nil {
 		return nil, err
 	}
+	checksumPtrs := make([]uint64, 0)
+	for _, ptrs1 := range allPtrs {
+		checksumPtrs = append(checksumPtrs, ptrs1[1:]...)
+	}
+	if err := i.refetchMissing(ctx, checksumPtrs, data); err != nil {
+		return nil, err
+	}
 
 	// Validate all data fetched.
 	for j, _ := range ptrRef {
@@ -334,6 +558,60 @@ func (i *integrity) GetMany(ctx context.Context, ptrs []uint64) (map[uint64][]by
 	return out, nil
 }
 
+// refetchMissing fetches any of `ptrs` that aren't in `data` once more, and adds
+// them to `data`. It's only given checksum blocks, which always exist. Storage
+// is supposed to return an error instead of leaving out blocks that it failed
+// to fetch, but this gives a backend that doesn't one more chance before the
+// missing blocks are reported as an integrity error.
+func (i *integrity) refetchMissing(ctx context.Context, ptrs []uint64, data map[uint64][]byte) error {
+	missing := make([]uint64, 0)
+	seen := make(map[uint64]struct{})
+	for _, ptr := range ptrs {
+		if _, ok := seen[ptr]; ok {
+			continue
+		} else if _, ok := data[ptr]; !ok {
+			missing = append(missing, ptr)
+		}
+		seen[ptr] = struct{}{}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	logging.Warnf("integrity: storage left out %v checksum blocks, fetching them again", len(missing))
+
+	refetched, err := i.base.GetMany(ctx, missing)
+	if err != nil {
+		return err
+	}
+	for ptr, d := range refetched {
+		data[ptr] = d
+	}
+	return nil
+}
+
+// getManyUnchecked fetches data blocks without validating them, for when
+// integrity is disabled.
+func (i *integrity) getManyUnchecked(ctx context.Context, ptrs []uint64) (map[uint64][]byte, error) {
+	dataPtrs := make([]uint64, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		if ptr < i.curr.Nodes {
+			dataPtrs = append(dataPtrs, dataPtr(ptr))
+		}
+	}
+	data, err := i.base.GetMany(ctx, dataPtrs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[uint64][]byte)
+	for _, ptr := range ptrs {
+		if d, ok := data[dataPtr(ptr)]; ok && ptr < i.curr.Nodes {
+			out[ptr] = d
+		}
+	}
+	return out, nil
+}
+
 func (i *integrity) createChecksumBlocks(ctx context.Context, prev, curr uint64) error {
 	curr2 := curr
 
@@ -341,7 +619,7 @@ func (i *integrity) createChecksumBlocks(ctx context.Context, prev, curr uint64)
 	copy(expectedLeft[:], i.curr.Hash)
 	expectedRest := [32]byte{} // The expected value of every other block of level.
 
-	for level := 0; level < 21; level++ {
+	for level := 0; level < maxLevels; level++ {
 		if prev == 1 && level > 0 {
 			prev = 0
 		} else {
@@ -352,6 +630,9 @@ func (i *integrity) createChecksumBlocks(ctx context.Context, prev, curr uint64)
 		} else {
 			curr = (curr + 7) / 8
 		}
+		if curr == 0 {
+			break
+		}
 
 		// Compute the contents of the left-most block of the level (if we
 		// happen to need to set that block), and the contents of every other
@@ -368,6 +649,9 @@ func (i *integrity) createChecksumBlocks(ctx context.Context, prev, curr uint64)
 
 		// Write the new checksum blocks.
 		for offset := prev; offset < curr; offset++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			if offset == 0 {
 				if err := i.base.Set(ctx, checksumPtr(level, offset), dataLeft, Metadata); err != nil {
 					return err
@@ -389,7 +673,33 @@ func (i *integrity) createChecksumBlocks(ctx context.Context, prev, curr uint64)
 }
 
 func (i *integrity) Set(ctx context.Context, ptr uint64, data []byte, dt DataType) error {
-	if ptr+1 > i.curr.Nodes {
+	if err := i.set(ctx, ptr, data, dt); err != nil {
+		return i.checkFailure(ctx, err)
+	}
+	return nil
+}
+
+func (i *integrity) set(ctx context.Context, ptr uint64, data []byte, dt DataType) error {
+	if ptr >= maxNodes {
+		return fmt.Errorf("integrity: pointer is out of range: %v", ptr)
+	} else if !i.checksums {
+		if ptr+1 > i.curr.Nodes {
+			i.curr.Nodes = ptr + 1
+		}
+		if err := i.base.Set(ctx, dataPtr(ptr), data, dt); err != nil {
+			return err
+		}
+		i.curr.Version += 1
+		i.curr.Hash = nil
+		return nil
+	} else if ptr+1 > i.curr.Nodes {
+		// Adding a level to the tree moves the current root hash into a new
+		// checksum block, so it needs to be up-to-date first.
+		if i.curr.Nodes > 0 && numLevels(ptr+1) != numLevels(i.curr.Nodes) {
+			if err := i.flush(ctx); err != nil {
+				return err
+			}
+		}
 		if err := i.createChecksumBlocks(ctx, i.curr.Nodes, ptr+1); err != nil {
 			return err
 		}
@@ -397,48 +707,108 @@ func (i *integrity) Set(ctx context.Context, ptr uint64, data []byte, dt DataTyp
 	if err := i.base.Set(ctx, dataPtr(ptr), data, dt); err != nil {
 		return err
 	}
+	i.pending[ptr] = leafHash(data)
+	i.curr.Version += 1
 
-	ptrs := make([]uint64, 0)
-	checks := checksumBlocks(ptr, i.curr.Nodes)
-	for level, check := range checks {
-		ptrs = append(ptrs, checksumPtr(level, check[0]))
+	return nil
+}
+
+// numLevels returns the number of levels of checksum blocks in a tree with the
+// given number of nodes.
+func numLevels(nodes uint64) int {
+	return len(checksumBlocks(0, nodes))
+}
+
+// flush updates the checksum blocks and tree head to reflect all data blocks
+// written since the last flush. Checksum blocks that are shared by several
+// written blocks are only read, verified, and written once.
+func (i *integrity) flush(ctx context.Context) error {
+	if len(i.pending) == 0 {
+		return nil
 	}
+	levels := numLevels(i.curr.Nodes)
 
+	// Fetch every checksum block on the path from a written block to the root.
+	offsets := make([]map[uint64]struct{}, levels)
+	for level := range offsets {
+		offsets[level] = make(map[uint64]struct{})
+	}
+	ptrs := make([]uint64, 0)
+	for ptr, _ := range i.pending {
+		for level, check := range checksumBlocks(ptr, i.curr.Nodes) {
+			if _, ok := offsets[level][check[0]]; !ok {
+				offsets[level][check[0]] = struct{}{}
+				ptrs = append(ptrs, checksumPtr(level, check[0]))
+			}
+		}
+	}
 	nodes, err := i.base.GetMany(ctx, ptrs)
 	if err != nil {
 		return err
+	} else if err := i.refetchMissing(ctx, ptrs, nodes); err != nil {
+		return err
 	}
-
-	prev, expected := [32]byte{}, leafHash(data)
-	for level, check := range checks {
-		block, ok := nodes[ptrs[level]]
+	for _, ptr := range ptrs {
+		block, ok := nodes[ptr]
 		if !ok {
 			return fmt.Errorf("integrity: missing checksum block")
 		} else if len(block) != 8*32 {
 			return fmt.Errorf("integrity: checksum block is malformed")
-		} else if level > 0 && !bytes.Equal(prev[:], block[32*check[1]:32*check[1]+32]) {
-			return fmt.Errorf("integrity: block does not equal expected value")
 		}
-		prev = intermediateHash(block)
+	}
 
-		copy(block[32*check[1]:], expected[:])
-		if err := i.base.Set(ctx, ptrs[level], block, Metadata); err != nil {
-			return err
+	// Verify the fetched blocks against their parents, and the tree head,
+	// before anything is changed.
+	for level := 0; level < levels; level++ {
+		for offset, _ := range offsets[level] {
+			hash := intermediateHash(nodes[checksumPtr(level, offset)])
+			if level == levels-1 {
+				if !bytes.Equal(hash[:], i.curr.Hash) {
+					return fmt.Errorf("integrity: block does not equal tree head")
+				}
+				continue
+			}
+			parent, pos := nodes[checksumPtr(level+1, offset/8)], 32*(offset%8)
+			if !bytes.Equal(hash[:], parent[pos:pos+32]) {
+				return fmt.Errorf("integrity: block does not equal expected value")
+			}
 		}
-		expected = intermediateHash(block)
 	}
 
-	if !bytes.Equal(prev[:], i.curr.Hash) {
-		return fmt.Errorf("integrity: block does not equal tree head")
+	// Update the blocks from the bottom of the tree up.
+	hashes := i.pending
+	for level := 0; level < levels; level++ {
+		for idx, hash := range hashes {
+			block := nodes[checksumPtr(level, idx/8)]
+			copy(block[32*(idx%8):], hash[:])
+		}
+		next := make(map[uint64][32]byte)
+		for offset, _ := range offsets[level] {
+			block := nodes[checksumPtr(level, offset)]
+			if err := i.base.Set(ctx, checksumPtr(level, offset), block, Metadata); err != nil {
+				return err
+			}
+			next[offset] = intermediateHash(block)
+		}
+		hashes = next
 	}
-	i.curr.Version += 1
-	i.curr.Hash = expected[:]
+	hash := hashes[0]
+	i.curr.Hash = hash[:]
+	i.pending = make(map[uint64][32]byte)
 
 	return nil
 }
 
 func (i *integrity) Commit(ctx context.Context) error {
+	if i.detectConflicts {
+		if err := i.checkConflict(ctx); err != nil {
+			return err
+		}
+	}
 	// Write the new tree head to storage and commit the transaction.
+	if err := i.flush(ctx); err != nil {
+		return i.checkFailure(ctx, err)
+	}
 	data, err := marshalTreeHead(i.curr, i.mac)
 	if err != nil {
 		return err
@@ -447,21 +817,281 @@ func (i *integrity) Commit(ctx context.Context) error {
 	} else if err := i.base.Commit(ctx); err != nil {
 		return err
 	}
+	i.last = i.curr.clone()
 
 	// Write the new tree head to disk as well, but fail-open if it doesn't work
 	// because the transaction is already committed.
-	if err := os.MkdirAll(path.Dir(i.pinFile), 0744); err != nil {
-		log.Printf("integrity: failed to create directory for pin file: %v", err)
-	} else if err := ioutil.WriteFile(i.pinFile, data, 0744); err != nil {
-		log.Printf("integrity: failed to write pin file: %v", err)
-	} else {
-		i.lastSave = time.Now()
-	}
+	i.savePin(data)
+
+	return nil
+}
+
+// started records that a transaction started from the tree head `head`.
+func (i *integrity) started(head *treeHead) {
+	i.changed = i.last != nil && !head.equals(i.last)
+	i.last = head
+}
 
+// checkConflict reads the tree head again and returns ErrConflict if it's
+// different from the one that the current transaction started from. Nothing in
+// the transaction has been written to storage yet, so the other client's
+// changes are left intact.
+func (i *integrity) checkConflict(ctx context.Context) error {
+	raw, err := i.base.Get(ctx, 0)
+	if err == ErrObjectNotFound {
+		if i.pinned.equals(&treeHead{}) {
+			return nil
+		}
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	head, err := unmarshalTreeHead(raw, i.mac)
+	if err != nil {
+		return err
+	} else if !head.equals(i.pinned) {
+		return ErrConflict
+	}
 	return nil
 }
 
+// checkFailure returns ErrConflict instead of `err` if conflicts are being
+// detected and either the tree head has changed or another client is in the
+// middle of a commit, since blocks written by another client fail to verify
+// against the tree head that the transaction started from.
+func (i *integrity) checkFailure(ctx context.Context, err error) error {
+	if !i.detectConflicts || i.curr == nil {
+		return err
+	} else if i.checkConflict(ctx) == ErrConflict {
+		return ErrConflict
+	} else if locked, lerr := i.shared.Locked(ctx); lerr == nil && locked {
+		return ErrConflict
+	}
+	return err
+}
+
 func (i *integrity) Rollback(ctx context.Context) {
 	i.base.Rollback(ctx)
-	i.curr = nil
+	i.curr, i.pending = nil, nil
+}
+
+// IntegrityPreview returns what the state of the integrity tree would be after
+// making the given writes to storage created with WithIntegrity, if the tree's
+// current state is `current`. Nothing is written to `base`, which should be the
+// storage beneath the integrity layer, in an active transaction. The checksum
+// blocks read from it are verified against `current` as usual.
+func IntegrityPreview(ctx context.Context, base BlockStorage, current *Pin, writes map[uint64][]byte) (*Pin, error) {
+	i := &integrity{
+		base:      &previewStorage{base, make(map[uint64][]byte)},
+		checksums: true,
+
+		curr:    &treeHead{Version: current.Version, Nodes: current.Nodes, Hash: dup(current.Hash)},
+		pending: make(map[uint64][32]byte),
+	}
+
+	ptrs := make([]uint64, 0, len(writes))
+	for ptr, _ := range writes {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(a, b int) bool { return ptrs[a] < ptrs[b] })
+	for _, ptr := range ptrs {
+		if err := i.Set(ctx, ptr, writes[ptr], Unknown); err != nil {
+			return nil, err
+		}
+	}
+	if err := i.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return &Pin{i.curr.Version, i.curr.Nodes, i.curr.Hash}, nil
+}
+
+// previewStorage keeps any writes made to it in memory, in front of a base
+// that's only read from.
+type previewStorage struct {
+	base   BlockStorage
+	writes map[uint64][]byte
+}
+
+func (ps *previewStorage) Start(ctx context.Context, prefetch []uint64) (map[uint64][]byte, error) {
+	return nil, fmt.Errorf("integrity: preview storage can't start transactions")
+}
+
+func (ps *previewStorage) Get(ctx context.Context, ptr uint64) ([]byte, error) {
+	data, err := ps.GetMany(ctx, []uint64{ptr})
+	if err != nil {
+		return nil, err
+	} else if data[ptr] == nil {
+		return nil, ErrObjectNotFound
+	}
+	return data[ptr], nil
+}
+
+func (ps *previewStorage) GetMany(ctx context.Context, ptrs []uint64) (map[uint64][]byte, error) {
+	out := make(map[uint64][]byte)
+	remaining := make([]uint64, 0)
+	for _, ptr := range ptrs {
+		if data, ok := ps.writes[ptr]; ok {
+			out[ptr] = dup(data)
+		} else {
+			remaining = append(remaining, ptr)
+		}
+	}
+	if len(remaining) > 0 {
+		data, err := ps.base.GetMany(ctx, remaining)
+		if err != nil {
+			return nil, err
+		}
+		for ptr, val := range data {
+			out[ptr] = val
+		}
+	}
+	return out, nil
+}
+
+func (ps *previewStorage) Set(ctx context.Context, ptr uint64, data []byte, dt DataType) error {
+	ps.writes[ptr] = dup(data)
+	return nil
+}
+
+func (ps *previewStorage) Commit(ctx context.Context) error {
+	return fmt.Errorf("integrity: preview storage can't commit transactions")
+}
+
+func (ps *previewStorage) Rollback(ctx context.Context) {}
+
+// keys translates the pointers in `ptrs` into the pointers that are used for
+// them by the base storage layer, and adds the tree head, password verifier,
+// and checksum blocks.
+// Checksum blocks are only required to exist if the tree is being maintained.
+func (i *integrity) keys(ptrs map[uint64]bool) map[uint64]bool {
+	out := map[uint64]bool{0: true, verifierPtr: false, kdfPtr: false}
+	for ptr, required := range ptrs {
+		out[dataPtr(ptr)] = required
+	}
+	for ptr := uint64(0); ptr < i.curr.Nodes; ptr += 8 {
+		for level, block := range checksumBlocks(ptr, i.curr.Nodes) {
+			out[checksumPtr(level, block[0])] = i.checksums
+		}
+	}
+	return out
+}
+
+// truncate shrinks the tree so that it holds only the first `nodes` data
+// blocks, and returns the pointers in the base storage layer of the data and
+// checksum blocks that stop being part of it. The caller is responsible for
+// deleting them. The tree is rebuilt from the data blocks that are kept, which
+// are verified against the current tree first.
+func (i *integrity) truncate(ctx context.Context, nodes uint64) ([]uint64, error) {
+	if nodes >= i.curr.Nodes {
+		return nil, nil
+	}
+
+	hashes := make(map[uint64][32]byte)
+	if i.checksums {
+		batch := make([]uint64, 0, 100)
+		for ptr := uint64(0); ptr < nodes; ptr++ {
+			batch = append(batch, ptr)
+			if len(batch) < cap(batch) && ptr < nodes-1 {
+				continue
+			}
+			data, err := i.GetMany(ctx, batch)
+			if err != nil {
+				return nil, err
+			}
+			for _, ptr := range batch {
+				if d, ok := data[ptr]; ok {
+					hashes[ptr] = leafHash(d)
+				}
+			}
+			batch = batch[:0]
+		}
+	}
+
+	before := i.treeKeys()
+	if i.checksums {
+		i.curr.Nodes, i.curr.Hash = 0, nil
+		if err := i.createChecksumBlocks(ctx, 0, nodes); err != nil {
+			return nil, err
+		}
+		i.pending = hashes
+	} else {
+		i.curr.Nodes, i.curr.Hash = nodes, nil
+	}
+	i.curr.Version += 1
+	after := i.treeKeys()
+
+	stale := make([]uint64, 0)
+	for ptr := range before {
+		if _, ok := after[ptr]; !ok {
+			stale = append(stale, ptr)
+		}
+	}
+	return stale, nil
+}
+
+// treeKeys returns the pointers in the base storage layer of every data and
+// checksum block in the tree, along with the tree head.
+func (i *integrity) treeKeys() map[uint64]bool {
+	ptrs := make(map[uint64]bool, i.curr.Nodes)
+	for ptr := uint64(0); ptr < i.curr.Nodes; ptr++ {
+		ptrs[ptr] = true
+	}
+	return i.keys(ptrs)
+}
+
+// VerifyWAL checks any entries left over in a local WAL from a previous run
+// against the integrity tree, before they're allowed to be flushed to remote
+// storage. `store` should be the output of WithIntegrity, wrapping a
+// BufferedStorage over the WAL.
+//
+// Checksum blocks and the tree head are verified implicitly, as part of
+// verifying the data blocks beneath them.
+func VerifyWAL(ctx context.Context, store BlockStorage) error {
+	i, ok := store.(*integrity)
+	if !ok {
+		return fmt.Errorf("integrity: expected integrity layer as input, but got: %T", store)
+	} else if !i.checksums {
+		return fmt.Errorf("integrity: can't verify wal when integrity is disabled")
+	}
+	bs, ok := i.base.(*BufferedStorage)
+	if !ok {
+		return fmt.Errorf("integrity: expected buffered storage below integrity layer, but got: %T", i.base)
+	}
+	wal, ok := unwrapCache(bs.base).(*localWAL)
+	if !ok {
+		return fmt.Errorf("integrity: expected local wal below buffered storage, but got: %T", bs.base)
+	}
+	select {
+	case <-wal.verified:
+		return nil
+	default:
+	}
+
+	pending := make(map[uint64]struct{})
+	for _, key := range wal.replayKeys {
+		pending[key] = struct{}{}
+	}
+	logging.Infof("integrity: verifying %v entries left in the wal", len(pending))
+
+	if _, err := i.Start(ctx, nil); err != nil {
+		return err
+	}
+	defer i.Rollback(ctx)
+
+	batch := make([]uint64, 0, 100)
+	for ptr := uint64(0); ptr < i.curr.Nodes; ptr++ {
+		if _, ok := pending[dataPtr(ptr)]; ok {
+			batch = append(batch, ptr)
+		}
+		if len(batch) == cap(batch) || (len(batch) > 0 && ptr == i.curr.Nodes-1) {
+			if _, err := i.GetMany(ctx, batch); err != nil {
+				return fmt.Errorf("integrity: failed to verify wal: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	close(wal.verified)
+	return nil
 }
@@ -27,7 +27,7 @@ func TestIntegrity(t *testing.T) {
 	defer os.RemoveAll(name)
 
 	store := NewBlockMemory()
-	temp, err := WithIntegrity(store, "password", name+"/pin.json")
+	temp, err := WithIntegrity(store, "password", name+"/pin.json", 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,3 +67,650 @@ func TestIntegrity(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIntegrityBatching(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	newStore := func(pinFile string) *integrity {
+		store, err := WithIntegrity(NewBlockMemory(), "password", name+pinFile, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store.(*integrity)
+	}
+	single, batched := newStore("/single.json"), newStore("/batched.json")
+
+	// Write the same data to both stores: either committing after every write,
+	// or all at once in one transaction.
+	ptrs := make([]uint64, 0)
+	data := make(map[uint64][]byte)
+	for i := 0; i < 300; i++ {
+		ptr := uint64(mrand.Intn(1000))
+		val := make([]byte, 64)
+		if _, err := rand.Read(val); err != nil {
+			t.Fatal(err)
+		}
+		ptrs, data[ptr] = append(ptrs, ptr), val
+	}
+
+	if _, err := batched.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, ptr := range ptrs {
+		if _, err := single.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := single.Set(ctx, ptr, data[ptr], Content); err != nil {
+			t.Fatal(err)
+		} else if err := single.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := batched.Set(ctx, ptr, data[ptr], Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batched.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if single.curr.Version != batched.curr.Version || single.curr.Nodes != batched.curr.Nodes {
+		t.Fatal("tree heads have different version or size")
+	} else if !bytes.Equal(single.curr.Hash, batched.curr.Hash) {
+		t.Fatal("tree heads have different root hash")
+	}
+
+	// Check that the batched writes can be read back.
+	if _, err := batched.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer batched.Rollback(ctx)
+	for ptr, val := range data {
+		got, err := batched.Get(ctx, ptr)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, val) {
+			t.Fatal("data not equal to expected")
+		}
+	}
+}
+
+func TestIntegrityLayout(t *testing.T) {
+	// Check that data and checksum blocks are laid out without gaps or
+	// overlaps, for a full tree with a few levels.
+	nodes := uint64(8 * 8 * 8)
+	seen := make(map[uint64]struct{})
+	for ptr := uint64(0); ptr < nodes; ptr++ {
+		seen[dataPtr(ptr)] = struct{}{}
+	}
+	total := nodes
+	for level, count := 0, nodes; level < numLevels(nodes); level++ {
+		count = (count + 7) / 8
+		for offset := uint64(0); offset < count; offset++ {
+			seen[checksumPtr(level, offset)] = struct{}{}
+		}
+		total += count
+	}
+	if uint64(len(seen)) != total {
+		t.Fatal("blocks overlap")
+	}
+	for ptr := uint64(1); ptr <= total; ptr++ {
+		if _, ok := seen[ptr]; !ok {
+			t.Fatalf("block %v is not used", ptr)
+		}
+	}
+
+	// Check the number of levels at the boundaries.
+	for level := 1; level <= maxLevels; level++ {
+		n := uint64(1) << (3 * uint(level))
+		if got := numLevels(n); got != level {
+			t.Fatalf("numLevels(%v) = %v, expected %v", n, got, level)
+		} else if level < maxLevels && numLevels(n+1) != level+1 {
+			t.Fatalf("numLevels(%v) = %v, expected %v", n+1, numLevels(n+1), level+1)
+		}
+	}
+
+	// Check that pointers at the end of the range don't overflow.
+	last := dataPtr(maxNodes - 1)
+	if last < maxNodes {
+		t.Fatal("data pointer has overflowed")
+	} else if root := checksumPtr(maxLevels-1, 0); root != last+maxLevels {
+		t.Fatalf("unexpected pointer to root checksum block: %v", root)
+	}
+}
+
+func TestIntegrityOutOfRange(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	store, err := WithIntegrity(NewBlockMemory(), "password", name+"/pin.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Rollback(ctx)
+
+	if err := store.Set(ctx, maxNodes, []byte("hello"), Content); err == nil {
+		t.Fatal("expected error when writing to pointer out of range")
+	}
+}
+
+// droppingStorage wraps a block storage backend, and leaves the largest
+// pointer out of the results of the next `drops` calls to GetMany.
+type droppingStorage struct {
+	BlockStorage
+	drops int
+}
+
+func (ds *droppingStorage) GetMany(ctx context.Context, ptrs []uint64) (map[uint64][]byte, error) {
+	data, err := ds.BlockStorage.GetMany(ctx, ptrs)
+	if err != nil || ds.drops == 0 || len(data) == 0 {
+		return data, err
+	}
+	ds.drops--
+	largest := uint64(0)
+	for ptr := range data {
+		if ptr > largest {
+			largest = ptr
+		}
+	}
+	delete(data, largest)
+	return data, nil
+}
+
+func TestIntegrityMissingBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	base := &droppingStorage{BlockStorage: NewBlockMemory()}
+	store, err := WithIntegrity(base, "password", name+"/pin.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := store.Set(ctx, 0, []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := store.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A checksum block that's left out once is fetched again.
+	base.drops = 1
+	if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if data, err := store.Get(ctx, 0); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+	store.Rollback(ctx)
+
+	// A checksum block that stays missing is an integrity error.
+	base.drops = 2
+	if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := store.Get(ctx, 0); err == nil {
+		t.Fatal("expected error when checksum block is missing")
+	}
+	store.Rollback(ctx)
+}
+
+func TestPinHistory(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	pinFile := name + "/pin.json"
+
+	// Make several commits, each of which should rotate the pin files.
+	store := NewBlockMemory()
+	integ, err := WithIntegrity(store, "password", pinFile, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := integ.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := integ.Set(ctx, uint64(i), []byte("hello"), Content); err != nil {
+			t.Fatal(err)
+		} else if err := integ.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, suffix := range []string{"", ".1", ".2"} {
+		if _, err := os.Stat(pinFile + suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(pinFile + ".3"); !os.IsNotExist(err) {
+		t.Fatal("too many pin files were kept")
+	}
+
+	pin, err := ReadPin(pinFile, "password", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if pin.Version != 4 || pin.Nodes != 4 {
+		t.Fatalf("unexpected pin: version=%v nodes=%v", pin.Version, pin.Nodes)
+	}
+
+	// Corrupt the newest pin file. The next newest should be used instead, and
+	// it should still be possible to detect that the remote storage has been
+	// rolled back to before it.
+	if err := ioutil.WriteFile(pinFile, []byte("garbage"), 0744); err != nil {
+		t.Fatal(err)
+	}
+	pin, err = ReadPin(pinFile, "password", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if pin.Version != 3 {
+		t.Fatalf("unexpected pin version: %v", pin.Version)
+	}
+
+	old, err := ioutil.ReadFile(pinFile + ".2")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := store.Set(ctx, 0, old, Metadata); err != nil {
+		t.Fatal(err)
+	}
+	integ, err = WithIntegrity(store, "password", pinFile, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := integ.Start(ctx, nil); err == nil {
+		t.Fatal("expected rollback to be detected")
+	}
+
+	// If no pin file is valid, an error should be returned.
+	if _, err := WithIntegrity(store, "wrong password", pinFile, 2); err == nil {
+		t.Fatal("expected error when no pin file is valid")
+	}
+}
+
+func TestRollbackProtection(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	pinFile := name + "/pin.json"
+
+	write := func(store BlockStorage, ptr uint64, data string) {
+		if _, err := store.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := store.Set(ctx, ptr, []byte(data), Content); err != nil {
+			t.Fatal(err)
+		} else if err := store.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(store BlockStorage, ptr uint64) string {
+		if _, err := store.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer store.Rollback(ctx)
+		data, err := store.Get(ctx, ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Data written with integrity should be readable without it.
+	base := NewBlockMemory()
+	integ, err := WithIntegrity(base, "password", pinFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(integ, 3, "hello")
+
+	rp, err := WithRollbackProtection(base, "password", pinFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if data := read(rp, 3); data != "hello" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+	write(rp, 20, "world")
+	if data := read(rp, 20); data != "world" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+
+	// Rolling back the tree head should be detected.
+	head, err := base.Get(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(rp, 21, "again")
+	if err := base.Set(ctx, 0, head, Metadata); err != nil {
+		t.Fatal(err)
+	}
+	rp, err = WithRollbackProtection(base, "password", pinFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Start(ctx, nil); err == nil {
+		t.Fatal("expected rollback to be detected")
+	}
+
+	// Integrity can't be turned back on after data has been modified.
+	integ, err = WithIntegrity(base, "password", name+"/other.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := integ.Start(ctx, nil); err == nil {
+		t.Fatal("expected error starting transaction with integrity enabled")
+	}
+}
+
+func TestIntegrityPreview(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	pinFile := name + "/pin.json"
+
+	mem := NewBlockMemory()
+	store, err := WithIntegrity(mem, "password", pinFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomWrites := func(n int) map[uint64][]byte {
+		out := make(map[uint64][]byte)
+		for i := 0; i < n; i++ {
+			val := make([]byte, 64)
+			if _, err := rand.Read(val); err != nil {
+				t.Fatal(err)
+			}
+			out[uint64(mrand.Intn(500))] = val
+		}
+		return out
+	}
+	apply := func(writes map[uint64][]byte) *Pin {
+		if _, err := store.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		for ptr, val := range writes {
+			if err := store.Set(ctx, ptr, val, Content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		pin, err := ReadPin(pinFile, "password", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pin
+	}
+	preview := func(current *Pin, writes map[uint64][]byte) *Pin {
+		before := make(map[uint64]string)
+		for ptr, val := range mem.(blockMemory) {
+			before[ptr] = string(val)
+		}
+		pin, err := IntegrityPreview(ctx, mem, current, writes)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(before) != len(mem.(blockMemory)) {
+			t.Fatal("preview modified storage")
+		}
+		for ptr, val := range mem.(blockMemory) {
+			if before[ptr] != string(val) {
+				t.Fatal("preview modified storage")
+			}
+		}
+		return pin
+	}
+	check := func(expected, got *Pin) {
+		if expected.Version != got.Version || expected.Nodes != got.Nodes {
+			t.Fatalf("unexpected version or size: %v %v != %v %v", got.Version, got.Nodes, expected.Version, expected.Nodes)
+		} else if !bytes.Equal(expected.Hash, got.Hash) {
+			t.Fatal("unexpected root hash")
+		}
+	}
+
+	writes := randomWrites(100)
+	predicted := preview(&Pin{}, writes)
+	current := apply(writes)
+	check(current, predicted)
+
+	writes = randomWrites(100)
+	writes[2000] = []byte("grow the tree")
+	predicted = preview(current, writes)
+	check(apply(writes), predicted)
+
+	// The preview should fail if the current state of the tree is wrong.
+	wrong := &Pin{current.Version, current.Nodes, make([]byte, 32)}
+	if _, err := IntegrityPreview(ctx, mem, wrong, randomWrites(1)); err == nil {
+		t.Fatal("expected preview from wrong tree head to fail")
+	}
+}
+
+func TestForkDetection(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	key := PasswordKey("password")
+
+	open := func(store ObjectStorage, pinFile string) BlockStorage {
+		t.Helper()
+		integ, err := WithIntegrityKey(NewBufferedStorage(NewSimpleReliable(store)), key, pinFile, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return integ
+	}
+	write := func(integ BlockStorage, ptr uint64) error {
+		if _, err := integ.Start(ctx, nil); err != nil {
+			return err
+		} else if err := integ.Set(ctx, ptr, []byte("hello"), Content); err != nil {
+			return err
+		}
+		return integ.Commit(ctx)
+	}
+
+	// Both clients start from the same state, and then each commits a
+	// different change to its own copy of it.
+	remote, fork := NewMemory(), NewMemory()
+	pinA, pinB := name+"/a.json", name+"/b.json"
+	if err := write(open(remote, pinA), 1); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := remote.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		data, err := remote.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := fork.Set(ctx, key, data, Unknown); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := ioutil.ReadFile(pinA); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(pinB, data, 0744); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(open(remote, pinA), 2); err != nil {
+		t.Fatal(err)
+	} else if err := write(open(fork, pinB), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second client notices the fork when it connects to the first's copy.
+	err = write(open(remote, pinB), 4)
+	if fe, ok := err.(*ForkError); !ok {
+		t.Fatalf("expected fork to be detected, got: %v", err)
+	} else if fe.Local.Version != 2 || fe.Remote.Version != 2 {
+		t.Fatalf("unexpected versions: local=%v remote=%v", fe.Local.Version, fe.Remote.Version)
+	}
+
+	// After accepting the remote state, it can continue from there.
+	discarded := false
+	pin, err := AcceptRemotePin(ctx, NewSimpleReliable(remote), key, pinB, 2, func() error {
+		discarded = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !discarded {
+		t.Fatal("local state wasn't discarded")
+	} else if pinned, err := ReadPinKey(pinA, key, 2); err != nil {
+		t.Fatal(err)
+	} else if pin.Version != pinned.Version || !bytes.Equal(pin.Hash, pinned.Hash) {
+		t.Fatal("accepted pin doesn't match remote state")
+	}
+	if err := write(open(remote, pinB), 4); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(pinB + ".rejected"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConflictDetection(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	key := PasswordKey("password")
+
+	remote := NewMemory()
+	open := func(pinFile string) *AppStorage {
+		t.Helper()
+		shared, err := NewSharedReliable(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		integ, err := WithIntegrityKey(NewBufferedStorage(shared), key, pinFile, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := NewAppStorage(integ)
+		if err := app.DetectConflicts(); err != nil {
+			t.Fatal(err)
+		}
+		return app
+	}
+	// alloc writes `data` to the next unused block.
+	alloc := func(app *AppStorage, data string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			state, err := app.State(ctx)
+			if err != nil {
+				return err
+			}
+			ptr := state.NextPtr
+			state.NextPtr++
+			return app.Set(ctx, ptr, []byte(data), Content)
+		}
+	}
+	a, b := open(name+"/a.json"), open(name+"/b.json")
+
+	// The first client commits while the second's transaction is in progress,
+	// so the second has to start over.
+	calls := 0
+	err = b.Transact(ctx, 3, func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			if err := a.Transact(ctx, 1, alloc(a, "a")); err != nil {
+				return err
+			}
+		}
+		return alloc(b, "b")(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if calls != 2 {
+		t.Fatalf("expected transaction to be run twice, got: %v", calls)
+	}
+
+	if err := a.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for ptr, expected := range []string{"a", "b"} {
+		if data, err := a.Get(ctx, uint64(ptr)); err != nil {
+			t.Fatal(err)
+		} else if string(data) != expected {
+			t.Fatalf("unexpected data in block %v: %q", ptr, data)
+		}
+	}
+	if err := alloc(b, "c")(ctx); err == nil {
+		t.Fatal("expected write outside of a transaction to fail")
+	} else if err := a.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A commit that conflicts is rolled back, and retrying doesn't help once
+	// the attempts run out.
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := alloc(b, "c")(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := a.Transact(ctx, 1, alloc(a, "d")); err != nil {
+		t.Fatal(err)
+	} else if err := b.Commit(ctx); err != ErrConflict {
+		t.Fatalf("expected conflict, got: %v", err)
+	}
+
+	// The next transaction starts from the other client's changes, so anything
+	// cached from before is out of date, but only that once.
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if !b.Changed() {
+		t.Fatal("expected transaction to see changes from other client")
+	}
+	b.Rollback(ctx)
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if b.Changed() {
+		t.Fatal("expected no new changes from other client")
+	}
+	b.Rollback(ctx)
+
+	// Conflicts can't be detected through a cache.
+	shared, err := NewSharedReliable(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	integ, err := WithIntegrityKey(NewBufferedStorage(NewCache(shared, 10)), key, name+"/c.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := NewAppStorage(integ).DetectConflicts(); err == nil {
+		t.Fatal("expected conflict detection through a cache to fail")
+	}
+
+	// Or without conditional writes.
+	integ, err = WithIntegrityKey(NewBufferedStorage(NewSimpleReliable(remote)), key, name+"/d.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := NewAppStorage(integ).DetectConflicts(); err == nil {
+		t.Fatal("expected conflict detection without a shared reliable storage to fail")
+	}
+}
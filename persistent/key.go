@@ -0,0 +1,76 @@
+package persistent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Key is the secret that a repository's encryption key, integrity key, and
+// password verifier are all derived from. It's either a password, which is
+// stretched with Argon2, or a random 32-byte key, like one kept by a key
+// management service, which subkeys are derived from directly.
+type Key struct {
+	password string
+	kdf      KDFParams
+	raw      []byte
+}
+
+// KDFParams are the Argon2id parameters that a password is stretched with.
+type KDFParams struct {
+	Time    uint32 // Time is the number of passes made over memory.
+	Memory  uint32 // Memory is the amount of memory used, in KiB.
+	Threads uint8  // Threads is the number of threads used.
+}
+
+func (p KDFParams) String() string {
+	if p == (KDFParams{}) {
+		return "a raw key"
+	}
+	return fmt.Sprintf("a password with kdf-time %v, kdf-memory %v, and kdf-threads %v", p.Time, p.Memory, p.Threads)
+}
+
+// DefaultKDFParams are the parameters used by PasswordKey.
+var DefaultKDFParams = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+// PasswordKey returns a Key derived from `password` with DefaultKDFParams.
+func PasswordKey(password string) Key { return Key{password: password, kdf: DefaultKDFParams} }
+
+// PasswordKeyWithParams returns a Key derived from `password` with `params`.
+// Every client has to use the same parameters, or they'll derive a different
+// key and fail with ErrIncorrectPassword.
+func PasswordKeyWithParams(password string, params KDFParams) (Key, error) {
+	if params.Time < 1 || params.Threads < 1 {
+		return Key{}, fmt.Errorf("key: kdf time and threads must be at least one")
+	} else if params.Memory < 8*uint32(params.Threads) {
+		return Key{}, fmt.Errorf("key: kdf memory must be at least 8 KiB per thread")
+	}
+	return Key{password: password, kdf: params}, nil
+}
+
+// RawKey returns a Key that's the 32 random bytes in `raw`.
+func RawKey(raw []byte) (Key, error) {
+	if len(raw) != 32 {
+		return Key{}, fmt.Errorf("key: raw key must be 32 bytes, but got %v", len(raw))
+	}
+	return Key{raw: dup(raw)}, nil
+}
+
+// KDF returns the parameters that the key is derived from its password with,
+// or zero if it's a raw key.
+func (k Key) KDF() KDFParams { return k.kdf }
+
+// derive returns the 32-byte subkey of `k` for the purpose identified by
+// `salt`.
+func (k Key) derive(salt string) []byte {
+	if k.raw == nil {
+		// NOTE: The fixed salt to Argon2 is intentional. Its purpose is domain
+		// separation, not to frustrate a password cracker.
+		return argon2.IDKey([]byte(k.password), []byte(salt), k.kdf.Time, k.kdf.Memory, k.kdf.Threads, 32)
+	}
+	mac := hmac.New(sha256.New, k.raw)
+	mac.Write([]byte(salt))
+	return mac.Sum(nil)
+}
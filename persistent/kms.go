@@ -0,0 +1,150 @@
+package persistent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// KeyProvider fetches the key that a repository is protected with from a key
+// management service, so that it doesn't need to be derived from a password.
+//
+// Each implementation is given the key wrapped (encrypted) by a key that never
+// leaves the service, and asks the service to unwrap it. The wrapped key can be
+// stored anywhere, because it's useless without access to the service.
+type KeyProvider interface {
+	// Key returns the unwrapped key.
+	Key(ctx context.Context) (Key, error)
+}
+
+type awsKMS struct {
+	client  *kms.KMS
+	keyId   string
+	wrapped []byte
+}
+
+// NewAWSKMS returns a KeyProvider that unwraps `wrapped` with AWS KMS in
+// `region`, using the credentials found in the environment. If `keyId` isn't
+// empty, it's the id or ARN of the key that `wrapped` must have been encrypted
+// with. The wrapped key is the ciphertext returned by KMS's Encrypt operation.
+func NewAWSKMS(region, keyId string, wrapped []byte) (KeyProvider, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	return &awsKMS{kms.New(sess), keyId, wrapped}, nil
+}
+
+func (ak *awsKMS) Key(ctx context.Context) (Key, error) {
+	input := &kms.DecryptInput{CiphertextBlob: ak.wrapped}
+	if ak.keyId != "" {
+		input.KeyId = aws.String(ak.keyId)
+	}
+	out, err := ak.client.DecryptWithContext(ctx, input)
+	if err != nil {
+		return Key{}, fmt.Errorf("kms: failed to unwrap key with aws kms: %v", err)
+	}
+	return RawKey(out.Plaintext)
+}
+
+type gcpKMS struct {
+	service *cloudkms.Service
+	name    string
+	wrapped []byte
+}
+
+// NewGCPKMS returns a KeyProvider that unwraps `wrapped` with the Google Cloud
+// KMS key named `name`, like
+// `projects/p/locations/l/keyRings/r/cryptoKeys/k`. Authentication credentials
+// are read from the file at `credentialsPath` if it's given, and found in the
+// environment otherwise.
+func NewGCPKMS(name, credentialsPath string, wrapped []byte) (KeyProvider, error) {
+	opts := make([]option.ClientOption, 0)
+	if credentialsPath != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsPath))
+	}
+	service, err := cloudkms.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpKMS{service, name, wrapped}, nil
+}
+
+func (gk *gcpKMS) Key(ctx context.Context) (Key, error) {
+	req := &cloudkms.DecryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(gk.wrapped)}
+	res, err := gk.service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(gk.name, req).Context(ctx).Do()
+	if err != nil {
+		return Key{}, fmt.Errorf("kms: failed to unwrap key with gcp kms: %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(res.Plaintext)
+	if err != nil {
+		return Key{}, fmt.Errorf("kms: failed to parse key from gcp kms: %v", err)
+	}
+	return RawKey(raw)
+}
+
+type vault struct {
+	url     string
+	token   string
+	wrapped string
+}
+
+// NewVault returns a KeyProvider that unwraps `wrapped` with the key named
+// `name` in the transit secrets engine of the HashiCorp Vault server at `addr`,
+// mounted at `mount`. The wrapped key is the ciphertext returned by the engine's
+// encrypt endpoint, like `vault:v1:...`. Requests are authenticated by `token`.
+func NewVault(addr, token, mount, name, wrapped string) (KeyProvider, error) {
+	if addr == "" || token == "" || name == "" {
+		return nil, fmt.Errorf("kms: vault address, token, and key name must be given")
+	} else if mount == "" {
+		mount = "transit"
+	}
+	url := strings.TrimSuffix(addr, "/") + "/v1/" + strings.Trim(mount, "/") + "/decrypt/" + name
+	return &vault{url, token, wrapped}, nil
+}
+
+func (v *vault) Key(ctx context.Context) (Key, error) {
+	body, err := json.Marshal(map[string]string{"ciphertext": v.wrapped})
+	if err != nil {
+		return Key{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", v.url, bytes.NewReader(body))
+	if err != nil {
+		return Key{}, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Key{}, fmt.Errorf("kms: failed to unwrap key with vault: %v", err)
+	}
+	defer resp.Body.Close()
+
+	parsed := struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return Key{}, fmt.Errorf("kms: failed to parse response from vault: %v", err)
+	} else if resp.StatusCode != http.StatusOK {
+		return Key{}, fmt.Errorf("kms: failed to unwrap key with vault: %v: %v", resp.Status, strings.Join(parsed.Errors, ", "))
+	}
+	raw, err := base64.StdEncoding.DecodeString(parsed.Data.Plaintext)
+	if err != nil {
+		return Key{}, fmt.Errorf("kms: failed to parse key from vault: %v", err)
+	}
+	return RawKey(raw)
+}
@@ -0,0 +1,98 @@
+package persistent
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+func TestVault(t *testing.T) {
+	ctx := context.Background()
+	raw := bytes.Repeat([]byte{7}, 32)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := make(map[string]string)
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if req.URL.Path != "/v1/transit/decrypt/utahfs" || req.Header.Get("X-Vault-Token") != "token" || body["ciphertext"] != "vault:v1:wrapped" {
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		rw.Write([]byte(`{"data": {"plaintext": "` + base64.StdEncoding.EncodeToString(raw) + `"}}`))
+	}))
+	defer srv.Close()
+
+	kp, err := NewVault(srv.URL, "token", "", "utahfs", "vault:v1:wrapped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := kp.Key(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(key.raw, raw) {
+		t.Fatal("unexpected key returned by vault")
+	}
+
+	kp, err = NewVault(srv.URL, "wrong", "", "utahfs", "vault:v1:wrapped")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := kp.Key(ctx); err == nil {
+		t.Fatal("expected error from vault")
+	}
+}
+
+func TestRawKey(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	if _, err := RawKey(make([]byte, 16)); err == nil {
+		t.Fatal("expected error from short key")
+	}
+	key, err := RawKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewBlockMemory()
+	integ, err := WithIntegrityKey(store, key, name+"/pin.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := CheckKey(ctx, integ, key); err != nil {
+		t.Fatal(err)
+	}
+	appStore := NewAppStorage(WithEncryptionKey(integ, key))
+	if err := appStore.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := appStore.Set(ctx, 0, []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := appStore.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A password that happens to be the same bytes isn't the same key.
+	wrong, err := WithIntegrity(store, string(key.raw), name+"/pin2.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := CheckPassword(ctx, wrong, string(key.raw)); err == nil || !strings.Contains(err.Error(), "raw key") {
+		t.Fatalf("expected raw key error, got: %v", err)
+	}
+
+	if _, err := ReadPinKey(name+"/pin.json", key, 0); err != nil {
+		t.Fatal(err)
+	}
+}
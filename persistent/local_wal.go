@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
 	"os"
 	"path"
 	"strings"
@@ -13,6 +12,8 @@ import (
 
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/cloudflare/utahfs/internal/logging"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -24,8 +25,56 @@ var LocalWALSize = prometheus.NewGaugeVec(
 	[]string{"path"},
 )
 
+var LocalWALPaused = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "local_wal_paused",
+		Help: "Whether draining the local WAL is paused: 1 if it is, 0 if not.",
+	},
+	[]string{"path"},
+)
+
+// walThrottleMax is how long a transaction is delayed by a WAL in
+// WALFullThrottle mode, just before it's full.
+const walThrottleMax = 500 * time.Millisecond
+
+// WALFullMode is what a local WAL does when a transaction is started while it
+// holds more than its maximum number of entries.
+type WALFullMode int
+
+const (
+	// WALFullBlock blocks transactions from starting until enough entries
+	// have been uploaded.
+	WALFullBlock WALFullMode = iota
+	// WALFullError fails transactions that write anything with ErrWALFull, so
+	// that the application sees an error instead of hanging. Transactions
+	// that only read are unaffected.
+	WALFullError
+	// WALFullThrottle delays each transaction once the WAL is half full, by
+	// longer the fuller it gets, so that writers are slowed down to the rate
+	// that entries are uploaded. Transactions still block if it's full.
+	WALFullThrottle
+)
+
+// ParseWALFullMode returns the WALFullMode with the given name: "block",
+// "error", or "throttle". The empty string is the same as "block".
+func ParseWALFullMode(name string) (WALFullMode, error) {
+	switch name {
+	case "", "block":
+		return WALFullBlock, nil
+	case "error":
+		return WALFullError, nil
+	case "throttle":
+		return WALFullThrottle, nil
+	default:
+		return 0, fmt.Errorf("wal: unknown wal-full behavior: %q", name)
+	}
+}
+
 type localWAL struct {
 	mu sync.Mutex
+	// drainMu is held while entries are being flushed to the base, so that an
+	// old value of a key is never written over a newer one.
+	drainMu sync.Mutex
 
 	base  ObjectStorage
 	local *sql.DB
@@ -33,10 +82,25 @@ type localWAL struct {
 	loc         string
 	maxSize     int
 	parallelism int
+	fullMode    WALFullMode
 	wake        chan struct{}
 
 	currSize  int
 	lastCount time.Time
+
+	// resumed is closed when draining isn't paused, and replaced with a new
+	// channel when it's paused again.
+	resumed chan struct{}
+
+	// replayKeys are the keys of entries that were left in the WAL by a
+	// previous run. verified is closed once it's safe to start draining them.
+	replayKeys []uint64
+	verified   chan struct{}
+
+	// cancel stops the goroutines started by NewLocalWALWithMode, and drained
+	// is closed once the one draining the WAL has returned.
+	cancel  context.CancelFunc
+	drained chan struct{}
 }
 
 // NewLocalWAL returns a ReliableStorage implementation that achieves reliable
@@ -44,8 +108,19 @@ type localWAL struct {
 // Write-Ahead Log (WAL) stored at `loc`.
 //
 // The WAL may have at least `maxSize` buffered entries before new writes start
-// blocking on old writes being flushed.
-func NewLocalWAL(base ObjectStorage, loc string, maxSize, parallelism int) (ReliableStorage, error) {
+// blocking on old writes being flushed. NewLocalWALWithMode can be used to do
+// something else when it's full.
+//
+// If `verify` is true and there are entries left over from a previous run, the
+// WAL won't start draining until VerifyWAL has been called and has checked the
+// leftover entries against the integrity tree.
+func NewLocalWAL(base ObjectStorage, loc string, maxSize, parallelism int, verify bool) (ReliableStorage, error) {
+	return NewLocalWALWithMode(base, loc, maxSize, parallelism, verify, WALFullBlock)
+}
+
+// NewLocalWALWithMode returns a local WAL, like NewLocalWAL, that handles
+// being full according to `mode`.
+func NewLocalWALWithMode(base ObjectStorage, loc string, maxSize, parallelism int, verify bool, mode WALFullMode) (ReliableStorage, error) {
 	if err := os.MkdirAll(path.Dir(loc), 0744); err != nil {
 		return nil, err
 	}
@@ -64,15 +139,39 @@ func NewLocalWAL(base ObjectStorage, loc string, maxSize, parallelism int) (Reli
 		loc:         loc,
 		maxSize:     maxSize,
 		parallelism: parallelism,
+		fullMode:    mode,
 		wake:        make(chan struct{}),
 
 		currSize:  0,
 		lastCount: time.Time{},
+
+		resumed:  make(chan struct{}),
+		verified: make(chan struct{}),
 	}
-	go wal.drain()
+	close(wal.resumed)
+	LocalWALPaused.WithLabelValues(loc).Set(0)
+	if err := wal.loadReplayKeys(); err != nil {
+		return nil, err
+	}
+	if !verify || len(wal.replayKeys) == 0 {
+		close(wal.verified)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wal.cancel, wal.drained = cancel, make(chan struct{})
+	go func() {
+		wal.drain(ctx)
+		close(wal.drained)
+	}()
 	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
 		for {
-			time.Sleep(10 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 			wal.count()
 		}
 	}()
@@ -80,30 +179,234 @@ func NewLocalWAL(base ObjectStorage, loc string, maxSize, parallelism int) (Reli
 	return wal, nil
 }
 
-func (lw *localWAL) drain() {
-	tick := time.Tick(5 * time.Second)
+// loadReplayKeys records the keys of all entries currently in the WAL. It's
+// called on startup, before any new entries have been written.
+func (lw *localWAL) loadReplayKeys() error {
+	rows, err := lw.local.Query("SELECT key FROM wal")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key uint64
+		if err := rows.Scan(&key); err != nil {
+			return err
+		}
+		lw.replayKeys = append(lw.replayKeys, key)
+	}
+	return rows.Err()
+}
+
+// Pending returns the number of entries in the WAL that haven't been flushed to
+// the base object storage provider yet.
+func (lw *localWAL) Pending() (int, error) {
+	var count int
+	err := lw.local.QueryRow("SELECT COUNT(*) FROM wal").Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// replayProgressInterval is how often progress is logged while replaying
+// entries left over from a previous run.
+var replayProgressInterval = 10 * time.Second
+
+// replay drains the entries left over from a previous run, logging progress
+// periodically so that a long recovery doesn't look like a hang.
+func (lw *localWAL) replay(ctx context.Context) error {
+	total := len(lw.replayKeys)
+	logging.Infof("wal: replaying %v entries left over from previous run", total)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(replayProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if count, err := lw.Pending(); err != nil {
+				logging.Error(err)
+			} else {
+				logging.Infof("wal: replay in progress, %v entries pending", count)
+			}
+		}
+	}()
+
+	defer close(done)
 
 	for {
+		if err := lw.waitResumed(ctx); err != nil {
+			return err
+		}
+		err := lw.drainOnce(ctx)
+		if err == nil {
+			break
+		}
+		logging.Error(err)
+
 		select {
-		case <-tick:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	logging.Infof("wal: finished replaying %v entries", total)
+	return nil
+}
+
+// drain flushes entries from the WAL to the base object storage provider in
+// the background, until `ctx` is cancelled.
+func (lw *localWAL) drain(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-lw.verified:
+	}
+	if len(lw.replayKeys) > 0 {
+		if err := lw.replay(ctx); err != nil {
+			return
+		}
+	}
+
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
 		case <-lw.wake:
 		}
 
-		if err := lw.drainOnce(); err != nil {
-			log.Println(err)
+		if err := lw.waitResumed(ctx); err != nil {
+			return
+		} else if err := lw.drainOnce(ctx); err != nil {
+			logging.Error(err)
+		}
+	}
+}
+
+// setPaused stops entries from being drained to the base object storage
+// provider, if `paused` is true, or lets draining continue if it's false.
+func (lw *localWAL) setPaused(paused bool) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	select {
+	case <-lw.resumed:
+		if paused {
+			lw.resumed = make(chan struct{})
+			logging.Info("wal: draining paused")
+		}
+	default:
+		if !paused {
+			close(lw.resumed)
+			logging.Info("wal: draining resumed")
+		}
+	}
+	if paused {
+		LocalWALPaused.WithLabelValues(lw.loc).Set(1)
+	} else {
+		LocalWALPaused.WithLabelValues(lw.loc).Set(0)
+	}
+}
+
+func (lw *localWAL) paused() bool {
+	lw.mu.Lock()
+	resumed := lw.resumed
+	lw.mu.Unlock()
+
+	select {
+	case <-resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// waitResumed blocks until draining isn't paused.
+func (lw *localWAL) waitResumed(ctx context.Context) error {
+	lw.mu.Lock()
+	resumed := lw.resumed
+	lw.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+// Close stops draining the WAL in the background, and then spends up to 30
+// seconds trying to flush it, so that the base is current when the process
+// exits. Entries that can't be flushed, like when draining is paused or the
+// base is unreachable, are left in the WAL for the next run. The WAL's database
+// is closed, and then the base.
+func (lw *localWAL) Close() error {
+	lw.cancel()
+	<-lw.drained
+
+	select {
+	case <-lw.verified:
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := lw.flush(ctx); err != nil {
+			logging.Warnf("wal: failed to flush before closing: %v", err)
 		}
+	default:
 	}
+	return Closers{lw.local, lw.base}.Close()
 }
 
 type walReq struct {
+	id  int64
 	key uint64
 	val []byte
 	dt  DataType
 }
 
-func (lw *localWAL) drainOnce() error {
+type walRes struct {
+	id  int64
+	err error
+}
+
+// flush blocks until every entry that was in the WAL when it was called has
+// been written to the base object storage provider. If draining is paused, it
+// returns ErrWALPaused immediately, rather than waiting to be allowed to upload
+// entries, which could take arbitrarily long.
+func (lw *localWAL) flush(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-lw.verified:
+	}
+	if lw.paused() {
+		return ErrWALPaused
+	}
+	if err := lw.drainOnce(ctx); err != nil {
+		return err
+	}
+	lw.mu.Lock()
+	lw.lastCount = time.Time{}
+	lw.mu.Unlock()
+	return nil
+}
+
+func (lw *localWAL) drainOnce(ctx context.Context) error {
+	lw.drainMu.Lock()
+	defer lw.drainMu.Unlock()
+
 	reqs := make(chan walReq, 100)
-	errs := make(chan error, 100)
+	results := make(chan walRes, 100)
 	defer close(reqs)
 
 	for i := 0; i < lw.parallelism; i++ {
@@ -116,17 +419,21 @@ func (lw *localWAL) drainOnce() error {
 
 				var err error
 				if len(req.val) > 0 {
-					err = lw.base.Set(context.Background(), hex(req.key), req.val, req.dt)
+					err = lw.base.Set(ctx, hex(req.key), req.val, req.dt)
 				} else {
-					err = lw.base.Delete(context.Background(), hex(req.key))
+					err = lw.base.Delete(ctx, hex(req.key))
 				}
 
-				errs <- err
+				results <- walRes{req.id, err}
 			}
 		}()
 	}
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		var (
 			ids  []int64
 			keys []uint64
@@ -134,7 +441,7 @@ func (lw *localWAL) drainOnce() error {
 			dts  []DataType
 		)
 
-		rows, err := lw.local.Query("SELECT id, key, val, dt FROM wal LIMIT 100")
+		rows, err := lw.local.QueryContext(ctx, "SELECT id, key, val, dt FROM wal LIMIT 100")
 		if err != nil {
 			return err
 		}
@@ -166,22 +473,31 @@ func (lw *localWAL) drainOnce() error {
 		// Write entries read from the WAL to the underlying storage. This is
 		// done outside of the database query to prevent blocking other threads.
 		for i, _ := range ids {
-			reqs <- walReq{keys[i], vals[i], dts[i]}
+			reqs <- walReq{ids[i], keys[i], vals[i], dts[i]}
 		}
+		idStrs := make([]string, 0, len(ids))
 		for range ids {
-			if subErr := <-errs; subErr != nil {
-				err = subErr
+			if res := <-results; res.err != nil {
+				err = res.err
+			} else {
+				idStrs = append(idStrs, fmt.Sprint(res.id))
 			}
 		}
-		if err != nil {
-			return err
-		}
 
-		idStrs := make([]string, 0, len(ids))
-		for _, id := range ids {
-			idStrs = append(idStrs, fmt.Sprint(id))
+		// Entries that were uploaded are removed even if others failed, so
+		// that they aren't uploaded again if the process is stopped before the
+		// rest succeed.
+		if len(idStrs) > 0 {
+			if _, delErr := lw.local.Exec("DELETE FROM wal WHERE id in (" + strings.Join(idStrs, ",") + ")"); delErr != nil {
+				return delErr
+			}
+			lw.mu.Lock()
+			if lw.currSize -= len(idStrs); lw.currSize < 0 {
+				lw.currSize = 0
+			}
+			lw.mu.Unlock()
+			logging.Debugf("wal: uploaded %v entries", len(idStrs))
 		}
-		_, err = lw.local.Exec("DELETE FROM wal WHERE id in (" + strings.Join(idStrs, ",") + ")")
 		if err != nil {
 			return err
 		}
@@ -197,8 +513,7 @@ func (lw *localWAL) count() (int, error) {
 	}
 	lw.mu.Unlock()
 
-	var count int
-	err := lw.local.QueryRow("SELECT COUNT(*) FROM wal").Scan(&count)
+	count, err := lw.Pending()
 	if err != nil {
 		return 0, err
 	}
@@ -213,11 +528,12 @@ func (lw *localWAL) count() (int, error) {
 }
 
 func (lw *localWAL) Start(ctx context.Context, prefetch []uint64) (map[uint64][]byte, error) {
-	// Block until the database has drained enough to accept new writes.
+	// Block until the database has drained enough to accept new writes. In
+	// WALFullError mode, Commit checks instead.
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
-	for {
+	for lw.fullMode != WALFullError {
 		count, err := lw.count()
 		if err != nil {
 			return nil, err
@@ -231,34 +547,90 @@ func (lw *localWAL) Start(ctx context.Context, prefetch []uint64) (map[uint64][]
 			case <-ticker.C:
 			}
 			continue
+		} else if lw.fullMode == WALFullThrottle {
+			if err := lw.throttle(ctx, count); err != nil {
+				return nil, err
+			}
 		}
-		return lw.GetMany(ctx, prefetch)
+		break
+	}
+	return lw.GetMany(ctx, prefetch)
+}
+
+// throttle sleeps for a time proportional to how much more than half full the
+// WAL is, given that it has `count` entries.
+func (lw *localWAL) throttle(ctx context.Context, count int) error {
+	half := lw.maxSize / 2
+	if count <= half || half == 0 {
+		return nil
+	}
+	delay := walThrottleMax * time.Duration(count-half) / time.Duration(lw.maxSize-half)
+
+	select {
+	case lw.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
 	}
 }
 
 func (lw *localWAL) Get(ctx context.Context, key uint64) ([]byte, error) {
-	var val []byte
-	err := lw.local.QueryRowContext(ctx, "SELECT val FROM wal WHERE key = ?", key).Scan(&val)
-	if err == sql.ErrNoRows {
+	val, ok, err := lw.getLocal(ctx, key)
+	if err != nil {
+		return nil, err
+	} else if !ok {
 		return lw.base.Get(ctx, hex(key))
 	} else if len(val) == 0 {
 		return nil, ErrObjectNotFound
-	} else if err != nil {
-		return nil, err
 	}
 	return val, nil
 }
 
+// getLocal returns the value of `key` in the WAL, and whether or not the WAL
+// has an entry for that key at all.
+func (lw *localWAL) getLocal(ctx context.Context, key uint64) ([]byte, bool, error) {
+	var val []byte
+	err := lw.local.QueryRowContext(ctx, "SELECT val FROM wal WHERE key = ?", key).Scan(&val)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
 func (lw *localWAL) GetMany(ctx context.Context, keys []uint64) (map[uint64][]byte, error) {
 	out := make(map[uint64][]byte)
+
+	// Answer what we can from the WAL, and fetch everything else from the
+	// backend in one batch.
+	missing := make(map[string]uint64)
+	hexKeys := make([]string, 0)
 	for _, key := range keys {
-		val, err := lw.Get(ctx, key)
-		if err == ErrObjectNotFound {
-			continue
-		} else if err != nil {
+		val, ok, err := lw.getLocal(ctx, key)
+		if err != nil {
 			return nil, err
+		} else if !ok {
+			missing[hex(key)] = key
+			hexKeys = append(hexKeys, hex(key))
+		} else if len(val) > 0 {
+			out[key] = val
 		}
-		out[key] = val
+	}
+	if len(hexKeys) == 0 {
+		return out, nil
+	}
+
+	data, err := getMany(ctx, lw.base, hexKeys)
+	if err != nil {
+		return nil, err
+	}
+	for hexKey, val := range data {
+		out[missing[hexKey]] = val
 	}
 	return out, nil
 }
@@ -266,6 +638,17 @@ func (lw *localWAL) GetMany(ctx context.Context, keys []uint64) (map[uint64][]by
 func (lw *localWAL) Commit(ctx context.Context, writes map[uint64]WriteData) error {
 	if len(writes) == 0 {
 		return nil
+	} else if lw.fullMode == WALFullError {
+		count, err := lw.count()
+		if err != nil {
+			return err
+		} else if count > lw.maxSize {
+			select {
+			case lw.wake <- struct{}{}:
+			default:
+			}
+			return ErrWALFull
+		}
 	}
 
 	tx, err := lw.local.BeginTx(ctx, nil)
@@ -292,6 +675,70 @@ func (lw *localWAL) Commit(ctx context.Context, writes map[uint64]WriteData) err
 			return err
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Count entries that replaced existing ones too, so the estimate errs on
+	// the side of the WAL being fuller than it is until it's next counted.
+	lw.mu.Lock()
+	lw.currSize += len(writes)
+	lw.mu.Unlock()
+	return nil
+}
+
+// findWAL returns the local WAL at the bottom of `store`, or nil if there isn't
+// one.
+func findWAL(store BlockStorage) *localWAL {
+	for {
+		switch s := store.(type) {
+		case *encryption:
+			store = s.base
+		case *integrity:
+			store = s.base
+		case *oblivious:
+			store = s.base
+		case *BufferedStorage:
+			wal, _ := unwrapCache(s.base).(*localWAL)
+			return wal
+		default:
+			return nil
+		}
+	}
+}
 
-	return tx.Commit()
+// FlushWAL blocks until every write that has been committed to `store` has
+// reached remote storage, by draining any local WAL beneath it. If there's no
+// WAL at the bottom of the stack, committed writes are already remote and it
+// returns immediately. If draining has been paused with PauseWAL, it returns
+// ErrWALPaused without waiting.
+func FlushWAL(ctx context.Context, store BlockStorage) error {
+	if wal := findWAL(store); wal != nil {
+		return wal.flush(ctx)
+	}
+	return nil
+}
+
+// PauseWAL stops the local WAL at the bottom of `store` from uploading entries
+// to remote storage, if `paused` is true, or lets it continue if it's false.
+// While paused, the WAL keeps accepting commits until it holds more entries
+// than its maximum size, and new transactions block after that.
+func PauseWAL(store BlockStorage, paused bool) error {
+	wal := findWAL(store)
+	if wal == nil {
+		return fmt.Errorf("wal: storage has no local wal to pause")
+	}
+	wal.setPaused(paused)
+	return nil
+}
+
+// WALPending returns the number of entries in the local WAL at the bottom of
+// `store` that haven't been uploaded to remote storage yet, including any left
+// over from a previous run that are still being replayed.
+func WALPending(store BlockStorage) (int, error) {
+	wal := findWAL(store)
+	if wal == nil {
+		return 0, fmt.Errorf("wal: storage has no local wal")
+	}
+	return wal.Pending()
 }
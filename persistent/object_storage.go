@@ -1,41 +1,317 @@
 package persistent
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/utahfs/internal/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var VerifiedWrites = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "verified_writes",
+		Help: "The number of writes to the storage provider that were read back to check them, and whether they matched.",
+	},
+	[]string{"operation", "success"},
 )
 
-type memory map[string][]byte
+// getMany fetches several objects from `base`, using its GetMany method if it
+// has one, or a series of calls to Get if not.
+func getMany(ctx context.Context, base ObjectStorage, keys []string) (map[string][]byte, error) {
+	if batch, ok := base.(BatchObjectStorage); ok {
+		return batch.GetMany(ctx, keys)
+	}
+
+	out := make(map[string][]byte)
+	for i, key := range keys {
+		data, err := base.Get(ctx, key)
+		if err == ErrObjectNotFound {
+			continue
+		} else if err != nil {
+			return nil, &PartialError{out, keys[i:], err}
+		}
+		out[key] = data
+	}
+	return out, nil
+}
+
+// getIfChanged fetches an object from `base` unless its current ETag is `etag`,
+// using a conditional request if `base` supports them. If it doesn't, the
+// object is always fetched and the returned ETag is empty.
+func getIfChanged(ctx context.Context, base ObjectStorage, key, etag string) ([]byte, string, error) {
+	if cond, ok := base.(ConditionalObjectStorage); ok {
+		if etag == "" {
+			return cond.GetWithETag(ctx, key)
+		}
+		return cond.GetIfChanged(ctx, key, etag)
+	}
+	data, err := base.Get(ctx, key)
+	return data, "", err
+}
+
+// setIfMatch writes an object to `base` only if its current ETag is `etag`, or
+// only if it doesn't exist when `etag` is empty. It fails if `base` doesn't
+// support conditional writes.
+func setIfMatch(ctx context.Context, base ObjectStorage, key string, data []byte, dt DataType, etag string) error {
+	if atomic, ok := base.(AtomicObjectStorage); ok {
+		return atomic.SetIfMatch(ctx, key, data, dt, etag)
+	}
+	return fmt.Errorf("storage: conditional writes aren't supported by %T", base)
+}
+
+// supportsSetIfMatch returns true if conditional writes to `base` are passed
+// all the way down to a provider that supports them. The wrappers in this
+// package implement SetIfMatch whether their base does or not.
+func supportsSetIfMatch(base ObjectStorage) bool {
+	switch s := base.(type) {
+	case *retry:
+		return supportsSetIfMatch(s.base)
+	case *prefix:
+		return supportsSetIfMatch(s.base)
+	case *readOnly:
+		return supportsSetIfMatch(s.base)
+	case *verifyWrites:
+		return supportsSetIfMatch(s.base)
+	case *Tee:
+		return supportsSetIfMatch(s.primary)
+	}
+	_, ok := base.(AtomicObjectStorage)
+	return ok
+}
+
+// Closers is a list of things that are closed together.
+type Closers []io.Closer
+
+// Close closes each of the closers in order, even if closing one of them fails,
+// and returns the first error.
+func (cs Closers) Close() error {
+	var firstErr error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type getResult struct {
+	key  string
+	data []byte
+	err  error
+}
+
+// parallelGetMany fetches several objects from `base` by calling Get from
+// `parallelism` goroutines at once. It's meant for implementing GetMany in
+// providers where each request has a lot of latency.
+func parallelGetMany(ctx context.Context, base ObjectStorage, keys []string, parallelism int) (map[string][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reqs := make(chan string, len(keys))
+	results := make(chan getResult, len(keys))
+	for _, key := range keys {
+		reqs <- key
+	}
+	close(reqs)
+
+	for i := 0; i < parallelism && i < len(keys); i++ {
+		go func() {
+			for key := range reqs {
+				if err := ctx.Err(); err != nil {
+					results <- getResult{key, nil, err}
+					continue
+				}
+				data, err := base.Get(ctx, key)
+				results <- getResult{key, data, err}
+			}
+		}()
+	}
+
+	out := make(map[string][]byte)
+	var (
+		failed   []string
+		firstErr error
+	)
+	for range keys {
+		res := <-results
+		if res.err == ErrObjectNotFound {
+			continue
+		} else if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+				cancel()
+			}
+			failed = append(failed, res.key)
+			continue
+		}
+		out[res.key] = res.data
+	}
+	if firstErr != nil {
+		return nil, &PartialError{out, failed, firstErr}
+	}
+	return out, nil
+}
+
+type memory struct {
+	mu      sync.Mutex
+	latency time.Duration
+	data    map[string][]byte
+}
 
 // NewMemory returns an object storage backend that simply stores data
 // in-memory.
-func NewMemory() ObjectStorage { return make(memory) }
+func NewMemory() ObjectStorage { return NewMemoryStorage(0) }
+
+// NewMemoryStorage returns an object storage backend that stores data in-memory,
+// like NewMemory, but waits for `latency` before answering each request. This
+// simulates the network delay of a remote storage provider, for tests and
+// benchmarks. A call to GetMany is treated as one request.
+func NewMemoryStorage(latency time.Duration) ObjectStorage {
+	return &memory{latency: latency, data: make(map[string][]byte)}
+}
+
+func (m *memory) wait(ctx context.Context) error {
+	if m.latency == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(m.latency):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-func (m memory) Get(ctx context.Context, key string) ([]byte, error) {
-	data, ok := m[key]
+func (m *memory) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.data[key]
 	if !ok {
 		return nil, ErrObjectNotFound
 	}
 	return dup(data), nil
 }
 
-func (m memory) Set(ctx context.Context, key string, data []byte, dt DataType) error {
-	m[key] = dup(data)
+// The memory backend's ETags are a hash of the object's contents.
+func memoryETag(data []byte) string {
+	h := sha256.Sum256(data)
+	return fmt.Sprintf("%x", h[:8])
+}
+
+func (m *memory) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return m.GetIfChanged(ctx, key, "")
+}
+
+func (m *memory) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.data[key]
+	if !ok {
+		return nil, "", ErrObjectNotFound
+	} else if curr := memoryETag(data); etag != "" && curr == etag {
+		return nil, "", ErrNotModified
+	} else {
+		return dup(data), curr, nil
+	}
+}
+
+func (m *memory) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string][]byte)
+	for _, key := range keys {
+		if data, ok := m.data[key]; ok {
+			out[key] = dup(data)
+		}
+	}
+	return out, nil
+}
+
+func (m *memory) Set(ctx context.Context, key string, data []byte, dt DataType) error {
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = dup(data)
 	return nil
 }
 
-func (m memory) Delete(ctx context.Context, key string) error {
-	delete(m, key)
+func (m *memory) SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error {
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if curr, ok := m.data[key]; etag == "" && ok || etag != "" && (!ok || memoryETag(curr) != etag) {
+		return ErrPreconditionFailed
+	}
+	m.data[key] = dup(data)
 	return nil
 }
 
+func (m *memory) Delete(ctx context.Context, key string) error {
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memory) List(ctx context.Context, prefix string) ([]string, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]string, 0)
+	for key, _ := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (m *memory) Close() error { return nil }
+
 type retry struct {
 	base     ObjectStorage
 	attempts int
 }
 
 // NewRetry wraps a base object storage backend, and will retry if requests
-// fail.
+// fail. Retries stop early if the request's context is cancelled, and writes
+// that fail with ErrReadOnly aren't retried.
 func NewRetry(base ObjectStorage, attempts int) (ObjectStorage, error) {
 	if attempts <= 0 {
 		return nil, errors.New("storage: attempts must be greater than zero")
@@ -45,6 +321,9 @@ func NewRetry(base ObjectStorage, attempts int) (ObjectStorage, error) {
 
 func (r *retry) Get(ctx context.Context, key string) (data []byte, err error) {
 	for i := 0; i < r.attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
 		data, err = r.base.Get(ctx, key)
 		if err == nil || err == ErrObjectNotFound {
 			return
@@ -54,10 +333,58 @@ func (r *retry) Get(ctx context.Context, key string) (data []byte, err error) {
 	return
 }
 
+func (r *retry) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return r.GetIfChanged(ctx, key, "")
+}
+
+func (r *retry) GetIfChanged(ctx context.Context, key, etag string) (data []byte, newEtag string, err error) {
+	for i := 0; i < r.attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		data, newEtag, err = getIfChanged(ctx, r.base, key, etag)
+		if err == nil || err == ErrObjectNotFound || err == ErrNotModified {
+			return
+		}
+	}
+
+	return
+}
+
+// GetMany keeps the objects that were fetched when the base returns a
+// *PartialError, and only asks for the keys that failed on the next attempt.
+func (r *retry) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	var err error
+	for i := 0; i < r.attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var data map[string][]byte
+		data, err = getMany(ctx, r.base, keys)
+		if pe, ok := err.(*PartialError); ok {
+			data, keys = pe.Data, pe.Failed
+		}
+		for key, val := range data {
+			out[key] = val
+		}
+		if err == nil {
+			return out, nil
+		}
+	}
+	if len(out) > 0 {
+		return nil, &PartialError{out, keys, err}
+	}
+	return nil, err
+}
+
 func (r *retry) Set(ctx context.Context, key string, data []byte, dt DataType) (err error) {
 	for i := 0; i < r.attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		err = r.base.Set(ctx, key, data, dt)
-		if err == nil {
+		if err == nil || err == ErrReadOnly {
 			return
 		}
 	}
@@ -65,9 +392,33 @@ func (r *retry) Set(ctx context.Context, key string, data []byte, dt DataType) (
 	return
 }
 
+// SetIfMatch isn't retried, because a write that succeeded but whose response
+// was lost would fail the second time, as if another client had changed the
+// object in between.
+func (r *retry) SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error {
+	return setIfMatch(ctx, r.base, key, data, dt, etag)
+}
+
 func (r *retry) Delete(ctx context.Context, key string) (err error) {
 	for i := 0; i < r.attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		err = r.base.Delete(ctx, key)
+		if err == nil || err == ErrReadOnly {
+			return
+		}
+	}
+
+	return
+}
+
+func (r *retry) List(ctx context.Context, prefix string) (keys []string, err error) {
+	for i := 0; i < r.attempts; i++ {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		keys, err = r.base.List(ctx, prefix)
 		if err == nil {
 			return
 		}
@@ -76,6 +427,8 @@ func (r *retry) Delete(ctx context.Context, key string) (err error) {
 	return
 }
 
+func (r *retry) Close() error { return r.base.Close() }
+
 type prefix struct {
 	base   ObjectStorage
 	prefix string
@@ -91,10 +444,313 @@ func (p *prefix) Get(ctx context.Context, key string) ([]byte, error) {
 	return p.base.Get(ctx, p.prefix+key)
 }
 
+func (p *prefix) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return getIfChanged(ctx, p.base, p.prefix+key, "")
+}
+
+func (p *prefix) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	return getIfChanged(ctx, p.base, p.prefix+key, etag)
+}
+
+func (p *prefix) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, p.prefix+key)
+	}
+	data, err := getMany(ctx, p.base, prefixed)
+	if pe, ok := err.(*PartialError); ok {
+		failed := make([]string, 0, len(pe.Failed))
+		for _, key := range pe.Failed {
+			failed = append(failed, key[len(p.prefix):])
+		}
+		return nil, &PartialError{p.strip(pe.Data), failed, pe.Err}
+	} else if err != nil {
+		return nil, err
+	}
+	return p.strip(data), nil
+}
+
+// strip removes the prefix from each key of `data`.
+func (p *prefix) strip(data map[string][]byte) map[string][]byte {
+	out := make(map[string][]byte, len(data))
+	for key, val := range data {
+		out[key[len(p.prefix):]] = val
+	}
+	return out
+}
+
 func (p *prefix) Set(ctx context.Context, key string, data []byte, dt DataType) error {
 	return p.base.Set(ctx, p.prefix+key, data, dt)
 }
 
+func (p *prefix) SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error {
+	return setIfMatch(ctx, p.base, p.prefix+key, data, dt, etag)
+}
+
 func (p *prefix) Delete(ctx context.Context, key string) error {
 	return p.base.Delete(ctx, p.prefix+key)
 }
+
+func (p *prefix) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := p.base.List(ctx, p.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, key[len(p.prefix):])
+	}
+	return out, nil
+}
+
+func (p *prefix) Close() error { return p.base.Close() }
+
+type readOnly struct {
+	base ObjectStorage
+}
+
+// NewReadOnly wraps a base object storage backend, and makes every attempt to
+// change it fail with ErrReadOnly. Reads are passed through unchanged.
+//
+// This is enforced by the storage stack itself, so it holds no matter what's
+// layered on top. Something that tries to write, like a WAL draining, keeps
+// failing rather than modifying the backend.
+func NewReadOnly(base ObjectStorage) ObjectStorage {
+	return &readOnly{base}
+}
+
+func (ro *readOnly) Get(ctx context.Context, key string) ([]byte, error) {
+	return ro.base.Get(ctx, key)
+}
+
+func (ro *readOnly) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return getIfChanged(ctx, ro.base, key, "")
+}
+
+func (ro *readOnly) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	return getIfChanged(ctx, ro.base, key, etag)
+}
+
+func (ro *readOnly) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	return getMany(ctx, ro.base, keys)
+}
+
+func (ro *readOnly) Set(ctx context.Context, key string, data []byte, dt DataType) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnly) SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnly) Delete(ctx context.Context, key string) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnly) List(ctx context.Context, prefix string) ([]string, error) {
+	return ro.base.List(ctx, prefix)
+}
+
+func (ro *readOnly) Close() error { return ro.base.Close() }
+
+type verifyWrites struct {
+	base ObjectStorage
+}
+
+// NewVerifyWrites wraps a base object storage backend, and reads every object
+// back from it after it's been written, to check that the backend stored it
+// correctly. A write that reads back differently, or that can't be read back,
+// fails. Likewise, a deleted object has to be gone when it's read back. This
+// doubles the number of requests made for each write, so it's meant for when
+// a backend isn't trusted to store data faithfully.
+func NewVerifyWrites(base ObjectStorage) ObjectStorage {
+	return &verifyWrites{base}
+}
+
+func (vw *verifyWrites) Get(ctx context.Context, key string) ([]byte, error) {
+	return vw.base.Get(ctx, key)
+}
+
+func (vw *verifyWrites) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return getIfChanged(ctx, vw.base, key, "")
+}
+
+func (vw *verifyWrites) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	return getIfChanged(ctx, vw.base, key, etag)
+}
+
+func (vw *verifyWrites) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	return getMany(ctx, vw.base, keys)
+}
+
+func (vw *verifyWrites) Set(ctx context.Context, key string, data []byte, dt DataType) error {
+	if err := vw.base.Set(ctx, key, data, dt); err != nil {
+		return err
+	}
+	return vw.verify(ctx, key, data)
+}
+
+// verify reads the object `key` back, and checks that it's `data`.
+func (vw *verifyWrites) verify(ctx context.Context, key string, data []byte) error {
+	stored, err := vw.base.Get(ctx, key)
+	if err == ErrObjectNotFound || err == nil && !bytes.Equal(stored, data) {
+		VerifiedWrites.WithLabelValues("set", "false").Inc()
+		err := fmt.Errorf("storage: object %v read back differently than it was written", key)
+		logging.Error(err)
+		return err
+	} else if err != nil {
+		return fmt.Errorf("storage: failed to read back object %v: %v", key, err)
+	}
+	VerifiedWrites.WithLabelValues("set", "true").Inc()
+	return nil
+}
+
+func (vw *verifyWrites) SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error {
+	if err := setIfMatch(ctx, vw.base, key, data, dt, etag); err != nil {
+		return err
+	}
+	return vw.verify(ctx, key, data)
+}
+
+func (vw *verifyWrites) Delete(ctx context.Context, key string) error {
+	if err := vw.base.Delete(ctx, key); err != nil {
+		return err
+	}
+	_, err := vw.base.Get(ctx, key)
+	if err == nil {
+		VerifiedWrites.WithLabelValues("delete", "false").Inc()
+		err := fmt.Errorf("storage: object %v still exists after being deleted", key)
+		logging.Error(err)
+		return err
+	} else if err != ErrObjectNotFound {
+		return fmt.Errorf("storage: failed to read back object %v: %v", key, err)
+	}
+	VerifiedWrites.WithLabelValues("delete", "true").Inc()
+	return nil
+}
+
+func (vw *verifyWrites) List(ctx context.Context, prefix string) ([]string, error) {
+	return vw.base.List(ctx, prefix)
+}
+
+func (vw *verifyWrites) Close() error { return vw.base.Close() }
+
+// Tee is an ObjectStorage implementation that copies every change it makes to
+// a primary backend into a shadow backend as well, like a local archive kept
+// for disaster recovery. Reads only ever go to the primary.
+type Tee struct {
+	primary, shadow ObjectStorage
+}
+
+// NewTee returns a Tee over `primary` and `shadow`. Changes are made to the
+// primary first, and only copied to the shadow if they succeed. Failing to
+// change the shadow is logged, but isn't returned to the caller, so that the
+// shadow can never make the primary unavailable. Verify finds what it's missed.
+func NewTee(primary, shadow ObjectStorage) *Tee {
+	return &Tee{primary, shadow}
+}
+
+func (t *Tee) Get(ctx context.Context, key string) ([]byte, error) {
+	return t.primary.Get(ctx, key)
+}
+
+func (t *Tee) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return getIfChanged(ctx, t.primary, key, "")
+}
+
+func (t *Tee) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	return getIfChanged(ctx, t.primary, key, etag)
+}
+
+func (t *Tee) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	return getMany(ctx, t.primary, keys)
+}
+
+func (t *Tee) Set(ctx context.Context, key string, data []byte, dt DataType) error {
+	if err := t.primary.Set(ctx, key, data, dt); err != nil {
+		return err
+	} else if err := t.shadow.Set(ctx, key, data, dt); err != nil {
+		logging.Warnf("tee: failed to write %v to shadow: %v", key, err)
+	}
+	return nil
+}
+
+func (t *Tee) SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error {
+	if err := setIfMatch(ctx, t.primary, key, data, dt, etag); err != nil {
+		return err
+	} else if err := t.shadow.Set(ctx, key, data, dt); err != nil {
+		logging.Warnf("tee: failed to write %v to shadow: %v", key, err)
+	}
+	return nil
+}
+
+func (t *Tee) Delete(ctx context.Context, key string) error {
+	if err := t.primary.Delete(ctx, key); err != nil {
+		return err
+	} else if err := t.shadow.Delete(ctx, key); err != nil && err != ErrObjectNotFound {
+		logging.Warnf("tee: failed to delete %v from shadow: %v", key, err)
+	}
+	return nil
+}
+
+func (t *Tee) List(ctx context.Context, prefix string) ([]string, error) {
+	return t.primary.List(ctx, prefix)
+}
+
+func (t *Tee) Close() error { return Closers{t.primary, t.shadow}.Close() }
+
+// TeeDiff describes how the shadow of a Tee differs from its primary.
+type TeeDiff struct {
+	Missing   []string // Keys that are in the primary, but not the shadow.
+	Different []string // Keys whose values in the primary and shadow differ.
+	Extra     []string // Keys that are in the shadow, but not the primary.
+}
+
+// Verify compares every object under `prefix` in the primary against the
+// shadow. Objects are read in batches, so only a batch is held in memory at a
+// time.
+func (t *Tee) Verify(ctx context.Context, prefix string) (*TeeDiff, error) {
+	primaryKeys, err := t.primary.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	shadowKeys, err := t.shadow.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	inShadow := make(map[string]bool, len(shadowKeys))
+	for _, key := range shadowKeys {
+		inShadow[key] = true
+	}
+
+	out := &TeeDiff{}
+	const batchSize = 100
+	for i := 0; i < len(primaryKeys); i += batchSize {
+		batch := primaryKeys[i:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		primary, err := getMany(ctx, t.primary, batch)
+		if err != nil {
+			return nil, err
+		}
+		shadow, err := getMany(ctx, t.shadow, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range batch {
+			delete(inShadow, key)
+			if val, ok := shadow[key]; !ok {
+				out.Missing = append(out.Missing, key)
+			} else if !bytes.Equal(val, primary[key]) {
+				out.Different = append(out.Different, key)
+			}
+		}
+	}
+	for _, key := range shadowKeys {
+		if inShadow[key] {
+			out.Extra = append(out.Extra, key)
+		}
+	}
+	return out, nil
+}
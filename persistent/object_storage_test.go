@@ -0,0 +1,312 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// slowStorage wraps an object storage backend and adds latency to every Get,
+// like a remote storage provider would have.
+type slowStorage struct {
+	ObjectStorage
+}
+
+func (ss slowStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	time.Sleep(time.Millisecond)
+	return ss.ObjectStorage.Get(ctx, key)
+}
+
+func testSlowStorage(t testing.TB, n int) (ObjectStorage, []string) {
+	ctx := context.Background()
+	store := NewMemory()
+
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%x", i)
+		if err := store.Set(ctx, key, []byte(key), Content); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return slowStorage{store}, keys
+}
+
+func TestParallelGetMany(t *testing.T) {
+	store, keys := testSlowStorage(t, 50)
+	keys = append(keys, "missing")
+
+	data, err := parallelGetMany(context.Background(), store, keys, 8)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != len(keys)-1 {
+		t.Fatalf("unexpected number of results: %v", len(data))
+	}
+	for _, key := range keys[:len(keys)-1] {
+		if string(data[key]) != key {
+			t.Fatalf("wrong value for key %v: %q", key, data[key])
+		}
+	}
+	if _, ok := data["missing"]; ok {
+		t.Fatal("missing key should not be in results")
+	}
+
+	ctx, cancel := cancelSoon()
+	defer cancel()
+	if _, err := parallelGetMany(ctx, blockingStorage{}, keys, 8); err == nil {
+		t.Fatal("expected error from backend to be returned")
+	}
+}
+
+// flakyStorage wraps an object storage backend, and fails to Get each key in
+// `fails` that many times before it succeeds. It counts the Gets of each key.
+type flakyStorage struct {
+	ObjectStorage
+
+	mu    sync.Mutex
+	fails map[string]int
+	gets  map[string]int
+}
+
+func (fs *flakyStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	fs.mu.Lock()
+	fs.gets[key]++
+	fail := fs.fails[key] > 0
+	fs.fails[key]--
+	fs.mu.Unlock()
+
+	if fail {
+		return nil, fmt.Errorf("transient failure")
+	}
+	return fs.ObjectStorage.Get(ctx, key)
+}
+
+func testFlakyStorage(t *testing.T, fails map[string]int) *flakyStorage {
+	ctx := context.Background()
+	store := NewMemory()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Set(ctx, key, []byte(key), Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &flakyStorage{ObjectStorage: store, fails: fails, gets: make(map[string]int)}
+}
+
+func TestPartialGetMany(t *testing.T) {
+	ctx := context.Background()
+	keys := []string{"a", "b", "c", "missing"}
+
+	// Keys that are canceled after the first failure are reported as failed,
+	// along with the key that actually failed. Each key that exists is either
+	// fetched or failed.
+	data, err := parallelGetMany(ctx, testFlakyStorage(t, map[string]int{"b": 1}), keys, 1)
+	if data != nil {
+		t.Fatal("expected no data to be returned with an error")
+	}
+	pe, ok := err.(*PartialError)
+	if !ok {
+		t.Fatalf("expected partial error, got: %v", err)
+	} else if string(pe.Data["a"]) != "a" || pe.Failed[0] != "b" {
+		t.Fatalf("unexpected partial error: %v %v", pe.Data, pe.Failed)
+	} else if _, ok := pe.Data["missing"]; ok {
+		t.Fatal("missing key should not be in results")
+	}
+	failed := make(map[string]bool)
+	for _, key := range pe.Failed {
+		failed[key] = true
+	}
+	for _, key := range keys[:3] {
+		if _, ok := pe.Data[key]; ok == failed[key] {
+			t.Fatalf("key %v should be fetched or failed: %v %v", key, pe.Data, pe.Failed)
+		}
+	}
+
+	// Retrying only asks again for the keys that failed, and keys that are
+	// absent are left out without an error.
+	store := testFlakyStorage(t, map[string]int{"b": 1})
+	r, err := NewRetry(store, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = getMany(ctx, r, keys)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != 3 || string(data["a"]) != "a" || string(data["b"]) != "b" || string(data["c"]) != "c" {
+		t.Fatalf("unexpected data: %v", data)
+	} else if store.gets["a"] != 1 || store.gets["b"] != 2 {
+		t.Fatalf("unexpected number of gets: %v", store.gets)
+	}
+
+	// Once the attempts run out, what was fetched is still reported.
+	r, err = NewRetry(testFlakyStorage(t, map[string]int{"c": 5}), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = getMany(ctx, NewPrefix(r, ""), keys)
+	if pe, ok := err.(*PartialError); !ok {
+		t.Fatalf("expected partial error, got: %v", err)
+	} else if len(pe.Data) != 2 || fmt.Sprint(pe.Failed) != "[c missing]" {
+		t.Fatalf("unexpected partial error: %v %v", pe.Data, pe.Failed)
+	}
+}
+
+func BenchmarkGetManySerial(b *testing.B) {
+	store, keys := testSlowStorage(b, 32)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getMany(ctx, store, keys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetManyParallel(b *testing.B) {
+	store, keys := testSlowStorage(b, 32)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parallelGetMany(ctx, store, keys, b2Parallelism); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryStorageLatency(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(20 * time.Millisecond)
+
+	start := time.Now()
+	if err := store.Set(ctx, "a", []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	} else if data, err := store.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatalf("unexpected data: %q", data)
+	} else if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("requests finished too quickly: %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.Get(ctx, "a"); err != context.Canceled {
+		t.Fatalf("expected request to be canceled, got: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	base := NewMemory()
+	if err := base.Set(ctx, "a", []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewRetry(NewReadOnly(base), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set(ctx, "b", []byte("world"), Content); err != ErrReadOnly {
+		t.Fatalf("unexpected error from set: %v", err)
+	} else if err := store.Delete(ctx, "a"); err != ErrReadOnly {
+		t.Fatalf("unexpected error from delete: %v", err)
+	}
+
+	if data, err := store.Get(ctx, "a"); err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected result from get: %q %v", data, err)
+	} else if _, err := store.Get(ctx, "b"); err != ErrObjectNotFound {
+		t.Fatalf("unexpected error from get: %v", err)
+	}
+	if data, err := getMany(ctx, store, []string{"a", "b"}); err != nil || len(data) != 1 || string(data["a"]) != "hello" {
+		t.Fatalf("unexpected result from get many: %v %v", data, err)
+	} else if keys, err := store.List(ctx, ""); err != nil || len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("unexpected result from list: %v %v", keys, err)
+	}
+}
+
+func TestTee(t *testing.T) {
+	ctx := context.Background()
+
+	primary, shadow := NewMemory(), NewMemory()
+	store := NewTee(primary, shadow)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Set(ctx, key, []byte(key), Content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete(ctx, "c"); err != nil {
+		t.Fatal(err)
+	} else if data, err := shadow.Get(ctx, "a"); err != nil || string(data) != "a" {
+		t.Fatalf("unexpected result from shadow: %q %v", data, err)
+	} else if _, err := shadow.Get(ctx, "c"); err != ErrObjectNotFound {
+		t.Fatalf("expected deleted object to be gone from shadow, got: %v", err)
+	}
+
+	// Reads never go to the shadow.
+	if err := shadow.Set(ctx, "z", []byte("z"), Content); err != nil {
+		t.Fatal(err)
+	} else if _, err := store.Get(ctx, "z"); err != ErrObjectNotFound {
+		t.Fatalf("unexpected error from get: %v", err)
+	}
+
+	// Writes still succeed when the shadow fails, and Verify finds them.
+	failing := NewTee(primary, NewReadOnly(shadow))
+	if err := failing.Set(ctx, "d", []byte("d"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := shadow.Set(ctx, "b", []byte("corrupted"), Content); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := store.Verify(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(diff.Missing, diff.Different, diff.Extra) != "[d] [b] [z]" {
+		t.Fatalf("unexpected differences: %v %v %v", diff.Missing, diff.Different, diff.Extra)
+	}
+}
+
+// lyingStorage wraps an object storage backend, but stores the wrong data for
+// writes to `key`, and never deletes anything.
+type lyingStorage struct {
+	ObjectStorage
+	key string
+}
+
+func (ls lyingStorage) Set(ctx context.Context, key string, data []byte, dt DataType) error {
+	if key == ls.key {
+		data = append([]byte{}, data...)
+		data[0] ^= 1
+	}
+	return ls.ObjectStorage.Set(ctx, key, data, dt)
+}
+
+func (ls lyingStorage) Delete(ctx context.Context, key string) error { return nil }
+
+func TestVerifyWrites(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewVerifyWrites(lyingStorage{NewMemory(), "b"})
+	if err := store.Set(ctx, "a", []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := store.Set(ctx, "b", []byte("hello"), Content); err == nil {
+		t.Fatal("expected corrupted write to fail")
+	} else if err := store.Delete(ctx, "a"); err == nil {
+		t.Fatal("expected ignored delete to fail")
+	}
+
+	// Errors from the base are returned as they are, without reading back.
+	store = NewVerifyWrites(NewReadOnly(NewMemory()))
+	if err := store.Set(ctx, "a", []byte("hello"), Content); err != ErrReadOnly {
+		t.Fatalf("expected error from base to be returned, got: %v", err)
+	}
+	store = NewVerifyWrites(NewMemory())
+	if err := store.Set(ctx, "a", []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+}
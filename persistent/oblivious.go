@@ -60,6 +60,9 @@ func marshalBucket(items map[uint64][]byte, maxSize int64) []byte {
 }
 
 func unmarshalBucket(data []byte, maxSize int64) (map[uint64][]byte, error) {
+	if int64(len(data)) != int64(blockSize)*(8+4+maxSize) {
+		return nil, fmt.Errorf("bucket has unexpected size: %v", len(data))
+	}
 	out := make(map[uint64][]byte)
 
 	r := bytes.NewReader(data)
@@ -243,10 +246,11 @@ func (o *oblivious) startAccess(ctx context.Context, ptrs []uint64) (map[uint64]
 		}
 	}
 	for ptr, data := range stash {
-		if _, ok := o.store.Stash[ptr]; ok {
+		if o.store.Has(ptr) {
 			continue
+		} else if err := o.store.Put(ctx, ptr, data); err != nil {
+			return nil, err
 		}
-		o.store.Stash[ptr] = data
 	}
 
 	return assignments, nil
@@ -274,7 +278,7 @@ func (o *oblivious) finishAccess(ctx context.Context, assignments map[uint64]uin
 	// There's a lot of stuff in the stash unrelated to our query. Lookup the
 	// assigned leafs for all those pointers and merge them into `assignments`.
 	extraPtrs := make([]uint64, 0)
-	for ptr, _ := range o.store.Stash {
+	for _, ptr := range o.store.Ptrs() {
 		if _, ok := assignments[ptr]; !ok {
 			extraPtrs = append(extraPtrs, ptr)
 		}
@@ -336,8 +340,10 @@ func (o *oblivious) buildBucket(ctx context.Context, node uint64, assignments ma
 		if node != cand {
 			continue
 		}
-		val, ok := o.store.Stash[ptr]
-		if !ok {
+		val, ok, err := o.store.Take(ctx, ptr)
+		if err != nil {
+			return err
+		} else if !ok {
 			continue
 		}
 
@@ -347,7 +353,6 @@ func (o *oblivious) buildBucket(ctx context.Context, node uint64, assignments ma
 		} else {
 			itemsRollback[ptr] = val
 		}
-		delete(o.store.Stash, ptr)
 
 		if len(items) == blockSize {
 			break
@@ -373,8 +378,11 @@ func (o *oblivious) GetMany(ctx context.Context, ptrs []uint64) (map[uint64][]by
 		return nil, err
 	}
 	for _, ptr := range ptrs {
-		data, ok := o.store.Stash[ptr]
-		if ok {
+		data, ok, err := o.store.Get(ctx, ptr)
+		if err != nil {
+			o.needRollback = true
+			return nil, err
+		} else if ok {
 			out[ptr] = dup(data)
 		}
 	}
@@ -401,9 +409,17 @@ func (o *oblivious) Set(ctx context.Context, ptr uint64, data []byte, _ DataType
 		o.store.Count = ptr + 1
 	}
 	if _, ok := o.originalVals[ptr]; !ok {
-		o.originalVals[ptr] = o.store.Stash[ptr]
+		orig, _, err := o.store.Get(ctx, ptr)
+		if err != nil {
+			o.needRollback = true
+			return err
+		}
+		o.originalVals[ptr] = orig
+	}
+	if err := o.store.Put(ctx, ptr, dup(data)); err != nil {
+		o.needRollback = true
+		return err
 	}
-	o.store.Stash[ptr] = dup(data)
 
 	if err := o.finishAccess(ctx, assignments); err != nil {
 		o.needRollback = true
@@ -439,7 +455,8 @@ func (o *oblivious) Rollback(ctx context.Context) {
 	// When Rollback is called and there haven't been any error conditions, we
 	// actually need to commit. This is because Get requests modify the user's
 	// data and we need to persist those changes to preserve the privacy
-	// guarantees of ORAM. Changes from Set requests are explicitly undone.
+	// guarantees of ORAM. Changes from Set requests are explicitly undone,
+	// both in the buckets that were written and in the stash.
 	for node, data := range o.rollbackWrites {
 		if err := o.base.Set(ctx, node, data, Content); err != nil {
 			o.needRollback = true
@@ -447,6 +464,22 @@ func (o *oblivious) Rollback(ctx context.Context) {
 			return
 		}
 	}
+	for ptr, orig := range o.originalVals {
+		if !o.store.Has(ptr) {
+			continue
+		}
+		var err error
+		if orig == nil {
+			_, _, err = o.store.Take(ctx, ptr)
+		} else {
+			err = o.store.Put(ctx, ptr, orig)
+		}
+		if err != nil {
+			o.needRollback = true
+			o.Rollback(ctx)
+			return
+		}
+	}
 
 	if err := o.store.Commit(ctx, o.integ.curr.Version); err != nil {
 		o.base.Rollback(ctx)
@@ -2,20 +2,51 @@ package persistent
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// stashSpiller is implemented by ObliviousStorage backends that can keep part of
+// the stash on disk during a transaction, so that a large stash doesn't have to
+// fit in memory. Spilled entries are still part of the stash: Commit persists
+// them along with the stash it's given.
+type stashSpiller interface {
+	// StashLimit returns the maximum number of stash entries to keep in
+	// memory, or zero if there's no limit.
+	StashLimit() int
+	// StartSpilled is like Start, but only returns up to StashLimit entries of
+	// the stash. The pointers of the rest are returned in `spilled`.
+	StartSpilled(ctx context.Context, version uint64) (stash map[uint64][]byte, spilled []uint64, size uint64, err error)
+	// Spill moves the stash entry for `ptr` to disk.
+	Spill(ctx context.Context, ptr uint64, val []byte) error
+	// Unspill returns the stash entry for `ptr` that's on disk, and removes it
+	// from there.
+	Unspill(ctx context.Context, ptr uint64) ([]byte, error)
+}
+
 type obliviousStore struct {
-	base ObliviousStorage
+	base    ObliviousStorage
+	spiller stashSpiller // Nil if the stash is always kept in memory.
+
+	// Stash is the part of the stash that's in memory, and spilled is the set
+	// of pointers whose entries are on disk. lastUse is when each entry in
+	// memory was last used, according to `clock`, so that the least recently
+	// used ones can be spilled first.
+	Stash   map[uint64][]byte
+	spilled map[uint64]struct{}
+	lastUse map[uint64]uint64
+	clock   uint64
 
-	Stash map[uint64][]byte
 	Count uint64
 
 	assignments map[uint64]uint64
@@ -24,22 +55,149 @@ type obliviousStore struct {
 // newObliviousStore wraps an implementation of the simpler ObliviousStorage
 // interface and makes it a bit more user-friendly.
 func newObliviousStore(base ObliviousStorage) *obliviousStore {
-	return &obliviousStore{base: base}
+	store := &obliviousStore{base: base}
+	if spiller, ok := base.(stashSpiller); ok && spiller.StashLimit() > 0 {
+		store.spiller = spiller
+	}
+	return store
 }
 
 func (os *obliviousStore) Start(ctx context.Context, version uint64) error {
-	stash, count, err := os.base.Start(ctx, version)
+	var (
+		stash   map[uint64][]byte
+		spilled []uint64
+		count   uint64
+		err     error
+	)
+	if os.spiller != nil {
+		stash, spilled, count, err = os.spiller.StartSpilled(ctx, version)
+	} else {
+		stash, count, err = os.base.Start(ctx, version)
+	}
 	if err != nil {
 		return err
 	}
 
 	os.Stash = stash
+	os.spilled = make(map[uint64]struct{})
+	for _, ptr := range spilled {
+		os.spilled[ptr] = struct{}{}
+	}
+	os.lastUse = make(map[uint64]uint64)
 	os.Count = count
 	os.assignments = make(map[uint64]uint64)
 
 	return nil
 }
 
+// Has returns true if there's an entry in the stash for `ptr`.
+func (os *obliviousStore) Has(ptr uint64) bool {
+	if _, ok := os.Stash[ptr]; ok {
+		return true
+	}
+	_, ok := os.spilled[ptr]
+	return ok
+}
+
+// Ptrs returns the pointers of every entry in the stash.
+func (os *obliviousStore) Ptrs() []uint64 {
+	out := make([]uint64, 0, len(os.Stash)+len(os.spilled))
+	for ptr := range os.Stash {
+		out = append(out, ptr)
+	}
+	for ptr := range os.spilled {
+		out = append(out, ptr)
+	}
+	return out
+}
+
+// Get returns the stash entry for `ptr`, reading it back into memory if it
+// was spilled.
+func (os *obliviousStore) Get(ctx context.Context, ptr uint64) ([]byte, bool, error) {
+	if _, ok := os.spilled[ptr]; ok {
+		val, err := os.spiller.Unspill(ctx, ptr)
+		if err != nil {
+			return nil, false, err
+		}
+		delete(os.spilled, ptr)
+		if err := os.Put(ctx, ptr, val); err != nil {
+			return nil, false, err
+		}
+		return val, true, nil
+	}
+	val, ok := os.Stash[ptr]
+	if ok {
+		os.touch(ptr)
+	}
+	return val, ok, nil
+}
+
+// Put sets the stash entry for `ptr` to `val`, spilling other entries to disk
+// if there are now too many in memory.
+func (os *obliviousStore) Put(ctx context.Context, ptr uint64, val []byte) error {
+	if _, ok := os.spilled[ptr]; ok {
+		if _, err := os.spiller.Unspill(ctx, ptr); err != nil {
+			return err
+		}
+		delete(os.spilled, ptr)
+	}
+	os.Stash[ptr] = val
+	os.touch(ptr)
+	return os.evict(ctx)
+}
+
+// Take removes the stash entry for `ptr` and returns it.
+func (os *obliviousStore) Take(ctx context.Context, ptr uint64) ([]byte, bool, error) {
+	if _, ok := os.spilled[ptr]; ok {
+		val, err := os.spiller.Unspill(ctx, ptr)
+		if err != nil {
+			return nil, false, err
+		}
+		delete(os.spilled, ptr)
+		return val, true, nil
+	}
+	val, ok := os.Stash[ptr]
+	delete(os.Stash, ptr)
+	delete(os.lastUse, ptr)
+	return val, ok, nil
+}
+
+func (os *obliviousStore) touch(ptr uint64) {
+	if os.spiller != nil {
+		os.clock++
+		os.lastUse[ptr] = os.clock
+	}
+}
+
+// evict spills the least recently used entries in memory, if there are more
+// than the limit. A quarter of the limit is freed up at once, so that a stream
+// of new entries doesn't spill one entry at a time.
+func (os *obliviousStore) evict(ctx context.Context) error {
+	if os.spiller == nil {
+		return nil
+	}
+	limit := os.spiller.StashLimit()
+	if len(os.Stash) <= limit {
+		return nil
+	}
+
+	ptrs := make([]uint64, 0, len(os.Stash))
+	for ptr := range os.Stash {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return os.lastUse[ptrs[i]] < os.lastUse[ptrs[j]] })
+
+	for _, ptr := range ptrs[:len(ptrs)-(limit-limit/4)] {
+		if err := os.spiller.Spill(ctx, ptr, os.Stash[ptr]); err != nil {
+			return err
+		}
+		delete(os.Stash, ptr)
+		delete(os.lastUse, ptr)
+		os.spilled[ptr] = struct{}{}
+	}
+	return nil
+}
+
 func (os *obliviousStore) Lookup(ctx context.Context, ptrs []uint64) (map[uint64]uint64, error) {
 	out := make(map[uint64]uint64)
 
@@ -76,18 +234,19 @@ func (os *obliviousStore) Assign(assignments map[uint64]uint64) {
 
 func (os *obliviousStore) Commit(ctx context.Context, version uint64) error {
 	err := os.base.Commit(ctx, version, os.Stash, os.assignments)
-
-	os.Stash = nil
-	os.Count = 0
-	os.assignments = nil
-
+	os.reset()
 	return err
 }
 
 func (os *obliviousStore) Rollback(ctx context.Context) {
 	os.base.Rollback(ctx)
+	os.reset()
+}
 
+func (os *obliviousStore) reset() {
 	os.Stash = nil
+	os.spilled = nil
+	os.lastUse = nil
 	os.Count = 0
 	os.assignments = nil
 }
@@ -97,13 +256,32 @@ type localOblivious struct {
 
 	tx      *sql.Tx
 	version uint64
+
+	// limit is the maximum number of stash entries to keep in memory, or zero
+	// for no limit. spillKey encrypts entries that are spilled to disk, and
+	// only exists in memory. spilledOld is the set of pointers whose entries
+	// were left in the stash table by StartSpilled, and haven't been read.
+	limit      int
+	spillKey   cipher.AEAD
+	spilledOld map[uint64]struct{}
 }
 
 // NewLocalOblivious returns an implementation of the ObliviousStorage
 // interface, used for storing temporary ORAM data, that's backed by an on-disk
 // database at `loc`.
 func NewLocalOblivious(loc string) (ObliviousStorage, error) {
-	if err := os.MkdirAll(path.Dir(loc), 0744); err != nil {
+	return NewLocalObliviousWithLimit(loc, 0)
+}
+
+// NewLocalObliviousWithLimit is like NewLocalOblivious, but at most `limit`
+// entries of the ORAM stash are kept in memory. The least recently used entries
+// beyond that are spilled to the database, encrypted with a key that's lost
+// when the process exits, and read back when they're needed. If `limit` is
+// zero, the whole stash is kept in memory.
+func NewLocalObliviousWithLimit(loc string, limit int) (ObliviousStorage, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("oblivious: stash limit must not be negative")
+	} else if err := os.MkdirAll(path.Dir(loc), 0744); err != nil {
 		return nil, err
 	}
 	db, err := sql.Open("sqlite3", loc)
@@ -122,34 +300,74 @@ func NewLocalOblivious(loc string) (ObliviousStorage, error) {
 	if err != nil {
 		return nil, err
 	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS spill (ptr integer not null primary key, val bytea)")
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	spillKey, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
 
-	return &localOblivious{db: db}, nil
+	return &localOblivious{db: db, limit: limit, spillKey: spillKey}, nil
 }
 
 func (lo *localOblivious) Start(ctx context.Context, version uint64) (map[uint64][]byte, uint64, error) {
-	tx, err := lo.db.BeginTx(context.Background(), nil)
+	stash, spilled, count, err := lo.start(ctx, version, 0)
 	if err != nil {
 		return nil, 0, err
+	} else if len(spilled) > 0 {
+		lo.Rollback(ctx)
+		return nil, 0, fmt.Errorf("oblivious: stash was spilled without a limit")
+	}
+	return stash, count, nil
+}
+
+func (lo *localOblivious) StashLimit() int { return lo.limit }
+
+func (lo *localOblivious) StartSpilled(ctx context.Context, version uint64) (map[uint64][]byte, []uint64, uint64, error) {
+	return lo.start(ctx, version, lo.limit)
+}
+
+func (lo *localOblivious) start(ctx context.Context, version uint64, limit int) (map[uint64][]byte, []uint64, uint64, error) {
+	tx, err := lo.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, nil, 0, err
 	}
 
-	stash, count, err := lo.initTx(ctx, version, tx)
+	stash, spilled, count, err := lo.initTx(ctx, version, limit, tx)
 	if err != nil {
 		tx.Rollback()
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 
 	lo.tx = tx
 	lo.version = version
-	return stash, count, nil
+	lo.spilledOld = make(map[uint64]struct{})
+	for _, ptr := range spilled {
+		lo.spilledOld[ptr] = struct{}{}
+	}
+	return stash, spilled, count, nil
 }
 
-func (lo *localOblivious) initTx(ctx context.Context, version uint64, tx *sql.Tx) (map[uint64][]byte, uint64, error) {
-	// Read the stash into memory.
+func (lo *localOblivious) initTx(ctx context.Context, version uint64, limit int, tx *sql.Tx) (map[uint64][]byte, []uint64, uint64, error) {
+	// Read the stash into memory, up to `limit` entries. The rest are left in
+	// the database.
 	stash := make(map[uint64][]byte)
+	spilled := make([]uint64, 0)
 
 	rows, err := tx.QueryContext(ctx, "SELECT ptr, val FROM stash WHERE version = ?", version)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 	for rows.Next() {
 		var (
@@ -158,13 +376,16 @@ func (lo *localOblivious) initTx(ctx context.Context, version uint64, tx *sql.Tx
 		)
 		if err := rows.Scan(&ptr, &val); err != nil {
 			rows.Close()
-			return nil, 0, err
+			return nil, nil, 0, err
+		} else if limit > 0 && len(stash) >= limit {
+			spilled = append(spilled, ptr)
+		} else {
+			stash[ptr] = val
 		}
-		stash[ptr] = val
 	}
 	if err := rows.Err(); err != nil {
 		rows.Close()
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 	rows.Close()
 
@@ -172,14 +393,14 @@ func (lo *localOblivious) initTx(ctx context.Context, version uint64, tx *sql.Tx
 	// current version.
 	_, err = tx.ExecContext(ctx, "DELETE FROM stash WHERE version != ?", version)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 
 	// Compute the count of leaves stored.
 	var count *uint64
 	err = tx.QueryRowContext(ctx, "SELECT MAX(ptr) FROM position WHERE version <= ?", version).Scan(&count)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	} else if count == nil {
 		count = new(uint64)
 	} else {
@@ -189,18 +410,103 @@ func (lo *localOblivious) initTx(ctx context.Context, version uint64, tx *sql.Tx
 	// Keep the positions map clean by removing overlapping assignments and
 	// removing future, failed versions.
 	if err := lo.deleteOverlapping(ctx, version, tx); err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 	_, err = tx.ExecContext(ctx, "DELETE FROM position WHERE version > ?", version)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 	_, err = tx.ExecContext(ctx, "DELETE FROM assignments")
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM spill")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return stash, spilled, *count, nil
+}
+
+func (lo *localOblivious) Spill(ctx context.Context, ptr uint64, val []byte) error {
+	nonce := make([]byte, lo.spillKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ct := lo.spillKey.Seal(nonce, nonce, val, nil)
+	_, err := lo.tx.ExecContext(ctx, "INSERT OR REPLACE INTO spill (ptr, val) VALUES (?, ?)", ptr, ct)
+	return err
+}
+
+func (lo *localOblivious) Unspill(ctx context.Context, ptr uint64) ([]byte, error) {
+	// Entries left behind by StartSpilled are still in the stash table, which
+	// must be left as it is in case the transaction is rolled back.
+	if _, ok := lo.spilledOld[ptr]; ok {
+		var val []byte
+		err := lo.tx.QueryRowContext(ctx, "SELECT val FROM stash WHERE ptr = ? AND version = ?", ptr, lo.version).Scan(&val)
+		if err != nil {
+			return nil, err
+		}
+		delete(lo.spilledOld, ptr)
+		return val, nil
+	}
+
+	var ct []byte
+	if err := lo.tx.QueryRowContext(ctx, "SELECT val FROM spill WHERE ptr = ?", ptr).Scan(&ct); err != nil {
+		return nil, err
+	} else if len(ct) < lo.spillKey.NonceSize() {
+		return nil, fmt.Errorf("oblivious: spilled stash entry is too short")
+	}
+	n := lo.spillKey.NonceSize()
+	val, err := lo.spillKey.Open(nil, ct[:n], ct[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("oblivious: failed to decrypt spilled stash entry: %v", err)
+	} else if _, err := lo.tx.ExecContext(ctx, "DELETE FROM spill WHERE ptr = ?", ptr); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// commitSpilled adds the stash entries that are still spilled to the stash
+// table at `version`, one at a time, and empties the spill table.
+func (lo *localOblivious) commitSpilled(ctx context.Context, version uint64) error {
+	for ptr := range lo.spilledOld {
+		_, err := lo.tx.ExecContext(ctx, "INSERT INTO stash (ptr, val, version) SELECT ptr, val, ? FROM stash WHERE ptr = ? AND version = ?", version, ptr, lo.version)
+		if err != nil {
+			return err
+		}
+	}
+
+	ptrs := make([]uint64, 0)
+	rows, err := lo.tx.QueryContext(ctx, "SELECT ptr FROM spill")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var ptr uint64
+		if err := rows.Scan(&ptr); err != nil {
+			rows.Close()
+			return err
+		}
+		ptrs = append(ptrs, ptr)
 	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
 
-	return stash, *count, nil
+	for _, ptr := range ptrs {
+		val, err := lo.Unspill(ctx, ptr)
+		if err != nil {
+			return err
+		}
+		_, err = lo.tx.ExecContext(ctx, "INSERT INTO stash (ptr, val, version) VALUES (?, ?, ?)", ptr, val, version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // deleteOverlapping deletes previous versions of assignments that were made
@@ -275,6 +581,9 @@ func (lo *localOblivious) Commit(ctx context.Context, version uint64, stash map[
 			return err
 		}
 	}
+	if err := lo.commitSpilled(ctx, version); err != nil {
+		return err
+	}
 
 	for ptr, leaf := range assignments {
 		_, err := lo.tx.ExecContext(ctx, "INSERT INTO position (ptr, leaf, version) VALUES (?, ?, ?)", ptr, leaf, version)
@@ -301,6 +610,7 @@ func (lo *localOblivious) Commit(ctx context.Context, version uint64, stash map[
 	}
 	lo.tx = nil
 	lo.version = 0
+	lo.spilledOld = nil
 	return nil
 }
 
@@ -311,4 +621,12 @@ func (lo *localOblivious) Rollback(ctx context.Context) {
 	lo.tx.Rollback()
 	lo.tx = nil
 	lo.version = 0
+	lo.spilledOld = nil
+}
+
+// Close rolls back any open transaction, since it can't be committed once the
+// database is closed, and then closes the database.
+func (lo *localOblivious) Close() error {
+	lo.Rollback(context.Background())
+	return lo.db.Close()
 }
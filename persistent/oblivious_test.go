@@ -29,7 +29,56 @@ func TestOblivious(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	auditor, store := testORAM(t, tempDir, localStore)
 
+	// Run tests.
+	t.Run("Correctness", testORAMCorrectness(store))
+	t.Run("Randomness", testORAMRandomness(auditor, store))
+}
+
+// countingSpiller counts how many stash entries are spilled to disk.
+type countingSpiller struct {
+	*localOblivious
+	spills int
+}
+
+func (cs *countingSpiller) Spill(ctx context.Context, ptr uint64, val []byte) error {
+	cs.spills++
+	return cs.localOblivious.Spill(ctx, ptr, val)
+}
+
+func TestObliviousSpill(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	localStore, err := NewLocalObliviousWithLimit(tempDir+"/oram", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiller := &countingSpiller{localOblivious: localStore.(*localOblivious)}
+	_, store := testORAM(t, tempDir, spiller)
+
+	t.Run("Correctness", testORAMCorrectness(store))
+	if spiller.spills == 0 {
+		t.Fatal("expected some stash entries to be spilled")
+	}
+
+	// No more than the limit should be in memory at the start of a transaction.
+	ctx := context.Background()
+	if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Rollback(ctx)
+	if n := len(store.(*oblivious).store.Stash); n > 2 {
+		t.Fatalf("too many stash entries in memory: %v", n)
+	}
+}
+
+// testORAM returns ORAM storage that keeps its local data in `localStore` and
+// its blocks in a database in `tempDir`, and the auditor beneath it.
+func testORAM(t *testing.T, tempDir string, localStore ObliviousStorage) (*oramAuditor, BlockStorage) {
 	// Setup block storage.
 	disk, err := NewDisk(tempDir + "/db")
 	if err != nil {
@@ -37,7 +86,7 @@ func TestOblivious(t *testing.T) {
 	}
 	base := NewBufferedStorage(NewSimpleReliable(disk))
 
-	integ, err := WithIntegrity(base, "password", tempDir+"/pin.json")
+	integ, err := WithIntegrity(base, "password", tempDir+"/pin.json", 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,10 +97,7 @@ func TestOblivious(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Run tests.
-	t.Run("Correctness", testORAMCorrectness(store))
-	t.Run("Randomness", testORAMRandomness(auditor, store))
+	return auditor, store
 }
 
 // testORAMCorrectness checks that data stored in ORAM can be successfully
@@ -23,6 +23,19 @@ const (
 
 var (
 	ErrObjectNotFound = errors.New("object not found")
+	ErrReadOnly       = errors.New("storage is read-only")
+	ErrNotModified    = errors.New("object not modified")
+	ErrWALFull        = errors.New("wal is full")
+	ErrWALPaused      = errors.New("wal is paused")
+
+	// ErrPreconditionFailed is returned by SetIfMatch when the object has
+	// changed since it was read.
+	ErrPreconditionFailed = errors.New("object has changed")
+
+	// ErrConflict is returned by Commit when another client committed changes
+	// after the current transaction started. The transaction is rolled back,
+	// and can be run again against the new state.
+	ErrConflict = errors.New("another client committed changes first")
 )
 
 // ObjectStorage defines the minimal interface that's implemented by a remote
@@ -36,6 +49,69 @@ type ObjectStorage interface {
 	Set(ctx context.Context, key string, data []byte, dt DataType) (err error)
 	// Delete removes the object with the given key.
 	Delete(ctx context.Context, key string) (err error)
+	// List returns the keys of every object that starts with `prefix`, in
+	// lexicographic order.
+	List(ctx context.Context, prefix string) (keys []string, err error)
+	// Close releases any connections or files held by the provider, and by
+	// any provider it wraps. It must not be used afterwards.
+	Close() error
+}
+
+// BatchObjectStorage is an extension of the ObjectStorage interface that's
+// implemented by providers that can fetch several objects faster than by
+// fetching them one at a time.
+type BatchObjectStorage interface {
+	ObjectStorage
+
+	// GetMany returns a map from each requested key to its data. Keys that
+	// don't correspond to any object are left out of the map. If any key
+	// couldn't be fetched for another reason, GetMany must return an error
+	// instead of leaving that key out. When only some keys failed, the error
+	// should be a *PartialError so that the caller can retry just those.
+	GetMany(ctx context.Context, keys []string) (data map[string][]byte, err error)
+}
+
+// PartialError is returned by GetMany when some of the requested keys were
+// fetched, and others couldn't be. Keys that were found to be absent are in
+// neither Data nor Failed.
+type PartialError struct {
+	Data   map[string][]byte // Data of the keys that were fetched.
+	Failed []string          // Keys that couldn't be fetched.
+	Err    error             // The first error from fetching one of Failed.
+}
+
+func (pe *PartialError) Error() string {
+	return fmt.Sprintf("failed to fetch %v of %v objects: %v", len(pe.Failed), len(pe.Failed)+len(pe.Data), pe.Err)
+}
+
+func (pe *PartialError) Unwrap() error { return pe.Err }
+
+// ConditionalObjectStorage is an extension of the ObjectStorage interface
+// that's implemented by providers that can tell whether an object has changed
+// without downloading it again. Each version of an object is identified by an
+// opaque ETag.
+type ConditionalObjectStorage interface {
+	ObjectStorage
+
+	// GetWithETag returns the data corresponding to the given key, like Get,
+	// along with the ETag of the version that was read.
+	GetWithETag(ctx context.Context, key string) (data []byte, etag string, err error)
+	// GetIfChanged returns ErrNotModified if the current version of the object
+	// has the ETag `etag`. Otherwise, it behaves like GetWithETag.
+	GetIfChanged(ctx context.Context, key, etag string) (data []byte, newEtag string, err error)
+}
+
+// AtomicObjectStorage is an extension of the ConditionalObjectStorage
+// interface that's implemented by providers that can write an object only if
+// it hasn't changed since it was read.
+type AtomicObjectStorage interface {
+	ConditionalObjectStorage
+
+	// SetIfMatch stores `data` under `key`, like Set, but only if the current
+	// version of the object has the ETag `etag`, or if there's no object with
+	// that key when `etag` is empty. Otherwise, it fails with
+	// ErrPreconditionFailed and the object is left as it is.
+	SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error
 }
 
 type WriteData struct {
@@ -58,6 +134,11 @@ type ReliableStorage interface {
 	// Commit persists the changes in `writes` to the backend, atomically. If
 	// the value of a key is nil, then that key is deleted.
 	Commit(ctx context.Context, writes map[uint64]WriteData) error
+
+	// Close flushes anything that's been committed but not yet persisted to
+	// the base, if possible, and then releases the resources held by the
+	// storage and everything beneath it.
+	Close() error
 }
 
 // BlockStorage is a derivative of ObjectStorage that uses uint64 pointers as
@@ -90,6 +171,9 @@ type ObliviousStorage interface {
 
 	// Rollback aborts the transaction without attempting to make any changes.
 	Rollback(ctx context.Context)
+
+	// Close releases the database or other state that the storage is kept in.
+	Close() error
 }
 
 // MapMutex implements the ability to lock and unlock specific keys of a map.
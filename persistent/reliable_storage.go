@@ -3,8 +3,20 @@ package persistent
 import (
 	"bytes"
 	"context"
+	"sync"
+	"time"
 
 	"github.com/cloudflare/utahfs/cache"
+	"github.com/cloudflare/utahfs/internal/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var WriteBehindDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "metadata_write_behind_depth",
+		Help: "The number of committed blocks waiting to be written to the local copy of metadata.",
+	},
 )
 
 type simpleReliable struct {
@@ -26,28 +38,61 @@ func (sr *simpleReliable) Get(ctx context.Context, key uint64) ([]byte, error) {
 }
 
 func (sr *simpleReliable) GetMany(ctx context.Context, keys []uint64) (map[uint64][]byte, error) {
-	out := make(map[uint64][]byte)
+	hexKeys := make([]string, 0, len(keys))
 	for _, key := range keys {
-		val, err := sr.Get(ctx, key)
-		if err == ErrObjectNotFound {
-			continue
-		} else if err != nil {
-			return nil, err
+		hexKeys = append(hexKeys, hex(key))
+	}
+	data, err := getMany(ctx, sr.base, hexKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[uint64][]byte)
+	for i, key := range keys {
+		if val, ok := data[hexKeys[i]]; ok {
+			out[key] = val
 		}
-		out[key] = val
 	}
 	return out, nil
 }
 
 func (sr *simpleReliable) Commit(ctx context.Context, writes map[uint64]WriteData) error {
 	for key, wr := range writes {
-		if err := sr.base.Set(ctx, hex(key), wr.Data, wr.Type); err != nil {
+		var err error
+		if wr.Data == nil {
+			err = sr.base.Delete(ctx, hex(key))
+		} else {
+			err = sr.base.Set(ctx, hex(key), wr.Data, wr.Type)
+		}
+		if err != nil {
 			panic(err)
 		}
 	}
 	return nil
 }
 
+func (sr *simpleReliable) Close() error { return sr.base.Close() }
+
+type readOnlyReliable struct {
+	ReliableStorage
+}
+
+// NewReadOnlyReliable wraps a base reliable storage backend, and makes every
+// commit that has writes in it fail with ErrReadOnly. The transaction is still
+// ended, as if nothing had been written.
+func NewReadOnlyReliable(base ReliableStorage) ReliableStorage {
+	return readOnlyReliable{base}
+}
+
+func (ro readOnlyReliable) Commit(ctx context.Context, writes map[uint64]WriteData) error {
+	if err := ro.ReliableStorage.Commit(ctx, nil); err != nil {
+		return err
+	} else if len(writes) > 0 {
+		return ErrReadOnly
+	}
+	return nil
+}
+
 type cacheStorage struct {
 	base  ReliableStorage
 	cache *cache.Cache
@@ -149,12 +194,16 @@ func (c *cacheStorage) Commit(ctx context.Context, writes map[uint64]WriteData)
 	return nil
 }
 
+func (c *cacheStorage) Close() error { return c.base.Close() }
+
 type blockReliable struct {
 	BlockStorage
 }
 
 // NewBlockReliable returns a ReliableStorage implementation based on a
-// BlockStorage implementation.
+// BlockStorage implementation. BlockStorage can't be closed, so closing the
+// returned storage does nothing; whatever is beneath the BlockStorage has to be
+// closed separately.
 func NewBlockReliable(base BlockStorage) ReliableStorage {
 	return &blockReliable{base}
 }
@@ -167,3 +216,221 @@ func (br *blockReliable) Commit(ctx context.Context, writes map[uint64]WriteData
 	}
 	return br.BlockStorage.Commit(ctx)
 }
+
+func (br *blockReliable) Close() error { return nil }
+
+type writeThrough struct {
+	base  ReliableStorage
+	high  ObjectStorage
+	types map[DataType]bool
+}
+
+// NewWriteThroughCache wraps a base ReliableStorage implementation, like a local
+// WAL, and writes objects of the given data types to `high` as soon as they've
+// been committed to the base, rather than waiting for the base to flush them.
+// `high` should be the same object storage that the base eventually writes
+// those objects to, such as the local copy of metadata kept by a tiered cache.
+//
+// This means that `high` is current even if the process is stopped before the
+// base has flushed, at the cost of a synchronous write to `high` for every
+// matching object in every commit. Reads are still served by the base, so if
+// `high` falls behind, like when writing to it fails, the base's newer copy is
+// used until it's flushed over the old one.
+//
+// Closing the cache closes the base, but not `high`, which is expected to be
+// closed along with the rest of the base's stack.
+func NewWriteThroughCache(base ReliableStorage, high ObjectStorage, types ...DataType) ReliableStorage {
+	set := make(map[DataType]bool)
+	for _, dt := range types {
+		set[dt] = true
+	}
+	return &writeThrough{base, high, set}
+}
+
+func (wt *writeThrough) Start(ctx context.Context, prefetch []uint64) (map[uint64][]byte, error) {
+	return wt.base.Start(ctx, prefetch)
+}
+
+func (wt *writeThrough) Get(ctx context.Context, key uint64) ([]byte, error) {
+	return wt.base.Get(ctx, key)
+}
+
+func (wt *writeThrough) GetMany(ctx context.Context, keys []uint64) (map[uint64][]byte, error) {
+	return wt.base.GetMany(ctx, keys)
+}
+
+func (wt *writeThrough) Commit(ctx context.Context, writes map[uint64]WriteData) error {
+	if err := wt.base.Commit(ctx, writes); err != nil {
+		return err
+	}
+
+	// The commit is durable at this point, so a failure to update `high` isn't
+	// reported to the caller. The base will write the object there later.
+	for key, wr := range writes {
+		if !wt.types[wr.Type] {
+			continue
+		}
+		var err error
+		if len(wr.Data) == 0 {
+			err = wt.high.Delete(ctx, hex(key))
+		} else {
+			err = wt.high.Set(ctx, hex(key), wr.Data, wr.Type)
+		}
+		if err != nil {
+			logging.Warnf("write-through: failed to write %x: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (wt *writeThrough) Close() error { return wt.base.Close() }
+
+type writeBehind struct {
+	base  ReliableStorage
+	high  ObjectStorage
+	types map[DataType]bool
+	size  int
+
+	// flushMu is held while queued objects are written to `high`, so that
+	// flushes happen one at a time, in the order they were queued. mu only
+	// protects the queue itself.
+	flushMu sync.Mutex
+	mu      sync.Mutex
+	pending map[uint64]WriteData
+
+	stop, done chan struct{}
+}
+
+// NewWriteBehindCache is like NewWriteThroughCache, except that objects are
+// queued in memory after they've been committed to the base, and written to
+// `high` in the background every `interval`. Only objects of the given data
+// types are queued; others, like file content, are left to the base. Objects
+// written again before they've been flushed only take one place in the queue.
+//
+// Each commit flushes whatever earlier commits left in the queue before it
+// commits to the base, so `high` is updated in the same order as the base, one
+// whole commit at a time. If a commit queues `size` objects or more, it flushes
+// them too before returning. Nothing is queued until its commit to the base has
+// succeeded, so `high` never gets data from a transaction that failed.
+//
+// If the process is stopped with objects still queued, or writing them fails,
+// `high` is only behind: the base also writes every object to `high` once it's
+// uploaded. Close stops the background flushes, and flushes the queue before
+// closing the base.
+func NewWriteBehindCache(base ReliableStorage, high ObjectStorage, size int, interval time.Duration, types ...DataType) ReliableStorage {
+	set := make(map[DataType]bool)
+	for _, dt := range types {
+		set[dt] = true
+	}
+	wb := &writeBehind{
+		base:  base,
+		high:  high,
+		types: set,
+		size:  size,
+
+		pending: make(map[uint64]WriteData),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(wb.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-wb.stop:
+				return
+			case <-ticker.C:
+			}
+			wb.flush(context.Background())
+		}
+	}()
+	return wb
+}
+
+func (wb *writeBehind) Start(ctx context.Context, prefetch []uint64) (map[uint64][]byte, error) {
+	return wb.base.Start(ctx, prefetch)
+}
+
+func (wb *writeBehind) Get(ctx context.Context, key uint64) ([]byte, error) {
+	return wb.base.Get(ctx, key)
+}
+
+func (wb *writeBehind) GetMany(ctx context.Context, keys []uint64) (map[uint64][]byte, error) {
+	return wb.base.GetMany(ctx, keys)
+}
+
+func (wb *writeBehind) Commit(ctx context.Context, writes map[uint64]WriteData) error {
+	wb.flush(ctx)
+	if err := wb.base.Commit(ctx, writes); err != nil {
+		return err
+	}
+
+	wb.mu.Lock()
+	for key, wr := range writes {
+		if wb.types[wr.Type] {
+			wb.pending[key] = wr
+		}
+	}
+	full := len(wb.pending) >= wb.size
+	WriteBehindDepth.Set(float64(len(wb.pending)))
+	wb.mu.Unlock()
+
+	if full {
+		wb.flush(ctx)
+	}
+	return nil
+}
+
+// flush writes every queued object to `high`. The queue is swapped out for an
+// empty one first, so commits can queue objects while it's being written, and
+// a newer copy of an object is only written by the next flush.
+func (wb *writeBehind) flush(ctx context.Context) {
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+
+	wb.mu.Lock()
+	pending := wb.pending
+	wb.pending = make(map[uint64]WriteData)
+	WriteBehindDepth.Set(0)
+	wb.mu.Unlock()
+
+	for key, wr := range pending {
+		var err error
+		if len(wr.Data) == 0 {
+			err = wb.high.Delete(ctx, hex(key))
+		} else {
+			err = wb.high.Set(ctx, hex(key), wr.Data, wr.Type)
+		}
+		if err != nil {
+			logging.Warnf("write-behind: failed to write %x: %v", key, err)
+		}
+	}
+}
+
+func (wb *writeBehind) Close() error {
+	close(wb.stop)
+	<-wb.done
+	wb.flush(context.Background())
+	return wb.base.Close()
+}
+
+// unwrapCache returns the ReliableStorage implementation underneath any
+// in-memory, write-through, or write-behind caches, and any read-only wrapper.
+func unwrapCache(base ReliableStorage) ReliableStorage {
+	for {
+		switch s := base.(type) {
+		case *cacheStorage:
+			base = s.base
+		case *writeThrough:
+			base = s.base
+		case *writeBehind:
+			base = s.base
+		case readOnlyReliable:
+			base = s.ReliableStorage
+		default:
+			return base
+		}
+	}
+}
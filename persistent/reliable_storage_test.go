@@ -0,0 +1,702 @@
+package persistent
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/utahfs/internal/logging"
+)
+
+func TestWriteThroughCache(t *testing.T) {
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	ctx := context.Background()
+
+	disk, err := NewDisk(path.Join(name, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The WAL never drains to a blocking provider, so anything that reaches the
+	// disk copy of the metadata got there by being written through.
+	wal, err := NewLocalWAL(NewTieredCache(Metadata, disk, blockingStorage{}), path.Join(name, "wal"), 1024, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewWriteThroughCache(wal, disk, Metadata)
+
+	for _, writes := range []map[uint64]WriteData{
+		{1: {[]byte("a"), Metadata}, 2: {[]byte("b"), Metadata}, 3: {[]byte("c"), Content}},
+		{1: {[]byte("d"), Metadata}, 2: {nil, Metadata}},
+	} {
+		if _, err := store.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := store.Commit(ctx, writes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, err := store.Get(ctx, 3); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(val, []byte("c")) {
+		t.Fatalf("unexpected value for content: %q", val)
+	}
+
+	// Simulate a crash by abandoning the WAL, and check the disk copy.
+	disk, err = NewDisk(path.Join(name, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := disk.Get(ctx, hex(1)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(val, []byte("d")) {
+		t.Fatalf("disk copy of metadata is stale: %q", val)
+	}
+	if _, err := disk.Get(ctx, hex(2)); err != ErrObjectNotFound {
+		t.Fatalf("expected deleted metadata to be gone, got: %v", err)
+	}
+	if _, err := disk.Get(ctx, hex(3)); err != ErrObjectNotFound {
+		t.Fatalf("expected content to only be in the WAL, got: %v", err)
+	}
+}
+
+func TestWriteBehindCache(t *testing.T) {
+	ctx := context.Background()
+	commit := func(store ReliableStorage, writes map[uint64]WriteData) {
+		if _, err := store.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := store.Commit(ctx, writes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(high ObjectStorage, key uint64) string {
+		val, err := high.Get(ctx, hex(key))
+		if err == ErrObjectNotFound {
+			return ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(val)
+	}
+
+	// Objects are queued until the next commit, or until there are `size` of
+	// them, counting an object written twice only once.
+	high := NewMemory()
+	store := NewWriteBehindCache(NewSimpleReliable(NewMemory()), high, 3, time.Hour, Metadata)
+	commit(store, map[uint64]WriteData{1: {[]byte("a"), Metadata}, 2: {[]byte("b"), Metadata}, 3: {[]byte("c"), Content}})
+	if val := get(high, 1) + get(high, 2); val != "" {
+		t.Fatalf("expected metadata to be queued, got: %q", val)
+	}
+	commit(store, map[uint64]WriteData{1: {[]byte("d"), Metadata}})
+	if val := get(high, 1) + get(high, 2) + get(high, 3); val != "ab" {
+		t.Fatalf("unexpected metadata after next commit: %q", val)
+	} else if val, err := store.Get(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if string(val) != "d" {
+		t.Fatalf("unexpected value from base: %q", val)
+	}
+	commit(store, map[uint64]WriteData{4: {[]byte("e"), Metadata}, 5: {[]byte("f"), Metadata}, 6: {[]byte("g"), Metadata}})
+	if val := get(high, 1) + get(high, 4) + get(high, 5) + get(high, 6); val != "defg" {
+		t.Fatalf("unexpected metadata after queue filled: %q", val)
+	}
+
+	// Closing the cache flushes the queue.
+	commit(store, map[uint64]WriteData{7: {[]byte("h"), Metadata}})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	} else if val := get(high, 7); val != "h" {
+		t.Fatalf("expected metadata to be flushed on close, got: %q", val)
+	}
+
+	// Otherwise, they're written after the interval.
+	high = NewMemory()
+	store = NewWriteBehindCache(NewSimpleReliable(NewMemory()), high, 1024, 10*time.Millisecond, Metadata)
+	commit(store, map[uint64]WriteData{1: {[]byte("a"), Metadata}})
+	time.Sleep(50 * time.Millisecond)
+	if val := get(high, 1); val != "a" {
+		t.Fatalf("expected metadata to be flushed, got: %q", val)
+	}
+}
+
+func TestLocalWALPause(t *testing.T) {
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	ctx := context.Background()
+
+	base := NewMemory()
+	store, err := NewLocalWAL(base, path.Join(name, "wal"), 1024, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal := store.(*localWAL)
+	wal.setPaused(true)
+
+	if _, err := wal.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := wal.Commit(ctx, map[uint64]WriteData{1: {[]byte("a"), Content}}); err != nil {
+		t.Fatal(err)
+	} else if err := wal.flush(ctx); err != ErrWALPaused {
+		t.Fatalf("expected flush to fail while paused, got: %v", err)
+	}
+	if _, err := base.Get(ctx, hex(1)); err != ErrObjectNotFound {
+		t.Fatalf("expected nothing to be uploaded while paused, got: %v", err)
+	} else if n, err := wal.Pending(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected 1 pending entry, got %v", n)
+	}
+
+	wal.setPaused(false)
+	if err := wal.flush(ctx); err != nil {
+		t.Fatal(err)
+	} else if val, err := base.Get(ctx, hex(1)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(val, []byte("a")) {
+		t.Fatalf("unexpected value: %q", val)
+	}
+}
+
+func TestLocalWALClose(t *testing.T) {
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	ctx := context.Background()
+
+	base := NewMemory()
+	open := func() *localWAL {
+		store, err := NewLocalWAL(base, path.Join(name, "wal"), 1024, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store.(*localWAL)
+	}
+	commit := func(wal *localWAL, key uint64) {
+		if _, err := wal.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := wal.Commit(ctx, map[uint64]WriteData{key: {[]byte("a"), Content}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An entry that can't be flushed, because draining is paused, is kept for
+	// the next run.
+	wal := open()
+	wal.setPaused(true)
+	commit(wal, 1)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := wal.Pending(); err == nil {
+		t.Fatal("expected database to be closed")
+	}
+	wal = open()
+	if n := len(wal.replayKeys); n != 1 {
+		t.Fatalf("expected 1 entry left over, got %v", n)
+	}
+
+	// Otherwise, everything is flushed before closing.
+	commit(wal, 2)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []uint64{1, 2} {
+		if val, err := base.Get(ctx, hex(key)); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(val, []byte("a")) {
+			t.Fatalf("unexpected value: %q", val)
+		}
+	}
+}
+
+func TestLocalWALFull(t *testing.T) {
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	ctx := context.Background()
+
+	// fill returns a WAL in `mode` that can hold 4 entries, over a slow
+	// backend, after committing `n` entries to it.
+	fill := func(mode WALFullMode, n int) ReliableStorage {
+		t.Helper()
+		wal, err := NewLocalWALWithMode(NewMemoryStorage(50*time.Millisecond), path.Join(name, fmt.Sprint(mode)), 4, 1, false, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writes := make(map[uint64]WriteData)
+		for i := 0; i < n; i++ {
+			writes[uint64(i)] = WriteData{[]byte("a"), Content}
+		}
+		if _, err := wal.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := wal.Commit(ctx, writes); err != nil {
+			t.Fatal(err)
+		}
+		return wal
+	}
+	startBy := func(wal ReliableStorage, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		_, err := wal.Start(ctx, nil)
+		return err
+	}
+
+	// Block: a full WAL stops transactions from starting until it drains.
+	wal := fill(WALFullBlock, 5)
+	if err := startBy(wal, 10*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("expected start to block, got: %v", err)
+	} else if err := startBy(wal, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Error: a full WAL can still be read from, but commits fail.
+	wal = fill(WALFullError, 5)
+	if err := startBy(wal, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if err := wal.Commit(ctx, map[uint64]WriteData{9: {[]byte("b"), Content}}); err != ErrWALFull {
+		t.Fatalf("expected wal to be full, got: %v", err)
+	} else if err := wal.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Throttle: a WAL that's more than half full delays transactions, but
+	// doesn't stop them.
+	wal = fill(WALFullThrottle, 3)
+	start := time.Now()
+	if err := startBy(wal, 10*time.Second); err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed < walThrottleMax/4 || elapsed >= walThrottleMax {
+		t.Fatalf("unexpected delay: %v", elapsed)
+	}
+	wal.Commit(ctx, nil)
+	if err := startBy(wal, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cutoffStorage wraps an object storage backend, and fails every Set after the
+// first `limit`, like a connection that's lost partway through an upload. It
+// counts the Sets that succeeded.
+type cutoffStorage struct {
+	ObjectStorage
+
+	mu          sync.Mutex
+	limit, sets int
+}
+
+func (cs *cutoffStorage) Set(ctx context.Context, key string, data []byte, dt DataType) error {
+	cs.mu.Lock()
+	if cs.sets >= cs.limit {
+		cs.mu.Unlock()
+		return fmt.Errorf("connection lost")
+	}
+	cs.sets++
+	cs.mu.Unlock()
+	return cs.ObjectStorage.Set(ctx, key, data, dt)
+}
+
+func TestLocalWALPartialBatch(t *testing.T) {
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	ctx := context.Background()
+
+	remote := NewMemory()
+	open := func(base ObjectStorage) (*localWAL, *AppStorage) {
+		t.Helper()
+		store, err := NewLocalWAL(base, path.Join(name, "wal"), 1024, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		integ, err := WithIntegrity(NewBufferedStorage(store), "password", path.Join(name, "pin.json"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store.(*localWAL), NewAppStorage(integ)
+	}
+	block := func(ptr uint64) []byte { return []byte(fmt.Sprintf("block %v", ptr)) }
+
+	// Commit a few batches' worth of blocks to the WAL, and cut the upload off
+	// partway through one of the batches.
+	cutoff := &cutoffStorage{ObjectStorage: remote, limit: 150}
+	wal, app := open(cutoff)
+	wal.setPaused(true)
+	if err := app.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for ptr := uint64(0); ptr < 200; ptr++ {
+		if err := app.Set(ctx, ptr, block(ptr), Content); err != nil {
+			t.Fatal(err)
+		} else if !app.NeedsEarlyCommit() {
+			continue
+		} else if err := app.CommitEarly(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	total, err := wal.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.setPaused(false)
+	if err := wal.flush(ctx); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+
+	// Stop the process without draining the WAL, and start it again. The
+	// entries uploaded before the cut-off, including those in the batch that
+	// failed, aren't uploaded again.
+	wal.cancel()
+	<-wal.drained
+	if err := wal.local.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resumed := &cutoffStorage{ObjectStorage: remote, limit: total}
+	wal, app = open(resumed)
+	if n := len(wal.replayKeys); n != total-150 {
+		t.Fatalf("expected %v entries left over, got %v", total-150, n)
+	} else if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	} else if resumed.sets != total-150 {
+		t.Fatalf("expected %v entries to be uploaded, got %v", total-150, resumed.sets)
+	}
+
+	// Everything is in remote storage, and matches the integrity tree.
+	integ, err := WithIntegrity(NewBufferedStorage(NewSimpleReliable(remote)), "password", path.Join(name, "pin.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app = NewAppStorage(integ)
+	if err := app.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Rollback(ctx)
+	for ptr := uint64(0); ptr < 200; ptr++ {
+		if data, err := app.Get(ctx, ptr); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, block(ptr)) {
+			t.Fatalf("unexpected data in block %v: %q", ptr, data)
+		}
+	}
+}
+
+func TestLocalWALReplayProgress(t *testing.T) {
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	ctx := context.Background()
+
+	buf := &bytes.Buffer{}
+	logging.SetOutput(buf)
+	defer logging.SetOutput(os.Stderr)
+	defer func(interval time.Duration) { replayProgressInterval = interval }(replayProgressInterval)
+	replayProgressInterval = 10 * time.Millisecond
+
+	// Leave entries in the WAL for the next run, by closing it while draining
+	// is paused.
+	base := NewMemoryStorage(20 * time.Millisecond)
+	store, err := NewLocalWAL(base, path.Join(name, "wal"), 1024, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal := store.(*localWAL)
+	wal.setPaused(true)
+	writes := make(map[uint64]WriteData)
+	for i := uint64(0); i < 10; i++ {
+		writes[i] = WriteData{[]byte("a"), Content}
+	}
+	if _, err := wal.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := wal.Commit(ctx, writes); err != nil {
+		t.Fatal(err)
+	} else if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening the WAL replays them, slowly enough that progress is logged
+	// along the way.
+	store, err = NewLocalWAL(base, path.Join(name, "wal"), 1024, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal = store.(*localWAL)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if n, err := wal.Pending(); err != nil {
+			t.Fatal(err)
+		} else if n == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("replay didn't finish, %v entries pending", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, msg := range []string{"replaying 10 entries", "replay in progress", "finished replaying 10 entries"} {
+		if !strings.Contains(out, msg) {
+			t.Fatalf("expected %q to be logged, got:\n%s", msg, out)
+		}
+	}
+}
+
+func TestLocalWALVerifyOnReplay(t *testing.T) {
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+	ctx := context.Background()
+
+	base := NewMemory()
+	open := func(verify bool) (*localWAL, BlockStorage) {
+		t.Helper()
+		wal, err := NewLocalWAL(base, path.Join(name, "wal"), 1024, 1, verify)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := WithIntegrity(NewBufferedStorage(wal), "password", path.Join(name, "pin.json"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wal.(*localWAL), store
+	}
+	// leave commits a few blocks while draining is paused, and closes the WAL,
+	// so that they're left over for the next run.
+	leave := func(val string) {
+		t.Helper()
+		wal, store := open(false)
+		if err := PauseWAL(store, true); err != nil {
+			t.Fatal(err)
+		} else if _, err := store.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		for ptr := uint64(0); ptr < 4; ptr++ {
+			if err := store.Set(ctx, ptr, []byte(val), Content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.Commit(ctx); err != nil {
+			t.Fatal(err)
+		} else if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// blocked returns true if flushing the WAL is still waiting for it to be
+	// verified.
+	blocked := func(store BlockStorage) bool {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		return FlushWAL(ctx, store) == context.DeadlineExceeded
+	}
+
+	// Entries that match the integrity tree are only uploaded once they've
+	// been verified.
+	leave("hello")
+	wal, store := open(true)
+	if n, err := WALPending(store); err != nil {
+		t.Fatal(err)
+	} else if n == 0 || n != len(wal.replayKeys) {
+		t.Fatalf("expected the entries left over to be pending, got %v", n)
+	} else if !blocked(store) {
+		t.Fatal("expected wal not to be flushed before being verified")
+	} else if err := VerifyWAL(ctx, store); err != nil {
+		t.Fatal(err)
+	} else if err := FlushWAL(ctx, store); err != nil {
+		t.Fatal(err)
+	} else if n, err := WALPending(store); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("expected wal to be empty after flushing, got %v entries", n)
+	} else if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry that's been tampered with fails verification, and nothing is
+	// uploaded.
+	leave("world")
+	wal, store = open(true)
+	if _, err := wal.local.Exec("UPDATE wal SET val = ? WHERE key = ?", []byte("tampered"), dataPtr(0)); err != nil {
+		t.Fatal(err)
+	} else if err := VerifyWAL(ctx, store); err == nil {
+		t.Fatal("expected tampered wal to fail verification")
+	} else if !blocked(store) {
+		t.Fatal("expected wal not to be flushed after failing verification")
+	} else if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnlyReliable(t *testing.T) {
+	ctx := context.Background()
+	base := NewSimpleReliable(NewMemory())
+	if _, err := base.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := base.Commit(ctx, map[uint64]WriteData{1: {[]byte("hello"), Content}}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewReadOnlyReliable(base)
+	if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if data, err := store.Get(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatal("unexpected data read")
+	} else if err := store.Commit(ctx, map[uint64]WriteData{1: {nil, Content}}); err != ErrReadOnly {
+		t.Fatalf("expected read-only error, got: %v", err)
+	} else if _, err := base.Get(ctx, 1); err != nil {
+		t.Fatal("object was deleted by read-only commit")
+	} else if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := store.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedReliable(t *testing.T) {
+	ctx := context.Background()
+	remote := NewMemory().(AtomicObjectStorage)
+
+	a, err := NewSharedReliable(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSharedReliable(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both clients start from the same tree head, so only the first to commit
+	// succeeds, and nothing from the second is written.
+	if _, err := a.Start(ctx, []uint64{0}); err != nil {
+		t.Fatal(err)
+	} else if _, err := b.Start(ctx, []uint64{0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Commit(ctx, map[uint64]WriteData{0: {[]byte("a0"), Metadata}, 1: {[]byte("a1"), Content}}); err != nil {
+		t.Fatal(err)
+	} else if err := b.Commit(ctx, map[uint64]WriteData{0: {[]byte("b0"), Metadata}, 2: {[]byte("b2"), Content}}); err != ErrConflict {
+		t.Fatalf("expected conflict, got: %v", err)
+	} else if _, err := remote.Get(ctx, "2"); err != ErrObjectNotFound {
+		t.Fatalf("expected block from conflicting commit to be missing, got: %v", err)
+	}
+
+	// Starting again sees the first client's commit.
+	data, err := b.Start(ctx, []uint64{0, 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data[0]) != "a0" || string(data[1]) != "a1" {
+		t.Fatalf("unexpected data: %q", data)
+	} else if err := b.Commit(ctx, map[uint64]WriteData{0: {[]byte("b0"), Metadata}, 1: {nil, Content}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Get(ctx, "1"); err != ErrObjectNotFound {
+		t.Fatalf("expected deleted block to be missing, got: %v", err)
+	} else if _, err := remote.Get(ctx, sharedLockKey); err != ErrObjectNotFound {
+		t.Fatalf("expected lock to be released, got: %v", err)
+	}
+}
+
+func TestSharedReliableRecover(t *testing.T) {
+	ctx := context.Background()
+	remote := NewMemory().(AtomicObjectStorage)
+
+	store, err := NewSharedReliable(remote)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := store.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// takeLock leaves a lock in storage, like a client that stopped partway
+	// through a commit that was started at `taken`.
+	takeLock := func(taken time.Time, head string) {
+		t.Helper()
+		raw, err := json.Marshal(&sharedLock{
+			Taken:  taken,
+			Base:   "",
+			Writes: map[uint64]WriteData{0: {[]byte(head), Metadata}, 1: {[]byte("1"), Content}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := remote.Set(ctx, sharedLockKey, raw, Metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A lock that was taken recently is left alone.
+	takeLock(time.Now(), "stopped")
+	if err := store.Commit(ctx, map[uint64]WriteData{0: {[]byte("head"), Metadata}}); err != ErrConflict {
+		t.Fatalf("expected conflict, got: %v", err)
+	} else if locked, err := store.(*sharedReliable).Locked(ctx); err != nil {
+		t.Fatal(err)
+	} else if !locked {
+		t.Fatal("expected storage to be locked")
+	} else if _, err := remote.Get(ctx, "1"); err != ErrObjectNotFound {
+		t.Fatalf("expected block from stopped commit to be missing, got: %v", err)
+	}
+
+	// Once its lease has run out, it's taken over, and the commit it was taken
+	// for is finished. The commit that found it still conflicts, because it
+	// started from the old tree head.
+	takeLock(time.Now().Add(-time.Hour), "stopped")
+	if err := store.Commit(ctx, map[uint64]WriteData{0: {[]byte("head"), Metadata}}); err != ErrConflict {
+		t.Fatalf("expected conflict, got: %v", err)
+	}
+	for key, expected := range map[string]string{"0": "stopped", "1": "1"} {
+		if data, err := remote.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		} else if string(data) != expected {
+			t.Fatalf("unexpected data in %v: %q", key, data)
+		}
+	}
+	if locked, err := store.(*sharedReliable).Locked(ctx); err != nil {
+		t.Fatal(err)
+	} else if locked {
+		t.Fatal("expected lock to be released")
+	}
+}
+
+// ignoredConditions is an AtomicObjectStorage implementation that accepts
+// conditional writes without checking the conditions, like some S3-compatible
+// services.
+type ignoredConditions struct {
+	AtomicObjectStorage
+}
+
+func (ic ignoredConditions) SetIfMatch(ctx context.Context, key string, data []byte, dt DataType, etag string) error {
+	return ic.Set(ctx, key, data, dt)
+}
+
+func TestSharedReliableProbe(t *testing.T) {
+	if _, err := NewSharedReliable(ignoredConditions{NewMemory().(AtomicObjectStorage)}); err == nil {
+		t.Fatal("expected storage that ignores conditions to be refused")
+	} else if _, err := NewSharedReliable(struct{ ObjectStorage }{NewMemory()}); err == nil {
+		t.Fatal("expected storage without conditional writes to be refused")
+	}
+}
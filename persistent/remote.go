@@ -2,12 +2,13 @@ package persistent
 
 import (
 	"bufio"
-	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
@@ -24,9 +25,17 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 
+	"github.com/cloudflare/utahfs/internal/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/crypto/argon2"
 )
 
+var RemoteHandshakes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "remote_handshakes",
+	Help: "The number of TLS handshakes a remote client has made with the server.",
+})
+
 func generateConfig(transportKey, hostname string) (*tls.Config, error) {
 	curve := elliptic.P256()
 
@@ -43,7 +52,7 @@ func generateConfig(transportKey, hostname string) (*tls.Config, error) {
 
 	caTempl := &x509.Certificate{
 		SerialNumber: big.NewInt(1),
-		Subject:      pkix.Name{CommonName: "utahfs-ca"},
+		Subject:      pkix.Name{CommonName: derivedCAName},
 		NotBefore:    time.Now().Add(-1 * 24 * time.Hour),
 		NotAfter:     time.Now().Add(364 * 24 * time.Hour),
 
@@ -76,6 +85,7 @@ func generateConfig(transportKey, hostname string) (*tls.Config, error) {
 	templ := &x509.Certificate{
 		SerialNumber: serial,
 		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
 		NotBefore:    time.Now().Add(-1 * 24 * time.Hour),
 		NotAfter:     time.Now().Add(364 * 24 * time.Hour),
 
@@ -112,43 +122,181 @@ func generateConfig(transportKey, hostname string) (*tls.Config, error) {
 	return cfg, nil
 }
 
+// compressionHeader is sent by a client that wants its transport to be
+// compressed. A server that supports compression compresses its responses to
+// these requests, and echoes the header back to let the client know that it may
+// compress the bodies of its own requests as well.
+const compressionHeader = "Utahfs-Compression"
+
+// transactionTimeoutHeader is sent by the server in response to a start
+// request, with how long the transaction may go without being pinged.
+const transactionTimeoutHeader = "Utahfs-Transaction-Timeout"
+
+// writeResponse writes `data` as the body of a successful response to `req`,
+// compressing it if the client asked for that.
+func writeResponse(rw http.ResponseWriter, req *http.Request, data map[uint64][]byte) {
+	if req.Header.Get(compressionHeader) != "gzip" {
+		rw.WriteHeader(http.StatusOK)
+		if err := writeMap(rw, data); err != nil {
+			logging.Error(err)
+		}
+		return
+	}
+
+	rw.Header().Set(compressionHeader, "gzip")
+	rw.Header().Set("Content-Encoding", "gzip")
+	rw.WriteHeader(http.StatusOK)
+	gz, _ := gzip.NewWriterLevel(rw, gzip.BestSpeed)
+	if err := writeMap(gz, data); err != nil {
+		logging.Error(err)
+	} else if err := gz.Close(); err != nil {
+		logging.Error(err)
+	}
+}
+
+// readBody parses a map from the body of a request or response, decompressing
+// it first if `header` says that it's compressed.
+func readBody(header http.Header, body io.Reader) (map[uint64][]byte, error) {
+	r, err := decodeBody(header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readMap(r)
+}
+
+// decodeBody returns a reader for the body of a request or response, which
+// decompresses it if `header` says that it's compressed.
+func decodeBody(header http.Header, body io.Reader) (io.ReadCloser, error) {
+	switch enc := header.Get("Content-Encoding"); enc {
+	case "":
+		return ioutil.NopCloser(body), nil
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	default:
+		return nil, fmt.Errorf("remote: unsupported content encoding: %v", enc)
+	}
+}
+
 func writeMap(w io.Writer, data map[uint64][]byte) error {
 	for key, val := range data {
-		hdr := make([]byte, 2*binary.MaxVarintLen64)
+		if err := writeEntry(w, key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		n := binary.PutUvarint(hdr, key)
-		m := binary.PutUvarint(hdr[n:], uint64(len(val)))
+// writeEntry writes one entry of a map to `w`: the key, followed by the length
+// of the value and then the value itself, which is the concatenation of
+// `parts`.
+func writeEntry(w io.Writer, key uint64, parts ...[]byte) error {
+	valLen := 0
+	for _, part := range parts {
+		valLen += len(part)
+	}
+	hdr := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(hdr, key)
+	n += binary.PutUvarint(hdr[n:], uint64(valLen))
 
-		if _, err := w.Write(hdr[:n+m]); err != nil {
+	if _, err := w.Write(hdr[:n]); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := w.Write(part); err != nil {
 			return err
-		} else if _, err := w.Write(val); err != nil {
+		}
+	}
+	return nil
+}
+
+// writeCommit writes the body of a commit request to `w`. It's framed like
+// writeMap, with the type of each write in the byte before its data.
+func writeCommit(w io.Writer, writes map[uint64]WriteData, compressed bool) error {
+	var gz *gzip.Writer
+	if compressed {
+		gz, _ = gzip.NewWriterLevel(w, gzip.BestSpeed)
+		w = gz
+	}
+	bw := bufio.NewWriter(w)
+
+	for key, wr := range writes {
+		if err := writeEntry(bw, key, []byte{byte(wr.Type)}, wr.Data); err != nil {
 			return err
 		}
 	}
+	if err := bw.Flush(); err != nil {
+		return err
+	} else if gz != nil {
+		return gz.Close()
+	}
 	return nil
 }
 
+// readCommit parses the body of a commit request, written by writeCommit. Each
+// write is decoded as soon as it's read, rather than after the whole body has
+// been, so only one copy of the commit is held in memory. That copy can't be
+// avoided, because the base's Commit takes every write at once.
+func readCommit(header http.Header, body io.Reader) (map[uint64]WriteData, error) {
+	r, err := decodeBody(header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out := make(map[uint64]WriteData)
+	err = readEntries(r, func(key uint64, val []byte) error {
+		if len(val) == 0 {
+			return fmt.Errorf("remote: write is missing its type")
+		}
+		out[key] = WriteData{val[1:], DataType(val[0])}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func readMap(r io.Reader) (map[uint64][]byte, error) {
-	br := bufio.NewReader(r)
 	out := make(map[uint64][]byte)
+	err := readEntries(r, func(key uint64, val []byte) error {
+		out[key] = val
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// readEntries reads the entries of a map written by writeMap from `r`, passing
+// each one to `fn` as soon as it's been read.
+func readEntries(r io.Reader, fn func(key uint64, val []byte) error) error {
+	br := bufio.NewReader(r)
 
 	for {
 		key, err := binary.ReadUvarint(br)
 		if err == io.EOF {
-			return out, nil
+			return nil
 		} else if err != nil {
-			return nil, err
+			return err
 		}
 
 		valLen, err := binary.ReadUvarint(br)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		val := make([]byte, valLen)
 		if _, err := io.ReadFull(br, val); err != nil {
-			return nil, err
+			return err
+		} else if err := fn(key, val); err != nil {
+			return err
 		}
-		out[key] = val
 	}
 }
 
@@ -166,21 +314,91 @@ func parseKeys(in []string) ([]uint64, error) {
 	return out, nil
 }
 
+// ErrTransactionTimedOut is returned by the remote client when the server has
+// ended its transaction, because it went too long without being pinged.
+var ErrTransactionTimedOut = errors.New("remote: transaction was ended by the server because it wasn't pinged in time")
+
 type remoteClient struct {
 	mu sync.Mutex
 
-	serverUrl *url.URL
-	client    *http.Client
-	oram      bool
+	serverUrl    *url.URL
+	client       *http.Client
+	oramSize     int64
+	readOnly     bool
+	compress     bool
+	pingInterval time.Duration
+	closed       chan struct{}
 
 	id string
+	// compressCommit is true if the server has said that it accepts compressed
+	// requests, in response to the current transaction's start request.
+	compressCommit bool
+}
+
+// RemoteClientOptions are the settings of a client from NewRemoteClient. The
+// zero value is a read-write client of a server's only repository, without
+// ORAM or compression, and with the default timeouts.
+type RemoteClientOptions struct {
+	// Repo, if not empty, is the name of the repository to use on a server from
+	// NewMultiRemoteServer. The transport key must be the key of that
+	// repository.
+	Repo string
+
+	// ORAMSize, if not zero, is the size of the server's ORAM blocks, which must
+	// be from the same num-ptrs and data-size as the client's. Starting a
+	// transaction fails if the server isn't using ORAM with blocks of exactly
+	// this size.
+	ORAMSize int64
+
+	// ReadOnly lets the client's transactions share a snapshot with other
+	// read-only clients instead of waiting for exclusive access, but any
+	// attempt to commit writes will fail with ErrReadOnly.
+	ReadOnly bool
+
+	// Compress compresses the maps of blocks sent to and from the server with
+	// gzip, provided that the server supports it. Blocks are encrypted before
+	// they get here, so this mostly compresses the framing around them.
+	Compress bool
+
+	// IdleTimeout is the longest that connections to the server are kept open
+	// while they're not being used, and HandshakeTimeout is the maximum amount
+	// of time to wait for a TLS handshake to complete. If either is zero, a
+	// default is used. Requests are multiplexed over a single HTTP/2
+	// connection when possible, so the requests of a transaction and its pings
+	// don't need separate connections.
+	IdleTimeout, HandshakeTimeout time.Duration
+
+	// PingInterval is how often the server is pinged while a transaction is
+	// open, or every 2 seconds if it's zero. Starting a transaction fails if
+	// this isn't less than half of the server's transaction timeout.
+	PingInterval time.Duration
 }
 
 // NewRemoteClient returns a ReliableStorage implementation that defers reads
-// and writes to a remote server.
+// and writes to a remote server, configured by `opts`.
 //
 // The corresponding server implementation is in NewRemoteServer.
-func NewRemoteClient(transportKey, serverUrl string, oram bool) (ReliableStorage, error) {
+func NewRemoteClient(transportKey, serverUrl string, opts RemoteClientOptions) (ReliableStorage, error) {
+	cfg, err := generateConfig(transportKey, "utahfs-client")
+	if err != nil {
+		return nil, err
+	}
+	return newRemoteClient(cfg, nil, serverUrl, opts)
+}
+
+// NewRemoteClientWithCerts is like NewRemoteClient, but authenticates with the
+// certificates in `certs` instead of ones derived from a transport key. The
+// server's certificate must be valid for the hostname in `serverUrl`, and the
+// server must be from NewRemoteServerWithCerts.
+func NewRemoteClientWithCerts(certs TLSFiles, serverUrl string, opts RemoteClientOptions) (ReliableStorage, error) {
+	cfg, err := certs.config()
+	if err != nil {
+		return nil, err
+	}
+	return newRemoteClient(cfg, &certs, serverUrl, opts)
+}
+
+func newRemoteClient(cfg *tls.Config, certs *TLSFiles, serverUrl string, opts RemoteClientOptions) (ReliableStorage, error) {
 	parsed, err := url.Parse(serverUrl)
 	if err != nil {
 		return nil, err
@@ -190,11 +408,30 @@ func NewRemoteClient(transportKey, serverUrl string, oram bool) (ReliableStorage
 		return nil, fmt.Errorf("remote: server url must end with / (forward slash)")
 	}
 
-	cfg, err := generateConfig(transportKey, "utahfs-client")
-	if err != nil {
-		return nil, err
+	// The repository is always chosen by the name sent in the handshake. A
+	// derived certificate is issued for that name, but one from a PKI is
+	// issued for the server's real hostname.
+	cfg.ServerName = serverHostname(opts.Repo)
+	verifyName, roots := cfg.ServerName, cfg.RootCAs
+	if certs != nil {
+		verifyName = parsed.Hostname()
+	}
+	// Verification is done by VerifyConnection instead, so that it can explain
+	// when the client and server are authenticating in different ways.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		RemoteHandshakes.Inc()
+		return verifyServer(cs, roots, verifyName, certs == nil)
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 90 * time.Second
+	}
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = 10 * time.Second
+	}
+	if opts.PingInterval == 0 {
+		opts.PingInterval = 2 * time.Second
 	}
-	cfg.ServerName = "utahfs-server"
 	// Code below is copied from net/http and slightly modified.
 	client := &http.Client{
 		Transport: &http.Transport{
@@ -204,9 +441,11 @@ func NewRemoteClient(transportKey, serverUrl string, oram bool) (ReliableStorage
 				KeepAlive: 30 * time.Second,
 				DualStack: true,
 			}).DialContext,
+			ForceAttemptHTTP2:     true,
 			MaxIdleConns:          3,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
+			MaxIdleConnsPerHost:   3,
+			IdleConnTimeout:       opts.IdleTimeout,
+			TLSHandshakeTimeout:   opts.HandshakeTimeout,
 			ExpectContinueTimeout: 1 * time.Second,
 
 			TLSClientConfig:    cfg,
@@ -217,18 +456,22 @@ func NewRemoteClient(transportKey, serverUrl string, oram bool) (ReliableStorage
 	}
 
 	rc := &remoteClient{
-		serverUrl: parsed,
-		client:    client,
-		oram:      oram,
+		serverUrl:    parsed,
+		client:       client,
+		oramSize:     opts.ORAMSize,
+		readOnly:     opts.ReadOnly,
+		compress:     opts.Compress,
+		pingInterval: opts.PingInterval,
+		closed:       make(chan struct{}),
 	}
 	go rc.maintain()
 	return rc, nil
 }
 
-func (rc *remoteClient) get(ctx context.Context, loc string) (map[uint64][]byte, error) {
+func (rc *remoteClient) get(ctx context.Context, loc string) (map[uint64][]byte, http.Header, error) {
 	parsed, err := url.Parse(loc)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	rc.mu.Lock()
 	fullLoc := rc.serverUrl.ResolveReference(parsed).String()
@@ -236,19 +479,29 @@ func (rc *remoteClient) get(ctx context.Context, loc string) (map[uint64][]byte,
 
 	req, err := http.NewRequest("GET", fullLoc, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if rc.compress {
+		req.Header.Set(compressionHeader, "gzip")
 	}
 	resp, err := rc.client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, nil, ErrTransactionTimedOut
 	} else if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("remote: unexpected response status: %v: %v", loc, resp.Status)
+		return nil, nil, statusError(loc, resp)
+	}
+	data, err := readBody(resp.Header, resp.Body)
+	if err != nil {
+		return nil, nil, err
 	}
-	return readMap(resp.Body)
+	return data, resp.Header, nil
 }
 
-func (rc *remoteClient) post(ctx context.Context, loc string, body io.Reader) error {
+func (rc *remoteClient) post(ctx context.Context, loc string, body io.Reader, compressed bool) error {
 	parsed, err := url.Parse(loc)
 	if err != nil {
 		return err
@@ -262,17 +515,33 @@ func (rc *remoteClient) post(ctx context.Context, loc string, body io.Reader) er
 		return err
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	resp, err := rc.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
-	} else if resp.StatusCode != http.StatusOK {
+	} else if resp.StatusCode == http.StatusGone {
 		resp.Body.Close()
-		return fmt.Errorf("remote: unexpected response status: %v: %v", loc, resp.Status)
+		return ErrTransactionTimedOut
+	} else if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return statusError(loc, resp)
 	}
 	resp.Body.Close()
 	return nil
 }
 
+// statusError returns the error for an unexpected status in `resp`, including
+// any explanation that the server gave in the body.
+func statusError(loc string, resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if msg := strings.TrimSpace(string(msg)); msg != "" {
+		return fmt.Errorf("remote: unexpected response status: %v: %v: %v", loc, resp.Status, msg)
+	}
+	return fmt.Errorf("remote: unexpected response status: %v: %v", loc, resp.Status)
+}
+
 func (rc *remoteClient) getId() string {
 	rc.mu.Lock()
 	id := rc.id
@@ -280,27 +549,38 @@ func (rc *remoteClient) getId() string {
 	return id
 }
 
-// maintain pings the remote server every 3s if there's an open transaction, to
-// let the server know that we're still alive.
+// maintain pings the remote server every `pingInterval` if there's an open
+// transaction, to let the server know that we're still alive. It stops when the
+// client is closed.
 func (rc *remoteClient) maintain() {
 	ctx := context.Background()
+	timedOut := ""
 
 	for {
-		time.Sleep(3 * time.Second)
+		select {
+		case <-rc.closed:
+			return
+		case <-time.After(rc.pingInterval):
+		}
 
 		id := rc.getId()
-		if id == "" {
+		if id == "" || id == timedOut {
 			continue
 		}
 
-		if err := rc.post(ctx, "ping?id="+id, nil); err != nil {
+		if err := rc.post(ctx, "ping?id="+id, nil, false); err == ErrTransactionTimedOut {
+			// Report this once, rather than on every ping until the
+			// transaction is ended.
+			logging.Error(err)
+			timedOut = id
+		} else if err != nil {
 			// Sometimes we'll ping a transaction that was closed after we got
 			// the current id but before the server saw our ping request. It's
 			// easiest to just ignore these errors.
 			if strings.HasSuffix(err.Error(), "401 Unauthorized") {
 				continue
 			}
-			log.Println(err)
+			logging.Error(err)
 		}
 	}
 }
@@ -321,10 +601,13 @@ func (rc *remoteClient) Start(ctx context.Context, prefetch []uint64) (map[uint6
 	for _, key := range prefetch {
 		loc += "&key=" + hex(key)
 	}
-	if rc.oram {
-		loc += "&oram=true"
+	if rc.oramSize > 0 {
+		loc += fmt.Sprintf("&oram=true&oram-size=%v", rc.oramSize)
+	}
+	if rc.readOnly {
+		loc += "&read-only=true"
 	}
-	data, err := rc.get(ctx, loc)
+	data, header, err := rc.get(ctx, loc)
 	if err != nil {
 		return nil, err
 	}
@@ -334,7 +617,21 @@ func (rc *remoteClient) Start(ctx context.Context, prefetch []uint64) (map[uint6
 		return nil, fmt.Errorf("remote: transaction already started")
 	}
 	rc.id = id
+	rc.compressCommit = rc.compress && header.Get(compressionHeader) == "gzip"
 	rc.mu.Unlock()
+
+	// Make sure that pings are frequent enough that the transaction won't be
+	// ended while it's still in use.
+	if raw := header.Get(transactionTimeoutHeader); raw != "" {
+		timeout, err := time.ParseDuration(raw)
+		if err != nil {
+			rc.Commit(ctx, nil)
+			return nil, fmt.Errorf("remote: failed to parse server's transaction timeout: %v", err)
+		} else if rc.pingInterval >= timeout/2 {
+			rc.Commit(ctx, nil)
+			return nil, fmt.Errorf("remote: ping interval of %v must be less than half of the server's transaction timeout of %v", rc.pingInterval, timeout)
+		}
+	}
 	return data, nil
 }
 
@@ -357,77 +654,288 @@ func (rc *remoteClient) GetMany(ctx context.Context, keys []uint64) (map[uint64]
 	for _, key := range keys {
 		loc += "&key=" + hex(key)
 	}
-	return rc.get(ctx, loc)
+	data, _, err := rc.get(ctx, loc)
+	return data, err
 }
 
 func (rc *remoteClient) Commit(ctx context.Context, writes map[uint64]WriteData) error {
-	id := rc.getId()
+	rc.mu.Lock()
+	id, compressed := rc.id, rc.compressCommit
+	rc.mu.Unlock()
 	if id == "" {
 		return fmt.Errorf("remote: transaction not active")
 	}
-	data := make(map[uint64][]byte)
-	for key, wr := range writes {
+	var readOnlyErr error
+	if rc.readOnly && len(writes) > 0 {
+		// Still end the transaction, so the server isn't left waiting for it
+		// to time out.
+		writes, readOnlyErr = nil, ErrReadOnly
+	}
+	for _, wr := range writes {
 		if wr.Type < 0 || wr.Type > 255 {
 			return fmt.Errorf("remote: write type is out of bounds")
 		}
-		data[key] = append([]byte{byte(wr.Type)}, wr.Data...)
 	}
-	buff := &bytes.Buffer{}
-	if err := writeMap(buff, data); err != nil {
-		return err
-	}
-	err := rc.post(ctx, "commit?id="+id, buff)
+	// The body is encoded while it's being sent, so that a large commit isn't
+	// copied into memory first. Closing the reader stops the encoder if the
+	// request ends early, and the encoder is waited for so that it's done with
+	// `writes` by the time this returns. Since the body is a pipe, the request
+	// has no GetBody and can't be replayed, so the HTTP client never retries
+	// it, even on a kept-alive connection that the server had closed; the
+	// commit fails instead.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		pw.CloseWithError(writeCommit(pw, writes, compressed))
+		close(done)
+	}()
+	err := rc.post(ctx, "commit?id="+id, pr, compressed)
+	pr.Close()
+	<-done
 
 	rc.mu.Lock()
 	rc.id = ""
 	rc.mu.Unlock()
+	if readOnlyErr != nil {
+		return readOnlyErr
+	}
 	return err
 }
 
+// Close stops pinging the server and closes idle connections to it. It doesn't
+// end an open transaction; the server does that itself once the pings stop.
+func (rc *remoteClient) Close() error {
+	close(rc.closed)
+	rc.client.CloseIdleConnections()
+	return nil
+}
+
 type remoteServer struct {
 	requestMu     sync.Mutex
 	transactionMu sync.Mutex
 	transactionId string
 	lastCheckIn   time.Time
 
-	base ReliableStorage
-	oram bool
+	// readers maps the id of each read-only transaction sharing the current
+	// snapshot to when that client last checked in. writersWaiting is the
+	// number of read-write transactions waiting to start, which stops new
+	// readers from joining the snapshot and starving them.
+	readers        map[string]time.Time
+	writersWaiting int
+
+	// timeout is how long a transaction may go without the client checking
+	// in. timedOut maps the ids of transactions that were ended because of it
+	// to when that happened, so that their clients can be told why.
+	timeout  time.Duration
+	timedOut map[string]time.Time
+
+	base     ReliableStorage
+	oramSize int64
 }
 
 // NewRemoteServer wraps a ReliableStorage implementation in an HTTP handler,
 // allowing remote clients to make requests to it.
 //
+// Read-write transactions have exclusive access to `base`. Read-only
+// transactions share a single underlying transaction, so they all see the same
+// consistent snapshot of the data, and writers wait until the last of them has
+// finished. New read-only transactions only join an existing snapshot while
+// there are no writers waiting.
+//
+// A transaction is ended if its client goes longer than `timeout` without
+// pinging it, or 5 seconds if `timeout` is zero. Any further requests in that
+// transaction fail with ErrTransactionTimedOut.
+//
+// If `base` uses ORAM, `oramSize` is the size of its blocks, and clients must
+// say that they're using ORAM with the same size. Otherwise it's zero.
+//
 // The corresponding client implementation is in NewRemoteClient.
-func NewRemoteServer(base ReliableStorage, transportKey string, oram bool) (*http.Server, error) {
-	cfg, err := generateConfig(transportKey, "utahfs-server")
+func NewRemoteServer(base ReliableStorage, transportKey string, oramSize int64, timeout time.Duration) (*http.Server, error) {
+	cfg, err := generateConfig(transportKey, serverHostname(""))
 	if err != nil {
 		return nil, err
 	}
-	rs := &remoteServer{base: base, oram: oram}
-	go rs.maintain()
+	return &http.Server{
+		Handler:   newRemoteServer(base, oramSize, timeout),
+		TLSConfig: cfg,
+	}, nil
+}
 
+// NewRemoteServerWithCerts is like NewRemoteServer, but authenticates with the
+// certificates in `certs` instead of ones derived from a transport key. Clients
+// must be from NewRemoteClientWithCerts, and have certificates issued by one of
+// the CAs in `certs`.
+func NewRemoteServerWithCerts(base ReliableStorage, certs TLSFiles, oramSize int64, timeout time.Duration) (*http.Server, error) {
+	cfg, err := certs.config()
+	if err != nil {
+		return nil, err
+	}
 	return &http.Server{
-		Handler:   rs,
+		Handler:   newRemoteServer(base, oramSize, timeout),
 		TLSConfig: cfg,
 	}, nil
 }
 
+func newRemoteServer(base ReliableStorage, oramSize int64, timeout time.Duration) *remoteServer {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	rs := &remoteServer{
+		readers: make(map[string]time.Time),
+
+		timeout:  timeout,
+		timedOut: make(map[string]time.Time),
+
+		base:     base,
+		oramSize: oramSize,
+	}
+	go rs.maintain()
+
+	return rs
+}
+
+// serverHostname returns the hostname in the server's certificate for the
+// repository `repo`, or for a server's only repository if `repo` is empty.
+func serverHostname(repo string) string {
+	if repo == "" {
+		return "utahfs-server"
+	}
+	return repo + ".utahfs-server"
+}
+
+// RemoteRepo is one of the repositories hosted by a server from
+// NewMultiRemoteServer. Its fields are the same as the arguments to
+// NewRemoteServer, or to NewRemoteServerWithCerts if Certs isn't nil.
+type RemoteRepo struct {
+	Base         ReliableStorage
+	TransportKey string
+	Certs        *TLSFiles
+	ORAMSize     int64
+	Timeout      time.Duration
+}
+
+// NewMultiRemoteServer returns a server like NewRemoteServer, that hosts several
+// independent repositories. Clients choose a repository by name, which is sent
+// as part of the TLS handshake so that the server can authenticate them with
+// that repository's transport key. A client only has access to the repository
+// it authenticated to, and each repository has its own transactions that don't
+// affect the others.
+func NewMultiRemoteServer(repos map[string]RemoteRepo) (*http.Server, error) {
+	cfgs := make(map[string]*tls.Config)
+	handler := make(multiServer)
+	for name, repo := range repos {
+		if !validRepoName(name) {
+			return nil, fmt.Errorf("remote: repository name must be lowercase letters, digits, and dashes: %q", name)
+		}
+		host := serverHostname(name)
+		var (
+			cfg *tls.Config
+			err error
+		)
+		if repo.Certs != nil {
+			cfg, err = repo.Certs.config()
+		} else {
+			cfg, err = generateConfig(repo.TransportKey, host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+		cfgs[host] = cfg
+		handler[host] = newRemoteServer(repo.Base, repo.ORAMSize, repo.Timeout)
+	}
+
+	return &http.Server{
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				cfg, ok := cfgs[hello.ServerName]
+				if !ok {
+					return nil, fmt.Errorf("remote: client asked for unknown repository: %q", hello.ServerName)
+				}
+				return cfg, nil
+			},
+			// The certificate is always chosen by GetConfigForClient, but
+			// http.Server expects there to be a way to get one here.
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cfg, ok := cfgs[hello.ServerName]
+				if !ok {
+					return nil, fmt.Errorf("remote: client asked for unknown repository: %q", hello.ServerName)
+				} else if cfg.GetCertificate != nil {
+					return cfg.GetCertificate(hello)
+				}
+				return &cfg.Certificates[0], nil
+			},
+		},
+	}, nil
+}
+
+func validRepoName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// multiServer routes each request to the repository that its connection was
+// authenticated for, by the hostname the client asked for in its handshake.
+type multiServer map[string]*remoteServer
+
+func (ms multiServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.TLS == nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rs, ok := ms[req.TLS.ServerName]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	rs.ServeHTTP(rw, req)
+}
+
 // maintain cancels transactions that have gone too long since the client last
 // checked in.
 func (rs *remoteServer) maintain() {
 	ctx := context.Background()
+	interval := time.Second
+	if rs.timeout/5 < interval {
+		interval = rs.timeout / 5
+	}
 
 	for {
-		time.Sleep(1 * time.Second)
+		time.Sleep(interval)
 
 		rs.requestMu.Lock()
-		if rs.transactionId != "" && time.Since(rs.lastCheckIn) > 5*time.Second {
+		if rs.transactionId != "" && time.Since(rs.lastCheckIn) > rs.timeout {
+			logging.Warnf("remote: ending transaction that hasn't been pinged in %v", time.Since(rs.lastCheckIn))
+			rs.timedOut[rs.transactionId] = time.Now()
 			rs.transactionMu.Unlock()
 			rs.transactionId = ""
 			rs.lastCheckIn = time.Time{}
 
 			if err := rs.base.Commit(ctx, nil); err != nil {
-				log.Println(err)
+				logging.Error(err)
+			}
+		}
+		for id, lastCheckIn := range rs.readers {
+			if time.Since(lastCheckIn) > rs.timeout {
+				rs.timedOut[id] = time.Now()
+				if err := rs.endRead(ctx, id); err != nil {
+					logging.Error(err)
+				}
+			}
+		}
+		// Clients are only expected to make a few more requests after their
+		// transaction ends, so there's no need to remember it for long.
+		for id, ended := range rs.timedOut {
+			if time.Since(ended) > 10*rs.timeout {
+				delete(rs.timedOut, id)
 			}
 		}
 		rs.requestMu.Unlock()
@@ -435,9 +943,15 @@ func (rs *remoteServer) maintain() {
 }
 
 func (rs *remoteServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Health checks are answered without taking the lock, so that they don't
+	// have to wait on whatever the current transaction is doing.
+	if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/healthz") {
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
 	query, _ := url.ParseQuery(req.URL.RawQuery)
 	if query.Get("id") == "" {
-		log.Println("remote: client provided no transaction id")
+		logging.Warn("remote: client provided no transaction id")
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -460,10 +974,88 @@ func (rs *remoteServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// authorized returns true if `id` is the id of an active transaction.
+func (rs *remoteServer) authorized(id string) bool {
+	if id == rs.transactionId {
+		return true
+	}
+	_, ok := rs.readers[id]
+	return ok
+}
+
+// unauthorized responds to a request in a transaction that isn't active. If the
+// transaction timed out, the client is told so.
+func (rs *remoteServer) unauthorized(rw http.ResponseWriter, id string) {
+	if _, ok := rs.timedOut[id]; ok {
+		rw.WriteHeader(http.StatusGone)
+		return
+	}
+	rw.WriteHeader(http.StatusUnauthorized)
+}
+
+// endRead removes `id` from the set of read-only transactions sharing the
+// current snapshot, and ends the underlying transaction if it was the last one.
+func (rs *remoteServer) endRead(ctx context.Context, id string) error {
+	delete(rs.readers, id)
+	if len(rs.readers) > 0 {
+		return nil
+	}
+	err := rs.base.Commit(ctx, nil)
+	rs.transactionMu.Unlock()
+	return err
+}
+
 func (rs *remoteServer) handleStart(rw http.ResponseWriter, req *http.Request) {
+	// Ensure that server and client agree on the use of ORAM, and on the size
+	// of its blocks. Older clients don't send the size.
+	clientORAM, clientSize := req.Form.Get("oram") == "true", req.Form.Get("oram-size")
+	msg := ""
+	if (rs.oramSize > 0) != clientORAM {
+		msg = fmt.Sprintf("client and server disagree on whether oram is enabled: client %v, server %v", clientORAM, rs.oramSize > 0)
+	} else if clientORAM && clientSize != "" && clientSize != fmt.Sprint(rs.oramSize) {
+		msg = fmt.Sprintf("client and server oram parameters differ: client's blocks are %v bytes and server's are %v bytes, so num-ptrs and data-size must be the same on both", clientSize, rs.oramSize)
+	}
+	if msg != "" {
+		logging.Error(msg)
+		http.Error(rw, msg, http.StatusBadRequest)
+		return
+	}
+	prefetch, err := parseKeys(req.Form["key"])
+	if err != nil {
+		logging.Error(err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id, readOnly := req.Form.Get("id"), req.Form.Get("read-only") == "true"
+	if rs.authorized(id) {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Join the current snapshot, if there is one that can be shared.
+	if readOnly && len(rs.readers) > 0 && rs.writersWaiting == 0 {
+		data, err := rs.base.GetMany(req.Context(), prefetch)
+		if err != nil {
+			logging.Error(err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rs.readers[id] = time.Now()
+
+		rw.Header().Set(transactionTimeoutHeader, rs.timeout.String())
+		writeResponse(rw, req, data)
+		return
+	}
+
+	if !readOnly {
+		rs.writersWaiting++
+	}
 	rs.requestMu.Unlock()
 	rs.transactionMu.Lock()
 	rs.requestMu.Lock()
+	if !readOnly {
+		rs.writersWaiting--
+	}
 
 	// In case we were hanging for a long time on the lock, quickly check if the
 	// client is still here.
@@ -474,68 +1066,67 @@ func (rs *remoteServer) handleStart(rw http.ResponseWriter, req *http.Request) {
 	default:
 	}
 
-	// Ensure that server and client agree on the use of ORAM.
-	clientORAM := req.Form.Get("oram") == "true"
-	if rs.oram != clientORAM {
-		rs.transactionMu.Unlock()
-		log.Println("client and server disagree on whether oram is enabled")
-		rw.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
 	// Start a new transaction, and record initial information about it.
-	prefetch, err := parseKeys(req.Form["key"])
-	if err != nil {
-		rs.transactionMu.Unlock()
-		log.Println(err)
-		rw.WriteHeader(http.StatusBadRequest)
-		return
-	}
 	data, err := rs.base.Start(req.Context(), prefetch)
 	if err != nil {
 		rs.transactionMu.Unlock()
-		log.Println(err)
+		logging.Error(err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	rs.transactionId = req.Form.Get("id")
-	rs.lastCheckIn = time.Now()
-
-	rw.WriteHeader(http.StatusOK)
-	if err := writeMap(rw, data); err != nil {
-		log.Println(err)
-		return
+	if readOnly {
+		rs.readers[id] = time.Now()
+	} else {
+		rs.transactionId = id
+		rs.lastCheckIn = time.Now()
 	}
+
+	rw.Header().Set(transactionTimeoutHeader, rs.timeout.String())
+	writeResponse(rw, req, data)
 }
 
 func (rs *remoteServer) handleGet(rw http.ResponseWriter, req *http.Request) {
-	if req.Form.Get("id") != rs.transactionId {
-		rw.WriteHeader(http.StatusUnauthorized)
+	if id := req.Form.Get("id"); !rs.authorized(id) {
+		rs.unauthorized(rw, id)
 		return
 	}
 
 	keys, err := parseKeys(req.Form["key"])
 	if err != nil {
-		log.Println(err)
+		logging.Error(err)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	data, err := rs.base.GetMany(req.Context(), keys)
 	if err != nil {
-		log.Println(err)
+		logging.Error(err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	rw.WriteHeader(http.StatusOK)
-	if err := writeMap(rw, data); err != nil {
-		log.Println(err)
-		return
-	}
+	writeResponse(rw, req, data)
 }
 
 func (rs *remoteServer) handleCommit(rw http.ResponseWriter, req *http.Request) {
-	if req.Form.Get("id") != rs.transactionId {
-		rw.WriteHeader(http.StatusUnauthorized)
+	id := req.Form.Get("id")
+	if _, ok := rs.readers[id]; ok {
+		data, err := readCommit(req.Header, req.Body)
+		if endErr := rs.endRead(req.Context(), id); endErr != nil {
+			logging.Error(endErr)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if err != nil {
+			logging.Error(err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		} else if len(data) > 0 {
+			logging.Warn("remote: read-only client attempted to commit writes")
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		return
+	} else if id != rs.transactionId {
+		rs.unauthorized(rw, id)
 		return
 	}
 
@@ -545,18 +1136,14 @@ func (rs *remoteServer) handleCommit(rw http.ResponseWriter, req *http.Request)
 		rs.lastCheckIn = time.Time{}
 	}()
 
-	data, err := readMap(req.Body)
+	writes, err := readCommit(req.Header, req.Body)
 	if err != nil {
-		log.Println(err)
+		logging.Error(err)
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	writes := make(map[uint64]WriteData)
-	for key, val := range data {
-		writes[key] = WriteData{val[1:], DataType(val[0])}
-	}
 	if err := rs.base.Commit(req.Context(), writes); err != nil {
-		log.Println(err)
+		logging.Error(err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -565,8 +1152,12 @@ func (rs *remoteServer) handleCommit(rw http.ResponseWriter, req *http.Request)
 }
 
 func (rs *remoteServer) handlePing(rw http.ResponseWriter, req *http.Request) {
-	if req.Form.Get("id") != rs.transactionId {
-		rw.WriteHeader(http.StatusUnauthorized)
+	id := req.Form.Get("id")
+	if _, ok := rs.readers[id]; ok {
+		rs.readers[id] = time.Now()
+		return
+	} else if id != rs.transactionId {
+		rs.unauthorized(rw, id)
 		return
 	}
 	rs.lastCheckIn = time.Now()
@@ -0,0 +1,132 @@
+package persistent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/utahfs/internal/logging"
+)
+
+// derivedCAName is the common name of the CA certificate that generateConfig
+// derives from a transport key. It's how each end recognizes that the other is
+// using derived certificates.
+const derivedCAName = "utahfs-ca"
+
+// TLSFiles are the paths of PEM-encoded files with certificates from an
+// existing PKI, which the client and server can authenticate each other with
+// instead of certificates derived from a transport key.
+//
+// The certificate and key are read again whenever either file changes, so they
+// can be rotated without a restart. The CA file is only read once.
+type TLSFiles struct {
+	Cert string // Certificate chain to present to the other end.
+	Key  string // Private key of the certificate.
+	CA   string // CA certificates that the other end's certificate must be issued by.
+}
+
+func (tf TLSFiles) config() (*tls.Config, error) {
+	if tf.Cert == "" || tf.Key == "" || tf.CA == "" {
+		return nil, fmt.Errorf("remote: certificate, key, and ca files must all be given")
+	}
+	rawCA, err := ioutil.ReadFile(tf.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rawCA) {
+		return nil, fmt.Errorf("remote: no certificates found in ca file %v", tf.CA)
+	}
+	kp := &keyPair{certFile: tf.Cert, keyFile: tf.Key}
+	if _, err := kp.get(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return kp.get()
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return kp.get()
+		},
+
+		RootCAs:   pool,
+		ClientCAs: pool,
+
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// keyPair is a certificate and private key loaded from files, which are loaded
+// again if they've been modified since.
+type keyPair struct {
+	certFile, keyFile string
+
+	mu              sync.Mutex
+	certMod, keyMod time.Time
+	cert            *tls.Certificate
+}
+
+func (kp *keyPair) get() (*tls.Certificate, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	certInfo, err := os.Stat(kp.certFile)
+	if err != nil {
+		return kp.stale(err)
+	}
+	keyInfo, err := os.Stat(kp.keyFile)
+	if err != nil {
+		return kp.stale(err)
+	} else if kp.cert != nil && certInfo.ModTime().Equal(kp.certMod) && keyInfo.ModTime().Equal(kp.keyMod) {
+		return kp.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return kp.stale(err)
+	}
+	kp.certMod, kp.keyMod, kp.cert = certInfo.ModTime(), keyInfo.ModTime(), &cert
+	return kp.cert, nil
+}
+
+// stale returns the last certificate that was loaded successfully, if there is
+// one, after failing to check for a newer one. A rotation that's half-finished
+// shouldn't stop new connections from being made.
+func (kp *keyPair) stale(err error) (*tls.Certificate, error) {
+	if kp.cert == nil {
+		return nil, fmt.Errorf("remote: failed to load certificate: %v", err)
+	}
+	logging.Warnf("remote: failed to reload certificate, using the previous one: %v", err)
+	return kp.cert, nil
+}
+
+// verifyServer checks that the server's certificate chain in `cs` is valid for
+// `name` and issued by one of `roots`. If it isn't, and the certificate looks
+// like the server is authenticating a different way to the client, the error
+// says so instead of just that verification failed.
+func verifyServer(cs tls.ConnectionState, roots *x509.CertPool, name string, derived bool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("remote: server presented no certificate")
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool(), DNSName: name}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	if err == nil {
+		return nil
+	}
+
+	serverDerived := cs.PeerCertificates[0].Issuer.CommonName == derivedCAName
+	if serverDerived && !derived {
+		return fmt.Errorf("remote: server authenticates with a transport key, but client was given certificate files")
+	} else if !serverDerived && derived {
+		return fmt.Errorf("remote: server authenticates with certificate files, but client was given a transport key")
+	}
+	return fmt.Errorf("remote: failed to verify server's certificate: %v", err)
+}
@@ -0,0 +1,164 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// testPKI writes a CA certificate, and a certificate and key issued by it for
+// each of `names`, to `dir`.
+func testPKI(t *testing.T, dir string, names ...string) {
+	writePEM := func(name, typ string, der []byte) {
+		raw := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+		if err := ioutil.WriteFile(path.Join(dir, name), raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTempl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-ca"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caRaw, err := x509.CreateCertificate(rand.Reader, caTempl, caTempl, caPriv.Public(), caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM("ca.pem", "CERTIFICATE", caRaw)
+
+	for i, name := range names {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templ := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, templ, caCert, priv.Public(), caPriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(name+".pem", "CERTIFICATE", raw)
+		writePEM(name+"-key.pem", "EC PRIVATE KEY", der)
+	}
+}
+
+func TestRemoteCerts(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testPKI(t, dir, "server", "client")
+	files := func(name string) TLSFiles {
+		return TLSFiles{
+			Cert: path.Join(dir, name+".pem"),
+			Key:  path.Join(dir, name+"-key.pem"),
+			CA:   path.Join(dir, "ca.pem"),
+		}
+	}
+
+	start := func(client ReliableStorage) error {
+		if _, err := client.Start(ctx, nil); err != nil {
+			return err
+		}
+		return client.Commit(ctx, map[uint64]WriteData{1: WriteData{[]byte("hello"), Content}})
+	}
+
+	srv, err := NewRemoteServerWithCerts(NewSimpleReliable(NewMemory()), files("server"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	client, err := NewRemoteClientWithCerts(files("client"), ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := start(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that derives its certificates from a transport key should be
+	// told that the server doesn't.
+	derived, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := start(derived); err == nil || !strings.Contains(err.Error(), "server authenticates with certificate files") {
+		t.Fatalf("unexpected error from client with transport key: %v", err)
+	}
+
+	// And the other way around.
+	srv2, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts2 := httptest.NewUnstartedServer(srv2.Handler)
+	ts2.TLS = srv2.TLSConfig
+	ts2.StartTLS()
+	defer ts2.Close()
+
+	client2, err := NewRemoteClientWithCerts(files("client"), ts2.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := start(client2); err == nil || !strings.Contains(err.Error(), "server authenticates with a transport key") {
+		t.Fatalf("unexpected error from client with certificate files: %v", err)
+	}
+
+	// A client certificate that isn't issued by the server's CA is rejected.
+	otherDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherDir)
+	testPKI(t, otherDir, "client")
+	other := files("client")
+	other.Cert, other.Key = path.Join(otherDir, "client.pem"), path.Join(otherDir, "client-key.pem")
+	client3, err := NewRemoteClientWithCerts(other, ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := start(client3); err == nil {
+		t.Fatal("expected client certificate from another ca to be rejected")
+	}
+}
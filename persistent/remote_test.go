@@ -3,8 +3,19 @@ package persistent
 import (
 	"testing"
 
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,7 +26,9 @@ func TestRemoteConnections(t *testing.T) {
 	go func() {
 		cfg, err := generateConfig("myPassword", "utahfs-test-server")
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			mu.Unlock()
+			return
 		}
 		s := http.Server{
 			Addr: "localhost:62849",
@@ -30,7 +43,7 @@ func TestRemoteConnections(t *testing.T) {
 			TLSConfig: cfg,
 		}
 		mu.Unlock()
-		t.Fatal(s.ListenAndServeTLS("", ""))
+		t.Error(s.ListenAndServeTLS("", ""))
 	}()
 
 	mu.Lock()
@@ -53,3 +66,496 @@ func TestRemoteConnections(t *testing.T) {
 		t.Fatalf("unexpected response status: %v", resp.Status)
 	}
 }
+
+func TestRemoteReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	newClient := func(readOnly bool) ReliableStorage {
+		client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{ReadOnly: readOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	writer, reader1, reader2 := newClient(false), newClient(true), newClient(true)
+
+	// Write some initial data.
+	if _, err := writer.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := writer.Commit(ctx, map[uint64]WriteData{1: {[]byte("hello"), Content}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both readers should be able to start transactions at the same time.
+	if _, err := reader1.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := reader2.Start(ctx, []uint64{1})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data[1]) != "hello" {
+		t.Fatal("data not equal to expected")
+	}
+
+	// A writer should block until both readers are done.
+	done := make(chan error, 1)
+	go func() {
+		_, err := writer.Start(ctx, nil)
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	if err := reader1.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("writer started while a reader was still active")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Readers shouldn't be able to commit writes.
+	err = reader2.Commit(ctx, map[uint64]WriteData{1: {[]byte("oops"), Content}})
+	if err != ErrReadOnly {
+		t.Fatalf("expected read-only error, got: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for writer to start")
+	}
+
+	val, err := writer.Get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(val) != "hello" {
+		t.Fatal("data not equal to expected")
+	} else if err := writer.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteConnectionReuse(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.EnableHTTP2 = true
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := client.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if _, err := client.Get(ctx, 1); err != nil && err != ErrObjectNotFound {
+			t.Fatal(err)
+		} else if err := client.Commit(ctx, map[uint64]WriteData{1: {[]byte("hello"), Content}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Fatalf("expected one connection to be reused, but %v were opened", conns)
+	}
+}
+
+func TestRemoteORAMMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	start := func(oramSize int64) error {
+		client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{ORAMSize: oramSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Start(ctx, nil); err != nil {
+			return err
+		}
+		return client.Commit(ctx, nil)
+	}
+
+	// Clients with different parameters should be refused with an error that
+	// says why, without leaving the server locked.
+	if err := start(2048); err == nil || !strings.Contains(err.Error(), "client's blocks are 2048 bytes and server's are 1024 bytes") {
+		t.Fatalf("expected error about mismatched block sizes, got: %v", err)
+	} else if err := start(0); err == nil || !strings.Contains(err.Error(), "disagree on whether oram is enabled") {
+		t.Fatalf("expected error about oram being disabled, got: %v", err)
+	} else if err := start(1024); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingReader counts the number of bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n *int
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	*cr.n += n
+	return n, err
+}
+
+func TestRemoteCompression(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		commitSize     int
+		commitEncoding string
+	)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/commit") {
+			req.Body = countingReader{req.Body, &commitSize}
+			commitEncoding = req.Header.Get("Content-Encoding")
+		}
+		srv.Handler.ServeHTTP(rw, req)
+	}))
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Commit a lot of small, encrypted blocks, like a metadata-heavy workload
+	// would, with and without compression.
+	writes := make(map[uint64]WriteData)
+	for i := uint64(0); i < 1000; i++ {
+		data := make([]byte, 128)
+		rand.Read(data)
+		writes[i] = WriteData{data, Metadata}
+	}
+	commit := func(compress bool) int {
+		client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{Compress: compress})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitSize = 0
+		if _, err := client.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := client.Commit(ctx, writes); err != nil {
+			t.Fatal(err)
+		} else if compress != (commitEncoding == "gzip") {
+			t.Fatalf("unexpected encoding of commit: %q", commitEncoding)
+		}
+
+		if _, err := client.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Commit(ctx, nil)
+		data, err := client.GetMany(ctx, []uint64{0, 500, 999})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ptr, val := range data {
+			if !bytes.Equal(val, writes[ptr].Data) {
+				t.Fatalf("unexpected data for block %v", ptr)
+			}
+		}
+		if len(data) != 3 {
+			t.Fatalf("unexpected number of blocks returned: %v", len(data))
+		}
+		return commitSize
+	}
+	plain, compressed := commit(false), commit(true)
+	t.Logf("commit of %v blocks: %v bytes uncompressed, %v bytes compressed", len(writes), plain, compressed)
+}
+
+func TestRemoteStreamingCommit(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		commitLength int64
+		reject       bool
+	)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/commit") {
+			commitLength = req.ContentLength
+			if reject {
+				// Fail without reading the body, like a server that's
+				// shutting down might.
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		srv.Handler.ServeHTTP(rw, req)
+	}))
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Commit more data than fits in the buffers between the client and server.
+	writes := make(map[uint64]WriteData)
+	for i := uint64(0); i < 512; i++ {
+		data := make([]byte, 32*1024)
+		rand.Read(data)
+		writes[i] = WriteData{data, Content}
+	}
+	writes[512] = WriteData{[]byte{}, Metadata}
+
+	for _, compress := range []bool{false, true} {
+		client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{Compress: compress})
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := client.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		} else if err := client.Commit(ctx, writes); err != nil {
+			t.Fatal(err)
+		} else if commitLength != -1 {
+			t.Fatalf("expected commit to be streamed, but it had length %v", commitLength)
+		}
+
+		if _, err := client.Start(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		data, err := client.GetMany(ctx, []uint64{0, 511, 512})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := client.Commit(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data[0], writes[0].Data) || !bytes.Equal(data[511], writes[511].Data) {
+			t.Fatal("unexpected data returned")
+		} else if len(data[512]) != 0 {
+			t.Fatal("unexpected data returned for empty write")
+		}
+	}
+
+	// A commit that the server refuses before reading it should fail, not
+	// hang.
+	client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := client.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	reject = true
+	if err := client.Commit(ctx, writes); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+}
+
+// allocated returns the number of bytes allocated while running `fn`.
+func allocated(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestRemoteCommitMemory(t *testing.T) {
+	writes := make(map[uint64]WriteData)
+	size := uint64(0)
+	for i := uint64(0); i < 256; i++ {
+		data := make([]byte, 64*1024)
+		rand.Read(data)
+		writes[i] = WriteData{data, Content}
+		size += uint64(len(data))
+	}
+
+	for _, compress := range []bool{false, true} {
+		f, err := ioutil.TempFile("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		// The client encodes the commit as it's written, without copying it.
+		var encodeErr error
+		if n := allocated(func() { encodeErr = writeCommit(f, writes, compress) }); encodeErr != nil {
+			t.Fatal(encodeErr)
+		} else if n > size/4 {
+			t.Fatalf("compress=%v: encoding a commit of %v bytes allocated %v bytes", compress, size, n)
+		}
+
+		// The server only holds the one copy of it that's committed.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{}
+		if compress {
+			header.Set("Content-Encoding", "gzip")
+		}
+		var (
+			decoded   map[uint64]WriteData
+			decodeErr error
+		)
+		if n := allocated(func() { decoded, decodeErr = readCommit(header, f) }); decodeErr != nil {
+			t.Fatal(decodeErr)
+		} else if n > size*3/2 {
+			t.Fatalf("compress=%v: decoding a commit of %v bytes allocated %v bytes", compress, size, n)
+		} else if len(decoded) != len(writes) || !bytes.Equal(decoded[7].Data, writes[7].Data) {
+			t.Fatalf("compress=%v: commit decoded incorrectly", compress)
+		}
+	}
+}
+
+func TestRemoteTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewRemoteServer(NewSimpleReliable(NewMemory()), "myPassword", 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropPings int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/ping") && atomic.LoadInt32(&dropPings) == 1 {
+			return
+		}
+		srv.Handler.ServeHTTP(rw, req)
+	}))
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// A client that doesn't ping often enough should refuse to start a
+	// transaction, and shouldn't leave the server locked.
+	slow, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{PingInterval: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := slow.Start(ctx, nil); err == nil {
+		t.Fatal("expected transaction with slow pings to fail")
+	}
+
+	client, err := NewRemoteClient("myPassword", ts.URL+"/", RemoteClientOptions{PingInterval: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := client.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	// A transaction that's still being pinged should outlive the timeout.
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := client.GetMany(ctx, []uint64{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the pings stop making it to the server, the transaction should be
+	// ended and the client told why.
+	atomic.StoreInt32(&dropPings, 1)
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := client.GetMany(ctx, []uint64{1}); err != ErrTransactionTimedOut {
+		t.Fatalf("expected timeout error, got: %v", err)
+	} else if err := client.Commit(ctx, nil); err != ErrTransactionTimedOut {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+
+	atomic.StoreInt32(&dropPings, 0)
+	if _, err := client.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := client.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiRemoteServer(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := NewMultiRemoteServer(map[string]RemoteRepo{
+		"a": {Base: NewSimpleReliable(NewMemory()), TransportKey: "passwordA"},
+		"b": {Base: NewSimpleReliable(NewMemory()), TransportKey: "passwordB"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	newClient := func(transportKey, repo string) ReliableStorage {
+		client, err := NewRemoteClient(transportKey, ts.URL+"/", RemoteClientOptions{Repo: repo})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	a, b := newClient("passwordA", "a"), newClient("passwordB", "b")
+
+	// Each repository has its own transactions, so both clients can have one
+	// open at once, and neither sees the other's data.
+	if _, err := a.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := b.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if err := a.Commit(ctx, map[uint64]WriteData{1: {[]byte("hello"), Content}}); err != nil {
+		t.Fatal(err)
+	} else if err := b.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := b.Get(ctx, 1); err != ErrObjectNotFound {
+		t.Fatalf("expected data to be isolated, got: %v", err)
+	} else if err := b.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Start(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else if val, err := a.Get(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if string(val) != "hello" {
+		t.Fatal("data not equal to expected")
+	} else if err := a.Commit(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients can't use a repository without its transport key, or one that
+	// doesn't exist.
+	if _, err := newClient("passwordB", "a").Start(ctx, nil); err == nil {
+		t.Fatal("accessed repository with the wrong transport key")
+	} else if _, err := newClient("passwordA", "c").Start(ctx, nil); err == nil {
+		t.Fatal("accessed repository that doesn't exist")
+	} else if _, err := newClient("passwordA", "").Start(ctx, nil); err == nil {
+		t.Fatal("accessed repository without naming it")
+	}
+}
@@ -3,7 +3,9 @@ package persistent
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -41,24 +43,45 @@ func NewS3(appId, appKey, bucket, url, region string) (ObjectStorage, error) {
 }
 
 func (s *s3Client) Get(ctx context.Context, key string) ([]byte, error) {
-	res, err := s.client.GetObject(&s3.GetObjectInput{
+	data, _, err := s.GetIfChanged(ctx, key, "")
+	return data, err
+}
+
+func (s *s3Client) GetWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	return s.GetIfChanged(ctx, key, "")
+}
+
+func (s *s3Client) GetIfChanged(ctx context.Context, key, etag string) ([]byte, string, error) {
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	res, err := s.client.GetObjectWithContext(ctx, input)
 	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
 		S3Ops.WithLabelValues("get", "true").Inc()
-		return nil, ErrObjectNotFound
+		return nil, "", ErrObjectNotFound
+	} else if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotModified {
+		S3Ops.WithLabelValues("get", "true").Inc()
+		return nil, "", ErrNotModified
 	} else if err != nil {
 		S3Ops.WithLabelValues("get", "false").Inc()
-		return nil, err
+		return nil, "", err
 	}
+	defer res.Body.Close()
+
 	data, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		S3Ops.WithLabelValues("get", "false").Inc()
-		return nil, err
+		return nil, "", err
+	} else if res.ContentLength != nil && *res.ContentLength != int64(len(data)) {
+		S3Ops.WithLabelValues("get", "false").Inc()
+		return nil, "", fmt.Errorf("s3: object %v was truncated: expected %v bytes, got %v", key, *res.ContentLength, len(data))
 	}
 	S3Ops.WithLabelValues("get", "true").Inc()
-	return data, nil
+	return data, aws.StringValue(res.ETag), nil
 }
 
 func (s *s3Client) Set(ctx context.Context, key string, data []byte, _ DataType) error {
@@ -76,6 +99,35 @@ func (s *s3Client) Set(ctx context.Context, key string, data []byte, _ DataType)
 	return nil
 }
 
+// SetIfMatch relies on the If-Match and If-None-Match headers, which not every
+// S3-compatible service enforces. NewSharedReliable checks that they are
+// before trusting them.
+func (s *s3Client) SetIfMatch(ctx context.Context, key string, data []byte, _ DataType, etag string) error {
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+	req.SetContext(ctx)
+
+	err := req.Send()
+	if rerr, ok := err.(awserr.RequestFailure); ok && (rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict) {
+		S3Ops.WithLabelValues("set", "true").Inc()
+		return ErrPreconditionFailed
+	} else if err != nil {
+		S3Ops.WithLabelValues("set", "false").Inc()
+		return err
+	}
+
+	S3Ops.WithLabelValues("set", "true").Inc()
+	return nil
+}
+
 func (s *s3Client) Delete(ctx context.Context, key string) error {
 	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -89,3 +141,28 @@ func (s *s3Client) Delete(ctx context.Context, key string) error {
 	S3Ops.WithLabelValues("delete", "true").Inc()
 	return nil
 }
+
+func (s *s3Client) List(ctx context.Context, prefix string) ([]string, error) {
+	out := make([]string, 0)
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			out = append(out, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		S3Ops.WithLabelValues("list", "false").Inc()
+		return nil, err
+	}
+
+	S3Ops.WithLabelValues("list", "true").Inc()
+	return out, nil
+}
+
+func (s *s3Client) Close() error {
+	s.client.Config.HTTPClient.CloseIdleConnections()
+	return nil
+}
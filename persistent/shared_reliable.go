@@ -0,0 +1,281 @@
+package persistent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/utahfs/internal/logging"
+)
+
+// sharedLockKey is the key of the object that a client holds while it commits
+// to shared storage. It can't collide with the keys of blocks, which are hex.
+const sharedLockKey = "lock"
+
+// sharedLock is the content of the lock object. It's also a journal of the
+// commit being made, so that another client can finish the commit if the one
+// holding the lock stops before it's done.
+type sharedLock struct {
+	Taken  time.Time
+	Base   string
+	Writes map[uint64]WriteData
+}
+
+type sharedReliable struct {
+	base AtomicObjectStorage
+
+	// lease is how long a client may hold the lock for before another client
+	// may take it over and finish its commit.
+	lease time.Duration
+
+	// etag is the ETag of the tree head that the current transaction started
+	// from, or empty if there wasn't one.
+	etag string
+}
+
+// NewSharedReliable returns a ReliableStorage implementation for several
+// clients that share `base` without a remote server. Each commit takes a lock
+// in `base`, checks that the tree head hasn't changed since the transaction
+// started, stores the transaction alongside the lock so it can be finished by
+// another client if this one stops, applies it, and then writes the tree head
+// only if it still hasn't changed. If another client has the lock or has
+// changed the tree head, the commit fails with ErrConflict without writing
+// anything.
+//
+// `base` must support conditional writes. To check that it doesn't just ignore
+// the conditions, as some S3-compatible services do, a test object is written
+// with them first, and an error is returned if they're not enforced.
+func NewSharedReliable(base ObjectStorage) (ReliableStorage, error) {
+	if !supportsSetIfMatch(base) {
+		return nil, fmt.Errorf("storage: conditional writes aren't supported by %T", base)
+	}
+	atomic := base.(AtomicObjectStorage)
+	if err := probeSetIfMatch(context.Background(), atomic); err != nil {
+		return nil, err
+	}
+	return &sharedReliable{base: atomic, lease: 10 * time.Minute}, nil
+}
+
+// probeSetIfMatch writes a test object to `base` with conditions that should
+// and shouldn't hold, and returns an error if `base` doesn't enforce them.
+func probeSetIfMatch(ctx context.Context, base AtomicObjectStorage) error {
+	buff := make([]byte, 8)
+	if _, err := rand.Read(buff); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("probe-%x", buff)
+	defer base.Delete(ctx, key)
+
+	if err := base.SetIfMatch(ctx, key, []byte("1"), Metadata, ""); err != nil {
+		return fmt.Errorf("storage: failed to write test object: %v", err)
+	} else if err := base.SetIfMatch(ctx, key, []byte("2"), Metadata, ""); err != ErrPreconditionFailed {
+		return fmt.Errorf("storage: backend doesn't enforce If-None-Match on writes")
+	}
+	_, etag, err := base.GetWithETag(ctx, key)
+	if err != nil {
+		return fmt.Errorf("storage: failed to read test object: %v", err)
+	} else if err := base.SetIfMatch(ctx, key, []byte("3"), Metadata, etag); err != nil {
+		return fmt.Errorf("storage: failed to write test object: %v", err)
+	} else if err := base.SetIfMatch(ctx, key, []byte("4"), Metadata, etag); err != ErrPreconditionFailed {
+		return fmt.Errorf("storage: backend doesn't enforce If-Match on writes")
+	}
+	return nil
+}
+
+func (sr *sharedReliable) Start(ctx context.Context, prefetch []uint64) (map[uint64][]byte, error) {
+	head, etag, err := sr.base.GetWithETag(ctx, hex(0))
+	if err == ErrObjectNotFound {
+		head, etag = nil, ""
+	} else if err != nil {
+		return nil, err
+	}
+	sr.etag = etag
+
+	keys := make([]uint64, 0, len(prefetch))
+	for _, key := range prefetch {
+		if key != 0 {
+			keys = append(keys, key)
+		}
+	}
+	out, err := sr.GetMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	} else if head != nil && len(keys) < len(prefetch) {
+		out[0] = head
+	}
+	return out, nil
+}
+
+func (sr *sharedReliable) Get(ctx context.Context, key uint64) ([]byte, error) {
+	return sr.base.Get(ctx, hex(key))
+}
+
+func (sr *sharedReliable) GetMany(ctx context.Context, keys []uint64) (map[uint64][]byte, error) {
+	hexKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		hexKeys = append(hexKeys, hex(key))
+	}
+	data, err := getMany(ctx, sr.base, hexKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[uint64][]byte)
+	for i, key := range keys {
+		if val, ok := data[hexKeys[i]]; ok {
+			out[key] = val
+		}
+	}
+	return out, nil
+}
+
+func (sr *sharedReliable) Commit(ctx context.Context, writes map[uint64]WriteData) error {
+	if len(writes) == 0 {
+		return nil
+	}
+
+	lock := &sharedLock{Taken: time.Now(), Base: sr.etag, Writes: writes}
+	raw, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	} else if err := sr.base.SetIfMatch(ctx, sharedLockKey, raw, Metadata, ""); err == ErrPreconditionFailed {
+		if err := sr.recover(ctx); err != nil {
+			logging.Warnf("shared: failed to recover commit lock: %v", err)
+		}
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+
+	if etag, err := sr.headETag(ctx); err != nil {
+		return err
+	} else if etag != sr.etag {
+		if err := sr.base.Delete(ctx, sharedLockKey); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	// If applying the commit fails, the lock is left in place so that the
+	// commit is finished by whichever client takes it over.
+	if err := sr.apply(ctx, lock); err != nil {
+		return err
+	}
+	return sr.base.Delete(ctx, sharedLockKey)
+}
+
+// apply makes the writes in `lock` to storage, writing the tree head last and
+// only if it still has the ETag that the commit started from. If the tree head
+// has already been written, because another client took over the lock
+// and finished the commit, that's not an error.
+func (sr *sharedReliable) apply(ctx context.Context, lock *sharedLock) error {
+	for key, wr := range lock.Writes {
+		if key == 0 {
+			continue
+		} else if sr.expired(lock) {
+			return fmt.Errorf("shared: commit took longer than half of the lock's lease")
+		}
+		var err error
+		if wr.Data == nil {
+			err = sr.base.Delete(ctx, hex(key))
+		} else {
+			err = sr.base.Set(ctx, hex(key), wr.Data, wr.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	wr, ok := lock.Writes[0]
+	if !ok {
+		return nil
+	} else if sr.expired(lock) {
+		return fmt.Errorf("shared: commit took longer than half of the lock's lease")
+	}
+	err := sr.base.SetIfMatch(ctx, hex(0), wr.Data, wr.Type, lock.Base)
+	if err == ErrPreconditionFailed {
+		if curr, err := sr.base.Get(ctx, hex(0)); err == nil && bytes.Equal(curr, wr.Data) {
+			return nil
+		}
+		return fmt.Errorf("shared: tree head was changed by another client while the commit lock was held")
+	}
+	return err
+}
+
+// expired returns true if half of the lease on `lock` has passed. Writes are
+// stopped at that point, rather than when the lease runs out, to leave margin
+// for requests that are slow to take effect and for clocks that disagree.
+func (sr *sharedReliable) expired(lock *sharedLock) bool {
+	return time.Since(lock.Taken) > sr.lease/2
+}
+
+// headETag returns the ETag of the tree head in storage, or empty if there
+// isn't one.
+func (sr *sharedReliable) headETag(ctx context.Context) (string, error) {
+	_, etag, err := sr.base.GetWithETag(ctx, hex(0))
+	if err == ErrObjectNotFound {
+		return "", nil
+	}
+	return etag, err
+}
+
+// Locked returns true if another client holds the commit lock. Reads may fail
+// while another client is committing, because the blocks they read may be newer
+// than the tree head. Locked is used to tell that apart from corruption. If the
+// lock has been held for longer than its lease, it's taken over first, and
+// the commit that was interrupted is finished.
+func (sr *sharedReliable) Locked(ctx context.Context) (bool, error) {
+	if err := sr.recover(ctx); err != nil {
+		return false, err
+	}
+	_, err := sr.base.Get(ctx, sharedLockKey)
+	if err == ErrObjectNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recover takes over the commit lock if it's been held for longer than its
+// lease, finishes the commit it was taken for if the tree head hasn't been
+// written yet, and releases it.
+func (sr *sharedReliable) recover(ctx context.Context) error {
+	raw, etag, err := sr.base.GetWithETag(ctx, sharedLockKey)
+	if err == ErrObjectNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lock := &sharedLock{}
+	if err := json.Unmarshal(raw, lock); err != nil {
+		return fmt.Errorf("shared: failed to parse commit lock: %v", err)
+	} else if time.Since(lock.Taken) < sr.lease {
+		return nil
+	}
+
+	taken := lock.Taken
+	lock.Taken = time.Now()
+	raw, err = json.Marshal(lock)
+	if err != nil {
+		return err
+	} else if err := sr.base.SetIfMatch(ctx, sharedLockKey, raw, Metadata, etag); err == ErrPreconditionFailed {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	logging.Warnf("shared: taking over commit lock that was taken at %v", taken)
+
+	if etag, err := sr.headETag(ctx); err != nil {
+		return err
+	} else if etag == lock.Base {
+		if err := sr.apply(ctx, lock); err != nil {
+			return err
+		}
+	}
+	return sr.base.Delete(ctx, sharedLockKey)
+}
+
+func (sr *sharedReliable) Close() error { return sr.base.Close() }
@@ -32,6 +32,38 @@ func (tc *tieredCache) Get(ctx context.Context, key string) ([]byte, error) {
 	return data, nil
 }
 
+// GetMany answers what it can from `high`, and fetches everything else from
+// `base` in one batch.
+func (tc *tieredCache) GetMany(ctx context.Context, keys []string) (map[string][]byte, error) {
+	out, err := getMany(ctx, tc.high, keys)
+	if err != nil {
+		return nil, err
+	}
+	missing := make([]string, 0)
+	for _, key := range keys {
+		if _, ok := out[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return out, nil
+	}
+
+	data, err := getMany(ctx, tc.base, missing)
+	if pe, ok := err.(*PartialError); ok {
+		for key, val := range pe.Data {
+			out[key] = val
+		}
+		return nil, &PartialError{out, pe.Failed, pe.Err}
+	} else if err != nil {
+		return nil, err
+	}
+	for key, val := range data {
+		out[key] = val
+	}
+	return out, nil
+}
+
 func (tc *tieredCache) Set(ctx context.Context, key string, data []byte, dt DataType) error {
 	if dt == tc.special {
 		if err := tc.high.Set(ctx, key, data, dt); err != nil {
@@ -47,3 +79,10 @@ func (tc *tieredCache) Delete(ctx context.Context, key string) error {
 	}
 	return tc.base.Delete(ctx, key)
 }
+
+func (tc *tieredCache) List(ctx context.Context, prefix string) ([]string, error) {
+	// Every object in `high` is also in `base`.
+	return tc.base.List(ctx, prefix)
+}
+
+func (tc *tieredCache) Close() error { return Closers{tc.high, tc.base}.Close() }
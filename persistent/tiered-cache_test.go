@@ -0,0 +1,30 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+)
+
+func TestTieredCacheGetMany(t *testing.T) {
+	ctx := context.Background()
+
+	base := &countingBatch{ObjectStorage: NewMemory()}
+	cache := NewTieredCache(Metadata, NewMemory(), base)
+	if err := cache.Set(ctx, "a", []byte("a"), Metadata); err != nil {
+		t.Fatal(err)
+	} else if err := cache.Set(ctx, "b", []byte("b"), Content); err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects that are in the high tier aren't fetched from the base, and the
+	// rest are fetched in one batch.
+	data, err := cache.(BatchObjectStorage).GetMany(ctx, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != 2 || string(data["a"]) != "a" || string(data["b"]) != "b" {
+		t.Fatalf("unexpected objects: %q", data)
+	} else if base.gets != 0 || base.batches != 1 {
+		t.Fatalf("unexpected requests: %v gets, %v batches", base.gets, base.batches)
+	}
+}
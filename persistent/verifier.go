@@ -0,0 +1,160 @@
+package persistent
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// verifierPtr is the pointer, underneath the integrity layer, where the
+// password verifier is stored. It's far beyond any pointer the integrity layer
+// will ever allocate.
+const verifierPtr = uint64(1) << 62
+
+// verifierPlaintext is the known plaintext that's encrypted to make the
+// password verifier.
+var verifierPlaintext = []byte("utahfs password verifier")
+
+// kdfPtr is the pointer, next to the password verifier, where the parameters
+// that the key was derived with are stored. They're stored in plaintext so that
+// a client with different parameters can be told so, instead of that its
+// password is wrong.
+const kdfPtr = verifierPtr + 1
+
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+func verifierKey(key Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.derive("9f1c64e0b2d3a87e"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newVerifier(key Key) ([]byte, error) {
+	aead, err := verifierKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return append(nonce, aead.Seal(nil, nonce, verifierPlaintext, nil)...), nil
+}
+
+func marshalKDF(kdf KDFParams) []byte {
+	out := make([]byte, 9)
+	binary.BigEndian.PutUint32(out[0:4], kdf.Time)
+	binary.BigEndian.PutUint32(out[4:8], kdf.Memory)
+	out[8] = kdf.Threads
+	return out
+}
+
+func unmarshalKDF(raw []byte) (KDFParams, error) {
+	if len(raw) != 9 {
+		return KDFParams{}, fmt.Errorf("verifier: kdf parameters are malformed")
+	}
+	return KDFParams{
+		Time:    binary.BigEndian.Uint32(raw[0:4]),
+		Memory:  binary.BigEndian.Uint32(raw[4:8]),
+		Threads: raw[8],
+	}, nil
+}
+
+func checkVerifier(raw []byte, key Key) error {
+	aead, err := verifierKey(key)
+	if err != nil {
+		return err
+	}
+
+	ns := aead.NonceSize()
+	if len(raw) < ns {
+		return fmt.Errorf("verifier: password verifier is malformed")
+	}
+	if _, err := aead.Open(nil, raw[:ns], raw[ns:], nil); err != nil {
+		return ErrIncorrectPassword
+	}
+	return nil
+}
+
+// CheckPassword checks `password` against the verifier stored alongside the
+// repository, and returns ErrIncorrectPassword if they don't match. If the key
+// was derived from it with different parameters than the repository's, the
+// error says so instead. `store` should be the output of WithIntegrity.
+//
+// Repositories without a verifier fall back on validating the tree head, and
+// have a verifier written if that succeeds.
+func CheckPassword(ctx context.Context, store BlockStorage, password string) error {
+	return CheckKey(ctx, store, PasswordKey(password))
+}
+
+// CheckKey is like CheckPassword, for storage created with WithIntegrityKey.
+func CheckKey(ctx context.Context, store BlockStorage, key Key) error {
+	i, ok := store.(*integrity)
+	if !ok {
+		return fmt.Errorf("verifier: expected integrity layer as input, but got: %T", store)
+	}
+
+	if _, err := i.base.Start(ctx, nil); err != nil {
+		return err
+	}
+	raw, err := i.base.Get(ctx, verifierPtr)
+	hasVerifier := err == nil
+	rawKDF, kdfErr := i.base.Get(ctx, kdfPtr)
+	i.base.Rollback(ctx)
+	if kdfErr == nil {
+		kdf, err := unmarshalKDF(rawKDF)
+		if err != nil {
+			return err
+		} else if kdf != key.KDF() {
+			return fmt.Errorf("verifier: repository uses %v, but %v is configured", kdf, key.KDF())
+		}
+	} else if kdfErr != ErrObjectNotFound {
+		return kdfErr
+	}
+	if hasVerifier {
+		if err := checkVerifier(raw, key); err != nil {
+			return err
+		} else if kdfErr == nil {
+			return nil
+		}
+	} else if err != ErrObjectNotFound {
+		return err
+	}
+
+	// Either there's no verifier, and the tree head is validated by starting a
+	// transaction, or the verifier was written before the parameters were
+	// recorded next to it.
+	if _, err := i.Start(ctx, nil); err != nil {
+		return err
+	}
+	if !hasVerifier {
+		verifier, err := newVerifier(key)
+		if err != nil {
+			i.Rollback(ctx)
+			return err
+		} else if err := i.base.Set(ctx, verifierPtr, verifier, Metadata); err != nil {
+			i.Rollback(ctx)
+			return err
+		}
+	}
+	if err := i.base.Set(ctx, kdfPtr, marshalKDF(key.KDF()), Metadata); err != nil {
+		i.Rollback(ctx)
+		return err
+	}
+	if err := i.Commit(ctx); err == ErrReadOnly {
+		// The tree head has already been validated, which is as much as a
+		// read-only client can do.
+		i.Rollback(ctx)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package persistent
+
+import (
+	"testing"
+
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func TestCheckPassword(t *testing.T) {
+	ctx := context.Background()
+
+	name, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(name)
+
+	// Write some data without a verifier, like an older repository would have.
+	store := NewBlockMemory()
+	integ, err := WithIntegrity(store, "password", name+"/pin.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appStore := NewAppStorage(WithEncryption(integ, "password"))
+	if err := appStore.Start(ctx); err != nil {
+		t.Fatal(err)
+	} else if err := appStore.Set(ctx, 0, []byte("hello"), Content); err != nil {
+		t.Fatal(err)
+	} else if err := appStore.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first check should succeed and write a verifier.
+	if err := CheckPassword(ctx, integ, "password"); err != nil {
+		t.Fatal(err)
+	} else if _, err := store.Get(ctx, verifierPtr); err != nil {
+		t.Fatal(err)
+	} else if raw, err := store.Get(ctx, kdfPtr); err != nil {
+		t.Fatal(err)
+	} else if kdf, err := unmarshalKDF(raw); err != nil {
+		t.Fatal(err)
+	} else if kdf != DefaultKDFParams {
+		t.Fatalf("unexpected kdf parameters recorded: %v", kdf)
+	}
+	if err := CheckPassword(ctx, integ, "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client with the wrong password should get a clear error.
+	wrong, err := WithIntegrity(store, "passwrod", name+"/pin2.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := CheckPassword(ctx, wrong, "passwrod"); err != ErrIncorrectPassword {
+		t.Fatalf("expected incorrect password error, got: %v", err)
+	}
+
+	// So should a client with the right password, but different parameters for
+	// deriving a key from it, and it should be told which parameters to use.
+	key, err := PasswordKeyWithParams("password", KDFParams{Time: 2, Memory: 32 * 1024, Threads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	weaker, err := WithIntegrityKey(store, key, name+"/pin3.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := CheckKey(ctx, weaker, key); err == nil || !strings.Contains(err.Error(), DefaultKDFParams.String()) {
+		t.Fatalf("expected kdf parameters error, got: %v", err)
+	} else if _, err := PasswordKeyWithParams("password", KDFParams{Time: 1, Memory: 8, Threads: 4}); err == nil {
+		t.Fatal("accepted too little memory for the number of threads")
+	}
+
+	// Data written before the verifier should still be readable.
+	if err := appStore.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data, err := appStore.Get(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatal("data not equal to expected")
+	}
+	appStore.Rollback(ctx)
+}
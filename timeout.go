@@ -0,0 +1,134 @@
+package utahfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudflare/utahfs/internal/logging"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// timeouts wraps a FUSE binding, and gives each operation that may have to wait
+// on storage a deadline. The storage stack gets the operation's context, so
+// requests to a backend that's hung are abandoned once the deadline passes, and
+// the operation fails with EIO instead of blocking whatever made it forever.
+//
+// Operations are processed one at a time, so time spent waiting for an earlier
+// operation to finish counts against the deadline as well. SyncFile has no
+// deadline, because it waits for everything in the WAL to be uploaded, which
+// can legitimately take a long time.
+type timeouts struct {
+	fuseutil.FileSystem
+	timeout time.Duration
+}
+
+func (t timeouts) run(ctx context.Context, name string, fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	err := fn(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logging.Warnf("utahfs: %v timed out after %v: %v", name, t.timeout, err)
+		return fuse.EIO
+	}
+	return err
+}
+
+func (t timeouts) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	return t.run(ctx, "StatFS", func(ctx context.Context) error { return t.FileSystem.StatFS(ctx, op) })
+}
+
+func (t timeouts) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	return t.run(ctx, "LookUpInode", func(ctx context.Context) error { return t.FileSystem.LookUpInode(ctx, op) })
+}
+
+func (t timeouts) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
+	return t.run(ctx, "GetInodeAttributes", func(ctx context.Context) error { return t.FileSystem.GetInodeAttributes(ctx, op) })
+}
+
+func (t timeouts) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	return t.run(ctx, "SetInodeAttributes", func(ctx context.Context) error { return t.FileSystem.SetInodeAttributes(ctx, op) })
+}
+
+func (t timeouts) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
+	return t.run(ctx, "MkDir", func(ctx context.Context) error { return t.FileSystem.MkDir(ctx, op) })
+}
+
+func (t timeouts) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
+	return t.run(ctx, "MkNode", func(ctx context.Context) error { return t.FileSystem.MkNode(ctx, op) })
+}
+
+func (t timeouts) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	return t.run(ctx, "CreateFile", func(ctx context.Context) error { return t.FileSystem.CreateFile(ctx, op) })
+}
+
+func (t timeouts) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	return t.run(ctx, "CreateSymlink", func(ctx context.Context) error { return t.FileSystem.CreateSymlink(ctx, op) })
+}
+
+func (t timeouts) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	return t.run(ctx, "Rename", func(ctx context.Context) error { return t.FileSystem.Rename(ctx, op) })
+}
+
+func (t timeouts) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
+	return t.run(ctx, "RmDir", func(ctx context.Context) error { return t.FileSystem.RmDir(ctx, op) })
+}
+
+func (t timeouts) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	return t.run(ctx, "Unlink", func(ctx context.Context) error { return t.FileSystem.Unlink(ctx, op) })
+}
+
+func (t timeouts) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
+	return t.run(ctx, "OpenDir", func(ctx context.Context) error { return t.FileSystem.OpenDir(ctx, op) })
+}
+
+func (t timeouts) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	return t.run(ctx, "ReadDir", func(ctx context.Context) error { return t.FileSystem.ReadDir(ctx, op) })
+}
+
+func (t timeouts) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
+	return t.run(ctx, "OpenFile", func(ctx context.Context) error { return t.FileSystem.OpenFile(ctx, op) })
+}
+
+func (t timeouts) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	return t.run(ctx, "ReadFile", func(ctx context.Context) error { return t.FileSystem.ReadFile(ctx, op) })
+}
+
+func (t timeouts) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	return t.run(ctx, "WriteFile", func(ctx context.Context) error { return t.FileSystem.WriteFile(ctx, op) })
+}
+
+func (t timeouts) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
+	return t.run(ctx, "FlushFile", func(ctx context.Context) error { return t.FileSystem.FlushFile(ctx, op) })
+}
+
+func (t timeouts) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) error {
+	return t.run(ctx, "ReleaseDirHandle", func(ctx context.Context) error { return t.FileSystem.ReleaseDirHandle(ctx, op) })
+}
+
+func (t timeouts) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
+	return t.run(ctx, "ReleaseFileHandle", func(ctx context.Context) error { return t.FileSystem.ReleaseFileHandle(ctx, op) })
+}
+
+func (t timeouts) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	return t.run(ctx, "ReadSymlink", func(ctx context.Context) error { return t.FileSystem.ReadSymlink(ctx, op) })
+}
+
+func (t timeouts) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
+	return t.run(ctx, "GetXattr", func(ctx context.Context) error { return t.FileSystem.GetXattr(ctx, op) })
+}
+
+func (t timeouts) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
+	return t.run(ctx, "ListXattr", func(ctx context.Context) error { return t.FileSystem.ListXattr(ctx, op) })
+}
+
+func (t timeouts) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	return t.run(ctx, "SetXattr", func(ctx context.Context) error { return t.FileSystem.SetXattr(ctx, op) })
+}
+
+func (t timeouts) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	return t.run(ctx, "RemoveXattr", func(ctx context.Context) error { return t.FileSystem.RemoveXattr(ctx, op) })
+}
@@ -1,3 +1,4 @@
 // Package utahfs provides a FUSE binding where files are stored encrypted in
-// the cloud.
+// the cloud, and a Volume type for accessing the same files from Go without
+// mounting them.
 package utahfs
@@ -0,0 +1,390 @@
+package utahfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Volume provides access to the files in a block filesystem from Go, without
+// going through FUSE. Paths are slash-separated and relative to the root of the
+// volume. Symlinks are not followed.
+//
+// Data stored is compatible with NewFilesystem, but a volume must not be used
+// at the same time as a FUSE binding over the same block filesystem.
+type Volume struct {
+	fs *filesystem
+}
+
+// NewVolume returns a Volume that stores data in the block filesystem `bfs`.
+func NewVolume(bfs *BlockFilesystem) (*Volume, error) {
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		return nil, err
+	}
+	return &Volume{fs.(*filesystem)}, nil
+}
+
+// Open opens the regular file at `path` for reading and writing.
+func (v *Volume) Open(path string) (*VolumeFile, error) {
+	ctx := context.Background()
+	defer v.fs.synchronize(ctx)()
+
+	id, nd, err := v.lookup(ctx, path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	} else if nd.Attrs.Mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+	} else if !nd.Attrs.Mode.IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: fuse.EINVAL}
+	}
+	return &VolumeFile{v: v, inode: id, gen: nd.Generation}, nil
+}
+
+// Create creates a regular file at `path`, or truncates it if it already
+// exists, and opens it for reading and writing.
+func (v *Volume) Create(path string) (*VolumeFile, error) {
+	ctx := context.Background()
+	defer v.fs.synchronize(ctx)()
+
+	id, nd, err := v.lookup(ctx, path)
+	if err == nil {
+		if nd.Attrs.Mode.IsDir() {
+			return nil, &os.PathError{Op: "create", Path: path, Err: syscall.EISDIR}
+		} else if !nd.Attrs.Mode.IsRegular() {
+			return nil, &os.PathError{Op: "create", Path: path, Err: fuse.EINVAL}
+		} else if err := nd.Truncate(0); err != nil {
+			v.fs.nm.Forget(nd)
+			return nil, &os.PathError{Op: "create", Path: path, Err: err}
+		}
+		nd.Attrs.Mtime = now()
+		nd.Attrs.Ctime = now()
+		gen := nd.Generation
+		if err := commit(ctx, v.fs.nm, nd); err != nil {
+			return nil, &os.PathError{Op: "create", Path: path, Err: err}
+		}
+		return &VolumeFile{v: v, inode: id, gen: gen}, nil
+	} else if err != fuse.ENOENT {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+
+	id, nd, err = v.mkNode(ctx, path, 0644)
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+	return &VolumeFile{v: v, inode: id, gen: nd.Generation}, nil
+}
+
+// WriteFile writes `data` to the regular file at `path`, creating it if it
+// doesn't exist or replacing its contents if it does. Unlike Create followed by
+// Write, it's done in one transaction, so if it fails, the file is left as it
+// was instead of empty or partly written.
+func (v *Volume) WriteFile(path string, data []byte) error {
+	ctx := context.Background()
+	defer v.fs.synchronize(ctx)()
+
+	nds := make([]*node, 0, 2)
+	_, nd, err := v.lookup(ctx, path)
+	if err == nil {
+		if nd.Attrs.Mode.IsDir() {
+			return &os.PathError{Op: "write", Path: path, Err: syscall.EISDIR}
+		} else if !nd.Attrs.Mode.IsRegular() {
+			return &os.PathError{Op: "write", Path: path, Err: fuse.EINVAL}
+		} else if err := nd.Truncate(0); err != nil {
+			v.fs.nm.Forget(nd)
+			return &os.PathError{Op: "write", Path: path, Err: err}
+		}
+		nd.Attrs.Ctime = now()
+		nds = append(nds, nd)
+	} else if err == fuse.ENOENT {
+		parts := splitPath(path)
+		parentID, _, err := v.walk(ctx, parts[:len(parts)-1])
+		if err != nil {
+			return &os.PathError{Op: "write", Path: path, Err: err}
+		}
+		parent, child, err := v.fs.mkNode(ctx, parentID, parts[len(parts)-1], 0644)
+		if err != nil {
+			return &os.PathError{Op: "write", Path: path, Err: err}
+		}
+		nd = child
+		nds = append(nds, parent, child)
+	} else {
+		return &os.PathError{Op: "write", Path: path, Err: err}
+	}
+
+	if _, err := nd.WriteAt(data, 0); err != nil {
+		forget(v.fs.nm, nds)
+		return &os.PathError{Op: "write", Path: path, Err: err}
+	}
+	nd.Attrs.Mtime = now()
+
+	if err := commit(ctx, v.fs.nm, nds...); err != nil {
+		return &os.PathError{Op: "write", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Mkdir creates a new directory at `path`.
+func (v *Volume) Mkdir(path string) error {
+	ctx := context.Background()
+	defer v.fs.synchronize(ctx)()
+
+	if _, _, err := v.mkNode(ctx, path, os.ModeDir|0755); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+// ReadDir returns the entries of the directory at `path`, sorted by name.
+func (v *Volume) ReadDir(path string) ([]os.FileInfo, error) {
+	ctx := context.Background()
+	defer v.fs.synchronize(ctx)()
+
+	_, nd, err := v.lookup(ctx, path)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+	} else if !nd.Attrs.Mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: fuse.ENOTDIR}
+	}
+
+	names := make([]string, 0, len(nd.Children))
+	for name, _ := range nd.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		child, err := v.fs.nm.Open(ctx, v.fs.ptr(nd.Children[name]))
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+		}
+		entries = append(entries, &volumeFileInfo{name, child.Attrs})
+	}
+	return entries, nil
+}
+
+// Stat returns information about the file or directory at `path`.
+func (v *Volume) Stat(path string) (os.FileInfo, error) {
+	ctx := context.Background()
+	defer v.fs.synchronize(ctx)()
+
+	_, nd, err := v.lookup(ctx, path)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	parts := splitPath(path)
+	name := "/"
+	if len(parts) > 0 {
+		name = parts[len(parts)-1]
+	}
+	return &volumeFileInfo{name, nd.Attrs}, nil
+}
+
+// Remove removes the file or empty directory at `path`.
+func (v *Volume) Remove(path string) error {
+	ctx := context.Background()
+	defer v.fs.synchronize(ctx)()
+
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return &os.PathError{Op: "remove", Path: path, Err: fuse.EINVAL}
+	}
+	_, parent, err := v.walk(ctx, parts[:len(parts)-1])
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	} else if !parent.Attrs.Mode.IsDir() {
+		return &os.PathError{Op: "remove", Path: path, Err: fuse.ENOTDIR}
+	} else if err := v.fs.rmNode(ctx, parent, parts[len(parts)-1], false); err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	} else if err := commit(ctx, v.fs.nm, parent); err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	return nil
+}
+
+// lookup returns the inode and node at `path`.
+func (v *Volume) lookup(ctx context.Context, path string) (fuseops.InodeID, *node, error) {
+	return v.walk(ctx, splitPath(path))
+}
+
+// walk follows the path components in `parts` from the root of the volume.
+func (v *Volume) walk(ctx context.Context, parts []string) (fuseops.InodeID, *node, error) {
+	id := fuseops.InodeID(fuseops.RootInodeID)
+	nd, err := v.fs.nm.Open(ctx, v.fs.ptr(id))
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, part := range parts {
+		if !nd.Attrs.Mode.IsDir() {
+			return 0, nil, fuse.ENOTDIR
+		}
+		childID, ok := nd.Children[part]
+		if !ok {
+			return 0, nil, fuse.ENOENT
+		}
+		id = childID
+		nd, err = v.fs.nm.Open(ctx, v.fs.ptr(id))
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return id, nd, nil
+}
+
+// mkNode creates a new node at `path` with the given mode, and commits it.
+func (v *Volume) mkNode(ctx context.Context, path string, mode os.FileMode) (fuseops.InodeID, *node, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return 0, nil, fuse.EEXIST
+	}
+	parentID, _, err := v.walk(ctx, parts[:len(parts)-1])
+	if err != nil {
+		return 0, nil, err
+	}
+	parent, child, err := v.fs.mkNode(ctx, parentID, parts[len(parts)-1], mode)
+	if err != nil {
+		return 0, nil, err
+	} else if err := commit(ctx, v.fs.nm, parent); err != nil {
+		return 0, nil, err
+	}
+	return parent.Children[parts[len(parts)-1]], child, nil
+}
+
+// splitPath returns the non-empty components of a slash-separated path.
+func splitPath(path string) []string {
+	out := make([]string, 0)
+	for _, part := range strings.Split(path, "/") {
+		if part != "" && part != "." {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// VolumeFile is a handle to a regular file in a Volume. Each call to Read or
+// Write runs in its own transaction. Once the file is deleted, they return
+// ESTALE, even if its inode has been reused by another file.
+type VolumeFile struct {
+	v *Volume
+
+	inode fuseops.InodeID
+	gen   uint64
+	pos   int64
+}
+
+var _ io.ReadWriteSeeker = &VolumeFile{}
+
+// open returns the file's node, or ESTALE if its inode now belongs to a
+// different file.
+func (f *VolumeFile) open(ctx context.Context) (*node, error) {
+	nd, err := f.v.fs.nm.Open(ctx, f.v.fs.ptr(f.inode))
+	if err != nil {
+		return nil, err
+	} else if nd.Generation != f.gen || !nd.Attrs.Mode.IsRegular() {
+		return nil, syscall.ESTALE
+	}
+	return nd, nil
+}
+
+func (f *VolumeFile) Read(p []byte) (int, error) {
+	ctx := context.Background()
+	defer f.v.fs.synchronize(ctx)()
+
+	nd, err := f.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(p) {
+		m, err := nd.ReadAt(p[n:], f.pos+int64(n))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		n += m
+	}
+	f.pos += int64(n)
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (f *VolumeFile) Write(p []byte) (int, error) {
+	ctx := context.Background()
+	defer f.v.fs.synchronize(ctx)()
+
+	nd, err := f.open(ctx)
+	if err != nil {
+		return 0, err
+	} else if _, err := nd.WriteAt(p, f.pos); err != nil {
+		f.v.fs.nm.Forget(nd)
+		return 0, err
+	}
+	nd.Attrs.Mtime = now()
+
+	if err := commit(ctx, f.v.fs.nm, nd); err != nil {
+		return 0, err
+	}
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *VolumeFile) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		// Offset is already in correct form.
+	} else if whence == io.SeekCurrent {
+		offset += f.pos
+	} else if whence == io.SeekEnd {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	} else {
+		return 0, fmt.Errorf("utahfs: unexpected value for whence")
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("utahfs: cannot seek past beginning of file")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Stat returns information about the file. The name is left empty.
+func (f *VolumeFile) Stat() (os.FileInfo, error) {
+	ctx := context.Background()
+	defer f.v.fs.synchronize(ctx)()
+
+	nd, err := f.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &volumeFileInfo{"", nd.Attrs}, nil
+}
+
+// Close releases the handle. It's always safe to call.
+func (f *VolumeFile) Close() error { return nil }
+
+type volumeFileInfo struct {
+	name  string
+	attrs fuseops.InodeAttributes
+}
+
+func (fi *volumeFileInfo) Name() string       { return fi.name }
+func (fi *volumeFileInfo) Size() int64        { return int64(fi.attrs.Size) }
+func (fi *volumeFileInfo) Mode() os.FileMode  { return fi.attrs.Mode }
+func (fi *volumeFileInfo) ModTime() time.Time { return fi.attrs.Mtime }
+func (fi *volumeFileInfo) IsDir() bool        { return fi.attrs.Mode.IsDir() }
+func (fi *volumeFileInfo) Sys() interface{}   { return fi.attrs }
@@ -0,0 +1,173 @@
+package utahfs
+
+import (
+	"testing"
+
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/cloudflare/utahfs/persistent"
+)
+
+func TestVolume(t *testing.T) {
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVolume(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Mkdir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.Create("dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := io.WriteString(f, "hello world"); err != nil {
+		t.Fatal(err)
+	} else if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.WriteString(f, "there"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = v.Open("/dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello there" {
+		t.Fatalf("unexpected file contents: %q", data)
+	}
+
+	info, err := v.Stat("dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Name() != "a.txt" || info.Size() != 11 || info.IsDir() {
+		t.Fatalf("unexpected file info: %v %v %v", info.Name(), info.Size(), info.IsDir())
+	}
+	entries, err := v.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Name() != "a.txt" {
+		t.Fatalf("unexpected directory entries: %v", entries)
+	}
+
+	if f, err := v.Create("dir/a.txt"); err != nil {
+		t.Fatal(err)
+	} else if data, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 0 {
+		t.Fatal("file was not truncated by create")
+	}
+
+	if err := v.Remove("dir"); err == nil {
+		t.Fatal("removed non-empty directory")
+	} else if err := v.Remove("dir/a.txt"); err != nil {
+		t.Fatal(err)
+	} else if err := v.Remove("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Open("dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got: %v", err)
+	}
+}
+
+func TestVolumeWriteFile(t *testing.T) {
+	crashing := &crashingStorage{ReliableStorage: persistent.NewSimpleReliable(persistent.NewMemory())}
+	store := persistent.NewAppStorage(persistent.NewBufferedStorage(crashing))
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVolume(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(v *Volume, path string) string {
+		f, err := v.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if err := v.WriteFile("a.txt", []byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := v.WriteFile("a.txt", []byte("hi")); err != nil {
+		t.Fatal(err)
+	} else if got := read(v, "a.txt"); got != "hi" {
+		t.Fatalf("unexpected file contents: %q", got)
+	} else if err := v.WriteFile("missing/a.txt", []byte("hi")); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got: %v", err)
+	}
+
+	// Failing to overwrite a file should leave its old contents, rather than
+	// an empty file.
+	crashing.crash = true
+	if err := v.WriteFile("a.txt", []byte("world")); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	crashing.crash = false
+	v, err = NewVolume(bfs)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := read(v, "a.txt"); got != "hi" {
+		t.Fatalf("unexpected file contents after failed write: %q", got)
+	}
+}
+
+func TestVolumeFileReused(t *testing.T) {
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVolume(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete a file and create another one, which reuses its inode. A handle
+	// to the old file shouldn't read the new one.
+	f, err := v.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := v.Remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	g, err := v.Create("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if g.inode != f.inode {
+		t.Fatalf("expected inode to be reused: %v != %v", g.inode, f.inode)
+	} else if _, err := io.WriteString(g, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(f); err != syscall.ESTALE {
+		t.Fatalf("expected stale handle error, got: %q %v", data, err)
+	} else if _, err := f.Stat(); err != syscall.ESTALE {
+		t.Fatalf("expected stale handle error, got: %v", err)
+	} else if _, err := f.Write([]byte("x")); err != syscall.ESTALE {
+		t.Fatalf("expected stale handle error, got: %v", err)
+	}
+	f, err = v.Open("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if data, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatalf("unexpected file contents: %q", data)
+	}
+}
@@ -0,0 +1,205 @@
+package utahfs
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const (
+	// xattrCreate and xattrReplace are the flags to setxattr(2) that make it
+	// fail if the attribute already exists, or doesn't exist yet.
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+
+	// maxXattrName and maxXattrValue are the largest name and value that an
+	// extended attribute may have, which are the same as Linux's limits.
+	maxXattrName  = 255
+	maxXattrValue = 64 * 1024
+
+	// aclAccess and aclDefault are the attributes that POSIX ACLs are kept
+	// in. The vendored FUSE library has no way to ask the kernel for
+	// FUSE_POSIX_ACL when mounting, so the kernel refuses them itself and
+	// they only arrive from callers that use the filesystem directly.
+	aclAccess  = "system.posix_acl_access"
+	aclDefault = "system.posix_acl_default"
+)
+
+// The tags of the entries in a POSIX ACL, as they're encoded by the kernel.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+func (fs *filesystem) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
+	defer fs.synchronizeLazily(ctx)()
+
+	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
+	if err != nil {
+		return err
+	}
+	val, ok := nd.Xattrs[op.Name]
+	if !ok {
+		return fuse.ENOATTR
+	} else if isACL(op.Name) {
+		val = fs.translateACL(val, localID)
+	}
+	op.BytesRead = len(val)
+	if len(op.Dst) == 0 {
+		// The caller only wants to know the size of the value.
+		return nil
+	} else if len(op.Dst) < len(val) {
+		return syscall.ERANGE
+	}
+	copy(op.Dst, val)
+
+	return nil
+}
+
+func (fs *filesystem) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
+	defer fs.synchronizeLazily(ctx)()
+
+	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(nd.Xattrs))
+	for name := range nd.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]byte, 0)
+	for _, name := range names {
+		out = append(out, name...)
+		out = append(out, 0)
+	}
+	op.BytesRead = len(out)
+	if len(op.Dst) == 0 {
+		return nil
+	} else if len(op.Dst) < len(out) {
+		return syscall.ERANGE
+	}
+	copy(op.Dst, out)
+
+	return nil
+}
+
+func (fs *filesystem) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	if len(op.Name) == 0 {
+		return fuse.EINVAL
+	} else if len(op.Name) > maxXattrName {
+		return syscall.ERANGE
+	} else if len(op.Value) > maxXattrValue {
+		return syscall.E2BIG
+	}
+	defer fs.synchronizeLazily(ctx, op.Inode)()
+
+	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
+	if err != nil {
+		return err
+	}
+	_, exists := nd.Xattrs[op.Name]
+	if op.Flags&xattrCreate != 0 && exists {
+		return fuse.EEXIST
+	} else if op.Flags&xattrReplace != 0 && !exists {
+		return fuse.ENOATTR
+	}
+	val := append([]byte{}, op.Value...)
+	if isACL(op.Name) {
+		if op.Name == aclDefault && !nd.Attrs.Mode.IsDir() {
+			return syscall.EACCES
+		} else if !validACL(val) {
+			return fuse.EINVAL
+		}
+		val = fs.translateACL(val, func(m map[uint32]uint32, id, _ uint32) uint32 {
+			return storedID(m, id)
+		})
+	}
+
+	if nd.Xattrs == nil {
+		nd.Xattrs = make(map[string][]byte)
+	}
+	nd.Xattrs[op.Name] = val
+	nd.Attrs.Ctime = now()
+
+	return commit(ctx, fs.nm, nd)
+}
+
+func (fs *filesystem) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	defer fs.synchronizeLazily(ctx, op.Inode)()
+
+	nd, err := fs.nm.Open(ctx, fs.ptr(op.Inode))
+	if err != nil {
+		return err
+	} else if _, ok := nd.Xattrs[op.Name]; !ok {
+		return fuse.ENOATTR
+	}
+	delete(nd.Xattrs, op.Name)
+	nd.Attrs.Ctime = now()
+
+	return commit(ctx, fs.nm, nd)
+}
+
+func isACL(name string) bool { return name == aclAccess || name == aclDefault }
+
+// validACL returns true if `val` is a POSIX ACL in the format that the kernel
+// uses for system.posix_acl_*: a little-endian version number of 2, followed
+// by 8-byte entries of a 16-bit tag, 16-bit permissions, and 32-bit id. It
+// must have exactly one entry for the owner, group, and others, and a mask if
+// it has any entries for named users or groups.
+func validACL(val []byte) bool {
+	if len(val) < 4 || (len(val)-4)%8 != 0 || binary.LittleEndian.Uint32(val) != 2 {
+		return false
+	}
+	counts := make(map[uint16]int)
+	for i := 4; i < len(val); i += 8 {
+		tag, perm := binary.LittleEndian.Uint16(val[i:]), binary.LittleEndian.Uint16(val[i+2:])
+		switch tag {
+		case aclUserObj, aclUser, aclGroupObj, aclGroup, aclMask, aclOther:
+		default:
+			return false
+		}
+		if perm&^7 != 0 {
+			return false
+		}
+		counts[tag]++
+	}
+	if counts[aclUserObj] != 1 || counts[aclGroupObj] != 1 || counts[aclOther] != 1 || counts[aclMask] > 1 {
+		return false
+	} else if counts[aclUser]+counts[aclGroup] > 0 && counts[aclMask] == 0 {
+		return false
+	}
+	return true
+}
+
+// translateACL returns a copy of the ACL `val`, with the ids of named users and
+// groups passed through `fn` with the filesystem's uid and gid maps. Ids that
+// aren't in the maps are kept as they are, rather than being given to the
+// user running the client, so that an ACL can't grant anyone more access on
+// one device than it does on another.
+func (fs *filesystem) translateACL(val []byte, fn func(m map[uint32]uint32, id, fallback uint32) uint32) []byte {
+	out := append([]byte{}, val...)
+	for i := 4; i+8 <= len(out); i += 8 {
+		var m map[uint32]uint32
+		switch binary.LittleEndian.Uint16(out[i:]) {
+		case aclUser:
+			m = fs.nm.uidMap
+		case aclGroup:
+			m = fs.nm.gidMap
+		default:
+			continue
+		}
+		id := binary.LittleEndian.Uint32(out[i+4:])
+		binary.LittleEndian.PutUint32(out[i+4:], fn(m, id, id))
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+package utahfs
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"encoding/binary"
+	"syscall"
+
+	"github.com/cloudflare/utahfs/persistent"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func testGetXattr(t *testing.T, fs fuseutil.FileSystem, inode fuseops.InodeID, name string) []byte {
+	ctx := context.Background()
+
+	size := &fuseops.GetXattrOp{Inode: inode, Name: name}
+	if err := fs.GetXattr(ctx, size); err != nil {
+		t.Fatal(err)
+	}
+	op := &fuseops.GetXattrOp{Inode: inode, Name: name, Dst: make([]byte, size.BytesRead)}
+	if err := fs.GetXattr(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+	return op.Dst[:op.BytesRead]
+}
+
+func TestXattrs(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, fs, "a", "hello")
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := fs.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	inode := lookup.Entry.Child
+
+	set := func(name, val string, flags uint32) error {
+		return fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: inode, Name: name, Value: []byte(val), Flags: flags})
+	}
+	if err := set("user.b", "1", xattrReplace); err != fuse.ENOATTR {
+		t.Fatalf("expected replacing a missing attribute to fail, got: %v", err)
+	} else if err := set("user.b", "1", 0); err != nil {
+		t.Fatal(err)
+	} else if err := set("user.a", "2", xattrCreate); err != nil {
+		t.Fatal(err)
+	} else if err := set("user.a", "3", xattrCreate); err != fuse.EEXIST {
+		t.Fatalf("expected creating an existing attribute to fail, got: %v", err)
+	}
+
+	list := &fuseops.ListXattrOp{Inode: inode, Dst: make([]byte, 4)}
+	if err := fs.ListXattr(ctx, list); err != syscall.ERANGE {
+		t.Fatalf("expected listing into a small buffer to fail, got: %v", err)
+	}
+	list.Dst = make([]byte, 64)
+	if err := fs.ListXattr(ctx, list); err != nil {
+		t.Fatal(err)
+	} else if names := string(list.Dst[:list.BytesRead]); names != "user.a\x00user.b\x00" {
+		t.Fatalf("unexpected list of attributes: %q", names)
+	}
+
+	if err := fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: inode, Name: "user.b"}); err != nil {
+		t.Fatal(err)
+	} else if err := fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: inode, Name: "user.b"}); err != fuse.ENOATTR {
+		t.Fatalf("expected removing a missing attribute to fail, got: %v", err)
+	}
+
+	// Attributes should be seen by a new binding to the same storage.
+	fs, err = NewFilesystem(bfs)
+	if err != nil {
+		t.Fatal(err)
+	} else if val := testGetXattr(t, fs, inode, "user.a"); string(val) != "2" {
+		t.Fatalf("unexpected value: %q", val)
+	} else if err := fs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: inode, Name: "user.b"}); err != fuse.ENOATTR {
+		t.Fatalf("expected removed attribute to be missing, got: %v", err)
+	}
+}
+
+// testACL encodes an ACL giving the owner rw-, the group and user `uid` r--,
+// and everyone else nothing.
+func testACL(uid uint32) []byte {
+	out := make([]byte, 4)
+	binary.LittleEndian.PutUint32(out, 2)
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{aclUserObj, 6, 0xffffffff},
+		{aclUser, 4, uid},
+		{aclGroupObj, 4, 0xffffffff},
+		{aclMask, 4, 0xffffffff},
+		{aclOther, 0, 0xffffffff},
+	} {
+		entry := make([]byte, 8)
+		binary.LittleEndian.PutUint16(entry, e.tag)
+		binary.LittleEndian.PutUint16(entry[2:], e.perm)
+		binary.LittleEndian.PutUint32(entry[4:], e.id)
+		out = append(out, entry...)
+	}
+	return out
+}
+
+func TestACLs(t *testing.T) {
+	ctx := context.Background()
+	store := persistent.NewAppStorage(persistent.NewBlockMemory())
+	bfs, err := NewBlockFilesystem(store, 12, 1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user with the ACL is 501 on this machine, and 1000 as stored.
+	first, err := NewFilesystemAs(bfs, 501, 20, map[uint32]uint32{1000: 501}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, first, "a", "hello")
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	if err := first.LookUpInode(ctx, lookup); err != nil {
+		t.Fatal(err)
+	}
+	inode := lookup.Entry.Child
+
+	set := func(name string, val []byte) error {
+		return first.SetXattr(ctx, &fuseops.SetXattrOp{Inode: inode, Name: name, Value: val})
+	}
+	if err := set(aclAccess, testACL(501)[:20]); err != fuse.EINVAL {
+		t.Fatalf("expected truncated acl to be rejected, got: %v", err)
+	} else if err := set(aclAccess, append(testACL(501)[:4], testACL(501)[12:]...)); err != fuse.EINVAL {
+		t.Fatalf("expected acl without an owner to be rejected, got: %v", err)
+	} else if err := set(aclDefault, testACL(501)); err != syscall.EACCES {
+		t.Fatalf("expected default acl on a file to be rejected, got: %v", err)
+	} else if err := set(aclAccess, testACL(501)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ACL is returned exactly as it was set, and the user in it is
+	// translated like the owner of a file is.
+	if val := testGetXattr(t, first, inode, aclAccess); !bytes.Equal(val, testACL(501)) {
+		t.Fatalf("unexpected acl: %x", val)
+	}
+	second, err := NewFilesystemAs(bfs, 1000, 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if val := testGetXattr(t, second, inode, aclAccess); !bytes.Equal(val, testACL(1000)) {
+		t.Fatalf("unexpected acl: %x", val)
+	}
+	// Users missing from the map are kept, not replaced with the current user.
+	third, err := NewFilesystemAs(bfs, 7, 8, map[uint32]uint32{2000: 42}, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if val := testGetXattr(t, third, inode, aclAccess); !bytes.Equal(val, testACL(1000)) {
+		t.Fatalf("unexpected acl: %x", val)
+	}
+}